@@ -0,0 +1,143 @@
+package audio
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// EchoSimulation describes a synthetic echo scenario for MeasureAEC. Zero
+// values select the defaults.
+type EchoSimulation struct {
+	// SampleRate and Channels are the capture format. Defaults to 24kHz
+	// mono.
+	SampleRate int
+	Channels   int
+	// Duration of the simulation. Defaults to 10s.
+	Duration time.Duration
+	// Delay from playback to capture, including the playback buffer.
+	// Defaults to 120ms.
+	Delay time.Duration
+	// EchoGain is the gain of the echo path. Defaults to 0.3.
+	EchoGain float64
+	// NoiseLevel is the RMS level of the capture noise. Defaults to 0.001.
+	NoiseLevel float64
+	// DoubleTalk adds near-end speech during the last quarter.
+	DoubleTalk bool
+	Seed       int64
+}
+
+// AECReport is the result of MeasureAEC.
+type AECReport struct {
+	EstimatedDelay time.Duration
+	DelayKnown     bool
+	// ERLE over the second half of the simulation, without near-end speech,
+	// in dB.
+	ERLE float64
+}
+
+// MeasureAEC runs an EchoCanceller on synthetic far-end speech mixed into
+// the capture through a delayed, attenuated and smeared echo path, and
+// reports how well it converged. It is a harness for tuning AECOptions
+// without a room, speakers and a microphone.
+func MeasureAEC(sim EchoSimulation, opts AECOptions) AECReport {
+	if sim.SampleRate == 0 {
+		sim.SampleRate = 24_000
+	}
+	if sim.Channels == 0 {
+		sim.Channels = 1
+	}
+	if sim.Duration == 0 {
+		sim.Duration = 10 * time.Second
+	}
+	if sim.Delay == 0 {
+		sim.Delay = 120 * time.Millisecond
+	}
+	if sim.EchoGain == 0 {
+		sim.EchoGain = 0.3
+	}
+	if sim.NoiseLevel == 0 {
+		sim.NoiseLevel = 0.001
+	}
+
+	rng := rand.New(rand.NewSource(sim.Seed))
+	rate := sim.SampleRate
+	total := int(int64(rate) * int64(sim.Duration) / int64(time.Second))
+	delay := int(int64(rate) * int64(sim.Delay) / int64(time.Second))
+
+	far := syntheticSpeech(rng, rate, total, 3.7)
+	var near []float64
+	if sim.DoubleTalk {
+		near = syntheticSpeech(rng, rate, total, 2.9)
+	}
+
+	// A short decaying echo path, as from a speaker and its enclosure
+	path := []float64{1, 0.4, -0.2, 0.1, 0.05}
+	capture := make([]float64, total)
+	for i := range capture {
+		var echo float64
+		for j, h := range path {
+			if k := i - delay - j*rate/8000; k >= 0 {
+				echo += h * far[k]
+			}
+		}
+		capture[i] = sim.EchoGain*echo + sim.NoiseLevel*rng.NormFloat64()
+		if near != nil && i >= total*3/4 {
+			capture[i] += near[i]
+		}
+	}
+
+	aec := NewEchoCanceller(opts)
+	frame := rate / 50
+	playback := make([]int16, frame)
+	pcm := make([]int16, frame*sim.Channels)
+	var micEnergy, outEnergy float64
+	for start := 0; start+frame <= total; start += frame {
+		for i := range pcm {
+			pcm[i] = clampInt16(float32(capture[start+i/sim.Channels] * 32768))
+		}
+		// The capture rate is only known from the first capture frame, the
+		// players write the reference in between.
+		aec.Process(pcm, rate, sim.Channels)
+		if start+2*frame <= total {
+			for i := range playback {
+				playback[i] = clampInt16(float32(far[start+frame+i] * 32768))
+			}
+			aec.WritePlayback(playback, rate, 1)
+		}
+
+		if start >= total/2 && (!sim.DoubleTalk || start < total*3/4) {
+			for i, s := range pcm {
+				d := capture[start+i/sim.Channels]
+				micEnergy += d * d
+				out := float64(s) / 32768
+				outEnergy += out * out
+			}
+		}
+	}
+
+	stats := aec.Stats()
+	report := AECReport{
+		EstimatedDelay: stats.Delay,
+		DelayKnown:     stats.DelayKnown,
+	}
+	if outEnergy > 0 {
+		report.ERLE = 10 * math.Log10(micEnergy/outEnergy)
+	}
+	return report
+}
+
+// syntheticSpeech returns filtered noise with syllable-like bursts at
+// syllables per second, at about -15dBFS.
+func syntheticSpeech(rng *rand.Rand, rate, n int, syllables float64) []float64 {
+	out := make([]float64, n)
+	var lp, env float64
+	for i := range out {
+		t := float64(i) / float64(rate)
+		lp += (rng.NormFloat64() - lp) * 0.3
+		target := math.Max(0, math.Sin(2*math.Pi*syllables*t))
+		env += (target - env) * 0.001
+		out[i] = 0.5 * lp * env
+	}
+	return out
+}
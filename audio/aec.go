@@ -0,0 +1,380 @@
+package audio
+
+import (
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"exp-openai-webrtc-streaming/internal/logging"
+)
+
+// AECOptions configures an EchoCanceller. Zero values select the defaults.
+type AECOptions struct {
+	// FilterLength is the length of the echo tail the adaptive filter models
+	// beyond the bulk delay. Defaults to 40ms.
+	FilterLength time.Duration
+	// MaxDelay is the longest delay between playback and capture the delay
+	// estimator looks for. Defaults to 500ms.
+	MaxDelay time.Duration
+	// StepSize is the NLMS adaptation step, between 0 and 1. Defaults to 0.5.
+	StepSize float64
+	Logger   *slog.Logger
+}
+
+const (
+	// aecWindow is the audio the delay is estimated on, every aecInterval
+	aecWindow   = time.Second
+	aecInterval = 500 * time.Millisecond
+	// aecEnvelopeRate is the rate of the envelopes correlated to estimate
+	// the delay
+	aecEnvelopeRate = 2000
+	// aecMinCorrelation is the normalized correlation needed to trust a
+	// delay estimate
+	aecMinCorrelation = 0.4
+	// aecGeigel is the threshold of the Geigel double-talk detector: the
+	// near end is talking when the capture is louder than this fraction of
+	// the recent reference peak, and the filter must not adapt.
+	aecGeigel = 0.5
+)
+
+// AECStats describes the state of an EchoCanceller.
+type AECStats struct {
+	// Delay is the estimated bulk delay from playback to capture, valid
+	// once DelayKnown.
+	Delay      time.Duration
+	DelayKnown bool
+	// ERLE is the echo return loss enhancement in dB over the last interval
+	// with playback: how much quieter the output is than the capture.
+	ERLE float64
+}
+
+// EchoCanceller removes the playback audio, the far end, from the captured
+// audio. Players write the decoded audio with WritePlayback, and the
+// captured audio goes through Process before being encoded.
+//
+// The playback and capture paths are aligned on the capture sample clock.
+// The bulk delay between them, which includes the playback buffer and the
+// device latencies, is estimated by correlating their envelopes, and an
+// NLMS adaptive filter models the echo path after that delay.
+type EchoCanceller struct {
+	opts AECOptions
+	log  *slog.Logger
+
+	mutex sync.Mutex
+	// rate is the capture rate, which is also the processing rate. Nothing
+	// is done until the first capture frame sets it.
+	rate     int
+	ref      []float32 // ring of reference samples by absolute index
+	refWrite int64     // absolute index of the next reference sample
+	captured int64     // absolute index of the next capture sample
+	mic      []float32 // ring of the last aecWindow of capture
+
+	weights    []float32
+	window     []float32 // reference samples of the frame being processed
+	delay      int       // of the first filter tap
+	estimated  int       // delay of the echo
+	delayKnown bool
+
+	sinceEstimate int
+	micEnergy     float64
+	outEnergy     float64
+	erle          float64
+}
+
+// NewEchoCanceller returns an EchoCanceller, which adapts to the capture
+// format of the first Process call.
+func NewEchoCanceller(opts AECOptions) *EchoCanceller {
+	if opts.FilterLength == 0 {
+		opts.FilterLength = 40 * time.Millisecond
+	}
+	if opts.MaxDelay == 0 {
+		opts.MaxDelay = 500 * time.Millisecond
+	}
+	if opts.StepSize == 0 {
+		opts.StepSize = 0.5
+	}
+	return &EchoCanceller{
+		opts: opts,
+		log:  logging.Component(opts.Logger, "aec"),
+	}
+}
+
+func (e *EchoCanceller) reset(rate int) {
+	e.rate = rate
+	// The reference ring must cover the largest delay and filter, plus the
+	// audio the players decode ahead of playback.
+	e.ref = make([]float32, e.samples(e.opts.MaxDelay+e.opts.FilterLength+aecWindow+5*time.Second))
+	e.mic = make([]float32, e.samples(aecWindow))
+	e.weights = make([]float32, e.samples(e.opts.FilterLength))
+	e.refWrite, e.captured = 0, 0
+	e.delay, e.estimated, e.delayKnown = 0, 0, false
+	e.sinceEstimate, e.micEnergy, e.outEnergy = 0, 0, 0
+}
+
+func (e *EchoCanceller) samples(d time.Duration) int {
+	return int(int64(e.rate) * int64(d) / int64(time.Second))
+}
+
+// WritePlayback implements PlaybackTap.
+func (e *EchoCanceller) WritePlayback(pcm []int16, sampleRate, channels int) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.rate == 0 {
+		return
+	}
+
+	mono := ConvertPCM(pcm, sampleRate, channels, e.rate, 1)
+
+	// Playback resuming after a pause lines up with the current capture.
+	if e.refWrite < e.captured {
+		for i := e.refWrite; i < e.captured && e.captured-i <= int64(len(e.ref)); i++ {
+			e.ref[i%int64(len(e.ref))] = 0
+		}
+		e.refWrite = e.captured
+	}
+	for _, s := range mono {
+		e.ref[e.refWrite%int64(len(e.ref))] = float32(s) / 32768
+		e.refWrite++
+	}
+}
+
+// refAt returns the reference sample at absolute index i, zero if it was
+// never written or has been overwritten.
+func (e *EchoCanceller) refAt(i int64) float32 {
+	if i < 0 || i >= e.refWrite || i <= e.refWrite-int64(len(e.ref)) {
+		return 0
+	}
+	return e.ref[i%int64(len(e.ref))]
+}
+
+// Process cancels the echo from a frame of interleaved capture PCM, in
+// place.
+func (e *EchoCanceller) Process(pcm []int16, sampleRate, channels int) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.rate != sampleRate {
+		e.reset(sampleRate)
+	}
+
+	frames := len(pcm) / channels
+	taps := len(e.weights)
+
+	// Reference samples from frame start - delay - taps + 1 to frame end -
+	// delay, so that window[k+taps-1-j] is the reference j samples before
+	// capture sample k.
+	start := e.captured - int64(e.delay) - int64(taps) + 1
+	if cap(e.window) < frames+taps-1 {
+		e.window = make([]float32, frames+taps-1)
+	}
+	window := e.window[:frames+taps-1]
+	var refEnergy float64
+	for i := range window {
+		window[i] = e.refAt(start + int64(i))
+		refEnergy += float64(window[i] * window[i])
+	}
+
+	for k := 0; k < frames; k++ {
+		var d float32
+		for ch := 0; ch < channels; ch++ {
+			d += float32(pcm[k*channels+ch]) / 32768
+		}
+		d /= float32(channels)
+		e.mic[(e.captured+int64(k))%int64(len(e.mic))] = d
+
+		if !e.delayKnown {
+			continue
+		}
+
+		x := window[k : k+taps]
+		var y, power, peak float32
+		for j, w := range e.weights {
+			xj := x[taps-1-j]
+			y += w * xj
+			power += xj * xj
+			if xj > peak {
+				peak = xj
+			} else if -xj > peak {
+				peak = -xj
+			}
+		}
+		residual := d - y
+
+		if power > 1e-6 && abs32(d) < aecGeigel*peak {
+			g := float32(e.opts.StepSize) * residual / (power + 1e-6)
+			for j := range e.weights {
+				e.weights[j] += g * x[taps-1-j]
+			}
+		}
+
+		if refEnergy > 0 {
+			e.micEnergy += float64(d * d)
+			e.outEnergy += float64(residual * residual)
+		}
+		echo := y * 32768
+		for ch := 0; ch < channels; ch++ {
+			i := k*channels + ch
+			pcm[i] = clampInt16(float32(pcm[i]) - echo)
+		}
+	}
+	e.captured += int64(frames)
+
+	e.sinceEstimate += frames
+	if e.sinceEstimate >= e.samples(aecInterval) {
+		e.sinceEstimate = 0
+		e.estimateDelay()
+		if e.micEnergy > 0 && e.outEnergy > 0 {
+			e.erle = 10 * math.Log10(e.micEnergy/e.outEnergy)
+		}
+		e.micEnergy, e.outEnergy = 0, 0
+	}
+}
+
+// estimateDelay correlates the envelopes of the last aecWindow of capture
+// and of the reference at every lag up to MaxDelay.
+func (e *EchoCanceller) estimateDelay() {
+	if e.captured < int64(len(e.mic)) {
+		return
+	}
+	block := max(e.rate/aecEnvelopeRate, 1)
+	n := len(e.mic) / block
+	lags := e.samples(e.opts.MaxDelay) / block
+	first := e.captured - int64(n*block)
+
+	mic := make([]float64, n)
+	for b := range mic {
+		for i := 0; i < block; i++ {
+			mic[b] += math.Abs(float64(e.mic[(first+int64(b*block+i))%int64(len(e.mic))]))
+		}
+	}
+	if !normalize(mic) {
+		return
+	}
+
+	// ref[lags+b] is the reference envelope of capture block b
+	ref := make([]float64, lags+n)
+	refFirst := first - int64(lags*block)
+	for b := range ref {
+		for i := 0; i < block; i++ {
+			ref[b] += math.Abs(float64(e.refAt(refFirst + int64(b*block+i))))
+		}
+	}
+
+	bestLag, best := 0, 0.0
+	shifted := make([]float64, n)
+	for lag := 0; lag <= lags; lag++ {
+		copy(shifted, ref[lags-lag:])
+		if !normalize(shifted) {
+			continue
+		}
+		var corr float64
+		for b := range mic {
+			corr += mic[b] * shifted[b]
+		}
+		if corr > best {
+			bestLag, best = lag, corr
+		}
+	}
+	if best < aecMinCorrelation {
+		return
+	}
+
+	// Keep a quarter of the filter before the estimated delay, for the
+	// imprecision of the envelopes and echo paths shorter than the bulk.
+	delay := max(bestLag*block-len(e.weights)/4, 0)
+	if e.delayKnown && abs(delay-e.delay) <= 2*block {
+		return
+	}
+	e.log.Debug("echo delay changed",
+		"delay", time.Duration(bestLag*block)*time.Second/time.Duration(e.rate),
+		"correlation", best)
+	e.delay, e.estimated, e.delayKnown = delay, bestLag*block, true
+	clear(e.weights)
+}
+
+// normalize removes the mean of v and scales it to unit energy. It returns
+// false if v is constant.
+func normalize(v []float64) bool {
+	var mean float64
+	for _, x := range v {
+		mean += x
+	}
+	mean /= float64(len(v))
+
+	var energy float64
+	for i := range v {
+		v[i] -= mean
+		energy += v[i] * v[i]
+	}
+	if energy < 1e-12 {
+		return false
+	}
+	norm := math.Sqrt(energy)
+	for i := range v {
+		v[i] /= norm
+	}
+	return true
+}
+
+// Stats returns the current delay estimate and cancellation performance.
+func (e *EchoCanceller) Stats() AECStats {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	stats := AECStats{DelayKnown: e.delayKnown, ERLE: e.erle}
+	if e.rate > 0 {
+		stats.Delay = time.Duration(e.estimated) * time.Second / time.Duration(e.rate)
+	}
+	return stats
+}
+
+// AECSource cancels the echo from a Source. Frames already encoded as
+// Opus are passed through.
+type AECSource struct {
+	source Source
+	aec    *EchoCanceller
+}
+
+// NewAECSource cancels the echo from source with aec, which the players
+// must be tapped into.
+func NewAECSource(source Source, aec *EchoCanceller) *AECSource {
+	return &AECSource{source: source, aec: aec}
+}
+
+func (s *AECSource) ReadAudio() (Frame, error) {
+	frame, err := s.source.ReadAudio()
+	if err != nil || len(frame.PCM) == 0 {
+		return frame, err
+	}
+	s.aec.Process(frame.PCM, frame.SampleRate, frame.Channels)
+	return frame, nil
+}
+
+// Close closes the wrapped source.
+func (s *AECSource) Close() error {
+	return CloseSource(s.source)
+}
+
+func clampInt16(v float32) int16 {
+	switch {
+	case v > math.MaxInt16:
+		return math.MaxInt16
+	case v < math.MinInt16:
+		return math.MinInt16
+	default:
+		return int16(v)
+	}
+}
+
+func abs32(v float32) float32 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
@@ -0,0 +1,47 @@
+package audio
+
+import (
+	"testing"
+	"time"
+)
+
+// aecFrame is the delay resolution of the echo canceller.
+const aecFrame = 20 * time.Millisecond
+
+func TestMeasureAEC(t *testing.T) {
+	tests := []struct {
+		name    string
+		sim     EchoSimulation
+		minERLE float64
+	}{
+		{"default", EchoSimulation{Seed: 1}, 15},
+		{"stereo long delay", EchoSimulation{Channels: 2, Delay: 250 * time.Millisecond, Seed: 2}, 15},
+		// The filter has twice the taps at 48kHz and converges slower on
+		// the noisy capture.
+		{"48kHz", EchoSimulation{SampleRate: 48_000, Seed: 5}, 3},
+		{"48kHz quiet", EchoSimulation{SampleRate: 48_000, NoiseLevel: 1e-6, Seed: 6}, 25},
+		{"loud echo", EchoSimulation{EchoGain: 0.6, Seed: 3}, 15},
+		{"double talk", EchoSimulation{DoubleTalk: true, Seed: 4}, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			report := MeasureAEC(tt.sim, AECOptions{})
+			t.Logf("estimated delay: %v (known: %v), ERLE: %.1f dB", report.EstimatedDelay, report.DelayKnown, report.ERLE)
+
+			delay := tt.sim.Delay
+			if delay == 0 {
+				delay = 120 * time.Millisecond
+			}
+			if !report.DelayKnown {
+				t.Fatal("the delay was not estimated")
+			}
+			if d := report.EstimatedDelay - delay; d < -aecFrame || d > aecFrame {
+				t.Errorf("estimated delay %v, want %v within %v", report.EstimatedDelay, delay, aecFrame)
+			}
+			if report.ERLE < tt.minERLE {
+				t.Errorf("ERLE %.1f dB, want %.0f dB or more", report.ERLE, tt.minERLE)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+// Package audio is the audio pipeline between the devices and the Realtime
+// API: the sources of user audio and their processing (echo cancellation,
+// capture processing, VAD), the Opus encoding, and the buffering, recording
+// and routing of the received tracks. The device backends live in
+// audio/device.
+package audio
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// The format of the audio played and captured by the devices.
+const (
+	SampleRate = 24_000 // 24kHz
+	Channels   = 2      // stereo
+)
+
+// RemoteTrack is the part of *webrtc.TrackRemote the players read from.
+type RemoteTrack interface {
+	Codec() webrtc.RTPCodecParameters
+	ReadRTP() (*rtp.Packet, interceptor.Attributes, error)
+	SetReadDeadline(deadline time.Time) error
+}
+
+// TrackWriter consumes a received audio track, e.g. by playing or recording
+// it. WriteWebRTCTrack returns once the track has ended.
+type TrackWriter interface {
+	WriteWebRTCTrack(track RemoteTrack) error
+}
+
+// PlaybackTap receives the audio decoded by a player, before it is buffered
+// for playback.
+type PlaybackTap interface {
+	WritePlayback(pcm []int16, sampleRate, channels int)
+}
+
+// Player plays the received tracks on an output device, see
+// device.NewPlayer.
+type Player interface {
+	TrackWriter
+	SetPlaybackTap(tap PlaybackTap)
+	// Drain waits until the audio received so far has been played, or ctx
+	// is done.
+	Drain(ctx context.Context) error
+	Close() error
+}
+
+// PlayerOptions configures the player backends. Zero values select the
+// defaults.
+type PlayerOptions struct {
+	// Device is the output device, see device.List. Only portaudio can play
+	// on a device other than the system default.
+	Device string
+	// Buffer is the capacity of the buffer between the decoder and the
+	// device, which absorbs the network jitter. Defaults to 500ms, 1s for
+	// portaudio.
+	Buffer time.Duration
+	// Prebuffer is the audio buffered before playback starts or resumes after
+	// an underrun. Defaults to 50ms; portaudio does not prebuffer.
+	Prebuffer time.Duration
+	// DeviceBuffer is the buffer of the audio device. Defaults to 10ms for
+	// oto and 20ms for portaudio.
+	DeviceBuffer time.Duration
+	Logger       *slog.Logger
+}
+
+// Validate checks that the prebuffer leaves room for a few frames below the
+// high water mark of the buffer, 80% of it, above which the oldest audio is
+// dropped. Otherwise the playback would never start or resume.
+func (o PlayerOptions) Validate() error {
+	capacity := cmp.Or(o.Buffer, defaultBufferCapacity)
+	prebuffer := cmp.Or(o.Prebuffer, defaultLowWater)
+	if highWater := capacity * 4 / 5; prebuffer+bufferHeadroom > highWater {
+		return fmt.Errorf("%v of prebuffer and %v of frames exceed the high water mark of the %v buffer, %v",
+			prebuffer, bufferHeadroom, capacity, highWater)
+	}
+	return nil
+}
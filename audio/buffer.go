@@ -0,0 +1,188 @@
+package audio
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"exp-openai-webrtc-streaming/internal/playback"
+	"exp-openai-webrtc-streaming/metrics"
+)
+
+// The defaults of NewBuffer, and the room PlayerOptions.Validate requires
+// above the low water mark for the frames written.
+const (
+	defaultBufferCapacity = 500 * time.Millisecond
+	defaultLowWater       = 50 * time.Millisecond
+	bufferHeadroom        = 60 * time.Millisecond
+)
+
+// Buffer is the jitter buffer between a decoder writing PCM as it arrives
+// and a device reading it at its own pace. Reads wait for a low water mark of
+// audio after an underrun, and writes drop the oldest audio above a high water
+// mark of 80% of the capacity.
+type Buffer struct {
+	buf    []byte
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	closed bool
+	// draining lets the reader take the audio below the low water mark,
+	// which is the end of the stream
+	draining bool
+	// session labels the depth in the metrics
+	session string
+
+	// Buffer configuration
+	capacity  int
+	lowWater  int // When to wait for more data
+	highWater int // When to start dropping data
+	frameSize int // Bytes per sample of all the channels
+}
+
+// NewBuffer buffers up to capacity of audio, 500ms if zero, and waits
+// for lowWater of audio before resuming the reads, 50ms if zero.
+func NewBuffer(sampleRate, channels int, capacity, lowWater time.Duration) *Buffer {
+	if capacity == 0 {
+		capacity = defaultBufferCapacity
+	}
+	if lowWater == 0 {
+		lowWater = defaultLowWater
+	}
+	// 48000 samples/sec * 2 channels * 2 bytes/sample = 192000 bytes/sec
+	bytesPerSecond := sampleRate * channels * 2
+	bufferCapacity := int(int64(bytesPerSecond) * int64(capacity) / int64(time.Second))
+	lowWaterMark := int(int64(bytesPerSecond) * int64(lowWater) / int64(time.Second))
+	// High water mark (80% of the capacity)
+	highWaterMark := (bufferCapacity * 4) / 5
+
+	b := &Buffer{
+		capacity:  bufferCapacity,
+		lowWater:  lowWaterMark,
+		highWater: highWaterMark,
+		frameSize: channels * 2,
+	}
+	b.buf = make([]byte, 0, b.capacity)
+	b.cond = sync.NewCond(&b.mutex)
+	return b
+}
+
+// Read implements io.Reader. It waits for the low water mark after an
+// underrun, and returns io.EOF once closed and empty.
+func (b *Buffer) Read(buf []byte) (n int, err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// Wait for enough data or until closed
+	if len(b.buf) < b.lowWater && !b.closed && !b.draining {
+		metrics.Default.BufferUnderruns.Inc()
+	}
+	for len(b.buf) < b.lowWater && !b.closed && !(b.draining && len(b.buf) > 0) {
+		b.cond.Wait()
+	}
+
+	if b.closed && len(b.buf) == 0 {
+		return 0, io.EOF
+	}
+
+	// Read what we can
+	n = copy(buf, b.buf)
+	b.buf = b.buf[n:]
+	if !b.closed {
+		metrics.Default.BufferDepth.WithLabelValues(b.session).Set(float64(len(b.buf)))
+	}
+
+	// If buffer is getting low, signal writer
+	if len(b.buf) < b.lowWater {
+		b.cond.Signal()
+	}
+
+	return n, nil
+}
+
+// Write implements io.Writer, dropping the oldest audio above the high water
+// mark, that of data itself once the buffer is empty. It returns
+// io.ErrClosedPipe once closed.
+func (b *Buffer) Write(data []byte) (n int, err error) {
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	n = len(data)
+	// If buffer would overflow high water mark, drop oldest data
+	for len(b.buf)+len(data) > b.highWater && len(b.buf) > 0 {
+		dropSize := len(data)
+		if dropSize > len(b.buf) {
+			dropSize = len(b.buf)
+		}
+		b.buf = b.buf[dropSize:]
+		metrics.Default.BufferDroppedBytes.Add(float64(dropSize))
+	}
+	if excess := len(data) - b.highWater; excess > 0 {
+		// Drop whole samples, keeping the channels in order.
+		dropSize := min((excess+b.frameSize-1)/b.frameSize*b.frameSize, len(data))
+		data = data[dropSize:]
+		metrics.Default.BufferDroppedBytes.Add(float64(dropSize))
+	}
+
+	// Append new data
+	b.buf = append(b.buf, data...)
+	metrics.Default.BufferDepth.WithLabelValues(b.session).Set(float64(len(b.buf)))
+
+	// Signal reader if we've reached low water mark
+	if len(b.buf) >= b.lowWater {
+		b.cond.Signal()
+	}
+
+	return n, nil
+}
+
+// Drain waits until the reader has taken all the buffered audio, or ctx is
+// done. The reader then no longer waits for the low water mark.
+func (b *Buffer) Drain(ctx context.Context) error {
+	b.mutex.Lock()
+	b.draining = true
+	b.cond.Broadcast()
+	b.mutex.Unlock()
+
+	return playback.WaitEmpty(ctx, func() int {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		if b.closed {
+			return 0
+		}
+		return len(b.buf)
+	})
+}
+
+// SetSession labels the depth of the buffer in the metrics with the ID of
+// its session, for the processes serving many calls, before the buffer is
+// used. The label is removed once the buffer is closed.
+func (b *Buffer) SetSession(id string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.session = id
+}
+
+// Close wakes up the reader, which still gets the buffered audio before
+// io.EOF, and rejects the writes.
+func (b *Buffer) Close() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !b.closed {
+		b.closed = true
+		b.cond.Broadcast()
+		if b.session != "" {
+			metrics.Default.BufferDepth.DeleteLabelValues(b.session)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package audio
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestBufferOverflow(t *testing.T) {
+	// 20ms frames of 8kHz mono in a buffer with a high water mark of 16ms.
+	b := NewBuffer(8_000, 1, 20*time.Millisecond, 10*time.Millisecond)
+	frame := make([]byte, 320)
+	for i := range frame {
+		frame[i] = byte(i / 2)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 3 {
+			if n, err := b.Write(frame); n != len(frame) || err != nil {
+				t.Errorf("Write = %d, %v", n, err)
+			}
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write did not return")
+	}
+
+	// The newest 16ms of the last frame are kept.
+	b.Close()
+	got, err := io.ReadAll(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 256 {
+		t.Fatalf("read %d bytes, want 256", len(got))
+	}
+	if got[0] != frame[64] || got[255] != frame[319] {
+		t.Errorf("read %d to %d, want the last 256 bytes of the frame", got[0], got[255])
+	}
+}
+
+func TestPlayerOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    PlayerOptions
+		wantErr bool
+	}{
+		{"defaults", PlayerOptions{}, false},
+		{"buffer below a frame", PlayerOptions{Buffer: 20 * time.Millisecond}, true},
+		{"buffer below the default prebuffer", PlayerOptions{Buffer: 40 * time.Millisecond}, true},
+		{"prebuffer above the high water mark", PlayerOptions{Buffer: 100 * time.Millisecond, Prebuffer: 90 * time.Millisecond}, true},
+		{"room for frames", PlayerOptions{Buffer: 150 * time.Millisecond, Prebuffer: 40 * time.Millisecond}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.opts.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want an error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+// Package device holds the audio device backends: the players, the
+// microphone capture and the device listing. The backends needing cgo and
+// system libraries can be left out with build tags: noportaudio drops the
+// portaudio player and the output devices, nooto the oto players, nomalgo
+// the microphone driver, and nolibopus the players and the microphone
+// encoder using libopus. Builds with CGO_ENABLED=0 have none of them but
+// oto-v3 on macOS and Windows, and always have the pure Go file and null
+// players.
+package device
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"exp-openai-webrtc-streaming/audio"
+)
+
+// The format the players play.
+const (
+	sampleRate = audio.SampleRate
+	channels   = audio.Channels
+)
+
+// backend is a player backend, registered by the file implementing it.
+type backend struct {
+	newPlayer func(opts audio.PlayerOptions) (audio.Player, error)
+	// selectsDevice tells whether the backend can play on another device
+	// than the system default.
+	selectsDevice bool
+}
+
+var backends = map[string]backend{}
+
+func register(name string, b backend) {
+	backends[name] = b
+}
+
+// Players returns the names of the player backends in this build, sorted.
+func Players() []string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// preferredPlayers are the player backends DefaultPlayer picks from, in
+// order.
+var preferredPlayers = []string{"oto-v2", "oto-v3", "portaudio", "null"}
+
+// DefaultPlayer returns the first of oto-v2, oto-v3, portaudio and null in
+// this build.
+func DefaultPlayer() string {
+	for _, name := range preferredPlayers {
+		if _, ok := backends[name]; ok {
+			return name
+		}
+	}
+	return "null"
+}
+
+// SelectsDevice reports whether the named player backend can play on
+// another device than the system default, see PlayerOptions.Device.
+func SelectsDevice(name string) bool {
+	return backends[name].selectsDevice
+}
+
+// NewPlayer creates the named player backend, see Players.
+func NewPlayer(name string, opts audio.PlayerOptions) (audio.Player, error) {
+	b, ok := backends[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown audio player %q, want %s", name, strings.Join(Players(), ", "))
+	}
+	if opts.Device != "" && !b.selectsDevice {
+		return nil, fmt.Errorf("%s cannot select an output device", name)
+	}
+	return b.newPlayer(opts)
+}
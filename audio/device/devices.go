@@ -0,0 +1,127 @@
+package device
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pion/mediadevices/pkg/driver"
+)
+
+// Kind tells capture devices from playback devices.
+type Kind string
+
+const (
+	Input  Kind = "input"
+	Output Kind = "output"
+)
+
+// Device is an audio device that can be selected by ID or by name.
+// Input devices are the microphones known to mediadevices, which does the
+// capture. Output devices are the PortAudio devices, the only player backend
+// that can play on a device other than the system default.
+type Device struct {
+	ID                string
+	Name              string
+	Kind              Kind
+	Channels          int
+	DefaultSampleRate float64
+	Latency           time.Duration
+	Default           bool
+}
+
+// List returns the input and output devices. Without PortAudio, see the
+// noportaudio build tag, there are no output devices.
+func List() ([]Device, error) {
+	outputs, err := listOutputDevices()
+	if err != nil {
+		return nil, err
+	}
+	return append(inputDevices(), outputs...), nil
+}
+
+func inputDevices() []Device {
+	var devices []Device
+	for _, d := range driver.GetManager().Query(driver.FilterAudioRecorder()) {
+		info := d.Info()
+		device := Device{
+			ID:      d.ID(),
+			Name:    info.Name,
+			Kind:    Input,
+			Default: info.Priority == driver.PriorityHigh,
+		}
+		if device.Name == "" {
+			device.Name = info.Label
+		}
+		for _, p := range d.Properties() {
+			if p.ChannelCount > device.Channels {
+				device.Channels = p.ChannelCount
+				device.DefaultSampleRate = float64(p.SampleRate)
+				device.Latency = p.Latency
+			}
+		}
+		devices = append(devices, device)
+	}
+	return devices
+}
+
+// findDevice returns the index of the device of devices matching query:
+// its ID, its name, or a unique case-insensitive part of its name.
+func findDevice(devices []Device, query string) (int, error) {
+	for i, d := range devices {
+		if d.ID == query {
+			return i, nil
+		}
+	}
+	for i, d := range devices {
+		if strings.EqualFold(d.Name, query) {
+			return i, nil
+		}
+	}
+
+	match := -1
+	var names []string
+	for i, d := range devices {
+		if strings.Contains(strings.ToLower(d.Name), strings.ToLower(query)) {
+			match = i
+			names = append(names, strconv.Quote(d.Name))
+		}
+	}
+	switch len(names) {
+	case 0:
+		return -1, fmt.Errorf("no audio device matches %q", query)
+	case 1:
+		return match, nil
+	default:
+		return -1, fmt.Errorf("audio device %q is ambiguous, it matches %s", query, strings.Join(names, ", "))
+	}
+}
+
+// findInputDevice returns the mediadevices ID of the microphone matching
+// query.
+func findInputDevice(query string) (string, error) {
+	devices := inputDevices()
+	i, err := findDevice(devices, query)
+	if err != nil {
+		return "", err
+	}
+	return devices[i].ID, nil
+}
+
+// Print writes the devices as a table.
+func Print(w io.Writer, devices []Device) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "KIND\tID\tNAME\tCHANNELS\tRATE\tLATENCY\tDEFAULT")
+	for _, d := range devices {
+		def := ""
+		if d.Default {
+			def = "*"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%.0f\t%s\t%s\n",
+			d.Kind, d.ID, d.Name, d.Channels, d.DefaultSampleRate, d.Latency, def)
+	}
+	return tw.Flush()
+}
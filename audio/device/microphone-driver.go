@@ -0,0 +1,6 @@
+//go:build cgo && !nomalgo
+
+package device
+
+// The microphone driver captures with malgo, which needs cgo.
+import _ "github.com/pion/mediadevices/pkg/driver/microphone" // 导入麦克风驱动
@@ -0,0 +1,14 @@
+//go:build !cgo || nolibopus
+
+package device
+
+import (
+	"github.com/pion/mediadevices"
+
+	"exp-openai-webrtc-streaming/audio"
+)
+
+// newCodecSelector has no encoder, the build has no libopus.
+func newCodecSelector(audio.OpusEncoderOptions) *mediadevices.CodecSelector {
+	return mediadevices.NewCodecSelector()
+}
@@ -0,0 +1,22 @@
+//go:build cgo && !nolibopus
+
+package device
+
+import (
+	"github.com/pion/mediadevices"
+	"github.com/pion/mediadevices/pkg/codec/opus"
+
+	"exp-openai-webrtc-streaming/audio"
+)
+
+// newCodecSelector encodes with the libopus encoder of mediadevices. It only
+// supports the bitrate and the frame duration of opts, see
+// audio.OpusEncoderOptions.MediaDevicesSupported.
+func newCodecSelector(opts audio.OpusEncoderOptions) *mediadevices.CodecSelector {
+	params := opus.Params{Latency: opus.Latency(opts.FrameDuration)}
+	if opts.FrameDuration == 0 {
+		params.Latency = opus.Latency20ms
+	}
+	params.BitRate = opts.Bitrate
+	return mediadevices.NewCodecSelector(mediadevices.WithAudioEncoders(&params))
+}
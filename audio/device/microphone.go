@@ -0,0 +1,70 @@
+package device
+
+import (
+	"fmt"
+
+	"github.com/pion/mediadevices"
+	"github.com/pion/mediadevices/pkg/prop"
+	// "github.com/xiph/ogg"
+
+	"exp-openai-webrtc-streaming/audio"
+)
+
+// GetUserMediaTrack captures the microphone matching device, see List, or
+// the default one if device is empty. The track encodes with the bitrate and
+// frame duration of opusOpts, without libopus it can only be read as PCM.
+// Without the microphone driver, see the nomalgo build tag, there is no
+// microphone to capture.
+func GetUserMediaTrack(sampleRate, channels int, device string, opusOpts audio.OpusEncoderOptions) (mediadevices.Track, error) {
+	var deviceID string
+	if device != "" {
+		id, err := findInputDevice(device)
+		if err != nil {
+			return nil, err
+		}
+		deviceID = id
+	}
+
+	codecSelector := newCodecSelector(opusOpts)
+
+	stream, err := mediadevices.GetUserMedia(mediadevices.MediaStreamConstraints{
+		Audio: func(c *mediadevices.MediaTrackConstraints) {
+			c.SampleRate = prop.Int(sampleRate)
+			c.ChannelCount = prop.Int(channels)
+			c.SampleSize = prop.Int(16) // 16-bit
+			if deviceID != "" {
+				c.DeviceID = prop.String(deviceID)
+			}
+		},
+		Codec: codecSelector,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get user media: %v", err)
+	}
+
+	audioTracks := stream.GetTracks()
+	if len(audioTracks) == 0 {
+		return nil, fmt.Errorf("no audio track found")
+	}
+
+	if len(audioTracks) > 1 {
+		return nil, fmt.Errorf("too many audio tracks: %d", len(audioTracks))
+	}
+
+	return audioTracks[0], nil
+}
+
+// MicrophoneSource captures the microphone matching device, or the default
+// one if device is empty. With pcm, the source yields PCM that can be
+// processed before encoding, otherwise mediadevices encodes it with
+// opusOpts.
+func MicrophoneSource(sampleRate, channels int, device string, opusOpts audio.OpusEncoderOptions, pcm bool) (audio.Source, error) {
+	track, err := GetUserMediaTrack(sampleRate, channels, device, opusOpts)
+	if err != nil {
+		return nil, err
+	}
+	if pcm {
+		return audio.NewMediaDevicesPCMSource(track)
+	}
+	return audio.NewMediaDevicesSource(track)
+}
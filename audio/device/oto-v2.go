@@ -1,8 +1,12 @@
-package main
+//go:build cgo && !nooto && !nolibopus
+
+package device
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
+	"log/slog"
 	"sync"
 	"time"
 
@@ -10,27 +14,44 @@ import (
 	opusv2 "github.com/hraban/opus"
 	"github.com/pion/webrtc/v4"
 	"golang.org/x/exp/rand"
-)
 
-const (
-	sampleRate = 24_000 // 24kHz
-	channels   = 2      // stereo
+	"exp-openai-webrtc-streaming/audio"
+	"exp-openai-webrtc-streaming/internal/logging"
+	"exp-openai-webrtc-streaming/internal/playback"
+	"exp-openai-webrtc-streaming/metrics"
 )
 
+func init() {
+	register("oto-v2", backend{newPlayer: func(opts audio.PlayerOptions) (audio.Player, error) {
+		return NewOpusV2AudioPlayer(opts)
+	}})
+}
+
+// OpusV2AudioPlayer decodes with libopus and plays on the default device
+// with oto, through an audio.Buffer.
 type OpusV2AudioPlayer struct {
 	context     *oto.Context
 	player      *oto.Player
-	audioBuffer *audioBuffer
+	audioBuffer *audio.Buffer
 	mutex       sync.Mutex
-	closed      bool
+	loops       playback.Loops
+	tap         playback.Tap
+	log         *slog.Logger
 }
 
-func NewOpusV2AudioPlayer() (*OpusV2AudioPlayer, error) {
+// NewOpusV2AudioPlayer plays on the default output device; oto cannot
+// select another.
+func NewOpusV2AudioPlayer(opts audio.PlayerOptions) (*OpusV2AudioPlayer, error) {
+	log := logging.Component(opts.Logger, "player").With("backend", "oto-v2")
+	if opts.DeviceBuffer == 0 {
+		opts.DeviceBuffer = 10 * time.Millisecond // lower for less latency
+	}
+
 	context, ready, err := oto.NewContext(&oto.NewContextOptions{
 		SampleRate:   sampleRate,
 		ChannelCount: channels,
 		Format:       oto.FormatSignedInt16LE,
-		BufferSize:   sampleRate / 100, // 10ms buffer (lower for less latency)
+		BufferSize:   opts.DeviceBuffer,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("failed to create audio context: %w", err)
@@ -39,21 +60,27 @@ func NewOpusV2AudioPlayer() (*OpusV2AudioPlayer, error) {
 	// Wait for the context to be ready
 	<-ready
 
-	audioBuffer := newAudioBuffer(sampleRate, channels)
+	audioBuffer := audio.NewBuffer(sampleRate, channels, opts.Buffer, opts.Prebuffer)
 	player := context.NewPlayer(audioBuffer)
 	// Try to set real-time priority if possible
 	if err := setRealtimePriority(); err != nil {
-		fmt.Printf("Warning: Could not set realtime priority: %v\n", err)
+		log.Warn("could not set realtime priority", "err", err)
 	}
 
 	return &OpusV2AudioPlayer{
 		context:     context,
 		player:      player,
 		audioBuffer: audioBuffer,
+		log:         log,
 	}, nil
 }
 
-func (ap *OpusV2AudioPlayer) orig_WriteWebRTCTrack(track *webrtc.TrackRemote) error {
+func (ap *OpusV2AudioPlayer) orig_WriteWebRTCTrack(track audio.RemoteTrack) error {
+	if !ap.loops.Start(track) {
+		return nil
+	}
+	defer ap.loops.Done(track)
+
 	codec := track.Codec()
 
 	if codec.MimeType != webrtc.MimeTypeOpus {
@@ -86,13 +113,16 @@ func (ap *OpusV2AudioPlayer) orig_WriteWebRTCTrack(track *webrtc.TrackRemote) er
 			end     time.Time
 		}
 
-		if ap.closed {
+		if ap.loops.IsClosed() {
 			return nil
 		}
 
 		ts.start = time.Now()
 		p, _, err := track.ReadRTP()
 		if err != nil {
+			if ap.loops.IsClosed() {
+				return nil
+			}
 			return fmt.Errorf("failed to read RTP packet: %w", err)
 		}
 
@@ -104,7 +134,7 @@ func (ap *OpusV2AudioPlayer) orig_WriteWebRTCTrack(track *webrtc.TrackRemote) er
 		samplesPerChannel, err := decoder.Decode(p.Payload, pcmBuf)
 		if err != nil {
 			ap.mutex.Unlock()
-			fmt.Printf("Failed to decode opus data: %v\n", err)
+			ap.log.Warn("failed to decode opus data", "err", err)
 			continue
 		}
 
@@ -122,7 +152,7 @@ func (ap *OpusV2AudioPlayer) orig_WriteWebRTCTrack(track *webrtc.TrackRemote) er
 		ts.convert = time.Now()
 		if _, err := ap.audioBuffer.Write(bsBuf[:totalSamples*2]); err != nil {
 			ap.mutex.Unlock()
-			fmt.Printf("Failed to write to audio buffer: %v\n", err)
+			ap.log.Warn("failed to write to audio buffer", "err", err)
 			continue
 		}
 
@@ -135,29 +165,26 @@ func (ap *OpusV2AudioPlayer) orig_WriteWebRTCTrack(track *webrtc.TrackRemote) er
 		ts.end = time.Now()
 
 		if rand.Intn(10) == 0 {
-			fmt.Printf(`RTP loop stats:
-    read:  %s
-    lock:  %s
-  decode:  %s
- convert:  %s
-   write:  %s
-     end:  %s
- => TOTAL: %s
-		`,
-				ts.read.Sub(ts.start),
-				ts.lock.Sub(ts.read),
-				ts.decode.Sub(ts.lock),
-				ts.convert.Sub(ts.decode),
-				ts.write.Sub(ts.convert),
-				ts.end.Sub(ts.write),
-				ts.end.Sub(ts.start),
+			ap.log.Debug("RTP loop stats",
+				"read", ts.read.Sub(ts.start),
+				"lock", ts.lock.Sub(ts.read),
+				"decode", ts.decode.Sub(ts.lock),
+				"convert", ts.convert.Sub(ts.decode),
+				"write", ts.write.Sub(ts.convert),
+				"end", ts.end.Sub(ts.write),
+				"total", ts.end.Sub(ts.start),
 			)
 		}
 	}
 }
 
 // Modified WriteWebRTCTrack with diagnostics
-func (ap *OpusV2AudioPlayer) WriteWebRTCTrack(track *webrtc.TrackRemote) error {
+func (ap *OpusV2AudioPlayer) WriteWebRTCTrack(track audio.RemoteTrack) error {
+	if !ap.loops.Start(track) {
+		return nil
+	}
+	defer ap.loops.Done(track)
+
 	codec := track.Codec()
 	if codec.MimeType != webrtc.MimeTypeOpus {
 		return fmt.Errorf("unsupported codec: %s", codec.MimeType)
@@ -170,17 +197,16 @@ func (ap *OpusV2AudioPlayer) WriteWebRTCTrack(track *webrtc.TrackRemote) error {
 		return fmt.Errorf("failed to create opus decoder: %w", err)
 	}
 
-	// Print codec details
-	fmt.Printf("Codec Details:\n")
-	fmt.Printf("MimeType: %s\n", codec.MimeType)
-	fmt.Printf("ClockRate: %d\n", codec.ClockRate)
-	fmt.Printf("Channels: %d\n", codec.Channels)
-	fmt.Printf("SDPFmtpLine: %s\n", codec.SDPFmtpLine)
+	ap.log.Debug("playing track",
+		"mime_type", codec.MimeType,
+		"clock_rate", codec.ClockRate,
+		"channels", codec.Channels,
+		"fmtp", codec.SDPFmtpLine)
 
 	// Start playing
 	ap.player.Play()
 
-	diagnostics := NewAudioDiagnostics()
+	diagnostics := audio.NewDiagnostics(ap.log)
 
 	// Allocate PCM buffers at maximum size
 	frameSizeMs := 60 // for max frameSize
@@ -188,18 +214,24 @@ func (ap *OpusV2AudioPlayer) WriteWebRTCTrack(track *webrtc.TrackRemote) error {
 	pcmBuf := make([]int16, frameSize*channels)
 	byteBuf := make([]byte, len(pcmBuf)*2)
 
-	var ts processLoopStats
+	ts := processLoopStats{log: ap.log}
+	var packets metrics.PacketCounter
+	lastFrameSize := 0
 
 	for {
 		ts.startSample()
-		if ap.closed {
+		if ap.loops.IsClosed() {
 			return nil
 		}
 
 		p, _, err := track.ReadRTP()
 		if err != nil {
+			if ap.loops.IsClosed() {
+				return nil
+			}
 			return fmt.Errorf("failed to read RTP packet: %w", err)
 		}
+		lost := packets.Count(p)
 
 		// if p.Padding {
 		// 	fmt.Println("PADDING")
@@ -214,21 +246,28 @@ func (ap *OpusV2AudioPlayer) WriteWebRTCTrack(track *webrtc.TrackRemote) error {
 		// 	fmt.Printf("PAYLOADOFFSET: %d\n", p.PayloadOffset)
 		// }
 
-		ts.read += ts.sinceLastMeasure()
+		ts.read += ts.measure("read")
 		ap.mutex.Lock()
 
-		ts.lock += ts.sinceLastMeasure()
+		ts.lock += ts.measure("lock")
+		if lost > 0 && lastFrameSize > 0 {
+			ap.concealLoss(decoder, min(lost, maxPLCFrames), lastFrameSize, pcmBuf, byteBuf)
+		}
+
 		// Decode Opus data to PCM
 		samplesPerChannel, err := decoder.Decode(p.Payload, pcmBuf)
 		if err != nil {
 			ap.mutex.Unlock()
-			fmt.Printf("Failed to decode opus data: %v\n", err)
+			metrics.Default.DecodeErrors.Inc()
+			ap.log.Warn("failed to decode opus data", "err", err)
 			continue
 		}
+		lastFrameSize = samplesPerChannel
 
-		ts.decode += ts.sinceLastMeasure()
+		ts.decode += ts.measure("decode")
 		// Log diagnostics
-		diagnostics.logStats(pcmBuf[:samplesPerChannel*2], p.Payload, samplesPerChannel)
+		diagnostics.LogStats(pcmBuf[:samplesPerChannel*2], p.Payload, samplesPerChannel)
+		ap.tap.Write(pcmBuf[:samplesPerChannel*channels], sampleRate, channels)
 
 		totalSamples := samplesPerChannel * 2
 
@@ -236,7 +275,7 @@ func (ap *OpusV2AudioPlayer) WriteWebRTCTrack(track *webrtc.TrackRemote) error {
 		nBytes, err := toByteArray(pcmBuf[:totalSamples], byteBuf)
 		if err != nil {
 			ap.mutex.Unlock()
-			fmt.Printf("Failed to convert PCM to bytes: %v\n", err)
+			ap.log.Warn("failed to convert PCM to bytes", "err", err)
 			continue
 		}
 		// for i := 0; i < totalSamples; i++ {
@@ -246,38 +285,87 @@ func (ap *OpusV2AudioPlayer) WriteWebRTCTrack(track *webrtc.TrackRemote) error {
 		// 	byteBuf[byteIndex+1] = byte(sample >> 8)
 		// }
 
-		ts.convert += ts.sinceLastMeasure()
+		ts.convert += ts.measure("convert")
 		// Write to audio buffer
 		if _, err := ap.audioBuffer.Write(byteBuf[:nBytes]); err != nil {
 			ap.mutex.Unlock()
-			fmt.Printf("Failed to write to audio buffer: %v\n", err)
+			ap.log.Warn("failed to write to audio buffer", "err", err)
 			continue
 		}
 
-		ts.write += ts.sinceLastMeasure()
+		ts.write += ts.measure("write")
 		ap.mutex.Unlock()
 
-		ts.unlock += ts.sinceLastMeasure()
+		ts.unlock += ts.measure("unlock")
 		if !ap.player.IsPlaying() {
 			ap.player.Play()
 		}
 
-		ts.end += ts.sinceLastMeasure()
+		ts.end += ts.measure("end")
 		ts.endSample()
 	}
 }
 
-func (ap *OpusV2AudioPlayer) Close() error {
-	ap.mutex.Lock()
-	defer ap.mutex.Unlock()
+// maxPLCFrames caps how many lost frames are concealed in a row; longer gaps
+// are left as silence.
+const maxPLCFrames = 5
+
+// concealLoss writes frames of packet loss concealment audio, frameSize
+// samples per channel each, to the audio buffer. It expects ap.mutex held.
+func (ap *OpusV2AudioPlayer) concealLoss(decoder *opusv2.Decoder, frames, frameSize int, pcmBuf []int16, byteBuf []byte) {
+	pcm := pcmBuf[:frameSize*channels]
+	for i := 0; i < frames; i++ {
+		if err := decoder.DecodePLC(pcm); err != nil {
+			metrics.Default.DecodeErrors.Inc()
+			ap.log.Warn("failed to conceal lost opus packet", "err", err)
+			return
+		}
+		metrics.Default.PLCFrames.Inc()
 
-	if ap.closed {
+		nBytes, err := toByteArray(pcm, byteBuf)
+		if err != nil {
+			return
+		}
+		if _, err := ap.audioBuffer.Write(byteBuf[:nBytes]); err != nil {
+			return
+		}
+	}
+}
+
+// SetPlaybackTap makes the player write the decoded audio to tap, e.g. an
+// EchoCanceller.
+func (ap *OpusV2AudioPlayer) SetPlaybackTap(tap audio.PlaybackTap) {
+	ap.tap.Set(tap)
+}
+
+// Drain waits until the audio received so far has been played, or ctx is
+// done.
+func (ap *OpusV2AudioPlayer) Drain(ctx context.Context) error {
+	if err := ap.audioBuffer.Drain(ctx); err != nil {
+		return err
+	}
+	// oto reads ahead into its own buffer
+	return playback.WaitEmpty(ctx, func() int {
+		ap.mutex.Lock()
+		defer ap.mutex.Unlock()
+		if ap.player == nil {
+			return 0
+		}
+		return ap.player.BufferedSize()
+	})
+}
+
+func (ap *OpusV2AudioPlayer) Close() error {
+	// Stop the read loops first, so nothing writes to the buffer or touches
+	// the player while they are being torn down.
+	if !ap.loops.Close() {
 		return nil
 	}
 
-	ap.closed = true
+	// Closing the buffer wakes up oto's reader with io.EOF.
+	ap.audioBuffer.Close()
 	if ap.player != nil {
-		ap.player.Close()
+		return ap.player.Close()
 	}
 	return nil
 }
@@ -332,6 +420,7 @@ type processLoopStats struct {
 	end      time.Duration
 	total    time.Duration
 	nsamples int
+	log      *slog.Logger
 
 	startedAt     time.Time
 	lastTimePoint time.Time
@@ -342,41 +431,41 @@ func (s *processLoopStats) startSample() {
 	s.lastTimePoint = s.startedAt
 }
 
-func (s *processLoopStats) sinceLastMeasure() time.Duration {
+// measure returns the time elapsed since the previous measure and records it
+// in the loop stage histogram under stage.
+func (s *processLoopStats) measure(stage string) time.Duration {
 	now := time.Now()
 	elapsed := now.Sub(s.lastTimePoint)
 	s.lastTimePoint = now
+	metrics.Default.LoopStageSeconds.WithLabelValues(stage).Observe(elapsed.Seconds())
 	return elapsed
 }
 
 func (s *processLoopStats) endSample() {
-	s.total += time.Since(s.startedAt)
+	elapsed := time.Since(s.startedAt)
+	metrics.Default.LoopStageSeconds.WithLabelValues("total").Observe(elapsed.Seconds())
+	s.total += elapsed
 	s.nsamples++
 	if s.nsamples%100 == 0 {
 		s.Print()
 	}
 }
 
+// Print logs the average time spent in each stage at debug level.
 func (s *processLoopStats) Print() {
 	n := time.Duration(s.nsamples)
+	if s.log == nil || n == 0 {
+		return
+	}
 
-	fmt.Printf(`RTP loop stats:
-    read:  %s
-    lock:  %s
-  decode:  %s
- convert:  %s
-   write:  %s
-  unlock:  %s
-     end:  %s
- => TOTAL: %s
-		`,
-		s.read/n,
-		s.lock/n,
-		s.decode/n,
-		s.convert/n,
-		s.write/n,
-		s.unlock/n,
-		s.end/n,
-		s.total/n,
+	s.log.Debug("RTP loop stats",
+		"read", s.read/n,
+		"lock", s.lock/n,
+		"decode", s.decode/n,
+		"convert", s.convert/n,
+		"write", s.write/n,
+		"unlock", s.unlock/n,
+		"end", s.end/n,
+		"total", s.total/n,
 	)
 }
@@ -0,0 +1,192 @@
+//go:build !nooto && (cgo || darwin || windows)
+
+package device
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/ebitengine/oto/v3"
+	"github.com/pion/opus"
+	"github.com/pion/webrtc/v4"
+
+	"exp-openai-webrtc-streaming/audio"
+	"exp-openai-webrtc-streaming/internal/logging"
+	"exp-openai-webrtc-streaming/internal/playback"
+	"exp-openai-webrtc-streaming/metrics"
+)
+
+func init() {
+	register("oto-v3", backend{newPlayer: func(opts audio.PlayerOptions) (audio.Player, error) {
+		return NewOpusV3AudioPlayer(opts)
+	}})
+}
+
+// OpusV3AudioPlayer decodes with the pure Go pion/opus decoder and plays on
+// the default device with oto, through an audio.Buffer.
+type OpusV3AudioPlayer struct {
+	context     *oto.Context
+	player      *oto.Player
+	audioBuffer *audio.Buffer
+	mutex       sync.Mutex
+	loops       playback.Loops
+	tap         playback.Tap
+	tapBuf      []int16
+	log         *slog.Logger
+}
+
+// NewOpusV3AudioPlayer plays on the default output device; oto cannot
+// select another.
+func NewOpusV3AudioPlayer(opts audio.PlayerOptions) (*OpusV3AudioPlayer, error) {
+	if opts.DeviceBuffer == 0 {
+		opts.DeviceBuffer = 10 * time.Millisecond
+	}
+	context, ready, err := oto.NewContext(&oto.NewContextOptions{
+		SampleRate:   sampleRate,
+		ChannelCount: channels,
+		Format:       oto.FormatFloat32LE,
+		BufferSize:   opts.DeviceBuffer,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create audio context: %w", err)
+	}
+
+	// Wait for the context to be ready
+	<-ready
+
+	audioBuffer := audio.NewBuffer(sampleRate, channels, opts.Buffer, opts.Prebuffer)
+
+	player := context.NewPlayer(audioBuffer)
+
+	return &OpusV3AudioPlayer{
+		context:     context,
+		player:      player,
+		audioBuffer: audioBuffer,
+		log:         logging.Component(opts.Logger, "player").With("backend", "oto-v3"),
+	}, nil
+}
+
+func (ap *OpusV3AudioPlayer) WriteWebRTCTrack(track audio.RemoteTrack) error {
+	if !ap.loops.Start(track) {
+		return nil
+	}
+	defer ap.loops.Done(track)
+
+	codec := track.Codec()
+
+	if codec.MimeType != webrtc.MimeTypeOpus {
+		return fmt.Errorf("unsupported codec: %s", track.Codec().MimeType)
+	}
+
+	ap.player.Play()
+
+	decoder := opus.NewDecoder()
+
+	// Buffer for decoded PCM data
+	pcmBuf := make([]byte, 96*20*4)
+
+	var packets metrics.PacketCounter
+	for {
+		if ap.loops.IsClosed() {
+			return nil
+		}
+
+		p, _, err := track.ReadRTP()
+		if err != nil {
+			if ap.loops.IsClosed() {
+				return nil
+			}
+			return fmt.Errorf("failed to read RTP packet: %w", err)
+		}
+		packets.Count(p)
+
+		for i := 0; i < len(pcmBuf); i++ {
+			pcmBuf[i] = 0
+		}
+
+		ap.mutex.Lock()
+		// Decode Opus data to PCM
+		bandwidth, _, err := decoder.Decode(p.Payload, pcmBuf)
+		if err != nil {
+			ap.mutex.Unlock()
+			metrics.Default.DecodeErrors.Inc()
+			ap.log.Warn("failed to decode opus data", "err", err)
+			continue
+		}
+
+		ap.writeTap(pcmBuf, bandwidth)
+
+		if _, err := ap.audioBuffer.Write(pcmBuf); err != nil {
+			ap.mutex.Unlock()
+			ap.log.Warn("failed to write to audio buffer", "err", err)
+			continue
+		}
+
+		ap.mutex.Unlock()
+		if !ap.player.IsPlaying() {
+			ap.player.Play()
+		}
+	}
+}
+
+// SetPlaybackTap makes the player write the decoded audio to tap, e.g. an
+// EchoCanceller.
+func (ap *OpusV3AudioPlayer) SetPlaybackTap(tap audio.PlaybackTap) {
+	ap.tap.Set(tap)
+}
+
+// writeTap converts the first 20ms of decoded audio for the tap. pion/opus
+// only decodes SILK, which it outputs as mono S16LE upsampled 3 times from
+// the rate of the bandwidth.
+func (ap *OpusV3AudioPlayer) writeTap(pcmBuf []byte, bandwidth opus.Bandwidth) {
+	rate := bandwidth.SampleRate() * 3
+	n := min(rate/50, len(pcmBuf)/2)
+	if cap(ap.tapBuf) < n {
+		ap.tapBuf = make([]int16, n)
+	}
+	pcm := ap.tapBuf[:n]
+	for i := range pcm {
+		pcm[i] = int16(binary.LittleEndian.Uint16(pcmBuf[i*2:]))
+	}
+	ap.tap.Write(pcm, rate, 1)
+}
+
+// Drain waits until the audio received so far has been played, or ctx is
+// done.
+func (ap *OpusV3AudioPlayer) Drain(ctx context.Context) error {
+	if err := ap.audioBuffer.Drain(ctx); err != nil {
+		return err
+	}
+	// oto reads ahead into its own buffer
+	return playback.WaitEmpty(ctx, func() int {
+		ap.mutex.Lock()
+		defer ap.mutex.Unlock()
+		if ap.player == nil {
+			return 0
+		}
+		return ap.player.BufferedSize()
+	})
+}
+
+func (ap *OpusV3AudioPlayer) Close() error {
+	// The read loops dereference ap.player, so they must be gone before it
+	// is released.
+	if !ap.loops.Close() {
+		return nil
+	}
+
+	// Closing the buffer wakes up oto's reader with io.EOF.
+	ap.audioBuffer.Close()
+
+	ap.mutex.Lock()
+	defer ap.mutex.Unlock()
+
+	err := ap.player.Close()
+	ap.player = nil
+	ap.context = nil
+	return err
+}
@@ -0,0 +1,8 @@
+//go:build !cgo || noportaudio || nolibopus
+
+package device
+
+// listOutputDevices returns no devices, the build has no PortAudio.
+func listOutputDevices() ([]Device, error) {
+	return nil, nil
+}
@@ -0,0 +1,266 @@
+//go:build cgo && !noportaudio && !nolibopus
+
+package device
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gordonklaus/portaudio"
+	opusv2 "github.com/hraban/opus"
+
+	"exp-openai-webrtc-streaming/audio"
+	"exp-openai-webrtc-streaming/internal/logging"
+	"exp-openai-webrtc-streaming/internal/playback"
+	"exp-openai-webrtc-streaming/metrics"
+)
+
+func init() {
+	register("portaudio", backend{
+		newPlayer: func(opts audio.PlayerOptions) (audio.Player, error) {
+			return NewPortaudioPlayer(opts)
+		},
+		selectsDevice: true,
+	})
+}
+
+// PortaudioPlayer plays on a PortAudio stream, from a ring buffer filled
+// as the packets arrive.
+type PortaudioPlayer struct {
+	stream      *portaudio.Stream
+	opusDecoder *opusv2.Decoder
+	mutex       sync.Mutex
+	loops       playback.Loops
+	tap         playback.Tap
+	buffer      []float32
+	bufferIndex int
+	pending     int // written samples not played yet
+	log         *slog.Logger
+}
+
+// NewPortaudioPlayer plays on the output device matching opts.Device, see
+// List, or on the default output device if it is empty.
+func NewPortaudioPlayer(opts audio.PlayerOptions) (*PortaudioPlayer, error) {
+	if opts.Buffer == 0 {
+		opts.Buffer = time.Second
+	}
+	if opts.DeviceBuffer == 0 {
+		opts.DeviceBuffer = 20 * time.Millisecond
+	}
+	framesPerBuffer := int(48000 * opts.DeviceBuffer / time.Second)
+
+	// Initialize PortAudio
+	if err := portaudio.Initialize(); err != nil {
+		return nil, fmt.Errorf("failed to initialize PortAudio: %w", err)
+	}
+
+	// Create Opus decoder
+	decoder, err := opusv2.NewDecoder(48000, 2)
+	if err != nil {
+		portaudio.Terminate()
+		return nil, fmt.Errorf("failed to create opus decoder: %w", err)
+	}
+
+	player := &PortaudioPlayer{
+		opusDecoder: decoder,
+		buffer:      make([]float32, int(48000*opts.Buffer/time.Second)),
+		bufferIndex: 0,
+		log:         logging.Component(opts.Logger, "player").With("backend", "portaudio"),
+	}
+
+	// Create and start PortAudio stream
+	var stream *portaudio.Stream
+	if opts.Device == "" {
+		stream, err = portaudio.OpenDefaultStream(
+			0,                   // input channels
+			2,                   // output channels (stereo)
+			48000,               // sample rate
+			framesPerBuffer,     // frames per buffer
+			player.processAudio, // callback
+		)
+	} else {
+		stream, err = openPortaudioOutput(opts.Device, framesPerBuffer, player.processAudio)
+	}
+	if err != nil {
+		portaudio.Terminate()
+		return nil, fmt.Errorf("failed to open PortAudio stream: %w", err)
+	}
+
+	if err := stream.Start(); err != nil {
+		stream.Close()
+		portaudio.Terminate()
+		return nil, fmt.Errorf("failed to start PortAudio stream: %w", err)
+	}
+
+	player.stream = stream
+	return player, nil
+}
+
+func (ap *PortaudioPlayer) processAudio(out []float32) {
+	ap.mutex.Lock()
+	defer ap.mutex.Unlock()
+
+	// Copy data from our buffer to the output
+	for i := range out {
+		if ap.bufferIndex >= len(ap.buffer) {
+			ap.bufferIndex = 0
+		}
+		out[i] = ap.buffer[ap.bufferIndex]
+		ap.bufferIndex++
+	}
+	ap.pending = max(ap.pending-len(out), 0)
+}
+
+func (ap *PortaudioPlayer) WriteWebRTCTrack(track audio.RemoteTrack) error {
+	if !ap.loops.Start(track) {
+		return nil
+	}
+	defer ap.loops.Done(track)
+
+	// Buffer for decoded PCM data (48kHz stereo, 20ms frame = 960*2 samples)
+	pcmBuf := make([]int16, 960*2)
+
+	ap.stream.Start()
+
+	var packets metrics.PacketCounter
+	for {
+		if ap.loops.IsClosed() {
+			return nil
+		}
+
+		// Read RTP packet
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			if ap.loops.IsClosed() {
+				return nil
+			}
+			return fmt.Errorf("failed to read RTP packet: %w", err)
+		}
+		packets.Count(packet)
+
+		ap.mutex.Lock()
+		// Decode Opus data to PCM
+		samplesRead, err := ap.opusDecoder.Decode(packet.Payload, pcmBuf)
+		if err != nil {
+			ap.mutex.Unlock()
+			metrics.Default.DecodeErrors.Inc()
+			ap.log.Warn("failed to decode opus data", "err", err)
+			continue
+		}
+
+		ap.tap.Write(pcmBuf[:samplesRead*2], 48000, 2)
+
+		// Convert int16 PCM to float32 and write to buffer
+		for i := 0; i < samplesRead*2; i++ {
+			bufferPos := (ap.bufferIndex + i) % len(ap.buffer)
+			ap.buffer[bufferPos] = float32(pcmBuf[i]) / 32768.0
+		}
+		// Writes start at the read position, overwriting what was pending
+		ap.pending = samplesRead * 2
+		ap.mutex.Unlock()
+	}
+}
+
+// SetPlaybackTap makes the player write the decoded audio to tap, e.g. an
+// EchoCanceller.
+func (ap *PortaudioPlayer) SetPlaybackTap(tap audio.PlaybackTap) {
+	ap.tap.Set(tap)
+}
+
+// Drain waits until the audio received so far has been played, or ctx is
+// done.
+func (ap *PortaudioPlayer) Drain(ctx context.Context) error {
+	return playback.WaitEmpty(ctx, func() int {
+		ap.mutex.Lock()
+		defer ap.mutex.Unlock()
+		return ap.pending
+	})
+}
+
+func (ap *PortaudioPlayer) Close() error {
+	if !ap.loops.Close() {
+		return nil
+	}
+
+	// ap.mutex must not be held here: Stop waits for processAudio, which
+	// takes the mutex itself.
+	if ap.stream != nil {
+		if err := ap.stream.Stop(); err != nil {
+			return fmt.Errorf("failed to stop stream: %w", err)
+		}
+		if err := ap.stream.Close(); err != nil {
+			return fmt.Errorf("failed to close stream: %w", err)
+		}
+	}
+
+	return portaudio.Terminate()
+}
+
+// openPortaudioOutput opens a 48kHz stereo stream on the output device
+// matching device.
+func openPortaudioOutput(device string, framesPerBuffer int, callback func([]float32)) (*portaudio.Stream, error) {
+	devices, infos, err := outputDevices()
+	if err != nil {
+		return nil, err
+	}
+	i, err := findDevice(devices, device)
+	if err != nil {
+		return nil, err
+	}
+
+	return portaudio.OpenStream(portaudio.StreamParameters{
+		Output: portaudio.StreamDeviceParameters{
+			Device:   infos[i],
+			Channels: 2,
+			Latency:  infos[i].DefaultLowOutputLatency,
+		},
+		SampleRate:      48000,
+		FramesPerBuffer: framesPerBuffer,
+	}, callback)
+}
+
+// listOutputDevices returns the PortAudio output devices.
+func listOutputDevices() ([]Device, error) {
+	if err := portaudio.Initialize(); err != nil {
+		return nil, fmt.Errorf("failed to initialize PortAudio: %w", err)
+	}
+	defer portaudio.Terminate()
+
+	devices, _, err := outputDevices()
+	return devices, err
+}
+
+// outputDevices returns the PortAudio output devices along with the
+// PortAudio device of each. PortAudio must be initialized.
+func outputDevices() ([]Device, []*portaudio.DeviceInfo, error) {
+	all, err := portaudio.Devices()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get audio devices: %w", err)
+	}
+	defaultOutput, _ := portaudio.DefaultOutputDevice()
+
+	var devices []Device
+	var infos []*portaudio.DeviceInfo
+	for i, d := range all {
+		if d.MaxOutputChannels == 0 {
+			continue
+		}
+		devices = append(devices, Device{
+			// PortAudio device indexes are stable until devices are plugged
+			// or unplugged.
+			ID:                strconv.Itoa(i),
+			Name:              d.Name,
+			Kind:              Output,
+			Channels:          d.MaxOutputChannels,
+			DefaultSampleRate: d.DefaultSampleRate,
+			Latency:           d.DefaultLowOutputLatency,
+			Default:           d == defaultOutput,
+		})
+		infos = append(infos, d)
+	}
+	return devices, infos, nil
+}
@@ -0,0 +1,91 @@
+package device
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"exp-openai-webrtc-streaming/audio"
+	"exp-openai-webrtc-streaming/internal/playback"
+	"exp-openai-webrtc-streaming/metrics"
+)
+
+// The sinks are pure Go players, available in every build: "file" writes the
+// audio to the file named by PlayerOptions.Device, "null" discards it.
+func init() {
+	register("file", backend{
+		newPlayer: func(opts audio.PlayerOptions) (audio.Player, error) {
+			return NewFilePlayer(opts)
+		},
+		selectsDevice: true,
+	})
+	register("null", backend{newPlayer: func(audio.PlayerOptions) (audio.Player, error) {
+		return &NullPlayer{}, nil
+	}})
+}
+
+// FilePlayer records the model audio to a WAV or Ogg Opus file instead of
+// playing it, see audio.TrackRecorder. Without libopus, WAV files can only be
+// decoded from SILK, the Ogg files have the packets as received.
+type FilePlayer struct {
+	*audio.TrackRecorder
+}
+
+// NewFilePlayer records to opts.Device, the path of the file.
+func NewFilePlayer(opts audio.PlayerOptions) (*FilePlayer, error) {
+	if opts.Device == "" {
+		return nil, fmt.Errorf("the file player needs the output file as device")
+	}
+	recorder := audio.NewTrackRecorder(opts.Logger)
+	if err := recorder.Start(opts.Device); err != nil {
+		return nil, err
+	}
+	return &FilePlayer{recorder}, nil
+}
+
+// SetPlaybackTap does nothing, nothing is played.
+func (p *FilePlayer) SetPlaybackTap(audio.PlaybackTap) {}
+
+// Drain returns at once, the audio is written as it is received.
+func (p *FilePlayer) Drain(context.Context) error {
+	return nil
+}
+
+// NullPlayer reads the model audio and discards it, e.g. to run without an
+// audio device.
+type NullPlayer struct {
+	loops playback.Loops
+}
+
+func (p *NullPlayer) WriteWebRTCTrack(track audio.RemoteTrack) error {
+	if !p.loops.Start(track) {
+		return nil
+	}
+	defer p.loops.Done(track)
+
+	var packets metrics.PacketCounter
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			if p.loops.IsClosed() || errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("failed to read RTP packet: %w", err)
+		}
+		packets.Count(packet)
+	}
+}
+
+// SetPlaybackTap does nothing, nothing is played.
+func (p *NullPlayer) SetPlaybackTap(audio.PlaybackTap) {}
+
+// Drain returns at once, the audio is discarded as it is received.
+func (p *NullPlayer) Drain(context.Context) error {
+	return nil
+}
+
+func (p *NullPlayer) Close() error {
+	p.loops.Close()
+	return nil
+}
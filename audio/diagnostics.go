@@ -0,0 +1,76 @@
+package audio
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Diagnostics logs the rate, count and range of the audio decoded by a
+// player once a second.
+type Diagnostics struct {
+	sampleCount     int64
+	lastPrintTime   time.Time
+	packetsReceived int64
+	bytesReceived   int64
+	mutex           sync.Mutex
+	log             *slog.Logger
+}
+
+// NewDiagnostics creates diagnostics that log at debug level to logger,
+// or to slog.Default() if it is nil.
+func NewDiagnostics(logger *slog.Logger) *Diagnostics {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &Diagnostics{
+		lastPrintTime: time.Now(),
+		log:           logger,
+	}
+}
+
+// LogStats records a decoded packet and logs the stats once a second has
+// passed since the last time.
+func (d *Diagnostics) LogStats(pcmSamples []int16, opusPayload []byte, decodedSamples int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.sampleCount += int64(decodedSamples)
+	d.packetsReceived++
+	d.bytesReceived += int64(len(opusPayload))
+
+	// Log stats every second
+	if time.Since(d.lastPrintTime) >= time.Second {
+		sampleRate := float64(d.sampleCount) / time.Since(d.lastPrintTime).Seconds()
+		min, max := minMax(pcmSamples)
+		d.log.Debug("audio statistics",
+			"sample_rate", fmt.Sprintf("%.2f", sampleRate),
+			"packets_received", d.packetsReceived,
+			"bytes_received", d.bytesReceived,
+			"pcm_min", min,
+			"pcm_max", max)
+
+		d.sampleCount = 0
+		d.packetsReceived = 0
+		d.bytesReceived = 0
+		d.lastPrintTime = time.Now()
+	}
+}
+
+func minMax(samples []int16) (min, max int16) {
+	if len(samples) == 0 {
+		return 0, 0
+	}
+	min = samples[0]
+	max = samples[0]
+	for _, s := range samples {
+		if s < min {
+			min = s
+		}
+		if s > max {
+			max = s
+		}
+	}
+	return min, max
+}
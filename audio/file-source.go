@@ -0,0 +1,237 @@
+package audio
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-audio/wav"
+	"github.com/pion/mediadevices/pkg/wave"
+
+	"exp-openai-webrtc-streaming/internal/logging"
+)
+
+const fileSourceFrameDuration = 20 * time.Millisecond
+
+// FileSourceEnd is what a FileSource does once the file has been played.
+type FileSourceEnd int
+
+const (
+	// FileSourceStop ends the track.
+	FileSourceStop FileSourceEnd = iota
+	// FileSourceSilence keeps the track open and sends silence, so the model
+	// can answer the last utterance.
+	FileSourceSilence
+	// FileSourceLoop plays the file again from the start.
+	FileSourceLoop
+)
+
+// FileSourceOptions configures a FileSource.
+type FileSourceOptions struct {
+	// SampleRate and Channels are the format of the produced audio. The file
+	// is resampled and remixed to match. Defaults to 48kHz mono.
+	SampleRate int
+	Channels   int
+	// RawSampleRate and RawChannels are the format of raw s16le files, which
+	// have no header. Defaults to SampleRate and Channels.
+	RawSampleRate int
+	RawChannels   int
+	End           FileSourceEnd
+	Logger        *slog.Logger
+}
+
+// FileSource is a microphone replacement that plays a WAV, raw s16le PCM or
+// Ogg Opus file in real time, 20ms at a time. The format is picked from the
+// file extension: .wav, .ogg/.opus, or .raw/.pcm/.s16.
+type FileSource struct {
+	id   string
+	opts FileSourceOptions
+	log  *slog.Logger
+
+	pcm       []int16
+	frameSize int // samples per channel in one chunk
+
+	mutex    sync.Mutex
+	pos      int
+	deadline time.Time
+	done     chan struct{}
+	closed   bool
+}
+
+// NewFileSource loads path and returns a source playing it.
+func NewFileSource(path string, opts FileSourceOptions) (*FileSource, error) {
+	if opts.SampleRate == 0 {
+		opts.SampleRate = 48_000
+	}
+	if opts.Channels == 0 {
+		opts.Channels = 1
+	}
+	if opts.RawSampleRate == 0 {
+		opts.RawSampleRate = opts.SampleRate
+	}
+	if opts.RawChannels == 0 {
+		opts.RawChannels = opts.Channels
+	}
+
+	pcm, rate, ch, err := loadAudioFile(path, opts.RawSampleRate, opts.RawChannels)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &FileSource{
+		id:        "file:" + path,
+		opts:      opts,
+		log:       logging.Component(opts.Logger, "mic").With("file", path),
+		pcm:       ConvertPCM(pcm, rate, ch, opts.SampleRate, opts.Channels),
+		frameSize: opts.SampleRate * int(fileSourceFrameDuration/time.Millisecond) / 1000,
+		done:      make(chan struct{}),
+	}
+	s.log.Info("loaded audio file",
+		"rate", rate, "channels", ch,
+		"duration", time.Duration(len(s.pcm)/opts.Channels)*time.Second/time.Duration(opts.SampleRate))
+	return s, nil
+}
+
+func (s *FileSource) ID() string {
+	return s.id
+}
+
+func (s *FileSource) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+	return nil
+}
+
+// Read returns the next 20ms chunk, blocking until it is due.
+func (s *FileSource) Read() (wave.Audio, func(), error) {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil, func() {}, io.EOF
+	}
+
+	chunk := wave.NewInt16Interleaved(wave.ChunkInfo{
+		Len:          s.frameSize,
+		Channels:     s.opts.Channels,
+		SamplingRate: s.opts.SampleRate,
+	})
+
+	n := copy(chunk.Data, s.pcm[min(s.pos, len(s.pcm)):])
+	s.pos += n
+	if n < len(chunk.Data) {
+		switch s.opts.End {
+		case FileSourceStop:
+			if n == 0 {
+				s.mutex.Unlock()
+				s.log.Info("end of audio file")
+				return nil, func() {}, io.EOF
+			}
+			// the rest of the last chunk is silence
+		case FileSourceLoop:
+			for n < len(chunk.Data) && len(s.pcm) > 0 {
+				c := copy(chunk.Data[n:], s.pcm)
+				n += c
+				s.pos = c
+			}
+		case FileSourceSilence:
+		}
+	}
+
+	// Pace against a running deadline rather than sleeping a fixed time, so
+	// that encoding time does not add up to drift.
+	now := time.Now()
+	if s.deadline.IsZero() || now.Sub(s.deadline) > time.Second {
+		s.deadline = now
+	}
+	wait := s.deadline.Sub(now)
+	s.deadline = s.deadline.Add(fileSourceFrameDuration)
+	s.mutex.Unlock()
+
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-s.done:
+			return nil, func() {}, io.EOF
+		}
+	}
+	return chunk, func() {}, nil
+}
+
+// ReadAudio implements Source, so the file can be passed to Connect
+// without going through mediadevices.
+func (s *FileSource) ReadAudio() (Frame, error) {
+	chunk, _, err := s.Read()
+	if err != nil {
+		return Frame{}, err
+	}
+	return Frame{
+		PCM:        chunk.(*wave.Int16Interleaved).Data,
+		SampleRate: s.opts.SampleRate,
+		Channels:   s.opts.Channels,
+	}, nil
+}
+
+// loadAudioFile decodes path to interleaved 16-bit PCM and returns it with
+// its sample rate and channel count.
+func loadAudioFile(path string, rawRate, rawChannels int) ([]int16, int, int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("failed to open audio file: %w", err)
+	}
+	defer f.Close()
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".wav":
+		return decodeWav(f)
+	case ".ogg", ".opus":
+		pcm, ch, err := decodeOggOpus(f)
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("failed to decode %s: %w", path, err)
+		}
+		return pcm, 48_000, ch, nil
+	case ".raw", ".pcm", ".s16":
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		pcm := make([]int16, len(data)/2)
+		for i := range pcm {
+			pcm[i] = int16(binary.LittleEndian.Uint16(data[i*2:]))
+		}
+		return pcm, rawRate, rawChannels, nil
+	default:
+		return nil, 0, 0, fmt.Errorf("unsupported audio file type: %q", ext)
+	}
+}
+
+func decodeWav(f *os.File) ([]int16, int, int, error) {
+	decoder := wav.NewDecoder(f)
+	if !decoder.IsValidFile() {
+		return nil, 0, 0, fmt.Errorf("invalid WAV file: %s", f.Name())
+	}
+	buf, err := decoder.FullPCMBuffer()
+	if err != nil {
+		return nil, 0, 0, fmt.Errorf("failed to decode %s: %w", f.Name(), err)
+	}
+	if decoder.WavAudioFormat != 1 {
+		return nil, 0, 0, fmt.Errorf("unsupported WAV format %d, only PCM is supported", decoder.WavAudioFormat)
+	}
+
+	pcm := make([]int16, len(buf.Data))
+	for i, sample := range buf.Data {
+		pcm[i] = scaleToInt16(sample, int(decoder.BitDepth))
+	}
+	return pcm, int(decoder.SampleRate), int(decoder.NumChans), nil
+}
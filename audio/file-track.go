@@ -0,0 +1,25 @@
+//go:build cgo && !nolibopus
+
+package audio
+
+import (
+	"github.com/pion/mediadevices"
+	"github.com/pion/mediadevices/pkg/codec/opus"
+)
+
+// getFileTrack returns a mediadevices audio track playing the file at path,
+// encoded as 20ms Opus frames.
+func getFileTrack(path string, opts FileSourceOptions) (mediadevices.Track, error) {
+	src, err := NewFileSource(path, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	opusParams := opus.Params{
+		Latency: opus.Latency20ms,
+	}
+	codecSelector := mediadevices.NewCodecSelector(
+		mediadevices.WithAudioEncoders(&opusParams),
+	)
+	return mediadevices.NewAudioTrack(src, codecSelector), nil
+}
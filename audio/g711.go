@@ -0,0 +1,77 @@
+package audio
+
+// G.711 is the 8kHz telephony codec, one byte per sample: μ-law in North
+// America and Japan (RTP payload type 0, PCMU), A-law elsewhere (8, PCMA).
+
+const (
+	ulawBias = 0x84
+	ulawClip = 32635
+)
+
+// ULawEncode encodes a sample to μ-law.
+func ULawEncode(sample int16) byte {
+	s := int(sample)
+	sign := 0
+	if s < 0 {
+		s, sign = -s, 0x80
+	}
+	s = min(s, ulawClip) + ulawBias
+	exponent := 7
+	for mask := 0x4000; s&mask == 0 && exponent > 0; mask >>= 1 {
+		exponent--
+	}
+	mantissa := (s >> (exponent + 3)) & 0x0f
+	return ^byte(sign | exponent<<4 | mantissa)
+}
+
+// ULawDecode decodes a μ-law byte.
+func ULawDecode(b byte) int16 {
+	b = ^b
+	exponent := int(b>>4) & 0x07
+	mantissa := int(b) & 0x0f
+	s := ((mantissa << 3) + ulawBias) << exponent
+	s -= ulawBias
+	if b&0x80 != 0 {
+		return int16(-s)
+	}
+	return int16(s)
+}
+
+// ALawEncode encodes a sample to A-law.
+func ALawEncode(sample int16) byte {
+	s := int(sample)
+	sign := 0x80
+	if s < 0 {
+		s, sign = -s-1, 0
+	}
+	s = min(s, 0x7fff) >> 3
+	var b int
+	if s < 32 {
+		b = s >> 1
+	} else {
+		exponent := 1
+		for s >= 64 {
+			s >>= 1
+			exponent++
+		}
+		b = exponent<<4 | (s>>1)&0x0f
+	}
+	return byte(sign|b) ^ 0x55
+}
+
+// ALawDecode decodes an A-law byte.
+func ALawDecode(b byte) int16 {
+	b ^= 0x55
+	exponent := int(b>>4) & 0x07
+	mantissa := int(b) & 0x0f
+	var s int
+	if exponent == 0 {
+		s = mantissa<<4 + 8
+	} else {
+		s = (mantissa<<4 + 0x108) << (exponent - 1)
+	}
+	if b&0x80 == 0 {
+		return int16(-s)
+	}
+	return int16(s)
+}
@@ -0,0 +1,61 @@
+package audio
+
+import (
+	"math"
+	"testing"
+)
+
+func TestG711(t *testing.T) {
+	tests := []struct {
+		name   string
+		encode func(int16) byte
+		decode func(byte) int16
+		// samples and their codes, as in the G.711 tables
+		samples []int16
+		codes   []byte
+		decoded []int16
+	}{
+		{
+			name:   "μ-law",
+			encode: ULawEncode, decode: ULawDecode,
+			samples: []int16{0, 1000, -1000, math.MaxInt16, math.MinInt16},
+			codes:   []byte{0xff, 0xce, 0x4e, 0x80, 0x00},
+			decoded: []int16{0, 988, -988, 32124, -32124},
+		},
+		{
+			name:   "A-law",
+			encode: ALawEncode, decode: ALawDecode,
+			samples: []int16{0, 1000, -1000, math.MaxInt16, math.MinInt16},
+			codes:   []byte{0xd5, 0xfa, 0x7a, 0xaa, 0x2a},
+			decoded: []int16{8, 1008, -1008, 32256, -32256},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, sample := range tt.samples {
+				code := tt.encode(sample)
+				if code != tt.codes[i] {
+					t.Errorf("encode(%d) = %#x, want %#x", sample, code, tt.codes[i])
+				}
+				if got := tt.decode(code); got != tt.decoded[i] {
+					t.Errorf("decode(%#x) = %d, want %d", code, got, tt.decoded[i])
+				}
+			}
+			// Every code decodes to a value that encodes back to it, but
+			// for the two zeros of μ-law.
+			for b := range 256 {
+				s := tt.decode(byte(b))
+				if got := tt.decode(tt.encode(s)); got != s {
+					t.Errorf("code %#x: %d reencodes to %d", b, s, got)
+				}
+			}
+			// The quantization error stays below 1/16 of the sample.
+			for s := math.MinInt16 + 8; s <= math.MaxInt16-8; s += 7 {
+				got := int(tt.decode(tt.encode(int16(s))))
+				if diff := abs(got - s); diff > max(abs(s)/16, 16) {
+					t.Fatalf("%d decodes to %d", s, got)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package audio
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// oggPacketReader returns the packets of the first logical stream of an Ogg
+// file. Unlike pion's oggreader, which returns whole pages, it splits pages
+// into packets using the segment table, so it works with pages holding more
+// than one Opus frame.
+type oggPacketReader struct {
+	r       *bufio.Reader
+	serial  uint32
+	started bool
+	// packets that were completed on the current page, and the part of a
+	// packet continued on the next page
+	pending [][]byte
+	partial []byte
+}
+
+func newOggPacketReader(r io.Reader) *oggPacketReader {
+	return &oggPacketReader{r: bufio.NewReader(r)}
+}
+
+func (o *oggPacketReader) readPacket() ([]byte, error) {
+	for len(o.pending) == 0 {
+		if err := o.readPage(); err != nil {
+			return nil, err
+		}
+	}
+	p := o.pending[0]
+	o.pending = o.pending[1:]
+	return p, nil
+}
+
+func (o *oggPacketReader) readPage() error {
+	var header [27]byte
+	if _, err := io.ReadFull(o.r, header[:]); err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return fmt.Errorf("truncated ogg page header")
+		}
+		return err
+	}
+	if !bytes.Equal(header[:4], []byte("OggS")) {
+		return fmt.Errorf("invalid ogg page signature")
+	}
+
+	serial := binary.LittleEndian.Uint32(header[14:18])
+	segments := make([]byte, header[26])
+	if _, err := io.ReadFull(o.r, segments); err != nil {
+		return fmt.Errorf("truncated ogg segment table: %w", err)
+	}
+
+	var bodyLen int
+	for _, s := range segments {
+		bodyLen += int(s)
+	}
+	body := make([]byte, bodyLen)
+	if _, err := io.ReadFull(o.r, body); err != nil {
+		return fmt.Errorf("truncated ogg page: %w", err)
+	}
+
+	if !o.started {
+		o.started = true
+		o.serial = serial
+	}
+	if serial != o.serial {
+		// multiplexed streams, only the first one is used
+		return nil
+	}
+
+	// A packet ends with the first segment shorter than 255 bytes
+	for _, s := range segments {
+		o.partial = append(o.partial, body[:s]...)
+		body = body[s:]
+		if s < 255 {
+			o.pending = append(o.pending, o.partial)
+			o.partial = nil
+		}
+	}
+	return nil
+}
+
+// decodeOggOpus decodes an Ogg Opus stream to interleaved 16-bit PCM at
+// 48kHz, the rate Opus is always decoded at. It returns the PCM and the
+// channel count.
+func decodeOggOpus(r io.Reader) ([]int16, int, error) {
+	packets := newOggPacketReader(r)
+
+	// Identification header, see RFC 7845 section 5.1
+	head, err := packets.readPacket()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read OpusHead: %w", err)
+	}
+	if len(head) < 19 || !bytes.Equal(head[:8], []byte("OpusHead")) {
+		return nil, 0, fmt.Errorf("not an Ogg Opus stream")
+	}
+	channels := int(head[9])
+	preSkip := int(binary.LittleEndian.Uint16(head[10:12]))
+	if channels != 1 && channels != 2 {
+		return nil, 0, fmt.Errorf("unsupported Ogg Opus channel count: %d", channels)
+	}
+
+	// Comment header
+	if _, err := packets.readPacket(); err != nil {
+		return nil, 0, fmt.Errorf("failed to read OpusTags: %w", err)
+	}
+
+	decoder, err := newOpusDecoder(48_000, channels)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var pcm []int16
+	frame := make([]int16, 5760*channels) // 120ms, the longest Opus packet
+	for {
+		packet, err := packets.readPacket()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		n, err := decoder.Decode(packet, frame)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to decode opus packet: %w", err)
+		}
+		pcm = append(pcm, frame[:n*channels]...)
+	}
+
+	if skip := preSkip * channels; skip < len(pcm) {
+		pcm = pcm[skip:]
+	} else {
+		pcm = nil
+	}
+	return pcm, channels, nil
+}
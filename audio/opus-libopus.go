@@ -0,0 +1,44 @@
+//go:build cgo && !nolibopus
+
+package audio
+
+import (
+	"fmt"
+
+	opusv2 "github.com/hraban/opus"
+)
+
+// newOpusEncoder creates a libopus encoder configured with opts.
+func newOpusEncoder(sampleRate, channels int, opts OpusEncoderOptions) (opusEncoder, error) {
+	encoder, err := opusv2.NewEncoder(sampleRate, channels, opusv2.AppVoIP)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create opus encoder: %w", err)
+	}
+	if opts.Bitrate != 0 {
+		if err := encoder.SetBitrate(opts.Bitrate); err != nil {
+			return nil, fmt.Errorf("failed to set opus bitrate: %w", err)
+		}
+	}
+	if err := encoder.SetComplexity(opts.Complexity); err != nil {
+		return nil, fmt.Errorf("failed to set opus complexity: %w", err)
+	}
+	if err := encoder.SetDTX(opts.DTX); err != nil {
+		return nil, fmt.Errorf("failed to set opus dtx: %w", err)
+	}
+	if err := encoder.SetInBandFEC(opts.InBandFEC); err != nil {
+		return nil, fmt.Errorf("failed to set opus fec: %w", err)
+	}
+	if err := encoder.SetPacketLossPerc(opts.PacketLossPercent); err != nil {
+		return nil, fmt.Errorf("failed to set opus packet loss: %w", err)
+	}
+	return encoder, nil
+}
+
+// newOpusDecoder creates a libopus decoder, which decodes every Opus mode.
+func newOpusDecoder(sampleRate, channels int) (opusDecoder, error) {
+	decoder, err := opusv2.NewDecoder(sampleRate, channels)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create opus decoder: %w", err)
+	}
+	return decoder, nil
+}
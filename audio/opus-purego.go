@@ -0,0 +1,62 @@
+//go:build !cgo || nolibopus
+
+package audio
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/pion/opus"
+)
+
+// errNoOpusEncoder is returned when encoding in a build without libopus.
+var errNoOpusEncoder = errors.New("opus encoding needs libopus, build with cgo and without the nolibopus tag")
+
+func newOpusEncoder(int, int, OpusEncoderOptions) (opusEncoder, error) {
+	return nil, errNoOpusEncoder
+}
+
+// newOpusDecoder creates a pion/opus decoder. It only decodes SILK, the
+// speech mode, and fails on CELT and hybrid packets.
+func newOpusDecoder(sampleRate, channels int) (opusDecoder, error) {
+	return &pionOpusDecoder{
+		decoder:    opus.NewDecoder(),
+		sampleRate: sampleRate,
+		channels:   channels,
+		buf:        make([]byte, 1920), // 20ms of SILK upsampled to 48kHz
+	}, nil
+}
+
+type pionOpusDecoder struct {
+	decoder    opus.Decoder
+	sampleRate int
+	channels   int
+	buf        []byte
+	pcm        []int16
+}
+
+// Decode converts the pion/opus output, mono S16LE upsampled 3 times from
+// the rate of the bandwidth, to the rate and channels of the decoder.
+func (d *pionOpusDecoder) Decode(data []byte, pcm []int16) (int, error) {
+	bandwidth, _, err := d.decoder.Decode(data, d.buf)
+	if err != nil {
+		return 0, err
+	}
+
+	rate := bandwidth.SampleRate() * 3
+	n := min(int(int64(rate)*int64(OpusPacketDuration(data))/int64(time.Second)), len(d.buf)/2)
+	if cap(d.pcm) < n {
+		d.pcm = make([]int16, n)
+	}
+	mono := d.pcm[:n]
+	for i := range mono {
+		mono[i] = int16(binary.LittleEndian.Uint16(d.buf[i*2:]))
+	}
+
+	out := ConvertPCM(mono, rate, 1, d.sampleRate, d.channels)
+	if len(out) > len(pcm) {
+		return 0, errors.New("opus decode buffer too small")
+	}
+	return copy(pcm, out) / d.channels, nil
+}
@@ -0,0 +1,136 @@
+package audio
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OpusEncoderOptions configures the Opus encoding of the user audio. They are
+// also advertised in the SDP fmtp of the audio codec.
+type OpusEncoderOptions struct {
+	// Bitrate is the target bitrate in bits per second, zero lets the
+	// encoder pick one for the sample rate and channels.
+	Bitrate int `yaml:"bitrate"`
+	// Complexity trades CPU for quality, from 0 to 10.
+	Complexity int `yaml:"complexity"`
+	// DTX stops sending full packets during silence.
+	DTX bool `yaml:"dtx"`
+	// InBandFEC adds redundancy to recover from single packet losses. It is
+	// only effective with a PacketLossPercent above zero.
+	InBandFEC bool `yaml:"fec"`
+	// PacketLossPercent is the expected packet loss, from 0 to 100. Higher
+	// values make the encoder spend more of the bitrate on FEC.
+	PacketLossPercent int `yaml:"packet_loss"`
+	// FrameDuration is the duration of each packet: 10, 20, 40 or 60ms.
+	// Longer frames have less overhead but more latency. Defaults to 20ms.
+	FrameDuration time.Duration `yaml:"frame_duration"`
+}
+
+// DefaultOpusEncoderOptions returns the options used by realtime.NewClient,
+// which match what was negotiated before they were configurable.
+func DefaultOpusEncoderOptions() OpusEncoderOptions {
+	return OpusEncoderOptions{
+		Complexity:    10,
+		InBandFEC:     true,
+		FrameDuration: 20 * time.Millisecond,
+	}
+}
+
+// Validate checks the options are in the ranges libopus accepts. The errors
+// name the fields as in the config file.
+func (o OpusEncoderOptions) Validate() error {
+	if o.Bitrate != 0 && (o.Bitrate < 6_000 || o.Bitrate > 510_000) {
+		return fmt.Errorf("bitrate: %d out of range 6000-510000", o.Bitrate)
+	}
+	if o.Complexity < 0 || o.Complexity > 10 {
+		return fmt.Errorf("complexity: %d out of range 0-10", o.Complexity)
+	}
+	if o.PacketLossPercent < 0 || o.PacketLossPercent > 100 {
+		return fmt.Errorf("packet_loss: %d%% out of range 0-100", o.PacketLossPercent)
+	}
+	switch o.frameDuration() {
+	case 10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 60 * time.Millisecond:
+	default:
+		return fmt.Errorf("frame_duration: %v is not 10, 20, 40 or 60ms", o.FrameDuration)
+	}
+	return nil
+}
+
+func (o OpusEncoderOptions) frameDuration() time.Duration {
+	if o.FrameDuration == 0 {
+		return 20 * time.Millisecond
+	}
+	return o.FrameDuration
+}
+
+// Fmtp returns the SDP fmtp line of the Opus codec. The parameters describe
+// what this end sends, and that it can receive the same.
+func (o OpusEncoderOptions) Fmtp() string {
+	params := []string{"minptime=10"}
+	if ptime := o.frameDuration(); ptime > 20*time.Millisecond {
+		params = append(params, "maxptime="+strconv.Itoa(int(ptime/time.Millisecond)))
+	}
+	if o.InBandFEC {
+		params = append(params, "useinbandfec=1")
+	}
+	if o.DTX {
+		params = append(params, "usedtx=1")
+	}
+	if o.Bitrate != 0 {
+		params = append(params, "maxaveragebitrate="+strconv.Itoa(o.Bitrate))
+	}
+	return strings.Join(params, ";")
+}
+
+// MediaDevicesSupported reports whether the mediadevices encoder can apply
+// the options. Otherwise the audio must be captured as PCM and encoded by
+// the Sender.
+func (o OpusEncoderOptions) MediaDevicesSupported() bool {
+	// The mediadevices encoder keeps the libopus defaults for the rest,
+	// which FEC does not change without packet loss.
+	d := DefaultOpusEncoderOptions()
+	return o.Complexity == d.Complexity && !o.DTX && o.PacketLossPercent == 0
+}
+
+// opusEncoder encodes interleaved PCM frames, implemented with libopus in
+// cgo builds, see newOpusEncoder.
+type opusEncoder interface {
+	Encode(pcm []int16, data []byte) (int, error)
+}
+
+// opusDecoder decodes a packet to interleaved PCM and returns the samples
+// per channel. Without libopus it is pion/opus, which only decodes SILK.
+type opusDecoder interface {
+	Decode(data []byte, pcm []int16) (int, error)
+}
+
+// OpusPacketDuration returns the duration of an Opus packet from its TOC
+// byte and frame count, see RFC 6716 section 3.1, or zero if the packet is
+// malformed.
+func OpusPacketDuration(packet []byte) time.Duration {
+	if len(packet) == 0 {
+		return 0
+	}
+	var frame time.Duration
+	switch config := packet[0] >> 3; {
+	case config < 12: // SILK
+		frame = [...]time.Duration{10, 20, 40, 60}[config%4] * time.Millisecond
+	case config < 16: // hybrid
+		frame = [...]time.Duration{10, 20}[config%2] * time.Millisecond
+	default: // CELT
+		frame = [...]time.Duration{2500, 5000, 10_000, 20_000}[config%4] * time.Microsecond
+	}
+	switch packet[0] & 3 {
+	case 0:
+		return frame
+	case 1, 2:
+		return 2 * frame
+	default:
+		if len(packet) < 2 {
+			return 0
+		}
+		return time.Duration(packet[1]&0x3f) * frame
+	}
+}
@@ -0,0 +1,85 @@
+package audio
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOpusFmtp(t *testing.T) {
+	tests := []struct {
+		name string
+		opts OpusEncoderOptions
+		want string
+	}{
+		{"zero", OpusEncoderOptions{}, "minptime=10"},
+		{"default", DefaultOpusEncoderOptions(), "minptime=10;useinbandfec=1"},
+		{"20ms", OpusEncoderOptions{FrameDuration: 20 * time.Millisecond}, "minptime=10"},
+		{"60ms", OpusEncoderOptions{FrameDuration: 60 * time.Millisecond}, "minptime=10;maxptime=60"},
+		{"dtx", OpusEncoderOptions{DTX: true}, "minptime=10;usedtx=1"},
+		{"bitrate", OpusEncoderOptions{Bitrate: 32_000}, "minptime=10;maxaveragebitrate=32000"},
+		{
+			"all",
+			OpusEncoderOptions{Bitrate: 24_000, DTX: true, InBandFEC: true, FrameDuration: 40 * time.Millisecond},
+			"minptime=10;maxptime=40;useinbandfec=1;usedtx=1;maxaveragebitrate=24000",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.opts.Fmtp(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOpusEncoderOptionsValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    OpusEncoderOptions
+		wantErr string
+	}{
+		{"zero", OpusEncoderOptions{}, ""},
+		{"default", DefaultOpusEncoderOptions(), ""},
+		{"low bitrate", OpusEncoderOptions{Bitrate: 5_999}, "bitrate: 5999 out of range 6000-510000"},
+		{"high bitrate", OpusEncoderOptions{Bitrate: 510_001}, "bitrate: 510001 out of range 6000-510000"},
+		{"complexity", OpusEncoderOptions{Complexity: 11}, "complexity: 11 out of range 0-10"},
+		{"packet loss", OpusEncoderOptions{PacketLossPercent: -1}, "packet_loss: -1% out of range 0-100"},
+		{"frame duration", OpusEncoderOptions{FrameDuration: 30 * time.Millisecond}, "frame_duration: 30ms is not 10, 20, 40 or 60ms"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.opts.Validate()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("unexpected error %v", err)
+			case tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr):
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOpusPacketDuration(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet []byte
+		want   time.Duration
+	}{
+		{"empty", nil, 0},
+		{"SILK 10ms", []byte{0 << 3}, 10 * time.Millisecond},
+		{"SILK 60ms", []byte{3 << 3}, 60 * time.Millisecond},
+		{"hybrid 20ms", []byte{13 << 3}, 20 * time.Millisecond},
+		{"CELT 2.5ms", []byte{16 << 3}, 2500 * time.Microsecond},
+		{"CELT 20ms", []byte{31 << 3}, 20 * time.Millisecond},
+		{"two frames", []byte{31<<3 | 1}, 40 * time.Millisecond},
+		{"arbitrary frames", []byte{31<<3 | 3, 3}, 60 * time.Millisecond},
+		{"arbitrary without count", []byte{31<<3 | 3}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := OpusPacketDuration(tt.packet); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
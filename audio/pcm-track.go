@@ -0,0 +1,279 @@
+package audio
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+
+	"exp-openai-webrtc-streaming/internal/playback"
+)
+
+// PCMTrack is a RemoteTrack of the Opus packets encoded from the PCM written
+// to it, e.g. the model audio received over a WebSocket, so that it can be
+// played and recorded like a WebRTC track. The PCM may be written faster than
+// real time: the packets are released in real time, as they would arrive
+// over RTP. Encoding needs libopus.
+type PCMTrack struct {
+	queue      *queueTrack
+	sampleRate int
+	channels   int
+	duration   time.Duration // of a packet
+	frameLen   int           // samples of a packet, all channels
+	encoder    opusEncoder
+	opusBuf    []byte
+
+	mutex     sync.Mutex
+	pending   []int16 // PCM not yet encoded, less than a packet
+	packets   []*rtp.Packet
+	sequence  uint16
+	timestamp uint32
+	written   time.Duration
+	released  time.Duration
+	closed    bool
+	// wake is signaled when packets are queued
+	wake chan struct{}
+	done chan struct{}
+}
+
+// NewPCMTrack creates a track of the PCM in the format, encoded with opts.
+// The codec is the Opus codec negotiated over WebRTC, 48kHz stereo.
+func NewPCMTrack(sampleRate, channels int, opts OpusEncoderOptions) (*PCMTrack, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid opus options: %w", err)
+	}
+	encoder, err := newOpusEncoder(sampleRate, channels, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	duration := opts.frameDuration()
+	t := &PCMTrack{
+		queue: newQueueTrack(webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:    webrtc.MimeTypeOpus,
+				ClockRate:   48_000,
+				Channels:    2,
+				SDPFmtpLine: opts.Fmtp(),
+			},
+			PayloadType: 111,
+		}),
+		sampleRate: sampleRate,
+		channels:   channels,
+		duration:   duration,
+		frameLen:   int(int64(sampleRate)*int64(duration)/int64(time.Second)) * channels,
+		encoder:    encoder,
+		opusBuf:    make([]byte, 4000), // recommended max packet size
+		wake:       make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	go t.pace()
+	return t, nil
+}
+
+func (t *PCMTrack) Codec() webrtc.RTPCodecParameters {
+	return t.queue.Codec()
+}
+
+// ReadRTP returns the next packet once it is due, io.EOF once the track is
+// closed.
+func (t *PCMTrack) ReadRTP() (*rtp.Packet, interceptor.Attributes, error) {
+	return t.queue.ReadRTP()
+}
+
+func (t *PCMTrack) SetReadDeadline(deadline time.Time) error {
+	return t.queue.SetReadDeadline(deadline)
+}
+
+// Write encodes interleaved PCM, keeping the samples short of a packet for
+// the next call.
+func (t *PCMTrack) Write(pcm []int16) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closed {
+		return io.ErrClosedPipe
+	}
+
+	t.pending = append(t.pending, pcm...)
+	var encoded int
+	for len(t.pending)-encoded >= t.frameLen {
+		n, err := t.encoder.Encode(t.pending[encoded:encoded+t.frameLen], t.opusBuf)
+		if err != nil {
+			t.pending = t.pending[:0]
+			return fmt.Errorf("failed to encode opus: %w", err)
+		}
+		encoded += t.frameLen
+		t.packets = append(t.packets, &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				PayloadType:    111,
+				SequenceNumber: t.sequence,
+				Timestamp:      t.timestamp,
+			},
+			Payload: append([]byte(nil), t.opusBuf[:n]...),
+		})
+		t.sequence++
+		t.timestamp += uint32(48_000 * t.duration / time.Second)
+		t.written += t.duration
+	}
+	t.pending = t.pending[:copy(t.pending, t.pending[encoded:])]
+
+	select {
+	case t.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// pace releases the packets in real time, until the track is closed.
+func (t *PCMTrack) pace() {
+	defer t.queue.close()
+	var next time.Time
+	for {
+		t.mutex.Lock()
+		if len(t.packets) == 0 {
+			t.mutex.Unlock()
+			select {
+			case <-t.wake:
+				continue
+			case <-t.done:
+				return
+			}
+		}
+		p := t.packets[0]
+		t.packets = t.packets[1:]
+		t.mutex.Unlock()
+
+		// Restart the clock when the packets come late, e.g. between
+		// responses, rather than catching up with a burst.
+		if now := time.Now(); now.Sub(next) > t.duration {
+			next = now
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-t.done:
+			timer.Stop()
+			return
+		}
+		t.queue.push(p)
+		next = next.Add(t.duration)
+
+		t.mutex.Lock()
+		t.released += t.duration
+		t.mutex.Unlock()
+	}
+}
+
+// Written returns the duration of the audio encoded since the track was
+// created.
+func (t *PCMTrack) Written() time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.written
+}
+
+// Released returns the duration of the audio released to the reader since
+// the track was created.
+func (t *PCMTrack) Released() time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.released
+}
+
+// Clear drops the audio not released yet, e.g. when the user interrupts the
+// model, and returns its duration.
+func (t *PCMTrack) Clear() time.Duration {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	dropped := time.Duration(len(t.packets)) * t.duration
+	t.packets = nil
+	t.pending = t.pending[:0]
+	t.written -= dropped
+	return dropped
+}
+
+// Drain waits until the audio written so far has been released, or ctx is
+// done.
+func (t *PCMTrack) Drain(ctx context.Context) error {
+	return playback.WaitEmpty(ctx, func() int {
+		t.mutex.Lock()
+		defer t.mutex.Unlock()
+		if t.closed {
+			return 0
+		}
+		return len(t.packets)
+	})
+}
+
+// Close drops the audio not released yet and ends the track.
+func (t *PCMTrack) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.closed {
+		return nil
+	}
+	t.closed = true
+	t.packets = nil
+	close(t.done)
+	return nil
+}
+
+// DecodeTimer is implemented by the tracks whose decoding is timed, e.g. to
+// budget the CPU of the sessions of a gateway. The FrameDecoders of
+// NewTrackDecoder report how long each Decode took.
+type DecodeTimer interface {
+	DecodeTime(d time.Duration)
+}
+
+// FrameDecoder converts the frames of a Source to PCM in one format,
+// decoding the Opus frames, e.g. to send them as PCM over a WebSocket.
+type FrameDecoder struct {
+	sampleRate int
+	channels   int
+	decoder    opusDecoder
+	pcm        []int16
+	timer      DecodeTimer
+}
+
+// NewFrameDecoder returns a FrameDecoder to sampleRate and channels.
+func NewFrameDecoder(sampleRate, channels int) *FrameDecoder {
+	return &FrameDecoder{sampleRate: sampleRate, channels: channels}
+}
+
+// NewTrackDecoder returns a FrameDecoder of the packets of track, which
+// reports its decode time to track if it is a DecodeTimer.
+func NewTrackDecoder(track RemoteTrack, sampleRate, channels int) *FrameDecoder {
+	d := NewFrameDecoder(sampleRate, channels)
+	d.timer, _ = track.(DecodeTimer)
+	return d
+}
+
+// Decode returns the PCM of frame, valid until the next call.
+func (d *FrameDecoder) Decode(frame Frame) ([]int16, error) {
+	if d.timer != nil {
+		defer func(start time.Time) { d.timer.DecodeTime(time.Since(start)) }(time.Now())
+	}
+	if len(frame.PCM) > 0 {
+		return ConvertPCM(frame.PCM, frame.SampleRate, frame.Channels, d.sampleRate, d.channels), nil
+	}
+
+	if d.decoder == nil {
+		decoder, err := newOpusDecoder(d.sampleRate, d.channels)
+		if err != nil {
+			return nil, err
+		}
+		d.decoder = decoder
+		d.pcm = make([]int16, 5760*d.channels) // 120ms at 48kHz, the longest Opus packet
+	}
+	n, err := d.decoder.Decode(frame.Opus, d.pcm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode opus: %w", err)
+	}
+	return d.pcm[:n*d.channels], nil
+}
@@ -0,0 +1,104 @@
+package audio
+
+import "math"
+
+// ConvertPCM converts interleaved 16-bit PCM from inRate/inChannels to
+// outRate/outChannels. Channels are mixed down by averaging and up by
+// copying, the rate is converted with linear interpolation. Downsampling
+// first low-passes the input below the new Nyquist frequency, so that the
+// frequencies above it do not alias, e.g. from 48kHz to 8kHz for G.711. The
+// filter keeps no state between calls: each chunk is extended with its first
+// and last samples.
+func ConvertPCM(in []int16, inRate, inChannels, outRate, outChannels int) []int16 {
+	if inRate == outRate && inChannels == outChannels {
+		return in
+	}
+
+	inFrames := len(in) / inChannels
+	outFrames := int(int64(inFrames) * int64(outRate) / int64(inRate))
+	out := make([]int16, outFrames*outChannels)
+
+	frame := func(i, ch int) int32 {
+		if i >= inFrames {
+			i = inFrames - 1
+		}
+		if outChannels == 1 && inChannels > 1 {
+			var sum int32
+			for c := 0; c < inChannels; c++ {
+				sum += int32(in[i*inChannels+c])
+			}
+			return sum / int32(inChannels)
+		}
+		if ch >= inChannels {
+			ch = inChannels - 1
+		}
+		return int32(in[i*inChannels+ch])
+	}
+	if outRate < inRate {
+		kernel := lowPassKernel(inRate, outRate)
+		half := len(kernel) / 2
+		unfiltered := frame
+		frame = func(i, ch int) int32 {
+			var sum float64
+			for k, h := range kernel {
+				j := min(max(i+k-half, 0), inFrames-1)
+				sum += h * float64(unfiltered(j, ch))
+			}
+			return int32(math.Round(min(max(sum, math.MinInt16), math.MaxInt16)))
+		}
+	}
+
+	for o := 0; o < outFrames; o++ {
+		// Position of the output frame in the input, in 1/outRate units
+		pos := int64(o) * int64(inRate)
+		i := int(pos / int64(outRate))
+		frac := int32(pos % int64(outRate) * 1024 / int64(outRate))
+		for ch := 0; ch < outChannels; ch++ {
+			a, b := frame(i, ch), frame(i+1, ch)
+			out[o*outChannels+ch] = int16(a + (b-a)*frac/1024)
+		}
+	}
+	return out
+}
+
+// lowPassKernel returns a windowed-sinc FIR low-pass at the Nyquist frequency
+// of outRate, for input at inRate, with 8 zero crossings each side and a
+// Blackman window. It passes up to about 0.42·outRate within 1dB, e.g.
+// 3.4kHz for 8kHz, and attenuates by over 50dB from about 0.62·outRate. The
+// gain is 1 at 0Hz.
+func lowPassKernel(inRate, outRate int) []float64 {
+	cutoff := float64(outRate) / 2 / float64(inRate) // in cycles per sample
+	half := 8 * (inRate + outRate - 1) / outRate
+	kernel := make([]float64, 2*half+1)
+	var sum float64
+	for k := range kernel {
+		x := float64(k - half)
+		h := 2 * cutoff
+		if x != 0 {
+			h = math.Sin(2*math.Pi*cutoff*x) / (math.Pi * x)
+		}
+		window := 0.42 + 0.5*math.Cos(math.Pi*x/float64(half)) + 0.08*math.Cos(2*math.Pi*x/float64(half))
+		kernel[k] = h * window
+		sum += kernel[k]
+	}
+	for k := range kernel {
+		kernel[k] /= sum
+	}
+	return kernel
+}
+
+// scaleToInt16 converts a sample of the given bit depth to 16 bits.
+func scaleToInt16(sample, bitDepth int) int16 {
+	switch {
+	case bitDepth > 16:
+		return int16(sample >> (bitDepth - 16))
+	case bitDepth < 16:
+		if bitDepth == 8 {
+			// 8-bit WAV samples are unsigned
+			sample -= 128
+		}
+		return int16(sample << (16 - bitDepth))
+	default:
+		return int16(sample)
+	}
+}
@@ -0,0 +1,102 @@
+package audio
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestConvertPCM(t *testing.T) {
+	tests := []struct {
+		name                 string
+		in                   []int16
+		inRate, inChannels   int
+		outRate, outChannels int
+		want                 []int16
+	}{
+		{"same format", []int16{1, 2, 3}, 48_000, 1, 48_000, 1, []int16{1, 2, 3}},
+		{"stereo to mono", []int16{100, 300, -100, -300}, 48_000, 2, 48_000, 1, []int16{200, -200}},
+		{"mono to stereo", []int16{100, -100}, 48_000, 1, 48_000, 2, []int16{100, 100, -100, -100}},
+		{"upsample", []int16{0, 600, 1200}, 8_000, 1, 16_000, 1, []int16{0, 300, 600, 900, 1200, 1200}},
+		{"empty", nil, 8_000, 1, 48_000, 1, []int16{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ConvertPCM(tt.in, tt.inRate, tt.inChannels, tt.outRate, tt.outChannels)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertPCMRates(t *testing.T) {
+	tests := []struct {
+		inRate, outRate int
+	}{
+		{48_000, 8_000},
+		{8_000, 48_000},
+		{48_000, 24_000},
+		{24_000, 48_000},
+		{44_100, 48_000},
+		{48_000, 16_000},
+	}
+	for _, tt := range tests {
+		// A second of a 440Hz tone keeps its length and level.
+		in := sine(440, 10_000, tt.inRate, tt.inRate)
+		out := ConvertPCM(in, tt.inRate, 1, tt.outRate, 1)
+		if len(out) != tt.outRate {
+			t.Errorf("%d to %d: %d samples, want %d", tt.inRate, tt.outRate, len(out), tt.outRate)
+			continue
+		}
+		// the start and end are skipped, for the edges of the filters
+		if level := rms(out[tt.outRate/10 : tt.outRate*9/10]); math.Abs(level-rms(in)) > 0.05*rms(in) {
+			t.Errorf("%d to %d: level %.0f, want %.0f", tt.inRate, tt.outRate, level, rms(in))
+		}
+	}
+}
+
+func TestConvertPCMAliasing(t *testing.T) {
+	tests := []struct {
+		inRate, outRate int
+		freq            float64
+		// the level of the output relative to the input
+		minDB, maxDB float64
+	}{
+		{48_000, 8_000, 1_000, -0.5, 0.5},
+		{48_000, 8_000, 3_400, -1, 0.5},
+		{48_000, 8_000, 5_500, -200, -50},
+		{48_000, 8_000, 7_300, -200, -50},
+		{48_000, 8_000, 15_100, -200, -50},
+		{48_000, 16_000, 10_300, -200, -50},
+		{44_100, 16_000, 12_100, -200, -50},
+		{48_000, 24_000, 15_100, -200, -50},
+	}
+	for _, tt := range tests {
+		// Above the new Nyquist frequency, the tone would fold back into the
+		// band as another one.
+		in := sine(tt.freq, 10_000, tt.inRate, tt.inRate)
+		out := ConvertPCM(in, tt.inRate, 1, tt.outRate, 1)
+		db := 20 * math.Log10(max(rms(out[tt.outRate/10:tt.outRate*9/10]), 1e-3)/rms(in))
+		if db < tt.minDB || db > tt.maxDB {
+			t.Errorf("%d to %d, %.0fHz: %.1fdB, want %.0f to %.0fdB", tt.inRate, tt.outRate, tt.freq, db, tt.minDB, tt.maxDB)
+		}
+	}
+}
+
+// sine returns n samples of a tone of freq Hz and amplitude at rate.
+func sine(freq, amplitude float64, rate, n int) []int16 {
+	pcm := make([]int16, n)
+	for i := range pcm {
+		pcm[i] = int16(amplitude * math.Sin(2*math.Pi*freq*float64(i)/float64(rate)))
+	}
+	return pcm
+}
+
+func rms(pcm []int16) float64 {
+	var sum float64
+	for _, s := range pcm {
+		sum += float64(s) * float64(s)
+	}
+	return math.Sqrt(sum / float64(len(pcm)))
+}
@@ -0,0 +1,395 @@
+package audio
+
+import (
+	"log/slog"
+	"math"
+	"sync"
+
+	"exp-openai-webrtc-streaming/internal/logging"
+	"exp-openai-webrtc-streaming/metrics"
+)
+
+// CaptureProcessingOptions selects and configures the stages applied to the
+// captured audio, in this order: high-pass filter, noise suppression and
+// automatic gain control. Zero values select the defaults.
+type CaptureProcessingOptions struct {
+	HighPass bool
+	// HighPassCutoff is the cutoff of the high-pass filter in Hz. Defaults
+	// to 80Hz, below the voice and above most hum and rumble.
+	HighPassCutoff float64
+
+	NoiseSuppression bool
+	// NoiseReductionDB is how much the noise is attenuated at most. Defaults
+	// to 15dB; more makes the remaining noise sound watery.
+	NoiseReductionDB float64
+
+	AGC bool
+	// AGCTargetDB is the level the speech is brought to, in dBFS. Defaults
+	// to -20dBFS.
+	AGCTargetDB float64
+	// AGCMaxGainDB caps the gain. Defaults to 20dB.
+	AGCMaxGainDB float64
+
+	Logger *slog.Logger
+}
+
+// CaptureLevels are the RMS levels of the last frame after each stage, in
+// dBFS. The levels of disabled stages are the same as the previous stage.
+type CaptureLevels struct {
+	Input            float64
+	HighPass         float64
+	NoiseSuppression float64
+	Output           float64
+	// AGCGain is the current gain of the AGC in dB.
+	AGCGain float64
+}
+
+// CaptureProcessor cleans up the captured audio before it is encoded.
+type CaptureProcessor struct {
+	opts CaptureProcessingOptions
+	log  *slog.Logger
+
+	mutex    sync.Mutex
+	rate     int
+	channels int
+	// per channel state
+	highPass []biquad
+	ns       []*noiseSuppressor
+	agc      agc
+	samples  []float64
+	levels   CaptureLevels
+}
+
+// NewCaptureProcessor returns a CaptureProcessor with opts, which adapts to
+// the format of the first frame.
+func NewCaptureProcessor(opts CaptureProcessingOptions) *CaptureProcessor {
+	if opts.HighPassCutoff == 0 {
+		opts.HighPassCutoff = 80
+	}
+	if opts.NoiseReductionDB == 0 {
+		opts.NoiseReductionDB = 15
+	}
+	if opts.AGCTargetDB == 0 {
+		opts.AGCTargetDB = -20
+	}
+	if opts.AGCMaxGainDB == 0 {
+		opts.AGCMaxGainDB = 20
+	}
+	return &CaptureProcessor{
+		opts: opts,
+		log:  logging.Component(opts.Logger, "dsp"),
+	}
+}
+
+func (p *CaptureProcessor) reset(rate, channels int) {
+	p.rate, p.channels = rate, channels
+	p.highPass = make([]biquad, channels)
+	p.ns = make([]*noiseSuppressor, channels)
+	for ch := 0; ch < channels; ch++ {
+		p.highPass[ch] = newHighPass(p.opts.HighPassCutoff, rate)
+		p.ns[ch] = newNoiseSuppressor(rate, p.opts.NoiseReductionDB)
+	}
+	p.agc = agc{
+		target:  p.opts.AGCTargetDB,
+		maxGain: p.opts.AGCMaxGainDB,
+	}
+	p.log.Debug("capture processing",
+		"rate", rate, "channels", channels,
+		"high_pass", p.opts.HighPass,
+		"noise_suppression", p.opts.NoiseSuppression,
+		"agc", p.opts.AGC)
+}
+
+// Process runs the enabled stages on a frame of interleaved PCM, in place.
+func (p *CaptureProcessor) Process(pcm []int16, sampleRate, channels int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.rate != sampleRate || p.channels != channels {
+		p.reset(sampleRate, channels)
+	}
+
+	if cap(p.samples) < len(pcm) {
+		p.samples = make([]float64, len(pcm))
+	}
+	x := p.samples[:len(pcm)]
+	for i, s := range pcm {
+		x[i] = float64(s) / 32768
+	}
+	p.levels.Input = rmsDBFS(x)
+
+	if p.opts.HighPass {
+		for i := range x {
+			x[i] = p.highPass[i%channels].process(x[i])
+		}
+	}
+	p.levels.HighPass = rmsDBFS(x)
+
+	if p.opts.NoiseSuppression {
+		for ch := 0; ch < channels; ch++ {
+			p.ns[ch].process(x, ch, channels)
+		}
+	}
+	p.levels.NoiseSuppression = rmsDBFS(x)
+
+	if p.opts.AGC {
+		p.agc.process(x, p.levels.NoiseSuppression)
+	}
+	p.levels.AGCGain = p.agc.gain
+	p.levels.Output = rmsDBFS(x)
+
+	for i, v := range x {
+		pcm[i] = clampInt16(float32(v * 32768))
+	}
+
+	p.levels.report(metrics.Default)
+}
+
+// Levels returns the levels of the last processed frame.
+func (p *CaptureProcessor) Levels() CaptureLevels {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.levels
+}
+
+func (l CaptureLevels) report(m *metrics.Metrics) {
+	m.CaptureLevel.WithLabelValues("input").Set(l.Input)
+	m.CaptureLevel.WithLabelValues("high_pass").Set(l.HighPass)
+	m.CaptureLevel.WithLabelValues("noise_suppression").Set(l.NoiseSuppression)
+	m.CaptureLevel.WithLabelValues("output").Set(l.Output)
+	m.CaptureAGCGain.Set(l.AGCGain)
+}
+
+// ProcessingSource runs a CaptureProcessor on a Source. Frames already
+// encoded as Opus are passed through.
+type ProcessingSource struct {
+	source    Source
+	processor *CaptureProcessor
+}
+
+// NewProcessingSource runs processor on the frames of source.
+func NewProcessingSource(source Source, processor *CaptureProcessor) *ProcessingSource {
+	return &ProcessingSource{source: source, processor: processor}
+}
+
+func (s *ProcessingSource) ReadAudio() (Frame, error) {
+	frame, err := s.source.ReadAudio()
+	if err != nil || len(frame.PCM) == 0 {
+		return frame, err
+	}
+	s.processor.Process(frame.PCM, frame.SampleRate, frame.Channels)
+	return frame, nil
+}
+
+// Close closes the wrapped source.
+func (s *ProcessingSource) Close() error {
+	return CloseSource(s.source)
+}
+
+func rmsDBFS(x []float64) float64 {
+	if len(x) == 0 {
+		return -120
+	}
+	var sum float64
+	for _, v := range x {
+		sum += v * v
+	}
+	rms := math.Sqrt(sum / float64(len(x)))
+	if rms < 1e-6 {
+		return -120
+	}
+	return 20 * math.Log10(rms)
+}
+
+// biquad is a second-order IIR filter in direct form I.
+type biquad struct {
+	b0, b1, b2, a1, a2 float64
+	x1, x2, y1, y2     float64
+}
+
+// newHighPass returns a Butterworth high-pass filter, see the Audio EQ
+// Cookbook.
+func newHighPass(cutoff float64, rate int) biquad {
+	w := 2 * math.Pi * cutoff / float64(rate)
+	alpha := math.Sin(w) / (2 * math.Sqrt2 / 2) // Q = 1/sqrt(2)
+	cos := math.Cos(w)
+	a0 := 1 + alpha
+	return biquad{
+		b0: (1 + cos) / 2 / a0,
+		b1: -(1 + cos) / a0,
+		b2: (1 + cos) / 2 / a0,
+		a1: -2 * cos / a0,
+		a2: (1 - alpha) / a0,
+	}
+}
+
+func (f *biquad) process(x float64) float64 {
+	y := f.b0*x + f.b1*f.x1 + f.b2*f.x2 - f.a1*f.y1 - f.a2*f.y2
+	f.x2, f.x1 = f.x1, x
+	f.y2, f.y1 = f.y1, y
+	return y
+}
+
+// noiseSuppressor is a spectral subtraction noise suppressor working on
+// overlapping windows of about 20ms, which is also the latency it adds. The
+// noise spectrum is tracked per bin like the VAD tracks the noise floor:
+// down quickly, up slowly enough for speech to barely move it.
+type noiseSuppressor struct {
+	size, hop int
+	window    []float64 // sqrt-Hann, for both analysis and synthesis
+	minGain   float64
+
+	input    []float64 // ring of the last size input samples
+	pos      int       // next write position in input
+	filled   int       // input samples since the last block
+	acc      []float64 // overlap-add accumulator
+	output   []float64 // processed samples, returned from outPos
+	outPos   int
+	spec     []complex128
+	smoothed []float64
+	noise    []float64
+	gain     []float64
+	primed   bool
+}
+
+func newNoiseSuppressor(rate int, reductionDB float64) *noiseSuppressor {
+	size := 1
+	for size < rate/50 {
+		size <<= 1
+	}
+	ns := &noiseSuppressor{
+		size:    size,
+		hop:     size / 2,
+		window:  make([]float64, size),
+		minGain: math.Pow(10, -reductionDB/20),
+		input:   make([]float64, size),
+		acc:     make([]float64, size),
+		// One hop of silence, so that there are always enough processed
+		// samples to return.
+		output:   make([]float64, size/2),
+		spec:     make([]complex128, size),
+		noise:    make([]float64, size/2+1),
+		smoothed: make([]float64, size/2+1),
+		gain:     make([]float64, size/2+1),
+	}
+	for i := range ns.window {
+		ns.window[i] = math.Sqrt(0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(size)))
+	}
+	for i := range ns.gain {
+		ns.gain[i] = 1
+	}
+	return ns
+}
+
+// process suppresses the noise of channel ch of the interleaved samples x.
+func (ns *noiseSuppressor) process(x []float64, ch, channels int) {
+	for i := ch; i < len(x); i += channels {
+		ns.input[ns.pos] = x[i]
+		ns.pos = (ns.pos + 1) % ns.size
+		ns.filled++
+		if ns.filled == ns.hop {
+			ns.filled = 0
+			ns.block()
+		}
+
+		x[i] = ns.output[ns.outPos]
+		ns.outPos++
+	}
+}
+
+func (ns *noiseSuppressor) block() {
+	// The oldest sample is at pos
+	for i := range ns.spec {
+		ns.spec[i] = complex(ns.input[(ns.pos+i)%ns.size]*ns.window[i], 0)
+	}
+	fft(ns.spec, false)
+
+	for k := 0; k <= ns.size/2; k++ {
+		re, im := real(ns.spec[k]), imag(ns.spec[k])
+		power := re*re + im*im
+
+		// The noise is tracked on the smoothed power, the power of a single
+		// block varies too much.
+		if !ns.primed {
+			ns.smoothed[k], ns.noise[k] = power, power
+		}
+		ns.smoothed[k] += (power - ns.smoothed[k]) * 0.2
+		if ns.smoothed[k] < ns.noise[k] {
+			ns.noise[k] += (ns.smoothed[k] - ns.noise[k]) * 0.3
+		} else {
+			ns.noise[k] += (ns.smoothed[k] - ns.noise[k]) * 0.01
+		}
+
+		// Over-subtract to be safe, and smooth the gain over time to limit
+		// musical noise.
+		gain := ns.minGain
+		if power > 0 {
+			gain = math.Max(1-2*ns.noise[k]/power, ns.minGain)
+		}
+		ns.gain[k] = 0.6*ns.gain[k] + 0.4*gain
+
+		ns.spec[k] *= complex(ns.gain[k], 0)
+		if k > 0 && k < ns.size/2 {
+			ns.spec[ns.size-k] = complex(real(ns.spec[k]), -imag(ns.spec[k]))
+		}
+	}
+	ns.primed = true
+
+	fft(ns.spec, true)
+	for i := range ns.acc {
+		ns.acc[i] += real(ns.spec[i]) / float64(ns.size) * ns.window[i]
+	}
+	ns.output = append(ns.output[:0], ns.output[ns.outPos:]...)
+	ns.output = append(ns.output, ns.acc[:ns.hop]...)
+	ns.outPos = 0
+	copy(ns.acc, ns.acc[ns.hop:])
+	clear(ns.acc[ns.size-ns.hop:])
+}
+
+// agc brings the speech level to the target. The gain only adapts on frames
+// well above the noise, goes down quickly to avoid clipping and up slowly
+// to avoid pumping.
+type agc struct {
+	target     float64
+	maxGain    float64
+	gain       float64 // dB
+	noiseFloor float64
+	primed     bool
+}
+
+func (a *agc) process(x []float64, level float64) {
+	switch {
+	case !a.primed:
+		// Wait for the first frame with sound, the previous stages start
+		// with silence.
+		a.noiseFloor, a.primed = level, level > -100
+	case level < a.noiseFloor:
+		a.noiseFloor += (level - a.noiseFloor) * 0.5
+	default:
+		a.noiseFloor += (level - a.noiseFloor) * 0.005
+	}
+
+	prev := a.gain
+	if level > a.noiseFloor+10 && level > -60 {
+		want := math.Min(a.target-level, a.maxGain)
+		if want < a.gain {
+			a.gain += (want - a.gain) * 0.5
+		} else {
+			a.gain += (want - a.gain) * 0.05
+		}
+	}
+
+	// Ramp the gain over the frame to avoid clicks
+	from, to := math.Pow(10, prev/20), math.Pow(10, a.gain/20)
+	for i := range x {
+		g := from + (to-from)*float64(i)/float64(len(x))
+		x[i] = softClip(x[i] * g)
+	}
+}
+
+// softClip limits v to [-1, 1] without the harshness of hard clipping.
+func softClip(v float64) float64 {
+	if v > -0.9 && v < 0.9 {
+		return v
+	}
+	return math.Copysign(0.9+0.1*math.Tanh((math.Abs(v)-0.9)/0.1), v)
+}
@@ -0,0 +1,337 @@
+package audio
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-audio/audio"
+	"github.com/go-audio/wav"
+	"github.com/pion/mediadevices"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+
+	"exp-openai-webrtc-streaming/internal/logging"
+	"exp-openai-webrtc-streaming/internal/playback"
+)
+
+// TrackRecorder records the Opus audio of a local or remote track to WAV or
+// Ogg Opus files. Tracks are attached once with RecordTrack or
+// WriteWebRTCTrack, and recording is turned on and off with Start and Stop;
+// packets arriving while stopped are dropped.
+//
+// Ogg files contain the Opus packets as received. WAV files contain the
+// decoded audio at 48kHz with the channel count of the track codec, unless
+// Channels is set.
+type TrackRecorder struct {
+	// Channels overrides the channel count of WAV recordings.
+	Channels int
+
+	log   *slog.Logger
+	loops playback.Loops
+
+	mutex    sync.Mutex
+	sink     recordingSink
+	path     string
+	channels int // of the attached track
+	// readers are the encoded readers of the local tracks, closed to stop
+	// their loops since they have no read deadline
+	readers map[mediadevices.EncodedReadCloser]struct{}
+}
+
+// NewTrackRecorder returns a stopped TrackRecorder without a track.
+func NewTrackRecorder(logger *slog.Logger) *TrackRecorder {
+	return &TrackRecorder{
+		log:     logging.Component(logger, "recorder"),
+		readers: make(map[mediadevices.EncodedReadCloser]struct{}),
+	}
+}
+
+// Start records to path, replacing the current recording if any. The format
+// is picked from the extension: .wav, or .ogg/.opus.
+func (r *TrackRecorder) Start(path string) error {
+	var sink recordingSink
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".wav":
+		sink = &wavSink{}
+	case ".ogg", ".opus":
+		sink = &oggSink{}
+	default:
+		return fmt.Errorf("unsupported recording file type: %q", ext)
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create file '%s': %w", path, err)
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err := r.finish(); err != nil {
+		r.log.Warn("failed to finish previous recording", "err", err)
+	}
+	sink.open(f)
+	r.sink, r.path = sink, path
+	r.log.Info("recording", "path", path)
+	return nil
+}
+
+// Stop finishes the current recording.
+func (r *TrackRecorder) Stop() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.finish()
+}
+
+func (r *TrackRecorder) finish() error {
+	if r.sink == nil {
+		return nil
+	}
+	sink, path := r.sink, r.path
+	r.sink, r.path = nil, ""
+	if err := sink.close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	r.log.Info("wrote recording", "path", path)
+	return nil
+}
+
+// Close stops the recording and the loops reading the attached tracks.
+func (r *TrackRecorder) Close() error {
+	r.mutex.Lock()
+	for reader := range r.readers {
+		reader.Close()
+	}
+	r.mutex.Unlock()
+
+	r.loops.Close()
+	return r.Stop()
+}
+
+// WriteWebRTCTrack records a remote track, e.g. the model audio, until the
+// track ends or the recorder is closed. It makes TrackRecorder usable in
+// place of a player.
+func (r *TrackRecorder) WriteWebRTCTrack(track RemoteTrack) error {
+	if !r.loops.Start(track) {
+		return nil
+	}
+	defer r.loops.Done(track)
+
+	r.setChannels(int(track.Codec().Channels))
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			if r.loops.IsClosed() || errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("failed to read RTP packet: %w", err)
+		}
+		r.write(packet.Payload, packet.Timestamp)
+	}
+}
+
+// RecordTrack records a local track, e.g. the microphone, until the track
+// ends or the recorder is closed.
+func (r *TrackRecorder) RecordTrack(track mediadevices.Track) error {
+	if track.Kind() != webrtc.RTPCodecTypeAudio {
+		return fmt.Errorf("track is not audio (kind=%s)", track.Kind().String())
+	}
+
+	reader, err := track.NewEncodedReader(webrtc.MimeTypeOpus)
+	if err != nil {
+		return fmt.Errorf("failed to create opus reader: %w", err)
+	}
+	r.mutex.Lock()
+	r.readers[reader] = struct{}{}
+	r.mutex.Unlock()
+	defer func() {
+		r.mutex.Lock()
+		delete(r.readers, reader)
+		r.mutex.Unlock()
+		reader.Close()
+	}()
+
+	// mediadevices declares Opus as stereo, whatever the capture format
+	r.setChannels(2)
+
+	var timestamp uint32
+	for {
+		buf, release, err := reader.Read()
+		if err != nil {
+			if r.loops.IsClosed() || errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("failed to read encoded audio: %w", err)
+		}
+		r.write(buf.Data, timestamp)
+		timestamp += buf.Samples
+		release()
+	}
+}
+
+func (r *TrackRecorder) setChannels(channels int) {
+	r.mutex.Lock()
+	r.channels = channels
+	r.mutex.Unlock()
+}
+
+func (r *TrackRecorder) write(payload []byte, timestamp uint32) {
+	if len(payload) == 0 {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.sink == nil {
+		return
+	}
+
+	channels := r.Channels
+	if channels == 0 {
+		channels = r.channels
+	}
+	if channels != 1 {
+		channels = 2
+	}
+	if err := r.sink.write(payload, timestamp, channels); err != nil {
+		r.log.Warn("failed to record audio", "path", r.path, "err", err)
+	}
+}
+
+// recordingSink writes Opus packets to a file. The format of the file is
+// fixed by the first packet, with the channel count known by then.
+type recordingSink interface {
+	open(f *os.File)
+	write(payload []byte, timestamp uint32, channels int) error
+	close() error
+}
+
+type wavSink struct {
+	file     *os.File
+	encoder  *wav.Encoder
+	decoder  opusDecoder
+	channels int
+	pcm      []int16
+	buf      *audio.IntBuffer
+}
+
+func (s *wavSink) open(f *os.File) {
+	s.file = f
+}
+
+func (s *wavSink) write(payload []byte, _ uint32, channels int) error {
+	if s.encoder == nil {
+		decoder, err := newOpusDecoder(48_000, channels)
+		if err != nil {
+			return err
+		}
+		s.decoder = decoder
+		s.channels = channels
+		s.encoder = wav.NewEncoder(s.file, 48_000, 16, channels, 1)
+		s.pcm = make([]int16, 5760*channels) // 120ms, the longest Opus packet
+		s.buf = &audio.IntBuffer{
+			Format:         &audio.Format{NumChannels: channels, SampleRate: 48_000},
+			SourceBitDepth: 16,
+			Data:           make([]int, len(s.pcm)),
+		}
+	}
+
+	n, err := s.decoder.Decode(payload, s.pcm)
+	if err != nil {
+		return fmt.Errorf("failed to decode opus data: %w", err)
+	}
+
+	data := s.buf.Data[:cap(s.buf.Data)]
+	for i, sample := range s.pcm[:n*s.channels] {
+		data[i] = int(sample)
+	}
+	s.buf.Data = data[:n*s.channels]
+	return s.encoder.Write(s.buf)
+}
+
+func (s *wavSink) close() error {
+	if s.encoder != nil {
+		if err := s.encoder.Close(); err != nil {
+			s.file.Close()
+			return err
+		}
+	}
+	return s.file.Close()
+}
+
+type oggSink struct {
+	file   *os.File
+	writer *oggwriter.OggWriter
+	packet rtp.Packet
+}
+
+func (s *oggSink) open(f *os.File) {
+	s.file = f
+}
+
+func (s *oggSink) write(payload []byte, timestamp uint32, channels int) error {
+	if s.writer == nil {
+		writer, err := oggwriter.NewWith(s.file, 48_000, uint16(channels))
+		if err != nil {
+			return fmt.Errorf("failed to create ogg writer: %w", err)
+		}
+		s.writer = writer
+	}
+
+	s.packet.Timestamp = timestamp
+	s.packet.Payload = payload
+	return s.writer.WriteRTP(&s.packet)
+}
+
+func (s *oggSink) close() error {
+	if s.writer != nil {
+		// Closes the file too
+		return s.writer.Close()
+	}
+	return s.file.Close()
+}
+
+// Record records a local audio track to outputPath, see
+// TrackRecorder.Start, for up to duration, or until the track ends or ctx is
+// done. A zero duration records until one of the latter.
+func Record(
+	ctx context.Context,
+	track mediadevices.Track,
+	duration time.Duration,
+	outputPath string,
+	logger *slog.Logger,
+) error {
+	recorder := NewTrackRecorder(logger)
+	if err := recorder.Start(outputPath); err != nil {
+		return err
+	}
+
+	if duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, duration)
+		defer cancel()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- recorder.RecordTrack(track)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+	}
+	if closeErr := recorder.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
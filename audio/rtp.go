@@ -0,0 +1,421 @@
+package audio
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+
+	"exp-openai-webrtc-streaming/internal/logging"
+	"exp-openai-webrtc-streaming/internal/playback"
+)
+
+const (
+	// rtpMTU bounds the plain RTP packets, which are not fragmented.
+	rtpMTU = 1500
+	// rtpMaxMisorder is how far back a packet is taken as late rather than
+	// as a restart of the stream, as in RFC 3550.
+	rtpMaxMisorder = 100
+	// rtpIdleTimeout is how long RTPSource waits for a packet before it
+	// returns silence, so that the Sender can stop while the peer is
+	// silent.
+	rtpIdleTimeout = 100 * time.Millisecond
+	rtpFrameTime   = 20 * time.Millisecond
+)
+
+// opusSilence is a 20ms Opus packet of silence.
+var opusSilence = []byte{0xf8, 0xff, 0xfe}
+
+// RTPSourceOptions configures an RTPSource. Zero values select the defaults.
+type RTPSourceOptions struct {
+	// Codec is the encoding of the stream, as in an SDP rtpmap: opus, the
+	// default, or L16/<rate>/<channels>, linear PCM in network byte order,
+	// e.g. L16/48000/2. The rate of L16 must be one Opus encodes: 8000,
+	// 12000, 16000, 24000 or 48000. The channel count defaults to 1.
+	Codec string
+	// PCM decodes the Opus packets, e.g. for the capture processing. They
+	// are decoded to SampleRate and Channels, 48kHz mono by default.
+	PCM        bool
+	SampleRate int
+	Channels   int
+	Logger     *slog.Logger
+}
+
+// Validate checks the codec.
+func (o RTPSourceOptions) Validate() error {
+	_, _, _, err := parseRTPCodec(o.Codec)
+	return err
+}
+
+// parseRTPCodec returns the rate and channels of L16, or opus.
+func parseRTPCodec(codec string) (opus bool, rate, channels int, err error) {
+	if codec == "" || strings.EqualFold(codec, "opus") || strings.EqualFold(codec, "opus/48000/2") {
+		return true, 48_000, 2, nil
+	}
+	parts := strings.Split(codec, "/")
+	if !strings.EqualFold(parts[0], "L16") || len(parts) < 2 || len(parts) > 3 {
+		return false, 0, 0, fmt.Errorf("unsupported RTP codec %q, want opus or L16/<rate>/<channels>", codec)
+	}
+	rate, err = strconv.Atoi(parts[1])
+	if err != nil || rate <= 0 {
+		return false, 0, 0, fmt.Errorf("invalid L16 sample rate %q", parts[1])
+	}
+	switch rate {
+	case 8_000, 12_000, 16_000, 24_000, 48_000:
+	default:
+		return false, 0, 0, fmt.Errorf("unsupported L16 sample rate %d, want one of Opus: 8000, 12000, 16000, 24000 or 48000", rate)
+	}
+	channels = 1
+	if len(parts) == 3 {
+		channels, err = strconv.Atoi(parts[2])
+		if err != nil || channels <= 0 || channels > 2 {
+			return false, 0, 0, fmt.Errorf("invalid L16 channel count %q", parts[2])
+		}
+	}
+	return false, rate, channels, nil
+}
+
+// RTPSequence drops the late and duplicate packets of a received RTP
+// stream. A new SSRC, or a packet further back than a reordering explains,
+// restarts the stream, e.g. when the sender restarts with a new random
+// sequence number. The zero value is ready to use.
+type RTPSequence struct {
+	started  bool
+	ssrc     uint32
+	sequence uint16
+}
+
+// Next reports whether the packet of header is new, and records it if so.
+func (s *RTPSequence) Next(header *rtp.Header) bool {
+	if s.started && header.SSRC == s.ssrc {
+		delta := int16(header.SequenceNumber - s.sequence)
+		if delta <= 0 && delta > -rtpMaxMisorder {
+			return false // late or duplicate
+		}
+	}
+	s.started, s.ssrc, s.sequence = true, header.SSRC, header.SequenceNumber
+	return true
+}
+
+// Reset restarts the stream, so that the next packet is taken.
+func (s *RTPSequence) Reset() {
+	s.started = false
+}
+
+// RTPSource receives the user audio as plain RTP over UDP, e.g. from
+// GStreamer or FreeSWITCH, instead of the microphone. The sender paces the
+// stream, silence is returned while it sends nothing. The packets older than
+// the last one are dropped, there is no jitter buffer.
+type RTPSource struct {
+	conn     *net.UDPConn
+	opus     bool
+	rate     int
+	channels int
+	decoder  *FrameDecoder
+	log      *slog.Logger
+
+	buf      []byte
+	pcm      []int16
+	sequence RTPSequence
+	// idle is set once no packet has arrived for rtpIdleTimeout
+	idle bool
+}
+
+// ListenRTP receives the stream on the UDP address, e.g. :5004.
+func ListenRTP(addr string, opts RTPSourceOptions) (*RTPSource, error) {
+	opus, rate, channels, err := parseRTPCodec(opts.Codec)
+	if err != nil {
+		return nil, err
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RTP address: %w", err)
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for RTP: %w", err)
+	}
+
+	s := &RTPSource{
+		conn:     conn,
+		opus:     opus,
+		rate:     rate,
+		channels: channels,
+		log:      logging.Component(opts.Logger, "rtp"),
+		buf:      make([]byte, rtpMTU),
+	}
+	if opus && opts.PCM {
+		if opts.SampleRate == 0 {
+			opts.SampleRate = 48_000
+		}
+		if opts.Channels == 0 {
+			opts.Channels = 1
+		}
+		s.decoder = NewFrameDecoder(opts.SampleRate, opts.Channels)
+	}
+	s.log.Info("receiving RTP", "addr", conn.LocalAddr(), "codec", opts.Codec)
+	return s, nil
+}
+
+// Addr returns the local address, e.g. to find the port picked for :0.
+func (s *RTPSource) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// ReadAudio returns the frame of the next packet, io.EOF once the source is
+// closed. Without packets for rtpIdleTimeout, it returns 20ms of silence,
+// then every 20ms until a packet arrives.
+func (s *RTPSource) ReadAudio() (Frame, error) {
+	for {
+		timeout := rtpIdleTimeout
+		if s.idle {
+			timeout = rtpFrameTime
+		}
+		s.conn.SetReadDeadline(time.Now().Add(timeout))
+		n, err := s.conn.Read(s.buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return Frame{}, io.EOF
+			}
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				s.idle = true
+				return s.silence(), nil
+			}
+			return Frame{}, fmt.Errorf("failed to read RTP: %w", err)
+		}
+		var packet rtp.Packet
+		if err := packet.Unmarshal(s.buf[:n]); err != nil {
+			s.log.Debug("dropped invalid RTP packet", "err", err)
+			continue
+		}
+		if !s.sequence.Next(&packet.Header) {
+			continue
+		}
+		s.idle = false
+
+		frame, ok, err := s.frame(packet.Payload)
+		if err != nil {
+			s.log.Warn("dropped RTP packet", "err", err)
+			continue
+		}
+		if ok {
+			return frame, nil
+		}
+	}
+}
+
+func (s *RTPSource) frame(payload []byte) (Frame, bool, error) {
+	if !s.opus {
+		// L16 is big endian
+		s.pcm = s.pcm[:0]
+		for i := 0; i+1 < len(payload); i += 2 {
+			s.pcm = append(s.pcm, int16(binary.BigEndian.Uint16(payload[i:])))
+		}
+		if len(s.pcm) == 0 {
+			return Frame{}, false, nil
+		}
+		return Frame{PCM: s.pcm, SampleRate: s.rate, Channels: s.channels}, true, nil
+	}
+
+	duration := OpusPacketDuration(payload)
+	if duration == 0 {
+		return Frame{}, false, nil
+	}
+	frame := Frame{Opus: payload, Duration: duration}
+	if s.decoder == nil {
+		return frame, true, nil
+	}
+	pcm, err := s.decoder.Decode(frame)
+	if err != nil {
+		return Frame{}, false, err
+	}
+	return Frame{PCM: pcm, SampleRate: s.decoder.sampleRate, Channels: s.decoder.channels}, true, nil
+}
+
+// silence returns a 20ms frame of silence in the format of the stream.
+func (s *RTPSource) silence() Frame {
+	rate, channels := s.rate, s.channels
+	switch {
+	case s.decoder != nil:
+		rate, channels = s.decoder.sampleRate, s.decoder.channels
+	case s.opus:
+		return Frame{Opus: opusSilence, Duration: rtpFrameTime}
+	}
+	samples := int(int64(rate)*int64(rtpFrameTime)/int64(time.Second)) * channels
+	s.pcm = append(s.pcm[:0], make([]int16, samples)...)
+	return Frame{PCM: s.pcm, SampleRate: rate, Channels: channels}
+}
+
+func (s *RTPSource) Close() error {
+	return s.conn.Close()
+}
+
+// RTPWriterOptions configures an RTPWriter. Zero values select the defaults.
+type RTPWriterOptions struct {
+	// PayloadType is the payload type of the packets, 111 by default, the
+	// one of Opus over WebRTC.
+	PayloadType uint8
+	// Opus encodes the PCM frames written with WriteFrame.
+	Opus   OpusEncoderOptions
+	Logger *slog.Logger
+}
+
+// RTPWriter sends Opus as plain RTP over UDP, e.g. to GStreamer or
+// FreeSWITCH: the packets of the tracks it writes, such as the model audio,
+// or the frames of a Source, such as the microphone, see Tee.
+type RTPWriter struct {
+	conn        *net.UDPConn
+	payloadType uint8
+	ssrc        uint32
+	encoder     *frameEncoder
+	log         *slog.Logger
+	loops       playback.Loops
+
+	mutex    sync.Mutex
+	buf      []byte
+	sequence uint16
+	// timestamp is the one of the next packet
+	timestamp uint32
+}
+
+// DialRTP sends to the UDP address, e.g. 127.0.0.1:5006.
+func DialRTP(addr string, opts RTPWriterOptions) (*RTPWriter, error) {
+	if err := opts.Opus.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid opus options: %w", err)
+	}
+	if opts.PayloadType == 0 {
+		opts.PayloadType = 111
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid RTP address: %w", err)
+	}
+	conn, err := net.DialUDP("udp", nil, udpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial RTP: %w", err)
+	}
+
+	w := &RTPWriter{
+		conn:        conn,
+		payloadType: opts.PayloadType,
+		ssrc:        rand.Uint32(),
+		encoder:     newFrameEncoder(opts.Opus),
+		log:         logging.Component(opts.Logger, "rtp"),
+		buf:         make([]byte, rtpMTU),
+		sequence:    uint16(rand.Uint32()),
+		timestamp:   rand.Uint32(),
+	}
+	w.log.Info("sending RTP", "addr", udpAddr)
+	return w, nil
+}
+
+// WriteWebRTCTrack forwards the packets of an Opus track until it ends or
+// the writer is closed. They are renumbered into the stream of the writer,
+// so that the tracks of successive connections make one stream.
+func (w *RTPWriter) WriteWebRTCTrack(track RemoteTrack) error {
+	if !w.loops.Start(track) {
+		return nil
+	}
+	defer w.loops.Done(track)
+
+	// offset maps the timestamps of the track to the ones of the writer,
+	// keeping the gaps of the track, e.g. DTX
+	var offset uint32
+	started := false
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			if w.loops.IsClosed() || errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("failed to read RTP packet: %w", err)
+		}
+
+		w.mutex.Lock()
+		if !started {
+			started, offset = true, w.timestamp-packet.Timestamp
+		}
+		w.send(packet.Payload, packet.Timestamp+offset, OpusPacketDuration(packet.Payload))
+		w.mutex.Unlock()
+	}
+}
+
+// WriteFrame sends a frame of a Source, encoding its PCM if needed.
+func (w *RTPWriter) WriteFrame(frame Frame) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.encoder.encode(frame, func(packet []byte, duration time.Duration) error {
+		w.send(packet, w.timestamp, duration)
+		return nil
+	})
+}
+
+// send sends a packet and moves the timestamp of the next one past it. The
+// mutex must be held.
+func (w *RTPWriter) send(payload []byte, timestamp uint32, duration time.Duration) {
+	packet := rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			PayloadType:    w.payloadType,
+			SequenceNumber: w.sequence,
+			Timestamp:      timestamp,
+			SSRC:           w.ssrc,
+		},
+		Payload: payload,
+	}
+	w.sequence++
+	w.timestamp = timestamp + uint32(48_000*duration/time.Second)
+
+	n, err := packet.MarshalTo(w.buf)
+	if err != nil {
+		w.log.Warn("dropped RTP packet", "err", err)
+		return
+	}
+	// UDP errors, e.g. ICMP port unreachable while the receiver is down,
+	// must not end the stream.
+	if _, err := w.conn.Write(w.buf[:n]); err != nil {
+		w.log.Debug("failed to send RTP packet", "err", err)
+	}
+}
+
+// Tee returns a source yielding the frames of source, also sending them to
+// the writer. Closing it closes source and the writer.
+func (w *RTPWriter) Tee(source Source) Source {
+	return &teeSource{source: source, writer: w}
+}
+
+// Close stops the tracks being written and closes the socket.
+func (w *RTPWriter) Close() error {
+	w.loops.Close()
+	return w.conn.Close()
+}
+
+type teeSource struct {
+	source Source
+	writer *RTPWriter
+}
+
+func (s *teeSource) ReadAudio() (Frame, error) {
+	frame, err := s.source.ReadAudio()
+	if err != nil {
+		return frame, err
+	}
+	if err := s.writer.WriteFrame(frame); err != nil {
+		s.writer.log.Warn("failed to send frame", "err", err)
+	}
+	return frame, nil
+}
+
+func (s *teeSource) Close() error {
+	return errors.Join(CloseSource(s.source), s.writer.Close())
+}
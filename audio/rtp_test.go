@@ -0,0 +1,79 @@
+package audio
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+func TestRTPSource(t *testing.T) {
+	source, err := ListenRTP("127.0.0.1:0", RTPSourceOptions{Codec: "L16/16000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.DialUDP("udp", nil, source.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	send := func(ssrc uint32, sequence uint16, sample int16) {
+		payload := binary.BigEndian.AppendUint16(nil, uint16(sample))
+		packet := rtp.Packet{
+			Header:  rtp.Header{Version: 2, PayloadType: 96, SequenceNumber: sequence, SSRC: ssrc},
+			Payload: payload,
+		}
+		data, _ := packet.Marshal()
+		conn.Write(data)
+	}
+	read := func() Frame {
+		t.Helper()
+		frame, err := source.ReadAudio()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return frame
+	}
+
+	// Without packets, 20ms of silence.
+	start := time.Now()
+	if frame := read(); len(frame.PCM) != 320 || frame.PCM[0] != 0 || frame.SampleRate != 16_000 {
+		t.Errorf("idle frame %d samples at %dHz, want 20ms of silence at 16kHz", len(frame.PCM), frame.SampleRate)
+	}
+	if d := time.Since(start); d < rtpIdleTimeout || d > time.Second {
+		t.Errorf("silence after %v, want %v", d, rtpIdleTimeout)
+	}
+
+	send(1, 1000, 1)
+	send(1, 999, 2)  // late
+	send(1, 1000, 3) // duplicate
+	send(2, 999, 4)  // restarted sender
+	send(2, 60000, 5)
+	send(2, 59000, 6) // far back, restarted again
+	for _, want := range []int16{1, 4, 5, 6} {
+		if frame := read(); len(frame.PCM) != 1 || frame.PCM[0] != want {
+			t.Errorf("frame %v, want sample %d", frame.PCM, want)
+		}
+	}
+
+	source.Close()
+	if _, err := source.ReadAudio(); err != io.EOF {
+		t.Errorf("got %v after Close, want io.EOF", err)
+	}
+}
+
+func TestRTPSourceOptionsValidate(t *testing.T) {
+	for _, codec := range []string{"", "opus", "L16/48000/2", "L16/16000", "L16/8000/1"} {
+		if err := (RTPSourceOptions{Codec: codec}).Validate(); err != nil {
+			t.Errorf("%q: %v", codec, err)
+		}
+	}
+	for _, codec := range []string{"pcmu", "L16", "L16/44100/2", "L16/22050", "L16/48000/3", "L16/x"} {
+		if err := (RTPSourceOptions{Codec: codec}).Validate(); err == nil {
+			t.Errorf("%q: no error", codec)
+		}
+	}
+}
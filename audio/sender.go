@@ -0,0 +1,176 @@
+package audio
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+
+	"exp-openai-webrtc-streaming/internal/logging"
+)
+
+// Sender feeds a Source into a local track, encoding PCM frames to Opus
+// with the OpusEncoderOptions when needed, which needs libopus. Sources
+// yielding Opus are sent as they are.
+type Sender struct {
+	track  *webrtc.TrackLocalStaticSample
+	source Source
+	opts   OpusEncoderOptions
+	log    *slog.Logger
+
+	encoder *frameEncoder
+
+	done chan struct{}
+	// ended is closed once the sending stops, e.g. because the source ended
+	ended chan struct{}
+	wg    sync.WaitGroup
+}
+
+// NewSender creates the track of source. The sending starts with Start.
+func NewSender(source Source, opts OpusEncoderOptions, logger *slog.Logger) (*Sender, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid opus options: %w", err)
+	}
+	track, err := webrtc.NewTrackLocalStaticSample(
+		webrtc.RTPCodecCapability{
+			MimeType:    webrtc.MimeTypeOpus,
+			ClockRate:   48_000,
+			Channels:    2,
+			SDPFmtpLine: opts.Fmtp(),
+		},
+		"audio", "oai-realtime",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create local track: %w", err)
+	}
+
+	return &Sender{
+		track:   track,
+		source:  source,
+		opts:    opts,
+		log:     logging.Component(logger, "mic"),
+		encoder: newFrameEncoder(opts),
+	}, nil
+}
+
+// Track returns the local track to add to a peer connection.
+func (s *Sender) Track() *webrtc.TrackLocalStaticSample {
+	return s.track
+}
+
+// Start sends the source audio until it ends or Stop is called.
+func (s *Sender) Start() {
+	s.done = make(chan struct{})
+	s.ended = make(chan struct{})
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer close(s.ended)
+		for {
+			select {
+			case <-s.done:
+				return
+			default:
+			}
+
+			frame, err := s.source.ReadAudio()
+			if errors.Is(err, io.EOF) {
+				s.log.Info("audio source ended")
+				return
+			}
+			if err != nil {
+				s.log.Error("failed to read audio source", "err", err)
+				return
+			}
+			if err := s.send(frame); err != nil {
+				s.log.Warn("failed to send audio frame", "err", err)
+			}
+		}
+	}()
+}
+
+// Stop waits for the frame being read to be sent, sources must not block
+// much longer than a frame.
+func (s *Sender) Stop() {
+	if s.done == nil {
+		return
+	}
+	close(s.done)
+	s.wg.Wait()
+	s.done = nil
+}
+
+// Ended is closed once the sending stops after Start, e.g. because the
+// source ended.
+func (s *Sender) Ended() <-chan struct{} {
+	return s.ended
+}
+
+func (s *Sender) send(frame Frame) error {
+	// With DTX, the packets of 1 or 2 bytes during silence are still sent:
+	// TrackLocalStaticSample has no way to skip their timestamps without also
+	// skipping sequence numbers, which reads as loss.
+	return s.encoder.encode(frame, func(packet []byte, duration time.Duration) error {
+		return s.track.WriteSample(media.Sample{Data: packet, Duration: duration})
+	})
+}
+
+// frameEncoder encodes the PCM frames of a Source to Opus packets of the
+// frame duration of opts, which needs libopus. Frames already encoded as Opus
+// are passed through.
+type frameEncoder struct {
+	opts     OpusEncoderOptions
+	encoder  opusEncoder
+	rate     int
+	channels int
+	pending  []int16 // PCM not yet encoded, less than a packet
+	buf      []byte
+}
+
+func newFrameEncoder(opts OpusEncoderOptions) *frameEncoder {
+	return &frameEncoder{
+		opts: opts,
+		buf:  make([]byte, 4000), // recommended max packet size
+	}
+}
+
+// encode calls emit with the packets of frame, valid until emit returns.
+func (e *frameEncoder) encode(frame Frame, emit func(packet []byte, duration time.Duration) error) error {
+	if len(frame.PCM) == 0 {
+		return emit(frame.Opus, frame.Duration)
+	}
+
+	if e.encoder == nil || e.rate != frame.SampleRate || e.channels != frame.Channels {
+		encoder, err := newOpusEncoder(frame.SampleRate, frame.Channels, e.opts)
+		if err != nil {
+			return err
+		}
+		e.encoder, e.rate, e.channels = encoder, frame.SampleRate, frame.Channels
+		e.pending = e.pending[:0]
+	}
+
+	// Sources yield 20ms frames, the encoder may want them split or joined
+	duration := e.opts.frameDuration()
+	frameLen := int(int64(frame.SampleRate)*int64(duration)/int64(time.Second)) * frame.Channels
+	e.pending = append(e.pending, frame.PCM...)
+	var sent int
+	for len(e.pending)-sent >= frameLen {
+		n, err := e.encoder.Encode(e.pending[sent:sent+frameLen], e.buf)
+		if err != nil {
+			e.pending = e.pending[:0]
+			return fmt.Errorf("failed to encode opus: %w", err)
+		}
+		sent += frameLen
+		if err := emit(e.buf[:n], duration); err != nil {
+			e.pending = e.pending[:copy(e.pending, e.pending[sent:])]
+			return err
+		}
+	}
+	e.pending = e.pending[:copy(e.pending, e.pending[sent:])]
+	return nil
+}
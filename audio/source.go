@@ -0,0 +1,139 @@
+package audio
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pion/mediadevices"
+	mdaudio "github.com/pion/mediadevices/pkg/io/audio"
+	"github.com/pion/mediadevices/pkg/wave"
+	"github.com/pion/webrtc/v4"
+)
+
+// Frame is one frame of user audio, either PCM or an encoded Opus
+// packet.
+type Frame struct {
+	// PCM is interleaved 16-bit PCM. Its duration must be one that Opus can
+	// encode: 2.5, 5, 10, 20, 40 or 60ms.
+	PCM        []int16
+	SampleRate int
+	Channels   int
+
+	// Opus is an encoded Opus packet. It is used when PCM is empty.
+	Opus []byte
+	// Duration is the duration of the Opus packet.
+	Duration time.Duration
+}
+
+// Source produces the user audio sent to the model. ReadAudio must pace
+// the frames in real time, blocking until the next one is due, and returns
+// io.EOF once the source has ended. The returned frame is only valid until
+// the next call.
+type Source interface {
+	ReadAudio() (Frame, error)
+}
+
+// CloseSource closes source if it is an io.Closer, e.g. to release the
+// microphone. Sources wrapping another one close it.
+func CloseSource(source Source) error {
+	if closer, ok := source.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// mediaDevicesSource adapts a mediadevices track, such as the microphone, to
+// Source. The track does the Opus encoding.
+type mediaDevicesSource struct {
+	track  mediadevices.Track
+	reader mediadevices.EncodedReadCloser
+}
+
+// NewMediaDevicesSource returns a Source reading track encoded as Opus.
+func NewMediaDevicesSource(track mediadevices.Track) (Source, error) {
+	reader, err := track.NewEncodedReader(webrtc.MimeTypeOpus)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create opus reader: %w", err)
+	}
+	return &mediaDevicesSource{track: track, reader: reader}, nil
+}
+
+func (s *mediaDevicesSource) ReadAudio() (Frame, error) {
+	buf, release, err := s.reader.Read()
+	if err != nil {
+		return Frame{}, err
+	}
+	defer release()
+
+	return Frame{
+		// The buffer is reused once released
+		Opus: append([]byte(nil), buf.Data...),
+		// mediadevices always encodes Opus with a 48kHz clock
+		Duration: time.Duration(buf.Samples) * time.Second / 48_000,
+	}, nil
+}
+
+// Close closes the reader and the track.
+func (s *mediaDevicesSource) Close() error {
+	s.reader.Close()
+	return s.track.Close()
+}
+
+// mediaDevicesPCMSource adapts a mediadevices audio track to Source,
+// yielding 20ms PCM frames so that the audio can be processed before it is
+// encoded.
+type mediaDevicesPCMSource struct {
+	track    mediadevices.Track
+	reader   mdaudio.Reader
+	rate     int
+	channels int
+	pending  []int16
+	frame    []int16
+}
+
+// NewMediaDevicesPCMSource returns a Source reading the PCM of track.
+func NewMediaDevicesPCMSource(track mediadevices.Track) (Source, error) {
+	audioTrack, ok := track.(*mediadevices.AudioTrack)
+	if !ok {
+		return nil, fmt.Errorf("track is not audio (kind=%s)", track.Kind().String())
+	}
+	return &mediaDevicesPCMSource{track: track, reader: audioTrack.NewReader(false)}, nil
+}
+
+func (s *mediaDevicesPCMSource) ReadAudio() (Frame, error) {
+	for {
+		// Capture drivers deliver chunks of any size, Opus wants 20ms
+		if frameLen := s.rate / 50 * s.channels; frameLen > 0 && len(s.pending) >= frameLen {
+			s.frame = append(s.frame[:0], s.pending[:frameLen]...)
+			s.pending = s.pending[:copy(s.pending, s.pending[frameLen:])]
+			return Frame{PCM: s.frame, SampleRate: s.rate, Channels: s.channels}, nil
+		}
+
+		chunk, release, err := s.reader.Read()
+		if err != nil {
+			return Frame{}, err
+		}
+		info := chunk.ChunkInfo()
+		if info.SamplingRate != s.rate || info.Channels != s.channels {
+			s.rate, s.channels = info.SamplingRate, info.Channels
+			s.pending = s.pending[:0]
+		}
+		if pcm, ok := chunk.(*wave.Int16Interleaved); ok {
+			s.pending = append(s.pending, pcm.Data...)
+		} else {
+			for i := 0; i < info.Len; i++ {
+				for ch := 0; ch < info.Channels; ch++ {
+					sample := wave.Int16SampleFormat.Convert(chunk.At(i, ch)).(wave.Int16Sample)
+					s.pending = append(s.pending, int16(sample))
+				}
+			}
+		}
+		release()
+	}
+}
+
+// Close closes the track.
+func (s *mediaDevicesPCMSource) Close() error {
+	return s.track.Close()
+}
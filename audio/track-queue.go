@@ -0,0 +1,182 @@
+package audio
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// queueTrack is a RemoteTrack fed with packets by the application, so that
+// several writers can read the same remote track or the packets can be
+// delayed.
+type queueTrack struct {
+	codec   webrtc.RTPCodecParameters
+	packets chan *rtp.Packet
+
+	mutex    sync.Mutex
+	deadline time.Time
+	// changed is closed and replaced when the deadline changes
+	changed chan struct{}
+}
+
+func newQueueTrack(codec webrtc.RTPCodecParameters) *queueTrack {
+	return &queueTrack{
+		codec:   codec,
+		packets: make(chan *rtp.Packet, 100),
+		changed: make(chan struct{}),
+	}
+}
+
+func (t *queueTrack) Codec() webrtc.RTPCodecParameters {
+	return t.codec
+}
+
+// ReadRTP returns the next packet, io.EOF once the queue is closed and
+// empty.
+func (t *queueTrack) ReadRTP() (*rtp.Packet, interceptor.Attributes, error) {
+	for {
+		t.mutex.Lock()
+		deadline, changed := t.deadline, t.changed
+		t.mutex.Unlock()
+
+		var expired <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			expired = timer.C
+		}
+
+		select {
+		case p, ok := <-t.packets:
+			if timer != nil {
+				timer.Stop()
+			}
+			if !ok {
+				return nil, nil, io.EOF
+			}
+			return p, nil, nil
+		case <-expired:
+			return nil, nil, os.ErrDeadlineExceeded
+		case <-changed:
+			if timer != nil {
+				timer.Stop()
+			}
+		}
+	}
+}
+
+func (t *queueTrack) SetReadDeadline(deadline time.Time) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.deadline = deadline
+	close(t.changed)
+	t.changed = make(chan struct{})
+	return nil
+}
+
+// push queues a packet, dropping it if the reader is too far behind so that
+// a stalled writer does not stall the others.
+func (t *queueTrack) push(p *rtp.Packet) {
+	select {
+	case t.packets <- p:
+	default:
+	}
+}
+
+// close ends the track once the queued packets are read. There must be no
+// push after it.
+func (t *queueTrack) close() {
+	close(t.packets)
+}
+
+// splitTrack reads track and feeds its packets to n queueTracks, until track
+// ends.
+func splitTrack(track RemoteTrack, n int) []*queueTrack {
+	queues := make([]*queueTrack, n)
+	for i := range queues {
+		queues[i] = newQueueTrack(track.Codec())
+	}
+	go func() {
+		defer func() {
+			for _, q := range queues {
+				q.close()
+			}
+		}()
+		for {
+			p, _, err := track.ReadRTP()
+			if err != nil {
+				return
+			}
+			for _, q := range queues {
+				q.push(p)
+			}
+		}
+	}()
+	return queues
+}
+
+// DelayTrack returns a track replaying the packets of track delay after
+// they arrived, e.g. to simulate an echo.
+func DelayTrack(track RemoteTrack, delay time.Duration) RemoteTrack {
+	type arrival struct {
+		at     time.Time
+		packet *rtp.Packet
+	}
+	// Large enough for a few seconds of 20ms packets
+	arrivals := make(chan arrival, 500)
+	go func() {
+		defer close(arrivals)
+		for {
+			p, _, err := track.ReadRTP()
+			if err != nil {
+				return
+			}
+			select {
+			case arrivals <- arrival{time.Now(), p}:
+			default:
+			}
+		}
+	}()
+
+	queue := newQueueTrack(track.Codec())
+	go func() {
+		defer queue.close()
+		for a := range arrivals {
+			time.Sleep(time.Until(a.at.Add(delay)))
+			queue.push(a.packet)
+		}
+	}()
+	return queue
+}
+
+// MultiWriter writes a remote track to several writers, e.g. a player and a
+// TrackRecorder.
+type MultiWriter []TrackWriter
+
+func (w MultiWriter) WriteWebRTCTrack(track RemoteTrack) error {
+	if len(w) == 1 {
+		return w[0].WriteWebRTCTrack(track)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(w))
+	for i, queue := range splitTrack(track, len(w)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = w[i].WriteWebRTCTrack(queue)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package audio
+
+import (
+	"log/slog"
+	"math"
+	"time"
+
+	"exp-openai-webrtc-streaming/internal/logging"
+)
+
+// VADOptions configures the local voice activity detection. Zero values
+// select the defaults.
+type VADOptions struct {
+	// ThresholdDB is how far above the noise floor a frame must be to count
+	// as speech. Defaults to 12dB.
+	ThresholdDB float64
+	// MinLevelDB is the level, in dBFS, below which a frame is never speech.
+	// Defaults to -50dBFS.
+	MinLevelDB float64
+	// MinSpeech is how long speech must last before OnSpeechStart is called.
+	// Defaults to 60ms.
+	MinSpeech time.Duration
+	// Hangover is how long silence must last before speech is considered
+	// over, so that pauses between words are still sent. Defaults to 500ms.
+	Hangover time.Duration
+
+	// OnSpeechStart and OnSpeechStop are called from the goroutine reading
+	// the source and must not block.
+	OnSpeechStart func()
+	OnSpeechStop  func()
+
+	Logger *slog.Logger
+}
+
+// VAD is an energy-based voice activity detector. It tracks the noise floor
+// and considers frames well above it as speech.
+type VAD struct {
+	opts VADOptions
+	log  *slog.Logger
+
+	noiseFloor float64 // dBFS
+	// voiced and unvoiced are how long the level has been above or below
+	// the threshold
+	voiced   time.Duration
+	unvoiced time.Duration
+	speaking bool
+}
+
+// NewVAD returns a VAD with opts, starting in silence.
+func NewVAD(opts VADOptions) *VAD {
+	if opts.ThresholdDB == 0 {
+		opts.ThresholdDB = 12
+	}
+	if opts.MinLevelDB == 0 {
+		opts.MinLevelDB = -50
+	}
+	if opts.MinSpeech == 0 {
+		opts.MinSpeech = 60 * time.Millisecond
+	}
+	if opts.Hangover == 0 {
+		opts.Hangover = 500 * time.Millisecond
+	}
+	return &VAD{
+		opts:       opts,
+		log:        logging.Component(opts.Logger, "vad"),
+		noiseFloor: math.NaN(),
+		// nothing is sent until the first speech
+		unvoiced: opts.Hangover,
+	}
+}
+
+// Process analyzes one frame of interleaved PCM and returns whether it
+// should be sent. Frames are sent as soon as they are above the threshold,
+// so that the start of an utterance is not cut, and until Hangover after
+// the last one.
+func (v *VAD) Process(pcm []int16, sampleRate, channels int) bool {
+	if len(pcm) == 0 {
+		return v.speaking
+	}
+	duration := time.Duration(len(pcm)/channels) * time.Second / time.Duration(sampleRate)
+	level := levelDBFS(pcm)
+
+	// The floor follows the level down quickly and up slowly, so speech
+	// barely moves it while a change of room noise is picked up in seconds.
+	switch {
+	case math.IsNaN(v.noiseFloor):
+		v.noiseFloor = level
+	case level < v.noiseFloor:
+		v.noiseFloor += (level - v.noiseFloor) * 0.5
+	default:
+		v.noiseFloor += (level - v.noiseFloor) * 0.005
+	}
+
+	voiced := level > v.opts.MinLevelDB && level > v.noiseFloor+v.opts.ThresholdDB
+	if voiced {
+		v.voiced += duration
+		v.unvoiced = 0
+	} else {
+		v.unvoiced += duration
+		v.voiced = 0
+	}
+
+	switch {
+	case !v.speaking && v.voiced >= v.opts.MinSpeech:
+		v.speaking = true
+		v.log.Debug("speech started", "level", level, "noise_floor", v.noiseFloor)
+		if v.opts.OnSpeechStart != nil {
+			v.opts.OnSpeechStart()
+		}
+	case v.speaking && v.unvoiced >= v.opts.Hangover:
+		v.speaking = false
+		v.log.Debug("speech stopped", "level", level, "noise_floor", v.noiseFloor)
+		if v.opts.OnSpeechStop != nil {
+			v.opts.OnSpeechStop()
+		}
+	}
+
+	return voiced || v.speaking || v.unvoiced < v.opts.Hangover
+}
+
+// Speaking reports whether speech is in progress.
+func (v *VAD) Speaking() bool {
+	return v.speaking
+}
+
+// levelDBFS returns the RMS level of pcm relative to full scale.
+func levelDBFS(pcm []int16) float64 {
+	var sum float64
+	for _, s := range pcm {
+		f := float64(s) / 32768
+		sum += f * f
+	}
+	rms := math.Sqrt(sum / float64(len(pcm)))
+	if rms < 1e-6 {
+		return -120
+	}
+	return 20 * math.Log10(rms)
+}
+
+// VADSource gates a Source with a VAD: frames without speech are
+// replaced by digital silence, which Opus encodes in a couple of bytes.
+// Frames already encoded as Opus are passed through.
+type VADSource struct {
+	source  Source
+	vad     *VAD
+	silence []int16
+}
+
+// NewVADSource silences the frames of source without speech, detected by a
+// VAD with opts.
+func NewVADSource(source Source, opts VADOptions) *VADSource {
+	return &VADSource{
+		source: source,
+		vad:    NewVAD(opts),
+	}
+}
+
+func (s *VADSource) ReadAudio() (Frame, error) {
+	frame, err := s.source.ReadAudio()
+	if err != nil || len(frame.PCM) == 0 {
+		return frame, err
+	}
+
+	if !s.vad.Process(frame.PCM, frame.SampleRate, frame.Channels) {
+		if cap(s.silence) < len(frame.PCM) {
+			s.silence = make([]int16, len(frame.PCM))
+		}
+		frame.PCM = s.silence[:len(frame.PCM)]
+	}
+	return frame, nil
+}
+
+// Close closes the wrapped source.
+func (s *VADSource) Close() error {
+	return CloseSource(s.source)
+}
@@ -0,0 +1,620 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"exp-openai-webrtc-streaming/audio"
+	"exp-openai-webrtc-streaming/audio/device"
+	"exp-openai-webrtc-streaming/config"
+	"exp-openai-webrtc-streaming/metrics"
+	"exp-openai-webrtc-streaming/realtime"
+	"exp-openai-webrtc-streaming/redact"
+	"exp-openai-webrtc-streaming/relay"
+	"exp-openai-webrtc-streaming/sip"
+	"exp-openai-webrtc-streaming/tokenserver"
+	"exp-openai-webrtc-streaming/twilio"
+)
+
+// command is a subcommand of the CLI. run parses its flags from args over
+// cfg and returns a *usageError for invalid command lines.
+type command struct {
+	name    string
+	summary string
+	run     func(ctx context.Context, cfg *config.Config, args []string, logger *slog.Logger) error
+}
+
+var commands []command
+
+func init() {
+	// Assigned in init since the usage refers back to commands
+	commands = []command{
+		{"talk", "talk to the model through the microphone and player", runTalk},
+		{"record", "record the microphone to a WAV or Ogg file", runRecord},
+		{"devices", "list the audio devices", runDevices},
+		{"echo", "play the captured audio back after a delay", runEcho},
+		{"loopback", "send the captured audio through a local WebRTC connection and play it", runLoopbackCommand},
+		{"aec-test", "measure the echo canceller on a simulated echo", runAECTest},
+		{"token-server", "mint ephemeral tokens for browser clients over HTTP", runTokenServer},
+		{"relay", "relay the WebRTC calls of browser clients to the API", runRelay},
+		{"sip", "answer SIP phone calls and bridge them to the API", runSIP},
+		{"twilio", "bridge the calls of Twilio Media Streams to the API", runTwilio},
+	}
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+// usageError reports an invalid command line. err is nil when the flag
+// package already printed the problem.
+type usageError struct {
+	err error
+}
+
+func (e *usageError) Error() string {
+	if e.err == nil {
+		return "invalid usage"
+	}
+	return e.err.Error()
+}
+
+// parseFlags parses the flags of a command that takes no arguments.
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return &usageError{}
+	}
+	if fs.NArg() > 0 {
+		return &usageError{fmt.Errorf("%s: unexpected arguments: %q", fs.Name(), fs.Args())}
+	}
+	return nil
+}
+
+// registerAudioFlags binds the flags of the commands capturing and playing
+// audio to a.
+func registerAudioFlags(fs *flag.FlagSet, a *config.AudioConfig) {
+	fs.StringVar(&a.Player, "player", a.Player, "audio player `backend`: "+strings.Join(device.Players(), ", "))
+	fs.StringVar(&a.OutputDevice, "output-device", a.OutputDevice, "output `device` ID or name, portaudio only")
+	fs.StringVar(&a.InputDevice, "input-device", a.InputDevice, "input `device` ID or name")
+	fs.StringVar(&a.InputFile, "input-file", a.InputFile, "replay a WAV, Ogg Opus or raw PCM `file` instead of the microphone")
+	fs.StringVar(&a.InputRTP, "input-rtp", a.InputRTP, "receive plain RTP on the UDP `address` instead of the microphone")
+	fs.StringVar(&a.InputRTPCodec, "input-rtp-codec", a.InputRTPCodec, "`codec` of the RTP input: opus or L16/<rate>/<channels>")
+	fs.StringVar(&a.RTPOutput, "rtp-output", a.RTPOutput, "also send the captured audio as plain RTP to the UDP `address`")
+	fs.StringVar(&a.ModelRTPOutput, "model-rtp-output", a.ModelRTPOutput, "also send the model audio as plain RTP to the UDP `address`")
+	fs.StringVar(&a.Record, "record", a.Record, "record the played audio to a WAV or Ogg `file`")
+	fs.BoolVar(&a.VAD, "vad", a.VAD, "send silence instead of the audio without speech")
+	fs.BoolVar(&a.AEC, "aec", a.AEC, "cancel the echo of the player from the microphone")
+	fs.BoolVar(&a.HighPass, "hpf", a.HighPass, "high-pass filter the captured audio")
+	fs.BoolVar(&a.NoiseSuppression, "ns", a.NoiseSuppression, "suppress the noise of the captured audio")
+	fs.BoolVar(&a.AGC, "agc", a.AGC, "control the gain of the captured audio")
+}
+
+// parseConfigFlags parses the flags of a command and validates cfg with
+// them.
+func parseConfigFlags(fs *flag.FlagSet, cfg *config.Config, args []string) error {
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if err := cfg.Validate(); err != nil {
+		return &usageError{err}
+	}
+	return nil
+}
+
+// parseServerFlags is parseConfigFlags for the commands bridging calls.
+func parseServerFlags(fs *flag.FlagSet, cfg *config.Config, args []string) error {
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if err := cfg.ValidateServer(); err != nil {
+		return &usageError{err}
+	}
+	return nil
+}
+
+func runTalk(ctx context.Context, cfg *config.Config, args []string, logger *slog.Logger) error {
+	fs := flag.NewFlagSet("talk", flag.ContinueOnError)
+	registerAudioFlags(fs, &cfg.Audio)
+	fs.StringVar(&cfg.Model, "model", cfg.Model, "realtime `model`")
+	fs.StringVar(&cfg.Voice, "voice", cfg.Voice, "`voice` of the model")
+	fs.StringVar(&cfg.Instructions, "instructions", cfg.Instructions, "system `prompt` of the session")
+	fs.StringVar(&cfg.Transport, "transport", cfg.Transport, "`transport` of the API: webrtc or websocket")
+	fs.BoolVar(&cfg.ManualTurns, "manual-turns", cfg.ManualTurns, "end the turns with the local VAD instead of the server VAD, requires -vad")
+	fs.StringVar(&cfg.MetricsAddr, "metrics-addr", cfg.MetricsAddr, "serve the metrics on `address`, e.g. :9090")
+	if err := parseConfigFlags(fs, cfg, args); err != nil {
+		return err
+	}
+
+	// The key is only taken from the environment, command lines are visible
+	// to the other users.
+	apiKey := os.Getenv("OPENAI_API_KEY")
+	if apiKey == "" {
+		return errors.New("OPENAI_API_KEY is not set")
+	}
+	c := realtime.NewClient(apiKey)
+	cfg.Apply(c)
+	c.Logger = logger
+
+	serveMetrics(cfg.MetricsAddr, logger)
+
+	ac := &cfg.Audio
+	player, err := ac.OpenPlayer(logger)
+	if err != nil {
+		return fmt.Errorf("failed to create audio player: %w", err)
+	}
+	defer player.Close()
+
+	writer, closeWriter, err := ac.Writer(player, logger)
+	if err != nil {
+		return err
+	}
+	defer closeWriter.Close()
+
+	var onSpeechStop func()
+	if c.ManualTurns {
+		onSpeechStop = func() {
+			if err := c.CommitInputAudio(); err != nil {
+				logger.Warn("failed to commit input audio", "err", err)
+			}
+		}
+	}
+	source, err := ac.OpenSource(player, c.Opus, audio.FileSourceSilence, onSpeechStop, logger)
+	if err != nil {
+		return fmt.Errorf("failed to get audio source: %w", err)
+	}
+	defer audio.CloseSource(source)
+
+	// The deferred calls tear down in order: the connection, the source,
+	// the recorder, which finalizes its file, and the RTP output, then the
+	// player.
+	if err := c.Connect(source, writer); err != nil {
+		return fmt.Errorf("failed to connect to OpenAI Realtime API: %w", err)
+	}
+	defer c.Disconnect()
+	logger.Info("connected to OpenAI Realtime API, interrupt to quit")
+
+	<-ctx.Done()
+	logger.Info("shutting down, interrupt again to quit now")
+	c.StopCapture()
+	drain(cfg.ShutdownTimeout, logger, c, player)
+	return nil
+}
+
+// serveMetrics serves the metrics in the background, only when an address
+// is given.
+func serveMetrics(addr string, logger *slog.Logger) {
+	if addr == "" {
+		return
+	}
+	go func() {
+		if err := metrics.Serve(addr); err != nil {
+			logger.Error("failed to serve metrics", "err", err)
+		}
+	}()
+}
+
+// registerSessionFlags registers the flags of the commands serving many
+// calls, which run them in a realtime.SessionManager.
+func registerSessionFlags(fs *flag.FlagSet, cfg *config.Config, opts *realtime.ManagerOptions) {
+	fs.IntVar(&opts.MaxSessions, "max-sessions", 0, "limit the concurrent calls to `n`, 0 for no limit")
+	fs.DurationVar(&opts.DecodeBudget, "decode-budget", 0, "`time` per second each call may spend decoding the model audio, 0 for no limit")
+	fs.StringVar(&cfg.MetricsAddr, "metrics-addr", cfg.MetricsAddr, "serve the metrics on `address`, e.g. :9090")
+}
+
+// shutdownSessions closes the calls left, for at most timeout.
+func shutdownSessions(sessions *realtime.SessionManager, timeout time.Duration, logger *slog.Logger) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := sessions.Shutdown(ctx); err != nil {
+		logger.Warn("failed to close all the calls", "err", err)
+	}
+	stats := sessions.Stats()
+	logger.Info("served calls", "started", stats.Started, "rejected", stats.Rejected,
+		"decode_time", stats.DecodeTime, "write_time", stats.WriteTime, "skipped_packets", stats.SkippedPackets)
+}
+
+// drainer holds queued audio, e.g. an audio.Player or the realtime.Client.
+type drainer interface {
+	Drain(ctx context.Context) error
+}
+
+// drain lets the drainers pass on or play the audio they have queued, in
+// order, for up to timeout in total.
+func drain(timeout time.Duration, logger *slog.Logger, drainers ...drainer) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, d := range drainers {
+		if err := d.Drain(ctx); err != nil {
+			logger.Warn("stopped waiting for the queued audio", "err", err)
+			return
+		}
+	}
+}
+
+func runRecord(ctx context.Context, cfg *config.Config, args []string, logger *slog.Logger) error {
+	fs := flag.NewFlagSet("record", flag.ContinueOnError)
+	inputDevice := fs.String("input-device", cfg.Audio.InputDevice, "input `device` ID or name")
+	output := fs.String("o", "recording.wav", "output `file`, .wav or .ogg")
+	duration := fs.Duration("duration", 5*time.Second, "how long to record, 0 until interrupted")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	// The format of the decoded Opus audio, 48kHz stereo
+	track, err := device.GetUserMediaTrack(48_000, 2, *inputDevice, audio.DefaultOpusEncoderOptions())
+	if err != nil {
+		return fmt.Errorf("failed to get media track: %w", err)
+	}
+	defer track.Close()
+
+	if err := audio.Record(ctx, track, *duration, *output, logger); err != nil {
+		return fmt.Errorf("failed to record: %w", err)
+	}
+	return nil
+}
+
+func runDevices(ctx context.Context, cfg *config.Config, args []string, logger *slog.Logger) error {
+	fs := flag.NewFlagSet("devices", flag.ContinueOnError)
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	devices, err := device.List()
+	if err != nil {
+		return fmt.Errorf("failed to list audio devices: %w", err)
+	}
+	device.Print(os.Stdout, devices)
+	return nil
+}
+
+// delayedWriter writes the tracks to a player after a delay.
+type delayedWriter struct {
+	writer audio.TrackWriter
+	delay  time.Duration
+}
+
+func (w delayedWriter) WriteWebRTCTrack(track audio.RemoteTrack) error {
+	return w.writer.WriteWebRTCTrack(audio.DelayTrack(track, w.delay))
+}
+
+func runEcho(ctx context.Context, cfg *config.Config, args []string, logger *slog.Logger) error {
+	fs := flag.NewFlagSet("echo", flag.ContinueOnError)
+	registerAudioFlags(fs, &cfg.Audio)
+	delay := fs.Duration("delay", 300*time.Millisecond, "delay of the echo")
+	if err := parseConfigFlags(fs, cfg, args); err != nil {
+		return err
+	}
+	return runLocalAudio(ctx, cfg, *delay, logger)
+}
+
+func runLoopbackCommand(ctx context.Context, cfg *config.Config, args []string, logger *slog.Logger) error {
+	fs := flag.NewFlagSet("loopback", flag.ContinueOnError)
+	registerAudioFlags(fs, &cfg.Audio)
+	if err := parseConfigFlags(fs, cfg, args); err != nil {
+		return err
+	}
+	return runLocalAudio(ctx, cfg, 0, logger)
+}
+
+// runLocalAudio plays the captured audio back through a local WebRTC
+// connection, after delay if it is not zero.
+func runLocalAudio(ctx context.Context, cfg *config.Config, delay time.Duration, logger *slog.Logger) error {
+	ac := &cfg.Audio
+	player, err := ac.OpenPlayer(logger)
+	if err != nil {
+		return fmt.Errorf("failed to create audio player: %w", err)
+	}
+	defer player.Close()
+
+	writer, closeWriter, err := ac.Writer(player, logger)
+	if err != nil {
+		return err
+	}
+	defer closeWriter.Close()
+	if delay > 0 {
+		writer = delayedWriter{writer, delay}
+	}
+
+	source, err := ac.OpenSource(player, cfg.Opus, audio.FileSourceStop, nil, logger)
+	if err != nil {
+		return fmt.Errorf("failed to get audio source: %w", err)
+	}
+	defer audio.CloseSource(source)
+
+	err = realtime.RunLoopback(ctx, source, cfg.Opus, writer, logger)
+	drain(cfg.ShutdownTimeout, logger, player)
+	return err
+}
+
+func runAECTest(ctx context.Context, cfg *config.Config, args []string, logger *slog.Logger) error {
+	var sim audio.EchoSimulation
+	fs := flag.NewFlagSet("aec-test", flag.ContinueOnError)
+	fs.IntVar(&sim.SampleRate, "rate", 24_000, "capture sample `rate`")
+	fs.IntVar(&sim.Channels, "channels", 1, "capture channels")
+	fs.DurationVar(&sim.Delay, "delay", 120*time.Millisecond, "echo delay")
+	fs.BoolVar(&sim.DoubleTalk, "double-talk", false, "add near-end speech during the last quarter")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+
+	report := audio.MeasureAEC(sim, audio.AECOptions{Logger: logger})
+	fmt.Printf("estimated delay: %s (known: %t), ERLE: %.1f dB\n",
+		report.EstimatedDelay, report.DelayKnown, report.ERLE)
+	return nil
+}
+
+func runTokenServer(ctx context.Context, cfg *config.Config, args []string, logger *slog.Logger) error {
+	fs := flag.NewFlagSet("token-server", flag.ContinueOnError)
+	addr := fs.String("addr", ":8080", "listen `address`")
+	path := fs.String("path", "/session", "URL `path` of the endpoint")
+	origins := fs.String("allow-origin", "", "comma-separated `origins` of the browser apps, the app's own included, * for any without cookies")
+	rateLimit := fs.Int("rate", 10, "tokens a user may mint per minute, 0 for no limit")
+	fs.StringVar(&cfg.Model, "model", cfg.Model, "realtime `model` of the sessions")
+	fs.StringVar(&cfg.Voice, "voice", cfg.Voice, "`voice` of the sessions")
+	fs.StringVar(&cfg.Instructions, "instructions", cfg.Instructions, "system `prompt` of the sessions")
+	if err := parseConfigFlags(fs, cfg, args); err != nil {
+		return err
+	}
+
+	apiKey := os.Getenv("OPENAI_API_KEY")
+	if apiKey == "" {
+		return errors.New("OPENAI_API_KEY is not set")
+	}
+	redact.Register(apiKey)
+	// The callers and their bearer tokens, as user=token pairs. Like the
+	// API key, they are kept off the command line.
+	tokens, err := parseUserTokens(os.Getenv("TOKEN_SERVER_USERS"))
+	if err != nil {
+		return fmt.Errorf("TOKEN_SERVER_USERS: %w", err)
+	}
+	if len(tokens) == 0 {
+		return errors.New("TOKEN_SERVER_USERS is not set, want comma-separated user=token pairs")
+	}
+
+	opts := tokenserver.Options{
+		Sessions:     realtime.SessionsEndpoint{Key: redact.Secret(apiKey)},
+		Authenticate: tokenserver.BearerAuth(tokens),
+		DefaultTemplate: realtime.SessionConfig{
+			Model:        cfg.Model,
+			Voice:        cfg.Voice,
+			Instructions: cfg.Instructions,
+			Tools:        cfg.Tools,
+		},
+		RateLimit: *rateLimit,
+		Logger:    logger,
+	}
+	if *origins != "" {
+		opts.AllowedOrigins = strings.Split(*origins, ",")
+	}
+	server, err := tokenserver.New(opts)
+	if err != nil {
+		return &usageError{err}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(*path, server)
+	httpServer := &http.Server{Addr: *addr, Handler: mux}
+	logger.Info("serving tokens", "addr", *addr, "path", *path, "users", len(tokens))
+	return listenAndServe(ctx, httpServer, cfg.ShutdownTimeout, logger)
+}
+
+func runRelay(ctx context.Context, cfg *config.Config, args []string, logger *slog.Logger) error {
+	fs := flag.NewFlagSet("relay", flag.ContinueOnError)
+	addr := fs.String("addr", ":8080", "listen `address`")
+	path := fs.String("path", "/call", "URL `path` receiving the SDP offers")
+	recordDir := fs.String("record-dir", "", "record the calls to Ogg files in `dir`")
+	origins := fs.String("allow-origin", "", "comma-separated `origins` of the browser apps, the app's own included, * for any without cookies")
+	fs.StringVar(&cfg.Model, "model", cfg.Model, "realtime `model` of the calls")
+	fs.StringVar(&cfg.Voice, "voice", cfg.Voice, "`voice` of the calls")
+	fs.StringVar(&cfg.Instructions, "instructions", cfg.Instructions, "system `prompt` of the calls")
+	fs.StringVar(&cfg.Transport, "transport", cfg.Transport, "`transport` of the API: webrtc or websocket")
+	var managerOpts realtime.ManagerOptions
+	registerSessionFlags(fs, cfg, &managerOpts)
+	if err := parseServerFlags(fs, cfg, args); err != nil {
+		return err
+	}
+
+	apiKey := os.Getenv("OPENAI_API_KEY")
+	if apiKey == "" {
+		return errors.New("OPENAI_API_KEY is not set")
+	}
+	redact.Register(apiKey)
+	tokens, err := parseUserTokens(os.Getenv("RELAY_USERS"))
+	if err != nil {
+		return fmt.Errorf("RELAY_USERS: %w", err)
+	}
+	if len(tokens) == 0 {
+		return errors.New("RELAY_USERS is not set, want comma-separated user=token pairs")
+	}
+
+	managerOpts.Logger = logger
+	sessions := realtime.NewSessionManager(managerOpts)
+	defer shutdownSessions(sessions, cfg.ShutdownTimeout, logger)
+	serveMetrics(cfg.MetricsAddr, logger)
+
+	var allowedOrigins []string
+	if *origins != "" {
+		allowedOrigins = strings.Split(*origins, ",")
+	}
+	r, err := relay.New(relay.Options{
+		Authenticate:   tokenserver.BearerAuth(tokens),
+		AllowedOrigins: allowedOrigins,
+		Sessions:       sessions,
+		NewClient: func(user string) (*realtime.Client, error) {
+			c := realtime.NewClient(apiKey)
+			cfg.Apply(c)
+			return c, nil
+		},
+		OnEnd: func(s *relay.Session) {
+			usage := s.Usage()
+			logger.Info("call usage", "session", s.ID, "user", s.User,
+				"duration", usage.Duration, "user_bytes", usage.UserBytes, "model_bytes", usage.ModelBytes,
+				"input_tokens", usage.InputTokens, "output_tokens", usage.OutputTokens)
+		},
+		RecordDir: *recordDir,
+		Logger:    logger,
+	})
+	if err != nil {
+		return &usageError{err}
+	}
+	defer r.Close()
+
+	mux := http.NewServeMux()
+	mux.Handle(*path, r)
+	httpServer := &http.Server{Addr: *addr, Handler: mux}
+	logger.Info("relaying calls", "addr", *addr, "path", *path, "users", len(tokens))
+	return listenAndServe(ctx, httpServer, cfg.ShutdownTimeout, logger)
+}
+
+func runSIP(ctx context.Context, cfg *config.Config, args []string, logger *slog.Logger) error {
+	fs := flag.NewFlagSet("sip", flag.ContinueOnError)
+	addr := fs.String("addr", ":5060", "UDP `address` of the SIP signaling")
+	mediaIP := fs.String("media-ip", "", "`address` announced for the RTP, by default the one routing to the caller")
+	fs.StringVar(&cfg.Model, "model", cfg.Model, "realtime `model` of the calls")
+	fs.StringVar(&cfg.Voice, "voice", cfg.Voice, "`voice` of the calls")
+	fs.StringVar(&cfg.Instructions, "instructions", cfg.Instructions, "system `prompt` of the calls")
+	fs.StringVar(&cfg.Transport, "transport", cfg.Transport, "`transport` of the API: webrtc or websocket")
+	var managerOpts realtime.ManagerOptions
+	registerSessionFlags(fs, cfg, &managerOpts)
+	if err := parseServerFlags(fs, cfg, args); err != nil {
+		return err
+	}
+	var ip net.IP
+	if *mediaIP != "" {
+		if ip = net.ParseIP(*mediaIP); ip == nil {
+			return &usageError{fmt.Errorf("invalid -media-ip %q", *mediaIP)}
+		}
+	}
+
+	apiKey := os.Getenv("OPENAI_API_KEY")
+	if apiKey == "" {
+		return errors.New("OPENAI_API_KEY is not set")
+	}
+	redact.Register(apiKey)
+
+	managerOpts.Logger = logger
+	sessions := realtime.NewSessionManager(managerOpts)
+	defer shutdownSessions(sessions, cfg.ShutdownTimeout, logger)
+	serveMetrics(cfg.MetricsAddr, logger)
+
+	ua, err := sip.Listen(sip.Options{
+		Addr:     *addr,
+		MediaIP:  ip,
+		Sessions: sessions,
+		NewClient: func(call *sip.Call) (*realtime.Client, error) {
+			c := realtime.NewClient(apiKey)
+			cfg.Apply(c)
+			return c, nil
+		},
+		Logger: logger,
+	})
+	if err != nil {
+		return err
+	}
+	<-ctx.Done()
+	return ua.Close()
+}
+
+func runTwilio(ctx context.Context, cfg *config.Config, args []string, logger *slog.Logger) error {
+	fs := flag.NewFlagSet("twilio", flag.ContinueOnError)
+	addr := fs.String("addr", ":8080", "listen `address`")
+	path := fs.String("path", "/media", "URL `path` of the Media Streams WebSockets")
+	publicURL := fs.String("public-url", "", "`URL` of the streams as configured at Twilio, signed by Twilio; by default rebuilt from the requests")
+	fs.StringVar(&cfg.Model, "model", cfg.Model, "realtime `model` of the calls")
+	fs.StringVar(&cfg.Voice, "voice", cfg.Voice, "`voice` of the calls")
+	fs.StringVar(&cfg.Instructions, "instructions", cfg.Instructions, "system `prompt` of the calls")
+	fs.StringVar(&cfg.Transport, "transport", cfg.Transport, "`transport` of the API: webrtc or websocket")
+	var managerOpts realtime.ManagerOptions
+	registerSessionFlags(fs, cfg, &managerOpts)
+	if err := parseServerFlags(fs, cfg, args); err != nil {
+		return err
+	}
+
+	apiKey := os.Getenv("OPENAI_API_KEY")
+	if apiKey == "" {
+		return errors.New("OPENAI_API_KEY is not set")
+	}
+	redact.Register(apiKey)
+	authToken := os.Getenv("TWILIO_AUTH_TOKEN")
+	if authToken == "" {
+		return errors.New("TWILIO_AUTH_TOKEN is not set")
+	}
+	redact.Register(authToken)
+
+	managerOpts.Logger = logger
+	sessions := realtime.NewSessionManager(managerOpts)
+	defer shutdownSessions(sessions, cfg.ShutdownTimeout, logger)
+	serveMetrics(cfg.MetricsAddr, logger)
+
+	b, err := twilio.New(twilio.Options{
+		Authenticate: twilio.SignatureAuth(authToken, *publicURL),
+		Sessions:     sessions,
+		NewClient: func(call *twilio.Call) (*realtime.Client, error) {
+			c := realtime.NewClient(apiKey)
+			cfg.Apply(c)
+			return c, nil
+		},
+		Logger: logger,
+	})
+	if err != nil {
+		return &usageError{err}
+	}
+	defer b.Close()
+
+	mux := http.NewServeMux()
+	mux.Handle(*path, b)
+	httpServer := &http.Server{Addr: *addr, Handler: mux}
+	logger.Info("bridging streams", "addr", *addr, "path", *path)
+	return listenAndServe(ctx, httpServer, cfg.ShutdownTimeout, logger)
+}
+
+// listenAndServe serves until ctx is done, then shuts the server down,
+// waiting up to timeout for the requests in progress.
+func listenAndServe(ctx context.Context, server *http.Server, timeout time.Duration, logger *slog.Logger) error {
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logger.Warn("failed to drain the requests", "err", err)
+			server.Close()
+		}
+	}()
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// parseUserTokens parses comma-separated user=token pairs.
+func parseUserTokens(s string) (map[string]string, error) {
+	tokens := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		user, token, ok := strings.Cut(pair, "=")
+		if !ok || user == "" || token == "" {
+			return nil, fmt.Errorf("want user=token pairs")
+		}
+		redact.Register(token)
+		tokens[user] = token
+	}
+	return tokens, nil
+}
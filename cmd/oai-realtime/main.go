@@ -0,0 +1,114 @@
+// Command oai-realtime talks to the OpenAI Realtime API through the
+// microphone and the speakers, and tests the audio pipeline locally.
+//
+// It builds with CGO_ENABLED=0, without the microphone, libopus and the
+// players needing cgo, see the device package for the build tags. Such
+// builds play to the file and null players, and only decode SILK.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"text/tabwriter"
+
+	"exp-openai-webrtc-streaming/config"
+	"exp-openai-webrtc-streaming/internal/logging"
+)
+
+// Exit codes
+const (
+	exitOK    = 0
+	exitError = 1
+	exitUsage = 2
+)
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+// run runs the command line args and returns the exit code.
+func run(args []string) int {
+	fs := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+	configPath := fs.String("config", os.Getenv("OAI_CONFIG"), "YAML config `file`, see config.example.yaml")
+	logLevel := fs.String("log-level", "", "log `level`: debug, info, warn or error")
+	fs.Usage = func() { printUsage(fs) }
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return exitOK
+		}
+		return exitUsage
+	}
+
+	cfg, err := config.Load(*configPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid config:", err)
+		return exitUsage
+	}
+	if *logLevel != "" {
+		cfg.LogLevel = *logLevel
+	}
+	logger, err := logging.New(os.Stderr, cfg.LogLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitUsage
+	}
+	slog.SetDefault(logger)
+
+	// Without a command, talk to the model as before there were any.
+	name, cmdArgs := "talk", fs.Args()
+	if len(cmdArgs) > 0 {
+		name, cmdArgs = cmdArgs[0], cmdArgs[1:]
+	}
+	cmd := findCommand(name)
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		printUsage(fs)
+		return exitUsage
+	}
+
+	// SIGINT and SIGTERM end the command, which then cleans up and exits
+	// successfully. A second signal kills the process if the clean up
+	// hangs.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	err = cmd.run(ctx, cfg, cmdArgs, logger)
+	var usageErr *usageError
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, flag.ErrHelp):
+		return exitOK
+	case errors.As(err, &usageErr):
+		if usageErr.err != nil {
+			fmt.Fprintln(os.Stderr, usageErr.err)
+		}
+		return exitUsage
+	default:
+		logger.Error(cmd.name+" failed", "err", err)
+		return exitError
+	}
+}
+
+func printUsage(fs *flag.FlagSet) {
+	w := fs.Output()
+	fmt.Fprintf(w, "usage: %s [-config file] [-log-level level] [command] [flags]\n\ncommands:\n", fs.Name())
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, cmd := range commands {
+		fmt.Fprintf(tw, "  %s\t%s\n", cmd.name, cmd.summary)
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "\nThe default command is talk. Run a command with -h for its flags.\n\nflags:\n")
+	fs.PrintDefaults()
+}
@@ -0,0 +1,366 @@
+// Package config loads the deployment profiles of the client from YAML
+// files and the environment, see config.example.yaml.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"gopkg.in/yaml.v3"
+
+	"exp-openai-webrtc-streaming/audio"
+	"exp-openai-webrtc-streaming/audio/device"
+	"exp-openai-webrtc-streaming/realtime"
+	"exp-openai-webrtc-streaming/redact"
+)
+
+// Config is a deployment profile, loaded from a YAML file with Load.
+// Every field is optional; config.example.yaml documents the schema, the
+// defaults and the environment variables overriding each field, see
+// configEnv. The command line flags override both. The API key is only read
+// from OPENAI_API_KEY, so that profiles can be checked in.
+type Config struct {
+	Model        string          `yaml:"model"`
+	Voice        string          `yaml:"voice"`
+	Instructions string          `yaml:"instructions"`
+	Tools        []realtime.Tool `yaml:"tools"`
+	ManualTurns  bool            `yaml:"manual_turns"`
+	// Transport is webrtc or websocket, see realtime.Transport.
+	Transport   string            `yaml:"transport"`
+	ICEServers  []ICEServerConfig `yaml:"ice_servers"`
+	MetricsAddr string            `yaml:"metrics_addr"`
+	LogLevel    string            `yaml:"log_level"`
+	// ShutdownTimeout bounds how long the queued model audio may play after
+	// an interrupt, and how long the servers may take to drain their
+	// requests and close their calls.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
+	Audio AudioConfig              `yaml:"audio"`
+	Opus  audio.OpusEncoderOptions `yaml:"opus"`
+}
+
+// ICEServerConfig is a STUN or TURN server.
+type ICEServerConfig struct {
+	URLs       []string `yaml:"urls"`
+	Username   string   `yaml:"username"`
+	Credential string   `yaml:"credential"`
+}
+
+// AudioConfig selects the audio devices and processing.
+type AudioConfig struct {
+	// Player is the player backend, see device.Players.
+	Player       string `yaml:"player"`
+	InputDevice  string `yaml:"input_device"`
+	OutputDevice string `yaml:"output_device"`
+	// InputFile replays a recording instead of using the microphone.
+	InputFile string `yaml:"input_file"`
+	// InputRTP receives the user audio as plain RTP on a UDP address instead
+	// of using the microphone, encoded as InputRTPCodec, see
+	// audio.RTPSourceOptions.
+	InputRTP      string `yaml:"input_rtp"`
+	InputRTPCodec string `yaml:"input_rtp_codec"`
+	// RTPOutput also sends the user audio as plain RTP/Opus to a UDP address,
+	// ModelRTPOutput the model audio.
+	RTPOutput      string `yaml:"rtp_output"`
+	ModelRTPOutput string `yaml:"model_rtp_output"`
+	// Record records the played audio.
+	Record string `yaml:"record"`
+
+	// Buffer, Prebuffer and DeviceBuffer size the player buffers, see
+	// PlayerOptions.
+	Buffer       time.Duration `yaml:"buffer"`
+	Prebuffer    time.Duration `yaml:"prebuffer"`
+	DeviceBuffer time.Duration `yaml:"device_buffer"`
+
+	VAD              bool `yaml:"vad"`
+	AEC              bool `yaml:"aec"`
+	HighPass         bool `yaml:"high_pass"`
+	NoiseSuppression bool `yaml:"noise_suppression"`
+	AGC              bool `yaml:"agc"`
+}
+
+// Default returns the configuration used without a file, with the defaults
+// of realtime.Client.
+func Default() *Config {
+	c := realtime.NewClient("")
+	cfg := &Config{
+		Model:     c.Model,
+		Voice:     c.Voice,
+		Transport: string(c.Transport),
+		Audio:     AudioConfig{Player: device.DefaultPlayer()},
+		Opus:      c.Opus,
+
+		ShutdownTimeout: 5 * time.Second,
+	}
+	for _, server := range c.ICEServers {
+		cfg.ICEServers = append(cfg.ICEServers, ICEServerConfig{URLs: server.URLs})
+	}
+	return cfg
+}
+
+// Load reads the configuration at path over the defaults, applies the
+// environment overrides and validates the result. An empty path only
+// applies the environment to the defaults.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open config: %w", err)
+		}
+		defer f.Close()
+		if err := cfg.decode(f); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	if err := cfg.applyEnv(os.Getenv); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// decode reads YAML into cfg, rejecting unknown fields.
+func (cfg *Config) decode(r io.Reader) error {
+	decoder := yaml.NewDecoder(r)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// configEnv maps the environment variables to the fields they override.
+func configEnv(cfg *Config) (strs map[string]*string, bools map[string]*bool, ints map[string]*int, durations map[string]*time.Duration) {
+	strs = map[string]*string{
+		"OPENAI_MODEL":        &cfg.Model,
+		"OPENAI_VOICE":        &cfg.Voice,
+		"OPENAI_INSTRUCTIONS": &cfg.Instructions,
+		"OPENAI_TRANSPORT":    &cfg.Transport,
+		"METRICS_ADDR":        &cfg.MetricsAddr,
+		"LOG_LEVEL":           &cfg.LogLevel,
+		"AUDIO_PLAYER":        &cfg.Audio.Player,
+		"INPUT_DEVICE":        &cfg.Audio.InputDevice,
+		"OUTPUT_DEVICE":       &cfg.Audio.OutputDevice,
+		"INPUT_FILE":          &cfg.Audio.InputFile,
+		"INPUT_RTP":           &cfg.Audio.InputRTP,
+		"INPUT_RTP_CODEC":     &cfg.Audio.InputRTPCodec,
+		"RTP_OUTPUT":          &cfg.Audio.RTPOutput,
+		"MODEL_RTP_OUTPUT":    &cfg.Audio.ModelRTPOutput,
+	}
+	bools = map[string]*bool{
+		"MANUAL_TURNS": &cfg.ManualTurns,
+		"LOCAL_VAD":    &cfg.Audio.VAD,
+		"AEC":          &cfg.Audio.AEC,
+		"CAPTURE_HPF":  &cfg.Audio.HighPass,
+		"CAPTURE_NS":   &cfg.Audio.NoiseSuppression,
+		"CAPTURE_AGC":  &cfg.Audio.AGC,
+		"OPUS_DTX":     &cfg.Opus.DTX,
+		"OPUS_FEC":     &cfg.Opus.InBandFEC,
+	}
+	ints = map[string]*int{
+		"OPUS_BITRATE":     &cfg.Opus.Bitrate,
+		"OPUS_COMPLEXITY":  &cfg.Opus.Complexity,
+		"OPUS_PACKET_LOSS": &cfg.Opus.PacketLossPercent,
+	}
+	durations = map[string]*time.Duration{
+		"AUDIO_BUFFER":        &cfg.Audio.Buffer,
+		"AUDIO_PREBUFFER":     &cfg.Audio.Prebuffer,
+		"AUDIO_DEVICE_BUFFER": &cfg.Audio.DeviceBuffer,
+		"OPUS_FRAME_DURATION": &cfg.Opus.FrameDuration,
+		"SHUTDOWN_TIMEOUT":    &cfg.ShutdownTimeout,
+	}
+	return strs, bools, ints, durations
+}
+
+// applyEnv overrides cfg with the environment variables of configEnv that
+// are set, as returned by getenv.
+func (cfg *Config) applyEnv(getenv func(string) string) error {
+	strs, bools, ints, durations := configEnv(cfg)
+	for name, field := range strs {
+		if v := getenv(name); v != "" {
+			*field = v
+		}
+	}
+	for name, field := range bools {
+		if v := getenv(name); v != "" {
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return fmt.Errorf("%s: invalid boolean %q", name, v)
+			}
+			*field = b
+		}
+	}
+	for name, field := range ints {
+		if v := getenv(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("%s: invalid integer %q", name, v)
+			}
+			*field = n
+		}
+	}
+	for name, field := range durations {
+		if v := getenv(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("%s: invalid duration %q", name, v)
+			}
+			*field = d
+		}
+	}
+	return nil
+}
+
+// Validate checks the configuration. The errors name the bad field as in
+// the config file.
+func (cfg *Config) Validate() error {
+	if cfg.Model == "" {
+		return errors.New("model: must not be empty")
+	}
+	if cfg.Voice == "" {
+		return errors.New("voice: must not be empty")
+	}
+	switch realtime.Transport(cfg.Transport) {
+	case realtime.TransportWebRTC, realtime.TransportWebSocket:
+	default:
+		return fmt.Errorf("transport: unknown transport %q, want webrtc or websocket", cfg.Transport)
+	}
+	for i, tool := range cfg.Tools {
+		if tool.Name == "" {
+			return fmt.Errorf("tools[%d].name: must not be empty", i)
+		}
+		if t, ok := tool.Parameters["type"]; ok && t != "object" {
+			return fmt.Errorf("tools[%d].parameters.type: must be object, not %v", i, t)
+		}
+	}
+	for i, server := range cfg.ICEServers {
+		if len(server.URLs) == 0 {
+			return fmt.Errorf("ice_servers[%d].urls: must not be empty", i)
+		}
+		for j, u := range server.URLs {
+			if !strings.HasPrefix(u, "stun:") && !strings.HasPrefix(u, "stuns:") &&
+				!strings.HasPrefix(u, "turn:") && !strings.HasPrefix(u, "turns:") {
+				return fmt.Errorf("ice_servers[%d].urls[%d]: %q is not a stun or turn URL", i, j, u)
+			}
+		}
+	}
+	if cfg.LogLevel != "" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(strings.ToLower(cfg.LogLevel))); err != nil {
+			return fmt.Errorf("log_level: invalid level %q", cfg.LogLevel)
+		}
+	}
+	if cfg.ShutdownTimeout < 0 {
+		return errors.New("shutdown_timeout: must not be negative")
+	}
+	if cfg.ManualTurns && !cfg.Audio.VAD {
+		return errors.New("manual_turns: requires audio.vad")
+	}
+	if err := cfg.Audio.validate(); err != nil {
+		return fmt.Errorf("audio.%w", err)
+	}
+	if err := cfg.Opus.Validate(); err != nil {
+		return fmt.Errorf("opus.%w", err)
+	}
+	return nil
+}
+
+// ValidateServer checks the configuration of a server bridging calls to the
+// API, like Validate. The servers have no local VAD to end the turns, so
+// they reject manual_turns.
+func (cfg *Config) ValidateServer() error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	if cfg.ManualTurns {
+		return errors.New("manual_turns: not supported by the servers, the calls need the server VAD")
+	}
+	return nil
+}
+
+func (a *AudioConfig) validate() error {
+	if !slices.Contains(device.Players(), a.Player) {
+		return fmt.Errorf("player: unknown backend %q, want %s", a.Player, strings.Join(device.Players(), ", "))
+	}
+	if a.OutputDevice != "" && !device.SelectsDevice(a.Player) {
+		return fmt.Errorf("output_device: %s cannot select an output device, use portaudio or file", a.Player)
+	}
+	if a.Player == "file" && a.OutputDevice == "" {
+		return fmt.Errorf("output_device: the file player needs the file to write")
+	}
+	if a.InputRTP != "" && a.InputFile != "" {
+		return errors.New("input_rtp: cannot be used with input_file")
+	}
+	if err := (audio.RTPSourceOptions{Codec: a.InputRTPCodec}).Validate(); err != nil {
+		return fmt.Errorf("input_rtp_codec: %w", err)
+	}
+	durations := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"buffer", a.Buffer},
+		{"prebuffer", a.Prebuffer},
+		{"device_buffer", a.DeviceBuffer},
+	}
+	for _, d := range durations {
+		if d.value < 0 {
+			return fmt.Errorf("%s: must not be negative", d.name)
+		}
+	}
+	if err := a.PlayerOptions(nil).Validate(); err != nil {
+		return fmt.Errorf("prebuffer: %w", err)
+	}
+	return nil
+}
+
+// Apply configures the client, except for its key.
+func (cfg *Config) Apply(c *realtime.Client) {
+	c.Model = cfg.Model
+	c.Voice = cfg.Voice
+	c.Instructions = cfg.Instructions
+	c.Tools = cfg.Tools
+	c.ManualTurns = cfg.ManualTurns
+	c.Transport = realtime.Transport(cfg.Transport)
+	c.Opus = cfg.Opus
+	c.ICEServers = nil
+	for _, server := range cfg.ICEServers {
+		s := webrtc.ICEServer{URLs: server.URLs, Username: server.Username}
+		if server.Credential != "" {
+			redact.Register(server.Credential)
+			s.Credential = server.Credential
+		}
+		c.ICEServers = append(c.ICEServers, s)
+	}
+}
+
+// PlayerOptions returns the options of the player.
+func (a *AudioConfig) PlayerOptions(logger *slog.Logger) audio.PlayerOptions {
+	return audio.PlayerOptions{
+		Device:       a.OutputDevice,
+		Buffer:       a.Buffer,
+		Prebuffer:    a.Prebuffer,
+		DeviceBuffer: a.DeviceBuffer,
+		Logger:       logger,
+	}
+}
+
+// CaptureProcessing returns the options of the capture processing.
+func (a *AudioConfig) CaptureProcessing(logger *slog.Logger) audio.CaptureProcessingOptions {
+	return audio.CaptureProcessingOptions{
+		HighPass:         a.HighPass,
+		NoiseSuppression: a.NoiseSuppression,
+		AGC:              a.AGC,
+		Logger:           logger,
+	}
+}
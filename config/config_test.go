@@ -0,0 +1,123 @@
+package config
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"exp-openai-webrtc-streaming/realtime"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(cfg *Config)
+		// wantErr is the start of the error, the field, empty if valid
+		wantErr string
+	}{
+		{"default", func(cfg *Config) {}, ""},
+		{"websocket", func(cfg *Config) { cfg.Transport = "websocket" }, ""},
+		{"no model", func(cfg *Config) { cfg.Model = "" }, "model:"},
+		{"no voice", func(cfg *Config) { cfg.Voice = "" }, "voice:"},
+		{"transport", func(cfg *Config) { cfg.Transport = "udp" }, "transport:"},
+		{"tool without name", func(cfg *Config) { cfg.Tools = []realtime.Tool{{Description: "x"}} }, "tools[0].name:"},
+		{"tool parameters", func(cfg *Config) {
+			cfg.Tools = []realtime.Tool{{Name: "f", Parameters: map[string]any{"type": "string"}}}
+		}, "tools[0].parameters.type:"},
+		{"ice server without urls", func(cfg *Config) { cfg.ICEServers = []ICEServerConfig{{}} }, "ice_servers[0].urls:"},
+		{"ice server url", func(cfg *Config) {
+			cfg.ICEServers = []ICEServerConfig{{URLs: []string{"stun:a", "http://b"}}}
+		}, "ice_servers[0].urls[1]:"},
+		{"log level", func(cfg *Config) { cfg.LogLevel = "loud" }, "log_level:"},
+		{"log level case", func(cfg *Config) { cfg.LogLevel = "DEBUG" }, ""},
+		{"shutdown timeout", func(cfg *Config) { cfg.ShutdownTimeout = -time.Second }, "shutdown_timeout:"},
+		{"manual turns without vad", func(cfg *Config) { cfg.ManualTurns = true }, "manual_turns:"},
+		{"manual turns", func(cfg *Config) { cfg.ManualTurns, cfg.Audio.VAD = true, true }, ""},
+		{"player", func(cfg *Config) { cfg.Audio.Player = "speaker" }, "audio.player:"},
+		{"file player without file", func(cfg *Config) { cfg.Audio.Player = "file" }, "audio.output_device:"},
+		{"rtp and file input", func(cfg *Config) {
+			cfg.Audio.InputRTP, cfg.Audio.InputFile = ":5004", "in.wav"
+		}, "audio.input_rtp:"},
+		{"negative buffer", func(cfg *Config) { cfg.Audio.Buffer = -time.Millisecond }, "audio.buffer:"},
+		{"prebuffer", func(cfg *Config) {
+			cfg.Audio.Buffer, cfg.Audio.Prebuffer = 100*time.Millisecond, 200*time.Millisecond
+		}, "audio.prebuffer:"},
+		{"buffer below a frame", func(cfg *Config) { cfg.Audio.Buffer = 20 * time.Millisecond }, "audio.prebuffer:"},
+		{"buffer below the default prebuffer", func(cfg *Config) { cfg.Audio.Buffer = 40 * time.Millisecond }, "audio.prebuffer:"},
+		{"prebuffer above the high water mark", func(cfg *Config) {
+			cfg.Audio.Buffer, cfg.Audio.Prebuffer = 100*time.Millisecond, 90*time.Millisecond
+		}, "audio.prebuffer:"},
+		{"prebuffer without buffer", func(cfg *Config) { cfg.Audio.Prebuffer = 400 * time.Millisecond }, "audio.prebuffer:"},
+		{"small buffer", func(cfg *Config) {
+			cfg.Audio.Buffer, cfg.Audio.Prebuffer = 150*time.Millisecond, 40*time.Millisecond
+		}, ""},
+		{"opus", func(cfg *Config) { cfg.Opus.Complexity = 11 }, "opus.complexity:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			tt.modify(cfg)
+			err := cfg.Validate()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("unexpected error %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.wantErr)):
+				t.Errorf("got error %v, want %s...", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateServer(t *testing.T) {
+	cfg := Default()
+	if err := cfg.ValidateServer(); err != nil {
+		t.Fatalf("default: %v", err)
+	}
+	cfg.ManualTurns, cfg.Audio.VAD = true, true
+	if err := cfg.ValidateServer(); err == nil || !strings.HasPrefix(err.Error(), "manual_turns:") {
+		t.Errorf("manual turns: got error %v", err)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		check   func(cfg *Config) bool
+		wantErr string
+	}{
+		{"string", map[string]string{"OPENAI_VOICE": "alloy"}, func(cfg *Config) bool { return cfg.Voice == "alloy" }, ""},
+		{"bool", map[string]string{"OPUS_DTX": "true"}, func(cfg *Config) bool { return cfg.Opus.DTX }, ""},
+		{"int", map[string]string{"OPUS_BITRATE": "16000"}, func(cfg *Config) bool { return cfg.Opus.Bitrate == 16_000 }, ""},
+		{"duration", map[string]string{"SHUTDOWN_TIMEOUT": "2s"}, func(cfg *Config) bool { return cfg.ShutdownTimeout == 2*time.Second }, ""},
+		{"invalid bool", map[string]string{"OPUS_DTX": "maybe"}, nil, "OPUS_DTX:"},
+		{"invalid int", map[string]string{"OPUS_BITRATE": "fast"}, nil, "OPUS_BITRATE:"},
+		{"invalid duration", map[string]string{"SHUTDOWN_TIMEOUT": "5"}, nil, "SHUTDOWN_TIMEOUT:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			err := cfg.applyEnv(func(name string) string { return tt.env[name] })
+			switch {
+			case tt.wantErr != "":
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Errorf("got error %v, want %s...", err, tt.wantErr)
+				}
+			case err != nil:
+				t.Errorf("unexpected error %v", err)
+			case !tt.check(cfg):
+				t.Errorf("environment not applied: %+v", cfg)
+			}
+		})
+	}
+}
+
+func TestLoadExample(t *testing.T) {
+	cfg, err := Load("../config.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if def := Default(); cfg.Model != def.Model || cfg.Opus != def.Opus {
+		t.Errorf("the example changes the defaults: %+v", cfg)
+	}
+}
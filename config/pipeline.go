@@ -0,0 +1,118 @@
+package config
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+
+	"exp-openai-webrtc-streaming/audio"
+	"exp-openai-webrtc-streaming/audio/device"
+)
+
+// useProcessing reports whether a capture processing stage is enabled.
+func (a *AudioConfig) useProcessing() bool {
+	return a.HighPass || a.NoiseSuppression || a.AGC
+}
+
+// OpenPlayer creates the player backend with the player options.
+func (a *AudioConfig) OpenPlayer(logger *slog.Logger) (audio.Player, error) {
+	return device.NewPlayer(a.Player, a.PlayerOptions(logger))
+}
+
+// OpenSource opens the input file, the RTP input or the microphone, and
+// chains the enabled processing: echo cancellation of the player output,
+// capture processing and VAD, calling onSpeechStop at the end of speech if it
+// is not nil. The processed audio is also sent to the RTP output.
+func (a *AudioConfig) OpenSource(
+	player audio.Player,
+	opus audio.OpusEncoderOptions,
+	end audio.FileSourceEnd,
+	onSpeechStop func(),
+	logger *slog.Logger,
+) (audio.Source, error) {
+	// mediadevices can only encode with some of the options, the others need
+	// the PCM to be encoded by the audio.Sender.
+	pcm := a.VAD || a.AEC || a.useProcessing() || !opus.MediaDevicesSupported()
+
+	var source audio.Source
+	var err error
+	switch {
+	case a.InputFile != "":
+		source, err = audio.NewFileSource(a.InputFile, audio.FileSourceOptions{End: end, Logger: logger})
+	case a.InputRTP != "":
+		// The Opus packets are sent as they are, unless processed
+		source, err = audio.ListenRTP(a.InputRTP, audio.RTPSourceOptions{
+			Codec:      a.InputRTPCodec,
+			PCM:        a.VAD || a.AEC || a.useProcessing(),
+			SampleRate: audio.SampleRate,
+			Channels:   audio.Channels,
+			Logger:     logger,
+		})
+	default:
+		source, err = device.MicrophoneSource(audio.SampleRate, audio.Channels, a.InputDevice, opus, pcm)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if a.AEC {
+		aec := audio.NewEchoCanceller(audio.AECOptions{Logger: logger})
+		player.SetPlaybackTap(aec)
+		source = audio.NewAECSource(source, aec)
+	}
+	if a.useProcessing() {
+		source = audio.NewProcessingSource(source, audio.NewCaptureProcessor(a.CaptureProcessing(logger)))
+	}
+	if a.VAD {
+		source = audio.NewVADSource(source, audio.VADOptions{OnSpeechStop: onSpeechStop, Logger: logger})
+	}
+	if a.RTPOutput != "" {
+		writer, err := audio.DialRTP(a.RTPOutput, audio.RTPWriterOptions{Opus: opus, Logger: logger})
+		if err != nil {
+			audio.CloseSource(source)
+			return nil, err
+		}
+		source = writer.Tee(source)
+	}
+	return source, nil
+}
+
+// Writer returns the writer of the received audio: the player, plus the
+// recorder and the RTP output if enabled. The closer closes them, but not
+// the player.
+func (a *AudioConfig) Writer(player audio.Player, logger *slog.Logger) (audio.TrackWriter, io.Closer, error) {
+	writers := audio.MultiWriter{player}
+	var closers closers
+	if a.Record != "" {
+		recorder := audio.NewTrackRecorder(logger)
+		if err := recorder.Start(a.Record); err != nil {
+			return nil, nil, err
+		}
+		writers = append(writers, recorder)
+		closers = append(closers, recorder)
+	}
+	if a.ModelRTPOutput != "" {
+		rtpWriter, err := audio.DialRTP(a.ModelRTPOutput, audio.RTPWriterOptions{Logger: logger})
+		if err != nil {
+			closers.Close()
+			return nil, nil, err
+		}
+		writers = append(writers, rtpWriter)
+		closers = append(closers, rtpWriter)
+	}
+	if len(writers) == 1 {
+		return player, closers, nil
+	}
+	return writers, closers, nil
+}
+
+// closers closes the writers of Writer in order.
+type closers []io.Closer
+
+func (c closers) Close() error {
+	var errs []error
+	for _, closer := range c {
+		errs = append(errs, closer.Close())
+	}
+	return errors.Join(errs...)
+}
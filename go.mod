@@ -2,34 +2,45 @@ module exp-openai-webrtc-streaming
 
 go 1.23.4
 
-require github.com/pion/webrtc/v4 v4.0.7
+require (
+	github.com/ebitengine/oto/v3 v3.3.2
+	github.com/gordonklaus/portaudio v0.0.0-20230709114228-aafa478834f5
+	github.com/gorilla/websocket v1.5.3
+	github.com/hraban/opus v0.0.0-20230925203106-0188a62cb302
+	github.com/pion/opus v0.0.0-20240826153031-e8536fe9e4ca
+	github.com/pion/webrtc/v4 v4.0.7
+	github.com/prometheus/client_golang v1.20.5
+	golang.org/x/exp v0.0.0-20190306152737-a1d7652674e8
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/ebitengine/oto/v3 v3.3.2 // indirect
 	github.com/ebitengine/purego v0.8.1 // indirect
 	github.com/gen2brain/malgo v0.11.23 // indirect
 	github.com/go-audio/riff v1.0.0 // indirect
-	github.com/gordonklaus/portaudio v0.0.0-20230709114228-aafa478834f5 // indirect
 	github.com/hajimehoshi/oto v1.0.1 // indirect
-	github.com/hraban/opus v0.0.0-20230925203106-0188a62cb302 // indirect
+	github.com/klauspost/compress v1.17.9 // indirect
+	github.com/munnerz/goautoneg v0.0.0-20191010083416-a7dc8b61c822 // indirect
 	github.com/pion/dtls/v2 v2.2.12 // indirect
 	github.com/pion/ice/v2 v2.3.36 // indirect
 	github.com/pion/mdns v0.0.12 // indirect
-	github.com/pion/opus v0.0.0-20240826153031-e8536fe9e4ca // indirect
 	github.com/pion/srtp/v2 v2.0.20 // indirect
 	github.com/pion/stun v0.6.1 // indirect
 	github.com/pion/transport/v2 v2.2.10 // indirect
 	github.com/pion/turn/v2 v2.1.6 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/prometheus/client_model v0.6.1 // indirect
+	github.com/prometheus/common v0.55.0 // indirect
+	github.com/prometheus/procfs v0.15.1 // indirect
 	github.com/stretchr/testify v1.10.0 // indirect
 	github.com/viert/lame v0.0.0-20190823071122-49a063e7d5e6 // indirect
 	github.com/xiph/ogg v1.3.5 // indirect
-	golang.org/x/exp v0.0.0-20190306152737-a1d7652674e8 // indirect
 	golang.org/x/image v0.23.0 // indirect
 	golang.org/x/mobile v0.0.0-20190415191353-3e0bab5405d6 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
-	mccoy.space/g/ogg v0.0.0-20221103053400-1ea94e6f3152 // indirect
+	google.golang.org/protobuf v1.34.2 // indirect
 )
 
 require (
@@ -39,13 +50,13 @@ require (
 	github.com/pion/datachannel v1.5.10 // indirect
 	github.com/pion/dtls/v3 v3.0.4 // indirect
 	github.com/pion/ice/v4 v4.0.3 // indirect
-	github.com/pion/interceptor v0.1.37 // indirect
+	github.com/pion/interceptor v0.1.37
 	github.com/pion/logging v0.2.2 // indirect
 	github.com/pion/mdns/v2 v2.0.7 // indirect
 	github.com/pion/mediadevices v0.7.0
 	github.com/pion/randutil v0.1.0 // indirect
-	github.com/pion/rtcp v1.2.15 // indirect
-	github.com/pion/rtp v1.8.10 // indirect
+	github.com/pion/rtcp v1.2.15
+	github.com/pion/rtp v1.8.10
 	github.com/pion/sctp v1.8.35 // indirect
 	github.com/pion/sdp/v3 v3.0.9 // indirect
 	github.com/pion/srtp/v3 v3.0.4 // indirect
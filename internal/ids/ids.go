@@ -0,0 +1,19 @@
+// Package ids generates the random identifiers of the sessions and calls.
+package ids
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+// New returns 8 random bytes in hex, e.g. for a session ID or a SIP tag.
+// It panics if the system has no randomness, which nothing can work
+// without.
+func New() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("failed to read random bytes: %v", err))
+	}
+	return hex.EncodeToString(b)
+}
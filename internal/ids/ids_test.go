@@ -0,0 +1,17 @@
+package ids
+
+import "testing"
+
+func TestNew(t *testing.T) {
+	seen := map[string]bool{}
+	for range 1000 {
+		id := New()
+		if len(id) != 16 {
+			t.Fatalf("ID %q is not 16 hex digits", id)
+		}
+		if seen[id] {
+			t.Fatalf("ID %q repeated", id)
+		}
+		seen[id] = true
+	}
+}
@@ -0,0 +1,92 @@
+// Package logging creates the slog loggers of the packages, which redact
+// credentials whatever handler the application configured.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"exp-openai-webrtc-streaming/redact"
+)
+
+// New creates a text logger writing to w at the named level: "debug",
+// "info", "warn" or "error". An empty level means "info". Credentials are
+// redacted from everything it writes.
+func New(w io.Writer, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if level != "" {
+		if err := lvl.UnmarshalText([]byte(strings.ToLower(level))); err != nil {
+			return nil, fmt.Errorf("invalid log level %q: %w", level, err)
+		}
+	}
+
+	handler := slog.NewTextHandler(w, &slog.HandlerOptions{Level: lvl})
+	return slog.New(redact.NewHandler(handler)), nil
+}
+
+// Component returns logger, or slog.Default() if it is nil, annotated with
+// the component producing the records (pc, dc, player, mic, ...). The
+// components of nested loggers are joined into one attribute, e.g.
+// component=twilio/mic. Credentials are redacted from its output whatever
+// handler the embedding application configured.
+func Component(logger *slog.Logger, component string) *slog.Logger {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if h, ok := logger.Handler().(*componentHandler); ok {
+		return slog.New(newComponentHandler(h.base, h.component+"/"+component, h.ops))
+	}
+	base := logger.Handler()
+	if _, ok := base.(*redact.Handler); !ok {
+		base = redact.NewHandler(base)
+	}
+	return slog.New(newComponentHandler(base, component, nil))
+}
+
+// componentHandler adds the component attribute to the records of base,
+// keeping the attributes and groups added since apart, so that a nested
+// component can replace it.
+type componentHandler struct {
+	base      slog.Handler
+	component string
+	// ops are the WithAttrs and WithGroup calls since the component
+	ops []func(slog.Handler) slog.Handler
+	// handler is base with the component and ops
+	handler slog.Handler
+}
+
+func newComponentHandler(base slog.Handler, component string, ops []func(slog.Handler) slog.Handler) *componentHandler {
+	handler := base.WithAttrs([]slog.Attr{slog.String("component", component)})
+	for _, op := range ops {
+		handler = op(handler)
+	}
+	return &componentHandler{base: base, component: component, ops: ops, handler: handler}
+}
+
+func (h *componentHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.handler.Enabled(ctx, level)
+}
+
+func (h *componentHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.handler.Handle(ctx, r)
+}
+
+func (h *componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithAttrs(attrs) })
+}
+
+func (h *componentHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(next slog.Handler) slog.Handler { return next.WithGroup(name) })
+}
+
+func (h *componentHandler) with(op func(slog.Handler) slog.Handler) *componentHandler {
+	return &componentHandler{
+		base:      h.base,
+		component: h.component,
+		ops:       append(h.ops[:len(h.ops):len(h.ops)], op),
+		handler:   op(h.handler),
+	}
+}
@@ -0,0 +1,35 @@
+package logging
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestComponent(t *testing.T) {
+	var logs bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&logs, nil))
+	call := Component(logger, "twilio").With("call_sid", "CA1")
+	mic := Component(call, "mic")
+
+	mic.Info("started", "key", "sk-test-0123456789abcdef")
+	line := logs.String()
+	if n := strings.Count(line, "component="); n != 1 {
+		t.Errorf("%d component attributes, want 1:\n%s", n, line)
+	}
+	for _, want := range []string{"component=twilio/mic", "call_sid=CA1"} {
+		if !strings.Contains(line, want) {
+			t.Errorf("no %s:\n%s", want, line)
+		}
+	}
+	if strings.Contains(line, "sk-test-0123456789abcdef") {
+		t.Errorf("key not redacted:\n%s", line)
+	}
+
+	logs.Reset()
+	call.Info("ended")
+	if line := logs.String(); !strings.Contains(line, "component=twilio ") {
+		t.Errorf("parent logger changed:\n%s", line)
+	}
+}
@@ -0,0 +1,71 @@
+package playback
+
+import (
+	"sync"
+	"time"
+)
+
+// Track is the part of an audio.RemoteTrack that Loops interrupts.
+type Track interface {
+	SetReadDeadline(deadline time.Time) error
+}
+
+// Loops keeps track of the RTP read loops running inside a player, so
+// that Close can unblock them and wait until they have returned before the
+// player releases its resources.
+type Loops struct {
+	mutex  sync.Mutex
+	closed bool
+	tracks map[Track]struct{}
+	wg     sync.WaitGroup
+}
+
+// Start registers a new read loop for the track. It returns false if the
+// player is already closed, in which case the loop must not run.
+func (l *Loops) Start(track Track) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.closed {
+		return false
+	}
+	if l.tracks == nil {
+		l.tracks = make(map[Track]struct{})
+	}
+	l.tracks[track] = struct{}{}
+	l.wg.Add(1)
+	return true
+}
+
+// Done must be called when a loop started with Start returns.
+func (l *Loops) Done(track Track) {
+	l.mutex.Lock()
+	delete(l.tracks, track)
+	l.mutex.Unlock()
+	l.wg.Done()
+}
+
+// IsClosed reports whether Close has been called.
+func (l *Loops) IsClosed() bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.closed
+}
+
+// Close marks the loops as closed, interrupts the blocked ReadRTP calls and
+// waits for all loops to return. It reports whether this call closed them.
+func (l *Loops) Close() bool {
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		return false
+	}
+	l.closed = true
+	for track := range l.tracks {
+		track.SetReadDeadline(time.Now())
+	}
+	l.mutex.Unlock()
+
+	l.wg.Wait()
+	return true
+}
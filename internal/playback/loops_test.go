@@ -0,0 +1,104 @@
+package playback
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingTrack is a track whose read loop blocks until its deadline is set.
+type blockingTrack struct {
+	once     sync.Once
+	deadline chan struct{}
+}
+
+func newBlockingTrack() *blockingTrack {
+	return &blockingTrack{deadline: make(chan struct{})}
+}
+
+func (t *blockingTrack) SetReadDeadline(deadline time.Time) error {
+	t.once.Do(func() { close(t.deadline) })
+	return nil
+}
+
+func TestLoopsConcurrent(t *testing.T) {
+	var loops Loops
+	var returned sync.WaitGroup
+	var finished sync.Map
+
+	start := make(chan struct{})
+	for i := range 16 {
+		returned.Add(1)
+		go func() {
+			defer returned.Done()
+			<-start
+			track := newBlockingTrack()
+			if !loops.Start(track) {
+				return
+			}
+			go func() {
+				defer loops.Done(track)
+				// a read loop checks IsClosed between its reads
+				for !loops.IsClosed() {
+					select {
+					case <-track.deadline:
+					case <-time.After(time.Millisecond):
+					}
+				}
+				// the loop still holds resources until it returns
+				time.Sleep(10 * time.Millisecond)
+				finished.Store(i, true)
+			}()
+		}()
+	}
+	close(start)
+	returned.Wait()
+
+	if !loops.Close() {
+		t.Fatal("Close did not close the loops")
+	}
+	for i := range 16 {
+		if _, ok := finished.Load(i); !ok {
+			t.Errorf("Close returned before loop %d", i)
+		}
+	}
+	if loops.Close() {
+		t.Error("second Close closed the loops again")
+	}
+	if !loops.IsClosed() {
+		t.Error("IsClosed is false after Close")
+	}
+	if loops.Start(newBlockingTrack()) {
+		t.Error("Start after Close was accepted")
+	}
+}
+
+func TestLoopsCloseRacesStart(t *testing.T) {
+	for range 50 {
+		var loops Loops
+		var wg sync.WaitGroup
+		for range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				track := newBlockingTrack()
+				if loops.Start(track) {
+					go func() {
+						defer loops.Done(track)
+						<-track.deadline
+					}()
+				}
+			}()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			loops.Close()
+		}()
+		wg.Wait()
+		// the loops started after Close ran are refused, the others ended
+		if loops.Start(newBlockingTrack()) {
+			t.Fatal("Start after Close was accepted")
+		}
+	}
+}
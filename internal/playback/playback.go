@@ -0,0 +1,49 @@
+// Package playback holds the plumbing shared by the player backends of
+// audio/device and the audio.TrackRecorder.
+package playback
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// TapWriter receives the audio decoded by a player, see audio.PlaybackTap.
+type TapWriter interface {
+	WritePlayback(pcm []int16, sampleRate, channels int)
+}
+
+// Tap is the tap of a player. It can be set while the player runs.
+type Tap struct {
+	mutex sync.Mutex
+	tap   TapWriter
+}
+
+func (t *Tap) Set(tap TapWriter) {
+	t.mutex.Lock()
+	t.tap = tap
+	t.mutex.Unlock()
+}
+
+func (t *Tap) Write(pcm []int16, sampleRate, channels int) {
+	t.mutex.Lock()
+	tap := t.tap
+	t.mutex.Unlock()
+	if tap != nil {
+		tap.WritePlayback(pcm, sampleRate, channels)
+	}
+}
+
+// WaitEmpty polls size until it returns zero or ctx is done.
+func WaitEmpty(ctx context.Context, size func() int) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for size() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
@@ -1,3 +1,6 @@
+//go:build ignore
+
+// A sketch of sending the camera as plain RTP over UDP, kept for reference.
 package main
 
 // import (
@@ -0,0 +1,224 @@
+// Package metrics exports the audio and connection metrics to Prometheus.
+package metrics
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "oai_realtime"
+
+// Metrics holds the audio and connection metrics reported by the players,
+// the playback buffers, the Realtime API client and its session manager. Unlike
+// audio.Diagnostics and the player loop stats, the counters are never reset.
+type Metrics struct {
+	PacketsReceived prometheus.Counter
+	BytesReceived   prometheus.Counter
+	PacketsLost     prometheus.Counter
+	DecodeErrors    prometheus.Counter
+	PLCFrames       prometheus.Counter
+
+	BufferDepth        *prometheus.GaugeVec
+	BufferUnderruns    prometheus.Counter
+	BufferDroppedBytes prometheus.Counter
+
+	LoopStageSeconds *prometheus.HistogramVec
+
+	ICEConnectionState *prometheus.GaugeVec
+
+	CaptureLevel   *prometheus.GaugeVec
+	CaptureAGCGain prometheus.Gauge
+
+	Sessions              prometheus.Gauge
+	SessionsRejected      prometheus.Counter
+	SessionDecodeSeconds  prometheus.Counter
+	SessionWriteSeconds   prometheus.Counter
+	SessionSkippedPackets prometheus.Counter
+}
+
+// New creates the metrics and registers them with reg.
+func New(reg prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		PacketsReceived: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "rtp_packets_received_total",
+			Help:      "RTP packets received on remote audio tracks.",
+		}),
+		BytesReceived: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "rtp_payload_bytes_received_total",
+			Help:      "Opus payload bytes received on remote audio tracks.",
+		}),
+		PacketsLost: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "rtp_packets_lost_total",
+			Help:      "RTP packets missing from sequence number gaps.",
+		}),
+		DecodeErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "opus_decode_errors_total",
+			Help:      "Opus packets that failed to decode.",
+		}),
+		PLCFrames: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "opus_plc_frames_total",
+			Help:      "Frames synthesized by Opus packet loss concealment.",
+		}),
+		BufferDepth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "playback_buffer_bytes",
+			Help:      "PCM bytes queued in the playback buffer of each session, without a session for the local player.",
+		}, []string{"session"}),
+		BufferUnderruns: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "playback_buffer_underruns_total",
+			Help:      "Times the audio output had to wait for the playback buffer to refill.",
+		}),
+		BufferDroppedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "playback_buffer_dropped_bytes_total",
+			Help:      "PCM bytes dropped because the playback buffer was above its high water mark.",
+		}),
+		LoopStageSeconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "player_loop_stage_seconds",
+			Help:      "Time spent in each stage of the player RTP loop.",
+			Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 10), // 10µs .. ~2.6s
+		}, []string{"stage"}),
+		ICEConnectionState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "ice_connection_state",
+			Help:      "1 for the current ICE connection state of the peer connection, 0 otherwise.",
+		}, []string{"state"}),
+		CaptureLevel: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "capture_level_dbfs",
+			Help:      "RMS level of the last captured frame after each processing stage.",
+		}, []string{"stage"}),
+		CaptureAGCGain: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "capture_agc_gain_db",
+			Help:      "Current gain of the capture AGC.",
+		}),
+		Sessions: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "sessions",
+			Help:      "Sessions in progress in the session manager.",
+		}),
+		SessionsRejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "sessions_rejected_total",
+			Help:      "Sessions rejected over the session limit.",
+		}),
+		SessionDecodeSeconds: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "session_decode_seconds_total",
+			Help:      "Time the sessions spent decoding the model audio.",
+		}),
+		SessionWriteSeconds: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "session_write_seconds_total",
+			Help:      "Wall-clock time the sessions took to decode and write the model audio.",
+		}),
+		SessionSkippedPackets: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "session_skipped_packets_total",
+			Help:      "Model audio packets skipped by the sessions over their decode budget.",
+		}),
+	}
+
+	reg.MustRegister(
+		m.PacketsReceived,
+		m.BytesReceived,
+		m.PacketsLost,
+		m.DecodeErrors,
+		m.PLCFrames,
+		m.BufferDepth,
+		m.BufferUnderruns,
+		m.BufferDroppedBytes,
+		m.LoopStageSeconds,
+		m.ICEConnectionState,
+		m.CaptureLevel,
+		m.CaptureAGCGain,
+		m.Sessions,
+		m.SessionsRejected,
+		m.SessionDecodeSeconds,
+		m.SessionWriteSeconds,
+		m.SessionSkippedPackets,
+	)
+	return m
+}
+
+// Default are the process-wide metrics, registered with the default
+// Prometheus registry. The packages report to them.
+var Default = New(prometheus.DefaultRegisterer)
+
+var iceConnectionStates = []webrtc.ICEConnectionState{
+	webrtc.ICEConnectionStateNew,
+	webrtc.ICEConnectionStateChecking,
+	webrtc.ICEConnectionStateConnected,
+	webrtc.ICEConnectionStateCompleted,
+	webrtc.ICEConnectionStateDisconnected,
+	webrtc.ICEConnectionStateFailed,
+	webrtc.ICEConnectionStateClosed,
+}
+
+// SetICEConnectionState marks state as the current ICE connection state.
+func (m *Metrics) SetICEConnectionState(state webrtc.ICEConnectionState) {
+	for _, s := range iceConnectionStates {
+		v := 0.0
+		if s == state {
+			v = 1
+		}
+		m.ICEConnectionState.WithLabelValues(s.String()).Set(v)
+	}
+}
+
+// PacketCounter reports the packets received on one track to Default,
+// including the ones missing from gaps in the sequence numbers.
+type PacketCounter struct {
+	started bool
+	lastSeq uint16
+}
+
+// Count records p and returns how many packets were lost right before it.
+// Reordered and duplicate packets are not counted as losses.
+func (c *PacketCounter) Count(p *rtp.Packet) int {
+	Default.PacketsReceived.Inc()
+	Default.BytesReceived.Add(float64(len(p.Payload)))
+
+	if !c.started {
+		c.started = true
+		c.lastSeq = p.SequenceNumber
+		return 0
+	}
+
+	gap := p.SequenceNumber - c.lastSeq
+	if gap == 0 || gap >= 0x8000 {
+		// duplicate or late packet
+		return 0
+	}
+	c.lastSeq = p.SequenceNumber
+
+	lost := int(gap) - 1
+	if lost > 0 {
+		Default.PacketsLost.Add(float64(lost))
+	}
+	return lost
+}
+
+// Serve exposes the default Prometheus registry on addr under /metrics. It
+// blocks like http.ListenAndServe.
+func Serve(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		return fmt.Errorf("metrics server: %w", err)
+	}
+	return nil
+}
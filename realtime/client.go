@@ -0,0 +1,617 @@
+// Package realtime is a client of the OpenAI Realtime API over WebRTC or a
+// WebSocket. It sends the user audio of an audio.Source and writes the model
+// audio to an audio.TrackWriter, see Client.
+package realtime
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/mediadevices/pkg/codec"
+	"github.com/pion/webrtc/v4"
+
+	"exp-openai-webrtc-streaming/audio"
+	"exp-openai-webrtc-streaming/internal/logging"
+	"exp-openai-webrtc-streaming/metrics"
+	"exp-openai-webrtc-streaming/redact"
+)
+
+// The defaults of NewClient.
+const (
+	DefaultModel = "gpt-4o-realtime-preview-2024-12-17"
+	DefaultVoice = "verse"
+)
+
+// DefaultWebRTCURL is the endpoint of TransportWebRTC receiving the SDP
+// offers.
+const DefaultWebRTCURL = "https://api.openai.com/v1/realtime"
+
+// Transport is how a Client talks to the Realtime API.
+type Transport string
+
+const (
+	// TransportWebRTC carries the audio over RTP and the events over a data
+	// channel. It needs UDP, or a TURN server relaying over TCP.
+	TransportWebRTC Transport = "webrtc"
+	// TransportWebSocket carries the events over a WebSocket, the audio as
+	// base64 PCM16 in the events, for networks blocking UDP. The model audio
+	// is encoded to Opus for the TrackWriter, which needs libopus.
+	TransportWebSocket Transport = "websocket"
+)
+
+// Event is an event of the Realtime API, sent by the client or the server,
+// see https://platform.openai.com/docs/api-reference/realtime-client-events
+// and https://platform.openai.com/docs/api-reference/realtime-server-events.
+type Event struct {
+	Type string
+	// Data is the whole event as JSON.
+	Data json.RawMessage
+}
+
+// Client is a conversation with the Realtime API. Over WebRTC, it is one
+// peer connection, carrying the audio, and one data channel, carrying the
+// events; over a WebSocket, the connection carries both. Configure the
+// exported fields before Connect.
+type Client struct {
+	Key   redact.Secret
+	Model string
+	Voice string
+	// Instructions is the system prompt of the session, the model default
+	// if empty.
+	Instructions string
+	// Tools are the functions the model may call.
+	Tools []Tool
+	// ICEServers are the STUN and TURN servers of the peer connection.
+	ICEServers []webrtc.ICEServer
+	// StatsInterval is how often the connection stats are sampled.
+	StatsInterval time.Duration
+	// Logger receives the logs of the client. It defaults to slog.Default().
+	Logger *slog.Logger
+	// ManualTurns disables the server VAD. Turns are then ended by calling
+	// CommitInputAudio, e.g. when the local VAD detects the end of speech.
+	ManualTurns bool
+	// Opus configures the encoding of the user audio and the fmtp of the
+	// negotiated codec. Sources yielding Opus are sent as they are.
+	Opus audio.OpusEncoderOptions
+	// Transport is TransportWebRTC unless set to TransportWebSocket.
+	Transport Transport
+	// WebSocketURL is the endpoint of TransportWebSocket, DefaultWebSocketURL
+	// if empty, e.g. to test against a local stand-in.
+	WebSocketURL string
+	// OnEvent is called with the server events, from the goroutine reading
+	// them, so it must not block. The audio events of TransportWebSocket are
+	// not passed on, the audio goes to the TrackWriter with both transports.
+	OnEvent func(Event)
+	// SessionsURL and WebRTCURL are the endpoints of TransportWebRTC,
+	// DefaultSessionsURL and DefaultWebRTCURL if empty, e.g. to test against
+	// a local stand-in.
+	SessionsURL string
+	WebRTCURL   string
+	// HTTPClient makes the requests to these endpoints, by default a client
+	// timing out after 30s.
+	HTTPClient *http.Client
+
+	connectMutex   sync.Mutex
+	ephemeralToken redact.Secret
+	// peerConnection is used to exchange audio over media streams
+	peerConnection *webrtc.PeerConnection
+	// dataChannel is used to control the "conversation"
+	// https://platform.openai.com/docs/api-reference/realtime-client-events.
+	// It has its own mutex, since events are sent from the audio path while
+	// Disconnect waits for it. The mutex also guards ws.
+	dataChannel      *webrtc.DataChannel
+	dataChannelMutex sync.Mutex
+	// ws is the connection of TransportWebSocket
+	ws          *wsSession
+	stats       statsCollector
+	audioSender *audio.Sender
+}
+
+// NewClient creates a client authenticating with the API key. The key is
+// redacted from the logs and errors.
+func NewClient(key string) *Client {
+	redact.Register(key)
+	return &Client{
+		Key:   redact.Secret(key),
+		Model: DefaultModel,
+		Voice: DefaultVoice,
+
+		Transport:     TransportWebRTC,
+		ICEServers:    DefaultICEServers(),
+		Opus:          audio.DefaultOpusEncoderOptions(),
+		StatsInterval: defaultStatsInterval,
+		Logger:        slog.Default(),
+	}
+}
+
+// String describes the client without any of its credentials. fmt does not
+// call the Secret methods on unexported fields, so printing the struct
+// itself could reveal the ephemeral token.
+func (c *Client) String() string {
+	return fmt.Sprintf("realtime.Client{Model: %q, Voice: %q}", c.Model, c.Voice)
+}
+
+func (c *Client) GoString() string {
+	return c.String()
+}
+
+// DefaultICEServers returns the public Google STUN server.
+func DefaultICEServers() []webrtc.ICEServer {
+	return []webrtc.ICEServer{
+		{URLs: []string{"stun:stun.l.google.com:19302"}},
+	}
+}
+
+// Tool is a function the model may call, see
+// https://platform.openai.com/docs/guides/function-calling.
+type Tool struct {
+	Name        string `json:"name" yaml:"name"`
+	Description string `json:"description,omitempty" yaml:"description"`
+	// Parameters is the JSON schema of the arguments.
+	Parameters map[string]any `json:"parameters,omitempty" yaml:"parameters"`
+}
+
+func (t Tool) MarshalJSON() ([]byte, error) {
+	type tool Tool
+	return json.Marshal(struct {
+		Type string `json:"type"`
+		tool
+	}{"function", tool(t)})
+}
+
+// Connect sends the user audio read from source to the model and writes the
+// model audio to audioWriter. Wrap a mediadevices track, e.g. the microphone,
+// with audio.NewMediaDevicesSource.
+func (c *Client) Connect(
+	source audio.Source,
+	audioWriter audio.TrackWriter,
+) (err error) {
+	c.connectMutex.Lock()
+	defer c.connectMutex.Unlock()
+
+	// Whatever goes wrong, credentials must not leak through the error.
+	defer func() { err = redact.Error(err) }()
+
+	switch c.Transport {
+	case "", TransportWebRTC:
+	case TransportWebSocket:
+		return c.connectWebSocket(source, audioWriter)
+	default:
+		return fmt.Errorf("unknown transport %q", c.Transport)
+	}
+
+	if c.ephemeralToken == "" {
+		ephemeralToken, err := c.createEphemeralToken()
+		if err != nil {
+			return err
+		}
+
+		c.ephemeralToken = ephemeralToken
+		logging.Component(c.Logger, "api").Debug("created ephemeral token",
+			"token", c.ephemeralToken)
+	}
+
+	sender, err := audio.NewSender(source, c.Opus, c.Logger)
+	if err != nil {
+		return err
+	}
+
+	if err := c.setupPeerConnection(sender.Track(), audioWriter); err != nil {
+		return err
+	}
+
+	// The data channel must exist before the offer for SCTP to be
+	// negotiated.
+	if err := c.setupDataChannel(); err != nil {
+		// Clean up on error
+		c.peerConnection.Close()
+		c.peerConnection = nil
+		return err
+	}
+
+	if err := c.connectToRealtimeAPI(); err != nil {
+		// Clean up on error
+		c.dataChannelMutex.Lock()
+		c.dataChannel = nil
+		c.dataChannelMutex.Unlock()
+		c.peerConnection.Close()
+		c.peerConnection = nil
+		return err
+	}
+
+	c.audioSender = sender
+	c.audioSender.Start()
+	c.stats.start(c.peerConnection, c.StatsInterval)
+	return nil
+}
+
+// StopCapture stops sending the user audio, e.g. to let the model audio
+// play out before Disconnect. The source is left open.
+func (c *Client) StopCapture() {
+	c.connectMutex.Lock()
+	defer c.connectMutex.Unlock()
+	if c.audioSender != nil {
+		c.audioSender.Stop()
+	}
+	if c.ws != nil {
+		c.ws.stopCapture()
+	}
+}
+
+// Drain waits until the model audio received so far has been written to the
+// TrackWriter, or ctx is done. The WebSocket transport receives it faster
+// than real time; over WebRTC it returns at once.
+func (c *Client) Drain(ctx context.Context) error {
+	c.dataChannelMutex.Lock()
+	ws := c.ws
+	c.dataChannelMutex.Unlock()
+	if ws == nil {
+		return nil
+	}
+	return ws.track.Drain(ctx)
+}
+
+// Disconnect stops the user audio, then closes the data channel and the
+// peer connection, or the WebSocket.
+func (c *Client) Disconnect() {
+	c.connectMutex.Lock()
+	defer c.connectMutex.Unlock()
+
+	// c.ephemeralToken = "" // no need to reset
+	c.stats.stop()
+	if c.audioSender != nil {
+		c.audioSender.Stop()
+		c.audioSender = nil
+	}
+	c.dataChannelMutex.Lock()
+	if c.dataChannel != nil {
+		c.dataChannel.Close()
+		c.dataChannel = nil
+	}
+	ws := c.ws
+	c.ws = nil
+	c.dataChannelMutex.Unlock()
+	if ws != nil {
+		ws.close()
+	}
+	if c.peerConnection != nil {
+		c.peerConnection.Close()
+		c.peerConnection = nil
+	}
+}
+
+func (c *Client) setupPeerConnection(
+	userTrack webrtc.TrackLocal,
+	audioWriter audio.TrackWriter,
+) error {
+	config := webrtc.Configuration{ICEServers: c.ICEServers}
+
+	// Only Opus is negotiated, the codec the TrackWriters decode.
+	var mediaEngine webrtc.MediaEngine
+	opusParams := codec.NewRTPOpusCodec(48_000).RTPCodecParameters
+	opusParams.ClockRate = audio.SampleRate
+	opusParams.Channels = audio.Channels
+	opusParams.SDPFmtpLine = c.Opus.Fmtp()
+	mediaEngine.RegisterCodec(opusParams, webrtc.RTPCodecTypeAudio)
+
+	// The default interceptors generate the RTCP reports, the stats
+	// interceptor turns them into connection stats.
+	var interceptorRegistry interceptor.Registry
+	if err := webrtc.RegisterDefaultInterceptors(&mediaEngine, &interceptorRegistry); err != nil {
+		return fmt.Errorf("failed to register interceptors: %w", err)
+	}
+	if err := c.stats.register(&interceptorRegistry); err != nil {
+		return fmt.Errorf("failed to register stats interceptor: %w", err)
+	}
+	// mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
+	// 	RTPCodecCapability: RTPCodecCapability{MimeTypeOpus, 48000, 2, "minptime=10;useinbandfec=1", nil},
+	// 	PayloadType:        111,
+	// }, webrtc.RTPCodecTypeAudio)
+	api := webrtc.NewAPI(
+		webrtc.WithMediaEngine(&mediaEngine),
+		webrtc.WithInterceptorRegistry(&interceptorRegistry),
+	)
+
+	pc, err := api.NewPeerConnection(config)
+	// pc, err := webrtc.NewPeerConnection(config)
+	if err != nil {
+		return fmt.Errorf("failed to create peer connection: %w", err)
+	}
+
+	transceiver, err := pc.AddTransceiverFromTrack(
+		userTrack,
+		// webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendrecv},
+	)
+	if err != nil {
+		pc.Close()
+		return fmt.Errorf("failed to add user media track: %w", err)
+	}
+	sender := transceiver.Sender()
+	if encodings := sender.GetParameters().Encodings; len(encodings) > 0 {
+		c.stats.setOutboundSSRC(encodings[0].SSRC)
+	}
+	go drainRTCP(sender)
+
+	// Allow us to receive 1 audio track
+	// if _, err = pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio); err != nil {
+	// 	return fmt.Errorf("failed to add transceiver: %w", err)
+	// }
+
+	log := logging.Component(c.Logger, "pc")
+
+	pc.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		codec := track.Codec()
+		log.Info("received remote track",
+			"stream_id", track.StreamID(),
+			"track_id", track.ID(),
+			"kind", track.Kind().String(),
+			"payload_type", track.PayloadType(),
+			"mime_type", codec.MimeType,
+			"clock_rate", codec.ClockRate,
+			"channels", codec.Channels,
+			"fmtp", codec.SDPFmtpLine)
+
+		c.stats.setInbound(track.SSRC(), codec.ClockRate)
+		go drainRTCP(receiver)
+
+		// The writer reads the track until it ends, OnTrack must return.
+		go func() {
+			if err := audioWriter.WriteWebRTCTrack(track); err != nil {
+				log.Error("failed to write WebRTC track", "err", err)
+			}
+		}()
+	})
+
+	// The ICE state is logged and exported as a metric. A failed connection
+	// is not closed here, the owner of the client calls Disconnect.
+	pc.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
+		log.Info("ICE connection state changed", "state", connectionState.String())
+		metrics.Default.SetICEConnectionState(connectionState)
+	})
+
+	pc.OnSignalingStateChange(func(sigState webrtc.SignalingState) {
+		log.Info("signaling state changed", "state", sigState.String())
+	})
+
+	c.peerConnection = pc
+	return nil
+}
+
+func (c *Client) connectToRealtimeAPI() error {
+	// Create an offer
+	offer, err := c.peerConnection.CreateOffer(nil)
+	if err != nil {
+		return fmt.Errorf("failed to create offer: %w", err)
+	}
+
+	// Create channel for signaling
+	// gatherComplete := webrtc.GatheringCompletePromise(c.peerConnection)
+
+	// Set local description
+	err = c.peerConnection.SetLocalDescription(offer)
+	if err != nil {
+		return fmt.Errorf("failed to set local description: %w", err)
+	}
+
+	// Wait for ICE gathering to complete
+	// Wait for gathering to complete
+	// select {
+	// case <-gatherComplete:
+	// 	// Gathering is complete, can now send the offer
+	// 	// peerConnection.LocalDescription() now contains all candidates
+	// case <-time.After(time.Second * 15):
+	// 	// Handle timeout
+	// }
+
+	// Send offer to OpenAI API and get answer
+	answer, err := c.sendOffer(offer.SDP, c.ephemeralToken)
+	if err != nil {
+		return fmt.Errorf("failed to send offer: %w", err)
+	}
+
+	// Set remote description
+	err = c.peerConnection.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  answer,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set remote description: %w", err)
+	}
+
+	return nil
+}
+
+func (c *Client) setupDataChannel() error {
+	dc, err := c.peerConnection.CreateDataChannel("oai-events", nil)
+	if err != nil {
+		return fmt.Errorf("failed to create data channel: %w", err)
+	}
+
+	log := logging.Component(c.Logger, "dc")
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		c.handleEvent(log, msg.Data)
+	})
+	if c.ManualTurns {
+		dc.OnOpen(func() {
+			err := c.SendEvent(map[string]any{
+				"type":    "session.update",
+				"session": map[string]any{"turn_detection": nil},
+			})
+			if err != nil {
+				log.Error("failed to disable server VAD", "err", err)
+			}
+		})
+	}
+
+	c.dataChannelMutex.Lock()
+	c.dataChannel = dc
+	c.dataChannelMutex.Unlock()
+	return nil
+}
+
+// handleEvent logs a server event and passes it to OnEvent.
+func (c *Client) handleEvent(log *slog.Logger, data []byte) {
+	log.Debug("received message", "data", string(data))
+	if c.OnEvent == nil {
+		return
+	}
+	var event struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &event); err != nil {
+		log.Warn("failed to parse server event", "err", err)
+		return
+	}
+	c.OnEvent(Event{Type: event.Type, Data: data})
+}
+
+// SendEvent sends a client event, see
+// https://platform.openai.com/docs/api-reference/realtime-client-events.
+func (c *Client) SendEvent(event any) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	c.dataChannelMutex.Lock()
+	defer c.dataChannelMutex.Unlock()
+	if c.ws != nil {
+		return c.ws.write(data)
+	}
+	if c.dataChannel == nil {
+		return fmt.Errorf("not connected")
+	}
+	return c.dataChannel.SendText(string(data))
+}
+
+// CommitInputAudio ends the user turn and asks the model to respond. It is
+// only needed with ManualTurns.
+func (c *Client) CommitInputAudio() error {
+	if err := c.SendEvent(map[string]string{"type": "input_audio_buffer.commit"}); err != nil {
+		return err
+	}
+	return c.SendEvent(map[string]string{"type": "response.create"})
+}
+
+// session returns the session configuration shared by the transports.
+func (c *Client) session() SessionConfig {
+	return SessionConfig{
+		Model:        c.Model,
+		Voice:        c.Voice,
+		Instructions: c.Instructions,
+		Tools:        c.Tools,
+	}
+}
+
+// createEphemeralToken creates a new ephemeral token for the OpenAI Realtime
+// API, see SessionsEndpoint. Like there, the token is not registered with
+// redact: the servers create one per call, and the ek_ keys are redacted by
+// their shape.
+func (c *Client) createEphemeralToken() (redact.Secret, error) {
+	endpoint := SessionsEndpoint{Key: c.Key, URL: c.SessionsURL, HTTPClient: c.HTTPClient}
+	session, err := endpoint.Create(context.Background(), c.session())
+	if err != nil {
+		return "", err
+	}
+	return session.Token, nil
+}
+
+// getEphemeralToken creates a new ephemeral token for the OpenAI Realtime API.
+//
+// More details are at https://platform.openai.com/docs/api-reference/realtime-sessions/create.
+func (c *Client) sendOffer(sdp string, ephemeralToken redact.Secret) (string, error) {
+	endpoint := c.WebRTCURL
+	if endpoint == "" {
+		endpoint = DefaultWebRTCURL
+	}
+	endpointUrl := endpoint + "?model=" + url.QueryEscape(c.Model)
+	req, err := http.NewRequest("POST", endpointUrl, strings.NewReader(sdp))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+string(ephemeralToken))
+	req.Header.Set("Content-Type", "application/sdp")
+
+	client := c.HTTPClient
+	if client == nil {
+		client = defaultHTTPClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		return "", newAPIError(res)
+	}
+
+	answer, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+
+	return string(answer), nil
+}
+
+// APIError is an error response from the OpenAI API. Its message is redacted,
+// since the API may echo parts of the request back.
+type APIError struct {
+	StatusCode int
+	Type       string
+	Code       string
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("HTTP %d", e.StatusCode)
+	if e.Type != "" {
+		msg += " " + e.Type
+	}
+	if e.Code != "" {
+		msg += " (" + e.Code + ")"
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// maxAPIErrorMessage limits how much of an unstructured error body ends up
+// in an APIError.
+const maxAPIErrorMessage = 512
+
+func newAPIError(res *http.Response) error {
+	bs, _ := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+	apiErr := &APIError{StatusCode: res.StatusCode}
+
+	var body struct {
+		Error struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+			Code    string `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(bs, &body); err == nil && body.Error.Message != "" {
+		apiErr.Type = body.Error.Type
+		apiErr.Code = body.Error.Code
+		apiErr.Message = body.Error.Message
+	} else {
+		apiErr.Message = strings.TrimSpace(string(bs))
+		if len(apiErr.Message) > maxAPIErrorMessage {
+			apiErr.Message = apiErr.Message[:maxAPIErrorMessage] + "..."
+		}
+	}
+	apiErr.Message = redact.String(apiErr.Message)
+	return apiErr
+}
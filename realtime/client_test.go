@@ -0,0 +1,48 @@
+package realtime
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnectTimeout(t *testing.T) {
+	for _, hung := range []string{"/sessions", "/realtime"} {
+		t.Run(hung, func(t *testing.T) {
+			release := make(chan struct{})
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasSuffix(r.URL.Path, hung) {
+					<-release
+					return
+				}
+				io.WriteString(w, `{"client_secret":{"value":"ek_0123456789abcdef","expires_at":1700000060}}`)
+			}))
+			t.Cleanup(server.Close)
+			t.Cleanup(func() { close(release) })
+
+			c := NewClient("sk-test-0123456789")
+			c.ICEServers = nil
+			c.SessionsURL = server.URL + "/sessions"
+			c.WebRTCURL = server.URL + "/realtime"
+			c.HTTPClient = &http.Client{Timeout: 100 * time.Millisecond}
+			done := make(chan error, 1)
+			go func() { done <- c.Connect(&toneSource{}, newPacketCounter()) }()
+			select {
+			case err := <-done:
+				var timeout interface{ Timeout() bool }
+				if !errors.As(err, &timeout) || !timeout.Timeout() {
+					t.Errorf("got error %v, want a timeout", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Connect did not time out")
+			}
+			if c.peerConnection != nil {
+				t.Error("peer connection left after the failed Connect")
+			}
+		})
+	}
+}
@@ -0,0 +1,130 @@
+package realtime
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHandleEvent(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		wantType string
+		// wantNone is true if the event is not passed to OnEvent
+		wantNone bool
+	}{
+		{"response done", `{"type":"response.done","response":{"id":"r1"}}`, "response.done", false},
+		{"speech started", `{"type":"input_audio_buffer.speech_started","audio_start_ms":120}`, "input_audio_buffer.speech_started", false},
+		{"without type", `{"event_id":"e1"}`, "", false},
+		{"unknown fields", `{"type":"x.y","nested":{"a":[1,2]}}`, "x.y", false},
+		{"invalid", `{"type":`, "", true},
+		{"not an object", `"response.done"`, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var events []Event
+			c := NewClient("")
+			c.OnEvent = func(event Event) { events = append(events, event) }
+			c.handleEvent(slog.New(slog.NewTextHandler(io.Discard, nil)), []byte(tt.data))
+
+			if tt.wantNone {
+				if len(events) != 0 {
+					t.Fatalf("got %d events, want none", len(events))
+				}
+				return
+			}
+			if len(events) != 1 {
+				t.Fatalf("got %d events, want 1", len(events))
+			}
+			if events[0].Type != tt.wantType {
+				t.Errorf("type %q, want %q", events[0].Type, tt.wantType)
+			}
+			if string(events[0].Data) != tt.data {
+				t.Errorf("data %s, want the whole event", events[0].Data)
+			}
+		})
+	}
+}
+
+func TestNewAPIError(t *testing.T) {
+	const key = "sk-proj-abcdefghijklmnop1234"
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   APIError
+	}{
+		{
+			"structured", 401,
+			`{"error":{"message":"Incorrect API key provided: ` + key + `","type":"invalid_request_error","code":"invalid_api_key"}}`,
+			APIError{StatusCode: 401, Type: "invalid_request_error", Code: "invalid_api_key", Message: "Incorrect API key provided: [REDACTED]"},
+		},
+		{"unstructured", 502, "  Bad Gateway\n", APIError{StatusCode: 502, Message: "Bad Gateway"}},
+		{"empty", 500, "", APIError{StatusCode: 500}},
+		{"no message", 400, `{"error":{"type":"x"}}`, APIError{StatusCode: 400, Message: `{"error":{"type":"x"}}`}},
+		{
+			"long", 503, strings.Repeat("a", 600),
+			APIError{StatusCode: 503, Message: strings.Repeat("a", maxAPIErrorMessage) + "..."},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := &http.Response{StatusCode: tt.status, Body: io.NopCloser(strings.NewReader(tt.body))}
+			err, ok := newAPIError(res).(*APIError)
+			if !ok {
+				t.Fatalf("got %T, want *APIError", err)
+			}
+			if *err != tt.want {
+				t.Errorf("got %+v, want %+v", *err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAPIErrorString(t *testing.T) {
+	tests := []struct {
+		err  APIError
+		want string
+	}{
+		{APIError{StatusCode: 500}, "HTTP 500"},
+		{APIError{StatusCode: 404, Message: "not found"}, "HTTP 404: not found"},
+		{APIError{StatusCode: 401, Type: "invalid_request_error", Code: "invalid_api_key", Message: "bad key"},
+			"HTTP 401 invalid_request_error (invalid_api_key): bad key"},
+	}
+	for _, tt := range tests {
+		if got := tt.err.Error(); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
+
+func TestSessionConfigFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		config SessionConfig
+		want   string
+	}{
+		{"empty", SessionConfig{}, `{}`},
+		{"voice", SessionConfig{Voice: "alloy"}, `{"voice":"alloy"}`},
+		{
+			"tools",
+			SessionConfig{Model: "m", Tools: []Tool{{Name: "f", Parameters: map[string]any{"type": "object"}}}},
+			`{"model":"m","tools":[{"type":"function","name":"f","parameters":{"type":"object"}}]}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(tt.config.fields())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Errorf("got %s, want %s", data, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package realtime
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/mediadevices/pkg/codec"
+	"github.com/pion/webrtc/v4"
+
+	"exp-openai-webrtc-streaming/audio"
+	"exp-openai-webrtc-streaming/internal/logging"
+)
+
+// RunLoopback sends the audio of source over a WebRTC connection between two
+// local peers and writes the received track to audioWriter, until ctx is
+// done or the source ends. It exercises the capture, encoding, transport and
+// playback without the API.
+func RunLoopback(
+	ctx context.Context,
+	source audio.Source,
+	opts audio.OpusEncoderOptions,
+	audioWriter audio.TrackWriter,
+	logger *slog.Logger,
+) error {
+	log := logging.Component(logger, "loopback")
+
+	sender, err := audio.NewSender(source, opts, logger)
+	if err != nil {
+		return err
+	}
+
+	offerer, err := newLoopbackPeer(opts)
+	if err != nil {
+		return err
+	}
+	defer offerer.Close()
+	answerer, err := newLoopbackPeer(opts)
+	if err != nil {
+		return err
+	}
+	defer answerer.Close()
+
+	rtpSender, err := offerer.AddTrack(sender.Track())
+	if err != nil {
+		return fmt.Errorf("failed to add track: %w", err)
+	}
+	go drainRTCP(rtpSender)
+	answerer.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		log.Info("received loopback track",
+			"mime_type", track.Codec().MimeType,
+			"fmtp", track.Codec().SDPFmtpLine)
+		go drainRTCP(receiver)
+		go func() {
+			if err := audioWriter.WriteWebRTCTrack(track); err != nil {
+				log.Error("failed to write WebRTC track", "err", err)
+			}
+		}()
+	})
+
+	connected := make(chan struct{})
+	var once sync.Once
+	offerer.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.Info("connection state changed", "state", state.String())
+		if state == webrtc.PeerConnectionStateConnected {
+			once.Do(func() { close(connected) })
+		}
+	})
+
+	if err := negotiateLoopback(offerer, answerer); err != nil {
+		return err
+	}
+
+	select {
+	case <-connected:
+	case <-ctx.Done():
+		return nil
+	}
+
+	sender.Start()
+	defer sender.Stop()
+	select {
+	case <-ctx.Done():
+	case <-sender.Ended():
+	}
+	return nil
+}
+
+func newLoopbackPeer(opts audio.OpusEncoderOptions) (*webrtc.PeerConnection, error) {
+	var mediaEngine webrtc.MediaEngine
+	opusParams := codec.NewRTPOpusCodec(48_000).RTPCodecParameters
+	opusParams.SDPFmtpLine = opts.Fmtp()
+	if err := mediaEngine.RegisterCodec(opusParams, webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, fmt.Errorf("failed to register codec: %w", err)
+	}
+
+	var interceptorRegistry interceptor.Registry
+	if err := webrtc.RegisterDefaultInterceptors(&mediaEngine, &interceptorRegistry); err != nil {
+		return nil, fmt.Errorf("failed to register interceptors: %w", err)
+	}
+	api := webrtc.NewAPI(
+		webrtc.WithMediaEngine(&mediaEngine),
+		webrtc.WithInterceptorRegistry(&interceptorRegistry),
+	)
+
+	pc, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create peer connection: %w", err)
+	}
+	return pc, nil
+}
+
+// negotiateLoopback exchanges the offer and answer of two local peers, with
+// all candidates gathered since there is no trickling.
+func negotiateLoopback(offerer, answerer *webrtc.PeerConnection) error {
+	offer, err := offerer.CreateOffer(nil)
+	if err != nil {
+		return fmt.Errorf("failed to create offer: %w", err)
+	}
+	gathered := webrtc.GatheringCompletePromise(offerer)
+	if err := offerer.SetLocalDescription(offer); err != nil {
+		return fmt.Errorf("failed to set local description: %w", err)
+	}
+	<-gathered
+	if err := answerer.SetRemoteDescription(*offerer.LocalDescription()); err != nil {
+		return fmt.Errorf("failed to set remote description: %w", err)
+	}
+
+	answer, err := answerer.CreateAnswer(nil)
+	if err != nil {
+		return fmt.Errorf("failed to create answer: %w", err)
+	}
+	gathered = webrtc.GatheringCompletePromise(answerer)
+	if err := answerer.SetLocalDescription(answer); err != nil {
+		return fmt.Errorf("failed to set local description: %w", err)
+	}
+	<-gathered
+	if err := offerer.SetRemoteDescription(*answerer.LocalDescription()); err != nil {
+		return fmt.Errorf("failed to set remote description: %w", err)
+	}
+	return nil
+}
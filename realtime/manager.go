@@ -0,0 +1,385 @@
+package realtime
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+
+	"exp-openai-webrtc-streaming/audio"
+	"exp-openai-webrtc-streaming/internal/ids"
+	"exp-openai-webrtc-streaming/internal/logging"
+	"exp-openai-webrtc-streaming/metrics"
+)
+
+var (
+	// ErrTooManySessions is returned by SessionManager.Start beyond
+	// ManagerOptions.MaxSessions.
+	ErrTooManySessions = errors.New("too many sessions")
+	// ErrManagerClosed is returned by SessionManager.Start after Shutdown.
+	ErrManagerClosed = errors.New("session manager shut down")
+	// ErrUnauthorized is returned by the Authenticate hooks of the servers
+	// of the token server, relay and twilio packages to reject a request
+	// with 401. Other errors are rejected with 403.
+	ErrUnauthorized = errors.New("unauthorized")
+)
+
+// ManagerOptions configures a SessionManager. Zero values select the
+// defaults.
+type ManagerOptions struct {
+	// MaxSessions limits the concurrent sessions, unlimited if 0.
+	MaxSessions int
+	// DecodeBudget is the time each session may spend per second decoding
+	// the model audio, unlimited if 0. Only the decoders of
+	// audio.NewTrackDecoder are timed, e.g. those of the SIP and Twilio
+	// calls: the time the TrackWriter takes otherwise, e.g. writing to a
+	// slow WebSocket, is not charged. Over the budget, the packets are
+	// skipped until the budget refills, so that a session cannot starve the
+	// others.
+	DecodeBudget time.Duration
+	Logger       *slog.Logger
+}
+
+// SessionManager runs many clients in one process, e.g. the calls of a
+// gateway. It gives each session an ID, enforces the limits of its options
+// and reports the sessions to metrics.Default.
+//
+// Start on a nil SessionManager connects the clients without limits or
+// tracking, so that its users can take one optionally.
+type SessionManager struct {
+	opts ManagerOptions
+	log  *slog.Logger
+
+	mutex    sync.Mutex
+	sessions map[string]*ManagedSession
+	closed   bool
+	stats    ManagerStats
+}
+
+// ManagerStats are the aggregate stats of the sessions of a manager, the
+// ended ones included.
+type ManagerStats struct {
+	// Active is the number of sessions in progress.
+	Active   int
+	Started  int
+	Rejected int
+	// DecodeTime is the time the sessions spent decoding the model audio,
+	// WriteTime the wall-clock time their TrackWriters took on it, and
+	// SkippedPackets the packets skipped over the budgets.
+	DecodeTime     time.Duration
+	WriteTime      time.Duration
+	SkippedPackets int
+}
+
+// NewSessionManager returns a SessionManager with opts, without sessions.
+func NewSessionManager(opts ManagerOptions) *SessionManager {
+	return &SessionManager{
+		opts:     opts,
+		log:      logging.Component(opts.Logger, "sessions"),
+		sessions: make(map[string]*ManagedSession),
+	}
+}
+
+// ManagedSession is a client started by a SessionManager. Its owner closes
+// it once the conversation ends.
+type ManagedSession struct {
+	ID      string
+	Client  *Client
+	Started time.Time
+
+	manager   *SessionManager
+	budget    time.Duration
+	log       *slog.Logger
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// credit is the decode time left, refilled at budget per second
+	mutex      sync.Mutex
+	credit     time.Duration
+	refilled   time.Time
+	overBudget bool
+	stats      SessionStats
+}
+
+// SessionStats are the stats of one session.
+type SessionStats struct {
+	// Packets counts the packets of model audio passed to the TrackWriter,
+	// DecodeTime the time spent decoding them, see DecodeBudget, and
+	// WriteTime the wall-clock time the TrackWriter took on them.
+	Packets        int
+	DecodeTime     time.Duration
+	WriteTime      time.Duration
+	SkippedPackets int
+	Connection     ConnectionStats
+}
+
+// Start connects client like Client.Connect, as a new session. id
+// identifies the session, e.g. the ID of a call; a random one is picked if
+// empty. It returns ErrTooManySessions beyond the limit, without connecting.
+func (m *SessionManager) Start(id string, client *Client, source audio.Source, audioWriter audio.TrackWriter) (*ManagedSession, error) {
+	if id == "" {
+		id = ids.New()
+	}
+	s := &ManagedSession{
+		ID:      id,
+		Client:  client,
+		Started: time.Now(),
+		manager: m,
+		done:    make(chan struct{}),
+	}
+	if m != nil {
+		s.budget = m.opts.DecodeBudget
+		s.credit, s.refilled = s.budget, s.Started
+		s.log = m.log.With("session", id)
+		if err := m.add(s); err != nil {
+			return nil, err
+		}
+	} else {
+		s.log = logging.Component(client.Logger, "sessions").With("session", id)
+	}
+
+	if err := client.Connect(source, budgetWriter{s, audioWriter}); err != nil {
+		if m != nil {
+			m.remove(s)
+		}
+		return nil, err
+	}
+	return s, nil
+}
+
+func (m *SessionManager) add(s *ManagedSession) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.closed {
+		return ErrManagerClosed
+	}
+	if _, ok := m.sessions[s.ID]; ok {
+		return fmt.Errorf("session %s already started", s.ID)
+	}
+	if m.opts.MaxSessions > 0 && len(m.sessions) >= m.opts.MaxSessions {
+		m.stats.Rejected++
+		metrics.Default.SessionsRejected.Inc()
+		m.log.Warn("rejected session", "err", ErrTooManySessions, "max", m.opts.MaxSessions)
+		return ErrTooManySessions
+	}
+	m.sessions[s.ID] = s
+	m.stats.Started++
+	metrics.Default.Sessions.Inc()
+	return nil
+}
+
+// remove ends a session, adding its stats to the totals.
+func (m *SessionManager) remove(s *ManagedSession) {
+	s.mutex.Lock()
+	stats := s.stats
+	s.mutex.Unlock()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.sessions[s.ID] != s {
+		return
+	}
+	delete(m.sessions, s.ID)
+	m.stats.DecodeTime += stats.DecodeTime
+	m.stats.WriteTime += stats.WriteTime
+	m.stats.SkippedPackets += stats.SkippedPackets
+	metrics.Default.Sessions.Dec()
+}
+
+// Session returns the session with id, nil if it has ended.
+func (m *SessionManager) Session(id string) *ManagedSession {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.sessions[id]
+}
+
+// Sessions returns the sessions in progress.
+func (m *SessionManager) Sessions() []*ManagedSession {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	sessions := make([]*ManagedSession, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// Stats returns the aggregate stats of the sessions.
+func (m *SessionManager) Stats() ManagerStats {
+	m.mutex.Lock()
+	stats := m.stats
+	stats.Active = len(m.sessions)
+	sessions := make([]*ManagedSession, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		sessions = append(sessions, s)
+	}
+	m.mutex.Unlock()
+
+	// The totals of the ended sessions are in m.stats already.
+	for _, s := range sessions {
+		s.mutex.Lock()
+		stats.DecodeTime += s.stats.DecodeTime
+		stats.WriteTime += s.stats.WriteTime
+		stats.SkippedPackets += s.stats.SkippedPackets
+		s.mutex.Unlock()
+	}
+	return stats
+}
+
+// Shutdown rejects the new sessions and closes the ones in progress, in
+// parallel, until they are closed or ctx is done.
+func (m *SessionManager) Shutdown(ctx context.Context) error {
+	m.mutex.Lock()
+	m.closed = true
+	m.mutex.Unlock()
+
+	sessions := m.Sessions()
+	if len(sessions) > 0 {
+		m.log.Info("closing sessions", "count", len(sessions))
+	}
+	var wg sync.WaitGroup
+	for _, s := range sessions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Close()
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Done is closed once the session is closed.
+func (s *ManagedSession) Done() <-chan struct{} {
+	return s.done
+}
+
+// Stats returns the stats of the session so far.
+func (s *ManagedSession) Stats() SessionStats {
+	s.mutex.Lock()
+	stats := s.stats
+	s.mutex.Unlock()
+	stats.Connection = s.Client.Stats()
+	return stats
+}
+
+// Close disconnects the client and ends the session.
+func (s *ManagedSession) Close() error {
+	s.closeOnce.Do(func() {
+		s.Client.Disconnect()
+		close(s.done)
+
+		if s.manager != nil {
+			s.manager.remove(s)
+		}
+		s.mutex.Lock()
+		stats := s.stats
+		s.mutex.Unlock()
+		s.log.Debug("session ended", "duration", time.Since(s.Started).Round(time.Second),
+			"decode_time", stats.DecodeTime, "write_time", stats.WriteTime, "skipped_packets", stats.SkippedPackets)
+	})
+	return nil
+}
+
+// written records the time the TrackWriter took on a packet.
+func (s *ManagedSession) written(d time.Duration) {
+	s.mutex.Lock()
+	s.stats.Packets++
+	s.stats.WriteTime += d
+	s.mutex.Unlock()
+	metrics.Default.SessionWriteSeconds.Add(d.Seconds())
+}
+
+// charge records the time spent decoding a packet.
+func (s *ManagedSession) charge(d time.Duration) {
+	s.mutex.Lock()
+	s.stats.DecodeTime += d
+	s.credit -= d
+	s.mutex.Unlock()
+	metrics.Default.SessionDecodeSeconds.Add(d.Seconds())
+}
+
+// allow refills the budget and tells whether the next packet may be
+// processed, counting it as skipped otherwise.
+func (s *ManagedSession) allow() bool {
+	if s.budget == 0 {
+		return true
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	now := time.Now()
+	s.credit = min(s.credit+now.Sub(s.refilled)*s.budget/time.Second, s.budget)
+	s.refilled = now
+
+	over := s.credit <= 0
+	if over != s.overBudget {
+		s.overBudget = over
+		if over {
+			s.log.Warn("over the decode budget, skipping model audio", "budget", s.budget)
+		} else {
+			s.log.Info("back within the decode budget", "skipped_packets", s.stats.SkippedPackets)
+		}
+	}
+	if over {
+		s.stats.SkippedPackets++
+		metrics.Default.SessionSkippedPackets.Inc()
+	}
+	return !over
+}
+
+// budgetWriter passes the model audio to a TrackWriter through a
+// budgetTrack.
+type budgetWriter struct {
+	s      *ManagedSession
+	writer audio.TrackWriter
+}
+
+func (w budgetWriter) WriteWebRTCTrack(track audio.RemoteTrack) error {
+	return w.writer.WriteWebRTCTrack(&budgetTrack{RemoteTrack: track, s: w.s})
+}
+
+// budgetTrack charges the decode time reported by the decoders of the
+// TrackWriter, and skips the packets over the budget. It also times the
+// TrackWriter between its reads, for the stats.
+type budgetTrack struct {
+	audio.RemoteTrack
+	s *ManagedSession
+	// returned is when the last packet was returned
+	returned time.Time
+}
+
+func (t *budgetTrack) ReadRTP() (*rtp.Packet, interceptor.Attributes, error) {
+	if !t.returned.IsZero() {
+		t.s.written(time.Since(t.returned))
+	}
+	for {
+		p, attributes, err := t.RemoteTrack.ReadRTP()
+		if err != nil {
+			t.returned = time.Time{}
+			return p, attributes, err
+		}
+		if t.s.allow() {
+			t.returned = time.Now()
+			return p, attributes, nil
+		}
+	}
+}
+
+// DecodeTime implements audio.DecodeTimer.
+func (t *budgetTrack) DecodeTime(d time.Duration) {
+	t.s.charge(d)
+}
@@ -0,0 +1,147 @@
+package realtime
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"exp-openai-webrtc-streaming/audio"
+)
+
+// testWriter is a TrackWriter counting the packets, decoding them if decode
+// is set and then blocking for d, like a writer to a slow WebSocket.
+type testWriter struct {
+	decode bool
+	d      time.Duration
+
+	mutex   sync.Mutex
+	packets int
+}
+
+func (w *testWriter) WriteWebRTCTrack(track audio.RemoteTrack) error {
+	decoder := audio.NewTrackDecoder(track, wsSampleRate, 1)
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if w.decode {
+			duration := audio.OpusPacketDuration(packet.Payload)
+			if _, err := decoder.Decode(audio.Frame{Opus: packet.Payload, Duration: duration}); err != nil {
+				return err
+			}
+		}
+		w.mutex.Lock()
+		w.packets++
+		w.mutex.Unlock()
+		time.Sleep(w.d)
+	}
+}
+
+func (w *testWriter) count() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.packets
+}
+
+func TestSessionManager(t *testing.T) {
+	requireOpusEncoder(t)
+	// Each session of interest has its own stand-in, to send it the model
+	// audio.
+	server, budgetedServer, freeServer := newWSStandIn(t), newWSStandIn(t), newWSStandIn(t)
+	newClient := func(s *wsStandIn) *Client {
+		c := NewClient("sk-test")
+		c.Transport = TransportWebSocket
+		c.WebSocketURL = s.url()
+		return c
+	}
+
+	// A budget of 1µs is used up by the first packet decoded.
+	m := NewSessionManager(ManagerOptions{MaxSessions: 2, DecodeBudget: time.Microsecond})
+	decoding := &testWriter{decode: true}
+	budgeted, err := m.Start("a", newClient(budgetedServer), &toneSource{}, decoding)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Start("a", newClient(server), &toneSource{}, &testWriter{}); err == nil {
+		t.Fatal("started a session with the ID of another")
+	}
+	slow := &testWriter{d: 10 * time.Millisecond}
+	free, err := m.Start("", newClient(freeServer), &toneSource{}, slow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if free.ID == "" {
+		t.Fatal("no ID picked")
+	}
+	if _, err := m.Start("", newClient(server), &toneSource{}, &testWriter{}); !errors.Is(err, ErrTooManySessions) {
+		t.Fatalf("got %v, want ErrTooManySessions", err)
+	}
+	if stats := m.Stats(); stats.Active != 2 || stats.Started != 2 || stats.Rejected != 1 {
+		t.Fatalf("stats %+v", stats)
+	}
+	if m.Session("a") != budgeted {
+		t.Fatal("session a not found")
+	}
+
+	// One second of model audio for each session, 50 packets: the decoding
+	// session skips them once over its budget, while the session blocking
+	// without decoding is not charged for it.
+	budgetedServer.sendEvent(pcm16Delta("item_1", time.Second))
+	freeServer.sendEvent(pcm16Delta("item_1", time.Second))
+	for _, s := range []*ManagedSession{budgeted, free} {
+		waitFor(func() bool {
+			stats := s.Stats()
+			return stats.Packets+stats.SkippedPackets >= 50
+		})
+	}
+
+	b, f := budgeted.Stats(), free.Stats()
+	if f.Packets < 50 || f.SkippedPackets != 0 || f.DecodeTime != 0 || f.WriteTime < 50*slow.d {
+		t.Errorf("blocking session: %d packets, %d skipped, decode time %v, write time %v",
+			f.Packets, f.SkippedPackets, f.DecodeTime, f.WriteTime)
+	}
+	if decoding.count() > 2 || b.SkippedPackets < 48 || b.DecodeTime == 0 {
+		t.Errorf("decoding session: %d packets decoded, %d skipped, decode time %v",
+			decoding.count(), b.SkippedPackets, b.DecodeTime)
+	}
+
+	free.Close()
+	<-free.Done()
+	if stats := m.Stats(); stats.Active != 1 || stats.SkippedPackets != budgeted.Stats().SkippedPackets {
+		t.Fatalf("stats %+v", stats)
+	}
+	if _, err := m.Start("", newClient(server), &toneSource{}, &testWriter{}); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := m.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-budgeted.Done():
+	default:
+		t.Fatal("session not closed by Shutdown")
+	}
+	if len(m.Sessions()) != 0 {
+		t.Fatal("sessions left after Shutdown")
+	}
+	if _, err := m.Start("", newClient(server), &toneSource{}, &testWriter{}); !errors.Is(err, ErrManagerClosed) {
+		t.Fatalf("got %v, want ErrManagerClosed", err)
+	}
+
+	var none *SessionManager
+	s, err := none.Start("", newClient(server), &toneSource{}, &testWriter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+}
@@ -0,0 +1,130 @@
+package realtime
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"exp-openai-webrtc-streaming/redact"
+)
+
+// DefaultSessionsURL is the endpoint creating the sessions with their
+// ephemeral tokens.
+const DefaultSessionsURL = "https://api.openai.com/v1/realtime/sessions"
+
+// SessionConfig is the configuration of a session, see
+// https://platform.openai.com/docs/api-reference/realtime-sessions/create.
+// Empty fields are left to the API defaults.
+type SessionConfig struct {
+	Model        string `yaml:"model"`
+	Voice        string `yaml:"voice"`
+	Instructions string `yaml:"instructions"`
+	Tools        []Tool `yaml:"tools"`
+}
+
+// fields returns the fields of the configuration that are set, as in the
+// session object of the API.
+func (s SessionConfig) fields() map[string]any {
+	fields := map[string]any{}
+	if s.Model != "" {
+		fields["model"] = s.Model
+	}
+	if s.Voice != "" {
+		fields["voice"] = s.Voice
+	}
+	if s.Instructions != "" {
+		fields["instructions"] = s.Instructions
+	}
+	if len(s.Tools) > 0 {
+		fields["tools"] = s.Tools
+	}
+	return fields
+}
+
+// defaultHTTPClient makes the requests to the API without an HTTPClient, so
+// that a hung API cannot block a Connect or a token request forever.
+var defaultHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// Session is a session created with SessionsEndpoint.Create.
+type Session struct {
+	// Token is the ephemeral client secret, valid until ExpiresAt.
+	Token     redact.Secret
+	ExpiresAt time.Time
+	// Data is the response of the API, with the token in clear, e.g. to
+	// pass it on to a browser.
+	Data json.RawMessage
+}
+
+// SessionsEndpoint creates sessions with ephemeral tokens, which let
+// clients such as browsers connect without the API key.
+type SessionsEndpoint struct {
+	Key redact.Secret
+	// URL defaults to DefaultSessionsURL.
+	URL string
+	// HTTPClient defaults to a client timing out after 30s.
+	HTTPClient *http.Client
+}
+
+// Create creates a session. The token is not registered with redact, since
+// a server may create many of them; its ek_ shape is redacted.
+func (e *SessionsEndpoint) Create(ctx context.Context, config SessionConfig) (*Session, error) {
+	var bodyBuf bytes.Buffer
+	if err := json.NewEncoder(&bodyBuf).Encode(config.fields()); err != nil {
+		return nil, err
+	}
+
+	endpoint := e.URL
+	if endpoint == "" {
+		endpoint = DefaultSessionsURL
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, &bodyBuf)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+string(e.Key))
+	req.Header.Set("Content-Type", "application/json")
+
+	client := e.HTTPClient
+	if client == nil {
+		client = defaultHTTPClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != 200 {
+		return nil, newAPIError(res)
+	}
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	var output struct {
+		ClientSecret struct {
+			Value     string `json:"value"`
+			ExpiresAt int64  `json:"expires_at"`
+		} `json:"client_secret"`
+	}
+	if err := json.Unmarshal(data, &output); err != nil {
+		return nil, fmt.Errorf("failed to parse session: %w", err)
+	}
+
+	// should never happen
+	if output.ClientSecret.Value == "" {
+		return nil, fmt.Errorf("got back empty token")
+	}
+
+	return &Session{
+		Token:     redact.Secret(output.ClientSecret.Value),
+		ExpiresAt: time.Unix(output.ClientSecret.ExpiresAt, 0),
+		Data:      data,
+	}, nil
+}
@@ -0,0 +1,244 @@
+package realtime
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+const defaultStatsInterval = time.Second
+
+// RTPStreamStats describes one direction of the audio stream.
+type RTPStreamStats struct {
+	SSRC uint32
+	// Packets and Bytes are the totals received (inbound) or sent (outbound).
+	Packets uint64
+	Bytes   uint64
+	// PacketsLost is computed locally for the inbound stream and taken from
+	// the RTCP receiver reports of the remote peer for the outbound stream.
+	PacketsLost int64
+	// FractionLost is the loss reported in the last RTCP receiver report.
+	// It is only available for the outbound stream.
+	FractionLost float64
+	// Jitter is the interarrival jitter of the inbound stream.
+	Jitter time.Duration
+	// Bitrate is the payload bitrate in bits per second since the previous
+	// snapshot.
+	Bitrate float64
+}
+
+// ConnectionStats is a snapshot of the network quality of the peer connection.
+type ConnectionStats struct {
+	Timestamp time.Time
+
+	// Inbound is the model audio received from OpenAI, Outbound is the user
+	// audio sent to OpenAI.
+	Inbound  RTPStreamStats
+	Outbound RTPStreamStats
+
+	// RoundTripTime is measured with RTCP sender and receiver reports.
+	RoundTripTime time.Duration
+	// ICERoundTripTime is measured with STUN consent checks on the selected
+	// candidate pair. It is available even before RTCP has been exchanged.
+	ICERoundTripTime time.Duration
+
+	// CandidatePair is the selected ICE candidate pair, if any.
+	CandidatePair *webrtc.ICECandidatePair
+}
+
+// statsCollector samples the RTP stats interceptor and the ICE transport of a
+// peer connection at a fixed interval.
+type statsCollector struct {
+	mutex        sync.Mutex
+	getter       stats.Getter
+	inboundSSRC  uint32
+	inboundClock uint32
+	outboundSSRC uint32
+	last         ConnectionStats
+	subscribers  map[chan ConnectionStats]struct{}
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// register adds the RTP stats interceptor to the interceptor registry.
+func (s *statsCollector) register(registry *interceptor.Registry) error {
+	factory, err := stats.NewInterceptor()
+	if err != nil {
+		return err
+	}
+	factory.OnNewPeerConnection(func(_ string, getter stats.Getter) {
+		s.mutex.Lock()
+		s.getter = getter
+		s.mutex.Unlock()
+	})
+	registry.Add(factory)
+	return nil
+}
+
+func (s *statsCollector) setInbound(ssrc webrtc.SSRC, clockRate uint32) {
+	s.mutex.Lock()
+	s.inboundSSRC = uint32(ssrc)
+	s.inboundClock = clockRate
+	s.mutex.Unlock()
+}
+
+func (s *statsCollector) setOutboundSSRC(ssrc webrtc.SSRC) {
+	s.mutex.Lock()
+	s.outboundSSRC = uint32(ssrc)
+	s.mutex.Unlock()
+}
+
+// start samples pc every interval until stop is called.
+func (s *statsCollector) start(pc *webrtc.PeerConnection, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultStatsInterval
+	}
+
+	s.done = make(chan struct{})
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+				s.sample(pc)
+			}
+		}
+	}()
+}
+
+func (s *statsCollector) stop() {
+	if s.done == nil {
+		return
+	}
+	close(s.done)
+	s.wg.Wait()
+	s.done = nil
+}
+
+func (s *statsCollector) sample(pc *webrtc.PeerConnection) {
+	now := time.Now()
+	snapshot := ConnectionStats{Timestamp: now}
+
+	iceTransport := pc.SCTP().Transport().ICETransport()
+	if pair, err := iceTransport.GetSelectedCandidatePair(); err == nil {
+		snapshot.CandidatePair = pair
+	}
+	if pairStats, ok := iceTransport.GetSelectedCandidatePairStats(); ok {
+		snapshot.ICERoundTripTime = time.Duration(pairStats.CurrentRoundTripTime * float64(time.Second))
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.getter != nil {
+		if in := s.getter.Get(s.inboundSSRC); s.inboundSSRC != 0 && in != nil {
+			snapshot.Inbound = RTPStreamStats{
+				SSRC:        s.inboundSSRC,
+				Packets:     in.InboundRTPStreamStats.PacketsReceived,
+				Bytes:       in.InboundRTPStreamStats.BytesReceived,
+				PacketsLost: in.InboundRTPStreamStats.PacketsLost,
+			}
+			// The interceptor reports the jitter in RTP timestamp units
+			if s.inboundClock > 0 {
+				jitter := in.InboundRTPStreamStats.Jitter / float64(s.inboundClock)
+				snapshot.Inbound.Jitter = time.Duration(jitter * float64(time.Second))
+			}
+		}
+		if out := s.getter.Get(s.outboundSSRC); s.outboundSSRC != 0 && out != nil {
+			snapshot.Outbound = RTPStreamStats{
+				SSRC:         s.outboundSSRC,
+				Packets:      out.OutboundRTPStreamStats.PacketsSent,
+				Bytes:        out.OutboundRTPStreamStats.BytesSent,
+				PacketsLost:  out.RemoteInboundRTPStreamStats.PacketsLost,
+				FractionLost: out.RemoteInboundRTPStreamStats.FractionLost,
+			}
+			snapshot.RoundTripTime = out.RemoteInboundRTPStreamStats.RoundTripTime
+		}
+	}
+
+	if elapsed := now.Sub(s.last.Timestamp).Seconds(); !s.last.Timestamp.IsZero() && elapsed > 0 {
+		snapshot.Inbound.Bitrate = bitrate(s.last.Inbound.Bytes, snapshot.Inbound.Bytes, elapsed)
+		snapshot.Outbound.Bitrate = bitrate(s.last.Outbound.Bytes, snapshot.Outbound.Bytes, elapsed)
+	}
+	s.last = snapshot
+
+	for ch := range s.subscribers {
+		// Never block the collector on a slow subscriber, it will get the
+		// next snapshot instead.
+		select {
+		case ch <- snapshot:
+		default:
+		}
+	}
+}
+
+func bitrate(prevBytes, bytes uint64, seconds float64) float64 {
+	if bytes < prevBytes {
+		return 0
+	}
+	return float64(bytes-prevBytes) * 8 / seconds
+}
+
+func (s *statsCollector) snapshot() ConnectionStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.last
+}
+
+func (s *statsCollector) subscribe() (<-chan ConnectionStats, func()) {
+	ch := make(chan ConnectionStats, 1)
+
+	s.mutex.Lock()
+	if s.subscribers == nil {
+		s.subscribers = make(map[chan ConnectionStats]struct{})
+	}
+	s.subscribers[ch] = struct{}{}
+	s.mutex.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			s.mutex.Lock()
+			delete(s.subscribers, ch)
+			s.mutex.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// Stats returns the latest snapshot of the connection stats. It is zero
+// until the first interval after Connect has elapsed.
+func (c *Client) Stats() ConnectionStats {
+	return c.stats.snapshot()
+}
+
+// SubscribeStats returns a channel that receives a snapshot of the connection
+// stats every StatsInterval while connected. Snapshots are dropped if the
+// channel is not drained in time. The returned function unsubscribes and
+// closes the channel.
+func (c *Client) SubscribeStats() (<-chan ConnectionStats, func()) {
+	return c.stats.subscribe()
+}
+
+// drainRTCP reads RTCP packets until r is closed. Reading is what makes the
+// interceptors, and thus the stats, see the incoming reports.
+func drainRTCP(r interface {
+	ReadRTCP() ([]rtcp.Packet, interceptor.Attributes, error)
+}) {
+	for {
+		if _, _, err := r.ReadRTCP(); err != nil {
+			return
+		}
+	}
+}
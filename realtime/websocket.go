@@ -0,0 +1,274 @@
+package realtime
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"exp-openai-webrtc-streaming/audio"
+	"exp-openai-webrtc-streaming/internal/logging"
+)
+
+// DefaultWebSocketURL is the endpoint of TransportWebSocket.
+const DefaultWebSocketURL = "wss://api.openai.com/v1/realtime"
+
+// The format of the audio over the WebSocket, the pcm16 format of the API.
+const (
+	wsSampleRate = 24_000
+	wsChannels   = 1
+)
+
+// wsSession is a connection of TransportWebSocket. The user audio is sent
+// with input_audio_buffer.append events, and the model audio received with
+// response.audio.delta events is written to a PCMTrack, so that it reaches
+// the TrackWriter like a WebRTC track.
+type wsSession struct {
+	conn  *websocket.Conn
+	track *audio.PCMTrack
+	log   *slog.Logger
+	// writeMutex serializes the writes, which the connection requires
+	writeMutex sync.Mutex
+
+	// itemID is the item whose audio is being received, and itemStart where
+	// it starts in the track, to truncate it when the user interrupts
+	mutex     sync.Mutex
+	itemID    string
+	itemStart time.Duration
+
+	captureDone chan struct{}
+	captureWG   sync.WaitGroup
+	readWG      sync.WaitGroup
+}
+
+func (c *Client) connectWebSocket(source audio.Source, audioWriter audio.TrackWriter) error {
+	endpoint := c.WebSocketURL
+	if endpoint == "" {
+		endpoint = DefaultWebSocketURL
+	}
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+string(c.Key))
+	header.Set("OpenAI-Beta", "realtime=v1")
+
+	conn, res, err := websocket.DefaultDialer.Dial(endpoint+"?model="+url.QueryEscape(c.Model), header)
+	if err != nil {
+		if res != nil {
+			defer res.Body.Close()
+			return newAPIError(res)
+		}
+		return fmt.Errorf("failed to connect WebSocket: %w", err)
+	}
+
+	track, err := audio.NewPCMTrack(wsSampleRate, wsChannels, c.Opus)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	s := &wsSession{
+		conn:  conn,
+		track: track,
+		log:   logging.Component(c.Logger, "ws"),
+	}
+
+	// The model is picked by the URL
+	session := c.session()
+	session.Model = ""
+	fields := session.fields()
+	fields["input_audio_format"] = "pcm16"
+	fields["output_audio_format"] = "pcm16"
+	if c.ManualTurns {
+		fields["turn_detection"] = nil
+	}
+	if err := s.sendEvent(map[string]any{"type": "session.update", "session": fields}); err != nil {
+		track.Close()
+		conn.Close()
+		return fmt.Errorf("failed to update session: %w", err)
+	}
+
+	c.dataChannelMutex.Lock()
+	c.ws = s
+	c.dataChannelMutex.Unlock()
+
+	go func() {
+		if err := audioWriter.WriteWebRTCTrack(track); err != nil {
+			s.log.Error("failed to write model audio", "err", err)
+		}
+	}()
+	s.readWG.Add(1)
+	go s.read(c)
+	s.startCapture(source, logging.Component(c.Logger, "mic"))
+	return nil
+}
+
+// read handles the server events until the connection is closed. The audio
+// events are consumed here, the others go to the client like the events of
+// the data channel.
+func (s *wsSession) read(c *Client) {
+	defer s.readWG.Done()
+	// The track ends with the connection, which ends the TrackWriter.
+	defer s.track.Close()
+	for {
+		_, data, err := s.conn.ReadMessage()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) && !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				s.log.Error("failed to read WebSocket", "err", err)
+			}
+			return
+		}
+
+		var event struct {
+			Type   string `json:"type"`
+			ItemID string `json:"item_id"`
+			Delta  string `json:"delta"`
+		}
+		if err := json.Unmarshal(data, &event); err != nil {
+			s.log.Warn("failed to parse server event", "err", err)
+			continue
+		}
+		switch event.Type {
+		case "response.audio.delta":
+			if err := s.writeAudio(event.ItemID, event.Delta); err != nil {
+				s.log.Warn("failed to write model audio", "err", err)
+			}
+			continue
+		case "input_audio_buffer.speech_started":
+			s.interrupt()
+		}
+		c.handleEvent(s.log, data)
+	}
+}
+
+// writeAudio writes the base64 PCM16 of a response.audio.delta event.
+func (s *wsSession) writeAudio(itemID, delta string) error {
+	data, err := base64.StdEncoding.DecodeString(delta)
+	if err != nil {
+		return fmt.Errorf("failed to decode audio: %w", err)
+	}
+	pcm := make([]int16, len(data)/2)
+	for i := range pcm {
+		pcm[i] = int16(binary.LittleEndian.Uint16(data[i*2:]))
+	}
+
+	s.mutex.Lock()
+	if itemID != s.itemID {
+		s.itemID, s.itemStart = itemID, s.track.Written()
+	}
+	s.mutex.Unlock()
+	return s.track.Write(pcm)
+}
+
+// interrupt drops the model audio not played yet when the user starts
+// speaking, and truncates the item to what was played. Over WebRTC, the
+// server stops sending on its own.
+func (s *wsSession) interrupt() {
+	s.mutex.Lock()
+	itemID, start := s.itemID, s.itemStart
+	s.itemID = ""
+	s.mutex.Unlock()
+
+	if itemID == "" || s.track.Clear() == 0 {
+		return
+	}
+	played := max(s.track.Released()-start, 0)
+	s.log.Debug("truncating interrupted item", "item_id", itemID, "played", played)
+	err := s.sendEvent(map[string]any{
+		"type":          "conversation.item.truncate",
+		"item_id":       itemID,
+		"content_index": 0,
+		"audio_end_ms":  played.Milliseconds(),
+	})
+	if err != nil {
+		s.log.Warn("failed to truncate interrupted item", "err", err)
+	}
+}
+
+// startCapture sends the source audio until it ends or stopCapture is
+// called.
+func (s *wsSession) startCapture(source audio.Source, log *slog.Logger) {
+	s.captureDone = make(chan struct{})
+	s.captureWG.Add(1)
+	go func() {
+		defer s.captureWG.Done()
+		decoder := audio.NewFrameDecoder(wsSampleRate, wsChannels)
+		var buf []byte
+		for {
+			select {
+			case <-s.captureDone:
+				return
+			default:
+			}
+
+			frame, err := source.ReadAudio()
+			if errors.Is(err, io.EOF) {
+				log.Info("audio source ended")
+				return
+			}
+			if err != nil {
+				log.Error("failed to read audio source", "err", err)
+				return
+			}
+			pcm, err := decoder.Decode(frame)
+			if err != nil {
+				log.Warn("failed to send audio frame", "err", err)
+				continue
+			}
+
+			buf = buf[:0]
+			for _, sample := range pcm {
+				buf = binary.LittleEndian.AppendUint16(buf, uint16(sample))
+			}
+			err = s.sendEvent(map[string]string{
+				"type":  "input_audio_buffer.append",
+				"audio": base64.StdEncoding.EncodeToString(buf),
+			})
+			if err != nil {
+				log.Warn("failed to send audio frame", "err", err)
+			}
+		}
+	}()
+}
+
+// stopCapture waits for the frame being read to be sent.
+func (s *wsSession) stopCapture() {
+	if s.captureDone == nil {
+		return
+	}
+	close(s.captureDone)
+	s.captureWG.Wait()
+	s.captureDone = nil
+}
+
+func (s *wsSession) sendEvent(event any) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+	return s.write(data)
+}
+
+func (s *wsSession) write(data []byte) error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	return s.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// close stops the capture, then closes the connection, which ends the
+// track.
+func (s *wsSession) close() {
+	s.stopCapture()
+	s.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(time.Second))
+	s.conn.Close()
+	s.readWG.Wait()
+}
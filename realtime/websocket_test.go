@@ -0,0 +1,366 @@
+package realtime
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"exp-openai-webrtc-streaming/audio"
+)
+
+// wsStandIn is a local stand-in of the WebSocket endpoint of the API. It
+// records the client events and sends the events pushed to send.
+type wsStandIn struct {
+	*httptest.Server
+	send chan []byte
+	// closed is closed once the client has closed the connection
+	closed chan struct{}
+
+	mutex  sync.Mutex
+	header http.Header
+	query  string
+	events []json.RawMessage
+	// received is signaled on each event
+	received chan struct{}
+}
+
+func newWSStandIn(t *testing.T) *wsStandIn {
+	s := &wsStandIn{
+		send:     make(chan []byte, 100),
+		closed:   make(chan struct{}),
+		received: make(chan struct{}, 1000),
+	}
+	upgrader := websocket.Upgrader{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mutex.Lock()
+		s.header, s.query = r.Header.Clone(), r.URL.RawQuery
+		s.mutex.Unlock()
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		go func() {
+			for data := range s.send {
+				if conn.WriteMessage(websocket.TextMessage, data) != nil {
+					return
+				}
+			}
+		}()
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+					close(s.closed)
+				}
+				return
+			}
+			s.mutex.Lock()
+			s.events = append(s.events, data)
+			s.mutex.Unlock()
+			s.received <- struct{}{}
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *wsStandIn) url() string {
+	return "ws" + strings.TrimPrefix(s.URL, "http")
+}
+
+// sendEvent sends a server event.
+func (s *wsStandIn) sendEvent(event map[string]any) {
+	data, _ := json.Marshal(event)
+	s.send <- data
+}
+
+// waitEvent waits for a client event of type, and returns it.
+func (s *wsStandIn) waitEvent(t *testing.T, eventType string) map[string]any {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for seen := 0; ; {
+		s.mutex.Lock()
+		events := s.events[seen:]
+		seen = len(s.events)
+		s.mutex.Unlock()
+		for _, data := range events {
+			var event map[string]any
+			json.Unmarshal(data, &event)
+			if event["type"] == eventType {
+				return event
+			}
+		}
+		select {
+		case <-s.received:
+		case <-timeout:
+			t.Fatalf("no %s event", eventType)
+		}
+	}
+}
+
+// appendedAudio returns the bytes of PCM sent with input_audio_buffer.append.
+func (s *wsStandIn) appendedAudio() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var n int
+	for _, data := range s.events {
+		var event struct {
+			Type  string `json:"type"`
+			Audio string `json:"audio"`
+		}
+		json.Unmarshal(data, &event)
+		if event.Type == "input_audio_buffer.append" {
+			pcm, _ := base64.StdEncoding.DecodeString(event.Audio)
+			n += len(pcm)
+		}
+	}
+	return n
+}
+
+// toneSource is a Source of frames 20ms of a tone, count of them at most.
+type toneSource struct {
+	count, read int
+}
+
+func (s *toneSource) ReadAudio() (audio.Frame, error) {
+	if s.read >= s.count {
+		return audio.Frame{}, io.EOF
+	}
+	time.Sleep(20 * time.Millisecond)
+	pcm := make([]int16, 960*2)
+	for i := range pcm {
+		pcm[i] = int16(8000 * math.Sin(float64(s.read*960+i/2)*0.05))
+	}
+	s.read++
+	return audio.Frame{PCM: pcm, SampleRate: 48_000, Channels: 2}, nil
+}
+
+// packetCounter is a TrackWriter counting the packets of the track.
+type packetCounter struct {
+	mutex   sync.Mutex
+	packets int
+	done    chan struct{}
+}
+
+func newPacketCounter() *packetCounter {
+	return &packetCounter{done: make(chan struct{})}
+}
+
+func (w *packetCounter) WriteWebRTCTrack(track audio.RemoteTrack) error {
+	defer close(w.done)
+	for {
+		if _, _, err := track.ReadRTP(); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		w.mutex.Lock()
+		w.packets++
+		w.mutex.Unlock()
+	}
+}
+
+func (w *packetCounter) count() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.packets
+}
+
+// waitFor polls cond for up to 5s.
+func waitFor(cond func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !cond() && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// requireOpusEncoder skips the tests of the model audio of TransportWebSocket
+// in the builds without libopus, which cannot encode it.
+func requireOpusEncoder(t *testing.T) {
+	t.Helper()
+	track, err := audio.NewPCMTrack(wsSampleRate, wsChannels, audio.DefaultOpusEncoderOptions())
+	if err != nil {
+		t.Skip(err)
+	}
+	track.Close()
+}
+
+// pcm16Delta returns a response.audio.delta event with d of a tone.
+func pcm16Delta(itemID string, d time.Duration) map[string]any {
+	samples := int(d * wsSampleRate / time.Second)
+	data := make([]byte, 0, samples*2)
+	for i := range samples {
+		data = binary.LittleEndian.AppendUint16(data, uint16(int16(8000*math.Sin(float64(i)*0.1))))
+	}
+	return map[string]any{
+		"type":    "response.audio.delta",
+		"item_id": itemID,
+		"delta":   base64.StdEncoding.EncodeToString(data),
+	}
+}
+
+func TestWebSocketTransport(t *testing.T) {
+	requireOpusEncoder(t)
+	server := newWSStandIn(t)
+
+	c := NewClient("sk-test-0123456789")
+	c.Transport = TransportWebSocket
+	c.WebSocketURL = server.url()
+	c.Voice = "alloy"
+	c.ManualTurns = true
+	var eventsMutex sync.Mutex
+	var events []string
+	responseDone := make(chan struct{})
+	c.OnEvent = func(event Event) {
+		eventsMutex.Lock()
+		events = append(events, event.Type)
+		eventsMutex.Unlock()
+		if event.Type == "response.done" {
+			close(responseDone)
+		}
+	}
+	writer := newPacketCounter()
+	source := &toneSource{count: 10}
+	if err := c.Connect(source, writer); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect()
+
+	// session.update configures the session first
+	update := server.waitEvent(t, "session.update")
+	session, _ := update["session"].(map[string]any)
+	if session["voice"] != "alloy" || session["input_audio_format"] != "pcm16" || session["output_audio_format"] != "pcm16" {
+		t.Errorf("session.update %v", session)
+	}
+	if v, ok := session["turn_detection"]; !ok || v != nil {
+		t.Errorf("turn_detection %v, want null with ManualTurns", v)
+	}
+	if _, ok := session["model"]; ok {
+		t.Error("the model is in session.update, not only in the URL")
+	}
+	server.mutex.Lock()
+	auth, beta, query := server.header.Get("Authorization"), server.header.Get("OpenAI-Beta"), server.query
+	server.mutex.Unlock()
+	if auth != "Bearer sk-test-0123456789" || beta != "realtime=v1" || query != "model="+DefaultModel {
+		t.Errorf("handshake: Authorization %q, OpenAI-Beta %q, query %q", auth, beta, query)
+	}
+
+	// The user audio streams as 24kHz mono PCM16, 20ms in each append.
+	waitFor(func() bool { return server.appendedAudio() >= 10*480*2 })
+	if n := server.appendedAudio(); n != 10*480*2 {
+		t.Errorf("appended %d bytes of audio, want %d", n, 10*480*2)
+	}
+	if err := c.CommitInputAudio(); err != nil {
+		t.Fatal(err)
+	}
+	server.waitEvent(t, "input_audio_buffer.commit")
+	server.waitEvent(t, "response.create")
+
+	// The model audio reaches the TrackWriter as 20ms Opus packets, the
+	// audio events do not reach OnEvent.
+	server.sendEvent(map[string]any{"type": "response.created"})
+	for range 5 {
+		server.sendEvent(pcm16Delta("item1", 100*time.Millisecond))
+	}
+	server.sendEvent(map[string]any{"type": "response.done"})
+	select {
+	case <-responseDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no response.done event")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// the last packet is paced after the queue is drained
+	waitFor(func() bool { return writer.count() >= 25 })
+	if n := writer.count(); n != 25 {
+		t.Errorf("wrote %d packets of model audio, want 25", n)
+	}
+	eventsMutex.Lock()
+	got := strings.Join(events, ",")
+	eventsMutex.Unlock()
+	if got != "response.created,response.done" {
+		t.Errorf("events %s", got)
+	}
+
+	// Disconnect closes the WebSocket normally, which ends the track.
+	c.Disconnect()
+	select {
+	case <-server.closed:
+	case <-time.After(5 * time.Second):
+		t.Error("the WebSocket was not closed")
+	}
+	select {
+	case <-writer.done:
+	case <-time.After(5 * time.Second):
+		t.Error("the TrackWriter did not return")
+	}
+}
+
+func TestWebSocketInterrupt(t *testing.T) {
+	requireOpusEncoder(t)
+	server := newWSStandIn(t)
+
+	c := NewClient("k")
+	c.Transport = TransportWebSocket
+	c.WebSocketURL = server.url()
+	writer := newPacketCounter()
+	if err := c.Connect(&toneSource{}, writer); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Disconnect()
+	server.waitEvent(t, "session.update")
+
+	// A second of audio arrives in a burst, and the user interrupts it.
+	server.sendEvent(pcm16Delta("item1", time.Second))
+	time.Sleep(300 * time.Millisecond)
+	server.sendEvent(map[string]any{"type": "input_audio_buffer.speech_started"})
+
+	truncate := server.waitEvent(t, "conversation.item.truncate")
+	end, _ := truncate["audio_end_ms"].(float64)
+	if truncate["item_id"] != "item1" || end < 100 || end > 600 {
+		t.Errorf("truncate %v, want item1 at about 300ms", truncate)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if n := writer.count(); n > 35 {
+		t.Errorf("wrote %d packets, the interrupted audio was not cleared", n)
+	}
+}
+
+func TestWebSocketAPIError(t *testing.T) {
+	const key = "sk-test-0123456789"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		io.WriteString(w, `{"error":{"message":"Incorrect API key provided: `+key+`","type":"invalid_request_error","code":"invalid_api_key"}}`)
+	}))
+	defer server.Close()
+
+	c := NewClient(key)
+	c.Transport = TransportWebSocket
+	c.WebSocketURL = "ws" + strings.TrimPrefix(server.URL, "http")
+	err := c.Connect(&toneSource{}, newPacketCounter())
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized || apiErr.Code != "invalid_api_key" {
+		t.Fatalf("got error %v, want the API error", err)
+	}
+	if strings.Contains(err.Error(), key) {
+		t.Errorf("error %q has the key", err)
+	}
+}
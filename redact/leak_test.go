@@ -0,0 +1,136 @@
+package redact_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"exp-openai-webrtc-streaming/audio"
+	"exp-openai-webrtc-streaming/internal/logging"
+	"exp-openai-webrtc-streaming/realtime"
+	"exp-openai-webrtc-streaming/tokenserver"
+)
+
+const (
+	// goodKey is not shaped like an OpenAI key, only its registration by
+	// the client redacts it.
+	goodKey  = "project-credential-0123456789"
+	wrongKey = "sk-wrong-0123456789abcdef"
+	token    = "ek_0123456789abcdef"
+)
+
+// newEchoAPI returns a fake of the Realtime API rejecting the requests with
+// the credential they were made with in the error, as the API does. The
+// sessions endpoint mints a token for goodKey, which the WebRTC endpoint
+// rejects too.
+func newEchoAPI(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		credential := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if strings.HasSuffix(r.URL.Path, "/sessions") && credential == goodKey {
+			io.WriteString(w, `{"id":"sess_1","client_secret":{"value":"`+token+`","expires_at":1700000060}}`)
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		io.WriteString(w, `{"error":{"message":"Incorrect API key provided: `+credential+
+			`","type":"invalid_request_error","code":"invalid_api_key"}}`)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// checkRedacted fails if any secret is in the output.
+func checkRedacted(t *testing.T, what, output string, secrets ...string) {
+	t.Helper()
+	for _, secret := range secrets {
+		if strings.Contains(output, secret) {
+			t.Errorf("%s has %q:\n%s", what, secret, output)
+		}
+	}
+}
+
+// silence is a Source of 20ms frames of silence.
+type silence struct{}
+
+func (silence) ReadAudio() (audio.Frame, error) {
+	return audio.Frame{PCM: make([]int16, 960), SampleRate: 48_000, Channels: 1}, nil
+}
+
+type discard struct{}
+
+func (discard) WriteWebRTCTrack(track audio.RemoteTrack) error { return nil }
+
+func TestClientRedaction(t *testing.T) {
+	api := newEchoAPI(t)
+	tests := []struct {
+		name      string
+		key       string
+		transport realtime.Transport
+		// secret is the credential echoed back by the API
+		secret string
+	}{
+		{"sessions", "sk-rejected-0123456789abcdef", realtime.TransportWebRTC, "sk-rejected-0123456789abcdef"},
+		{"offer", goodKey, realtime.TransportWebRTC, token},
+		{"websocket", goodKey, realtime.TransportWebSocket, goodKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			logger, err := logging.New(&logs, "debug")
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := realtime.NewClient(tt.key)
+			c.Logger = logger
+			c.Transport = tt.transport
+			c.ICEServers = nil
+			c.SessionsURL = api.URL + "/v1/realtime/sessions"
+			c.WebRTCURL = api.URL + "/v1/realtime"
+			c.WebSocketURL = "ws" + strings.TrimPrefix(api.URL, "http") + "/v1/realtime"
+
+			err = c.Connect(silence{}, discard{})
+			if err == nil {
+				c.Disconnect()
+				t.Fatal("connected with a rejected credential")
+			}
+			if !strings.Contains(err.Error(), "Incorrect API key") {
+				t.Errorf("error %q is not the one of the API", err)
+			}
+			logger.Error("failed to connect", "err", err)
+			checkRedacted(t, "the error", err.Error(), tt.secret)
+			checkRedacted(t, "the logs", logs.String(), tt.key, tt.secret)
+		})
+	}
+}
+
+func TestTokenServerRedaction(t *testing.T) {
+	api := newEchoAPI(t)
+	var logs bytes.Buffer
+	logger, err := logging.New(&logs, "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := tokenserver.New(tokenserver.Options{
+		Sessions:     realtime.SessionsEndpoint{Key: wrongKey, URL: api.URL + "/v1/realtime/sessions"},
+		Authenticate: tokenserver.BearerAuth(map[string]string{"alice": "alice-token"}),
+		Logger:       logger,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/session", nil)
+	r.Header.Set("Authorization", "Bearer alice-token")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("status %d, want 502", w.Code)
+	}
+	if !strings.Contains(logs.String(), "invalid_api_key") {
+		t.Errorf("the API error is not logged:\n%s", logs.String())
+	}
+	checkRedacted(t, "the response", w.Body.String(), wrongKey)
+	checkRedacted(t, "the logs", logs.String(), wrongKey)
+}
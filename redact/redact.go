@@ -0,0 +1,167 @@
+// Package redact keeps credentials out of logs and error messages. Values
+// registered with Register, Authorization headers and anything shaped like
+// an OpenAI key are replaced with [REDACTED].
+package redact
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const redacted = "[REDACTED]"
+
+// Secret is a credential, such as the OpenAI API key or an ephemeral client
+// secret. It formats, logs and marshals as [REDACTED]; use string(s) at the
+// one place where the actual value is needed.
+type Secret string
+
+func (s Secret) String() string   { return redacted }
+func (s Secret) GoString() string { return `"` + redacted + `"` }
+
+// Format redacts s for every verb, including %q, %x and %#v.
+func (s Secret) Format(f fmt.State, verb rune) {
+	io.WriteString(f, redacted)
+}
+
+func (s Secret) LogValue() slog.Value {
+	return slog.StringValue(redacted)
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(redacted)
+}
+
+// secretPatterns match credentials that were never registered with
+// Register, e.g. ones echoed back by the API.
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)(bearer\s+)[^\s"',]+`),
+	regexp.MustCompile(`\bsk-[A-Za-z0-9_\-]{8,}`),
+	regexp.MustCompile(`\bek_[A-Za-z0-9_\-]{8,}`),
+}
+
+// knownSecrets are the exact credential values in use by this process.
+var knownSecrets struct {
+	mutex  sync.RWMutex
+	values map[string]struct{}
+}
+
+// Register makes String remove every occurrence of value.
+func Register(value string) {
+	if value == "" {
+		return
+	}
+
+	knownSecrets.mutex.Lock()
+	defer knownSecrets.mutex.Unlock()
+	if knownSecrets.values == nil {
+		knownSecrets.values = make(map[string]struct{})
+	}
+	knownSecrets.values[value] = struct{}{}
+}
+
+// String replaces the registered secrets, Authorization header values and
+// anything shaped like an OpenAI key in s with [REDACTED].
+func String(s string) string {
+	knownSecrets.mutex.RLock()
+	for value := range knownSecrets.values {
+		s = strings.ReplaceAll(s, value, redacted)
+	}
+	knownSecrets.mutex.RUnlock()
+
+	for i, re := range secretPatterns {
+		if i == 0 {
+			s = re.ReplaceAllString(s, "${1}"+redacted)
+			continue
+		}
+		s = re.ReplaceAllString(s, redacted)
+	}
+	return s
+}
+
+// Handler is a slog.Handler that runs the message and every string, error,
+// Stringer and other attribute through String before passing the record on.
+// The attributes of other kinds, such as a map or an http.Header, are passed
+// on formatted as strings.
+type Handler struct {
+	next slog.Handler
+}
+
+// NewHandler returns a Handler passing the redacted records to next.
+func NewHandler(next slog.Handler) *Handler {
+	return &Handler{next: next}
+}
+
+func (h *Handler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *Handler) Handle(ctx context.Context, r slog.Record) error {
+	out := slog.NewRecord(r.Time, r.Level, String(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(redactAttr(a))
+		return true
+	})
+	return h.next.Handle(ctx, out)
+}
+
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redactedAttrs := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redactedAttrs[i] = redactAttr(a)
+	}
+	return &Handler{next: h.next.WithAttrs(redactedAttrs)}
+}
+
+func (h *Handler) WithGroup(name string) slog.Handler {
+	return &Handler{next: h.next.WithGroup(name)}
+}
+
+func redactAttr(a slog.Attr) slog.Attr {
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, String(v.String()))
+	case slog.KindGroup:
+		group := v.Group()
+		attrs := make([]any, len(group))
+		for i, ga := range group {
+			attrs[i] = redactAttr(ga)
+		}
+		return slog.Group(a.Key, attrs...)
+	case slog.KindAny:
+		switch x := v.Any().(type) {
+		case error:
+			return slog.String(a.Key, String(x.Error()))
+		case fmt.Stringer:
+			return slog.String(a.Key, String(x.String()))
+		case []byte:
+			return slog.String(a.Key, String(string(x)))
+		default:
+			// e.g. an http.Header, formatted as by the text handler
+			return slog.String(a.Key, String(fmt.Sprintf("%+v", x)))
+		}
+	}
+	return slog.Attr{Key: a.Key, Value: v}
+}
+
+// Error wraps err so that its message is redacted, while errors.Is and
+// errors.As still see the original error.
+func Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &redactedError{err: err}
+}
+
+type redactedError struct {
+	err error
+}
+
+func (e *redactedError) Error() string { return String(e.err.Error()) }
+func (e *redactedError) Unwrap() error { return e.err }
@@ -0,0 +1,69 @@
+package redact
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHandlerRedactsCapturedOutput(t *testing.T) {
+	// registered is not shaped like a key, only Register catches it
+	const registered = "registered-credential-0123456789"
+	const apiKey = "sk-proj-abcdefghijklmnop1234"
+	Register(registered)
+
+	var out bytes.Buffer
+	log := slog.New(NewHandler(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug})))
+
+	log.Info("connecting", "key", Secret(apiKey))
+	log.Error("failed to connect",
+		"err", fmt.Errorf("failed to send offer: %w", fmt.Errorf("bad credential %s", registered)))
+	body := []byte(`{"error":{"message":"Incorrect API key provided: ` + apiKey + `","type":"invalid_request_error"}}`)
+	log.Warn("API error", "body", body, "status", 401)
+	log.With("auth", "Bearer "+registered).Debug("request " + apiKey)
+	log.Info("grouped", slog.Group("request", "header", "Authorization: Bearer "+apiKey))
+	log.Info("request", "header", http.Header{"Authorization": {"Bearer " + registered}},
+		"fields", map[string]string{"key": apiKey})
+
+	captured := out.String()
+	for _, secret := range []string{registered, apiKey} {
+		if strings.Contains(captured, secret) {
+			t.Errorf("secret %q in the output:\n%s", secret, captured)
+		}
+	}
+	if n := strings.Count(captured, redacted); n < 8 {
+		t.Errorf("%d redactions in the output, want 8 or more:\n%s", n, captured)
+	}
+}
+
+func TestSecretFormats(t *testing.T) {
+	const key = "sk-proj-abcdefghijklmnop1234"
+	s := Secret(key)
+	for _, format := range []string{"%v", "%+v", "%#v", "%s", "%q", "%x"} {
+		if got := fmt.Sprintf(format, s); strings.Contains(got, key) || !strings.Contains(got, redacted) {
+			t.Errorf("%s formats as %q", format, got)
+		}
+	}
+	if got := fmt.Sprintf("%+v", struct{ Key Secret }{s}); strings.Contains(got, key) {
+		t.Errorf("struct formats as %q", got)
+	}
+}
+
+func TestError(t *testing.T) {
+	const token = "ek_0123456789abcdef"
+	cause := fmt.Errorf("token %s rejected", token)
+	err := Error(fmt.Errorf("failed to connect: %w", cause))
+	if strings.Contains(err.Error(), token) {
+		t.Errorf("error message %q has the token", err)
+	}
+	if !errors.Is(err, cause) {
+		t.Error("the redacted error does not wrap the original one")
+	}
+	if Error(nil) != nil {
+		t.Error("Error(nil) is not nil")
+	}
+}
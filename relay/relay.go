@@ -0,0 +1,255 @@
+// Package relay terminates the WebRTC connections of browsers and relays
+// each of them to the Realtime API over its own realtime.Client, forwarding
+// the Opus RTP and the data channel events both ways. Browsers post their SDP
+// offer to the Relay as they would to the API, while the relay runs
+// server-side tools, and records, moderates and meters every call.
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sync"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/webrtc/v4"
+
+	"exp-openai-webrtc-streaming/internal/logging"
+	"exp-openai-webrtc-streaming/realtime"
+)
+
+// maxOfferSize limits the SDP offers read from the browsers.
+const maxOfferSize = 64 << 10
+
+// Options configures a Relay. Zero values select the defaults.
+type Options struct {
+	// Authenticate identifies the caller of an offer and returns its user,
+	// see tokenserver.Options. Required.
+	Authenticate func(r *http.Request) (user string, err error)
+	// NewClient returns the upstream client of a call of user, configured
+	// but not connected: its key, model, voice, instructions and tools.
+	// Required.
+	NewClient func(user string) (*realtime.Client, error)
+	// Sessions runs the upstream clients, e.g. to limit the concurrent
+	// calls, which are answered with 503 beyond the limit. Without it, the
+	// clients are connected directly.
+	Sessions *realtime.SessionManager
+	// Tools are run by the relay when the model calls them. They are added
+	// to the tools of every session, including the ones set by the browser
+	// with session.update.
+	Tools []Tool
+	// ClientEvent and ServerEvent filter the events of the browser and of
+	// the API, e.g. to moderate them; returning false drops the event. They
+	// are called from the goroutines reading the events, so they must not
+	// block.
+	ClientEvent func(s *Session, event realtime.Event) bool
+	ServerEvent func(s *Session, event realtime.Event) bool
+	// OnEnd is called once a call has ended, e.g. to meter it with
+	// Session.Usage.
+	OnEnd func(s *Session)
+	// RecordDir records the user and model audio of every call to Ogg Opus
+	// files in the directory, named after the session ID.
+	RecordDir string
+	// ICEServers are the STUN and TURN servers of the browser side.
+	ICEServers []webrtc.ICEServer
+	// AllowedOrigins are the origins of the browser apps allowed to post
+	// offers with CORS, see tokenserver.Options.
+	AllowedOrigins []string
+	Logger         *slog.Logger
+}
+
+// Tool is a function run by the relay rather than by the browser.
+type Tool struct {
+	realtime.Tool
+	// Call returns the output of the function for its JSON arguments. Its
+	// error is passed to the model as the output.
+	Call func(ctx context.Context, s *Session, arguments json.RawMessage) (string, error)
+}
+
+// Relay is the http.Handler receiving the SDP offers of the browsers. It
+// answers with 201 and the SDP answer once the call is connected upstream.
+type Relay struct {
+	opts Options
+	api  *webrtc.API
+	log  *slog.Logger
+
+	mutex    sync.Mutex
+	sessions map[string]*Session
+	closed   bool
+}
+
+// New returns a Relay with opts, or an error if a required hook is
+// missing.
+func New(opts Options) (*Relay, error) {
+	if opts.Authenticate == nil {
+		return nil, errors.New("the relay needs an Authenticate hook")
+	}
+	if opts.NewClient == nil {
+		return nil, errors.New("the relay needs a NewClient hook")
+	}
+	for _, tool := range opts.Tools {
+		if tool.Name == "" || tool.Call == nil {
+			return nil, fmt.Errorf("tool %q needs a name and a Call", tool.Name)
+		}
+	}
+
+	var mediaEngine webrtc.MediaEngine
+	if err := mediaEngine.RegisterCodec(opusCodec, webrtc.RTPCodecTypeAudio); err != nil {
+		return nil, fmt.Errorf("failed to register codec: %w", err)
+	}
+	var interceptorRegistry interceptor.Registry
+	if err := webrtc.RegisterDefaultInterceptors(&mediaEngine, &interceptorRegistry); err != nil {
+		return nil, fmt.Errorf("failed to register interceptors: %w", err)
+	}
+
+	return &Relay{
+		opts: opts,
+		api: webrtc.NewAPI(
+			webrtc.WithMediaEngine(&mediaEngine),
+			webrtc.WithInterceptorRegistry(&interceptorRegistry),
+		),
+		log:      logging.Component(opts.Logger, "relay"),
+		sessions: make(map[string]*Session),
+	}, nil
+}
+
+// ServeHTTP answers the CORS preflights of the allowed origins, and the SDP
+// offer POSTed by an authenticated browser with 201 and the SDP answer, once
+// the upstream client is connected. It answers 400 to an invalid offer, 503
+// beyond the session limit and 502 if the upstream fails.
+func (r *Relay) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if origin := req.Header.Get("Origin"); origin != "" {
+		w.Header().Add("Vary", "Origin")
+		switch {
+		case slices.Contains(r.opts.AllowedOrigins, origin):
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		case slices.Contains(r.opts.AllowedOrigins, "*"):
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		default:
+			r.log.Warn("rejected origin", "origin", origin)
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+	}
+
+	switch req.Method {
+	case http.MethodOptions:
+		// CORS preflight
+		w.Header().Set("Access-Control-Allow-Methods", "POST")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		w.Header().Set("Access-Control-Max-Age", "600")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "POST, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := r.opts.Authenticate(req)
+	if err != nil {
+		r.log.Info("rejected offer", "remote", req.RemoteAddr, "err", err)
+		if errors.Is(err, realtime.ErrUnauthorized) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		} else {
+			http.Error(w, "forbidden", http.StatusForbidden)
+		}
+		return
+	}
+
+	offer, err := io.ReadAll(io.LimitReader(req.Body, maxOfferSize))
+	if err != nil {
+		http.Error(w, "failed to read offer", http.StatusBadRequest)
+		return
+	}
+
+	s, answer, err := r.start(user, string(offer))
+	if err != nil {
+		var offerErr *offerError
+		if errors.As(err, &offerErr) {
+			r.log.Info("invalid offer", "user", user, "err", err)
+			http.Error(w, "invalid offer", http.StatusBadRequest)
+			return
+		}
+		if errors.Is(err, realtime.ErrTooManySessions) {
+			r.log.Warn("rejected call", "user", user, "err", err)
+			http.Error(w, "too many calls", http.StatusServiceUnavailable)
+			return
+		}
+		r.log.Error("failed to start call", "user", user, "err", err)
+		http.Error(w, "failed to connect upstream", http.StatusBadGateway)
+		return
+	}
+	s.log.Info("call started")
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.WriteHeader(http.StatusCreated)
+	io.WriteString(w, answer)
+}
+
+// offerError is an invalid offer, as opposed to an upstream failure.
+type offerError struct {
+	err error
+}
+
+func (e *offerError) Error() string { return e.err.Error() }
+func (e *offerError) Unwrap() error { return e.err }
+
+// Sessions returns the calls in progress.
+func (r *Relay) Sessions() []*Session {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	sessions := make([]*Session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// Close ends the calls in progress and rejects the new ones.
+func (r *Relay) Close() error {
+	r.mutex.Lock()
+	r.closed = true
+	sessions := make([]*Session, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		sessions = append(sessions, s)
+	}
+	r.mutex.Unlock()
+
+	for _, s := range sessions {
+		s.Close()
+	}
+	return nil
+}
+
+func (r *Relay) add(s *Session) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.closed {
+		return errors.New("relay closed")
+	}
+	r.sessions[s.ID] = s
+	return nil
+}
+
+func (r *Relay) remove(s *Session) {
+	r.mutex.Lock()
+	delete(r.sessions, s.ID)
+	r.mutex.Unlock()
+}
+
+func (r *Relay) tool(name string) *Tool {
+	for i := range r.opts.Tools {
+		if r.opts.Tools[i].Name == name {
+			return &r.opts.Tools[i]
+		}
+	}
+	return nil
+}
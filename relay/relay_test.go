@@ -0,0 +1,460 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+
+	"exp-openai-webrtc-streaming/realtime"
+	"exp-openai-webrtc-streaming/tokenserver"
+)
+
+// fakeAPI is a local fake of the WebRTC endpoints of the Realtime API, the
+// upstream of the realtime.Clients of the relay. Its peer echoes the audio
+// it receives, and its data channel answers response.create with a call of
+// the relay tool, then a response.done.
+type fakeAPI struct {
+	*httptest.Server
+	// updates receives the session.update events, toolOutputs the outputs
+	// of the function calls
+	updates     chan string
+	toolOutputs chan string
+
+	mutex     sync.Mutex
+	peers     []*webrtc.PeerConnection
+	responses int
+}
+
+func newFakeAPI(t *testing.T) *fakeAPI {
+	f := &fakeAPI{
+		updates:     make(chan string, 10),
+		toolOutputs: make(chan string, 10),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/realtime/sessions", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"client_secret":{"value":"ek_test0123456789","expires_at":4102444800}}`)
+	})
+	mux.HandleFunc("/v1/realtime", func(w http.ResponseWriter, r *http.Request) {
+		offer, _ := io.ReadAll(r.Body)
+		answer, err := f.answer(string(offer))
+		if err != nil {
+			t.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/sdp")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, answer)
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(func() {
+		f.Close()
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		for _, pc := range f.peers {
+			pc.Close()
+		}
+	})
+	return f
+}
+
+func (f *fakeAPI) answer(offer string) (string, error) {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return "", err
+	}
+	f.mutex.Lock()
+	f.peers = append(f.peers, pc)
+	f.mutex.Unlock()
+
+	model, err := webrtc.NewTrackLocalStaticRTP(opusCapability, "audio", "model")
+	if err != nil {
+		return "", err
+	}
+	if _, err := pc.AddTrack(model); err != nil {
+		return "", err
+	}
+	pc.OnTrack(func(user *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		for {
+			p, _, err := user.ReadRTP()
+			if err != nil {
+				return
+			}
+			model.WriteRTP(p)
+		}
+	})
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		dc.OnOpen(func() { dc.SendText(`{"type":"session.created"}`) })
+		dc.OnMessage(func(msg webrtc.DataChannelMessage) { f.clientEvent(dc, msg.Data) })
+	})
+
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		return "", err
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+	<-gathered
+	return pc.LocalDescription().SDP, nil
+}
+
+func (f *fakeAPI) clientEvent(dc *webrtc.DataChannel, data []byte) {
+	var event struct {
+		Type string `json:"type"`
+		Item struct {
+			Output string `json:"output"`
+		} `json:"item"`
+	}
+	json.Unmarshal(data, &event)
+	switch event.Type {
+	case "session.update":
+		f.updates <- string(data)
+	case "conversation.item.create":
+		f.toolOutputs <- event.Item.Output
+	case "response.create":
+		f.mutex.Lock()
+		f.responses++
+		first := f.responses == 1
+		f.mutex.Unlock()
+		if first {
+			dc.SendText(`{"type":"response.function_call_arguments.done","name":"lookup","call_id":"call1","arguments":"{\"q\":\"weather\"}"}`)
+		}
+		dc.SendText(`{"type":"response.done","response":{"usage":{"input_tokens":10,"output_tokens":5}}}`)
+	}
+}
+
+var opusCapability = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48_000, Channels: 2}
+
+// browser is the peer of a browser calling the relay.
+type browser struct {
+	pc     *webrtc.PeerConnection
+	mic    *webrtc.TrackLocalStaticSample
+	dc     *webrtc.DataChannel
+	events chan string
+	// played counts the packets of model audio received
+	played atomic.Int64
+}
+
+func newBrowser(t *testing.T) *browser {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	b := &browser{pc: pc, events: make(chan string, 100)}
+	if b.mic, err = webrtc.NewTrackLocalStaticSample(opusCapability, "audio", "mic"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pc.AddTrack(b.mic); err != nil {
+		t.Fatal(err)
+	}
+	pc.OnTrack(func(model *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		for {
+			if _, _, err := model.ReadRTP(); err != nil {
+				return
+			}
+			b.played.Add(1)
+		}
+	})
+	if b.dc, err = pc.CreateDataChannel("oai-events", nil); err != nil {
+		t.Fatal(err)
+	}
+	b.dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		var event struct {
+			Type string `json:"type"`
+		}
+		json.Unmarshal(msg.Data, &event)
+		b.events <- event.Type
+	})
+	return b
+}
+
+// call posts the offer of the browser to url with token, and applies the
+// answer if the status is 201.
+func (b *browser) call(t *testing.T, url, token string) int {
+	t.Helper()
+	offer, err := b.pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(b.pc)
+	if err := b.pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+
+	req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(b.pc.LocalDescription().SDP))
+	req.Header.Set("Content-Type", "application/sdp")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	answer, _ := io.ReadAll(res.Body)
+	if res.StatusCode == http.StatusCreated {
+		err := b.pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: string(answer)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return res.StatusCode
+}
+
+// speak sends 20ms Opus packets of silence until ctx is done.
+func (b *browser) speak(ctx context.Context) {
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			b.mic.WriteSample(media.Sample{Data: []byte{0xf8, 0xff, 0xfe}, Duration: 20 * time.Millisecond})
+		}
+	}
+}
+
+// waitEvent waits for the browser to receive an event of type, and returns
+// the types received before it.
+func (b *browser) waitEvent(t *testing.T, eventType string) []string {
+	t.Helper()
+	var before []string
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case got := <-b.events:
+			if got == eventType {
+				return before
+			}
+			before = append(before, got)
+		case <-timeout:
+			t.Fatalf("no %s event, got %v", eventType, before)
+		}
+	}
+}
+
+// sharedTools are the tools of every client, with room to append to them,
+// as config.Apply shares its tools.
+var sharedTools = append(make([]realtime.Tool, 0, 4), realtime.Tool{Name: "shared"})
+
+func newTestRelay(t *testing.T, api *fakeAPI, opts Options) *Relay {
+	t.Helper()
+	opts.Authenticate = tokenserver.BearerAuth(map[string]string{"alice": "alice-token"})
+	opts.NewClient = func(user string) (*realtime.Client, error) {
+		c := realtime.NewClient("sk-test-0123456789")
+		c.Tools = sharedTools
+		c.ICEServers = nil
+		c.SessionsURL = api.URL + "/v1/realtime/sessions"
+		c.WebRTCURL = api.URL + "/v1/realtime"
+		return c, nil
+	}
+	r, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+func TestRelay(t *testing.T) {
+	api := newFakeAPI(t)
+	ended := make(chan Usage, 1)
+	toolArgs := make(chan string, 1)
+	recordDir := t.TempDir()
+	r := newTestRelay(t, api, Options{
+		Tools: []Tool{{
+			Tool: realtime.Tool{Name: "lookup", Description: "looks up on the server"},
+			Call: func(ctx context.Context, s *Session, arguments json.RawMessage) (string, error) {
+				toolArgs <- string(arguments)
+				return "sunny", nil
+			},
+		}},
+		RecordDir: recordDir,
+		OnEnd:     func(s *Session) { ended <- s.Usage() },
+	})
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	b := newBrowser(t)
+	b.dc.OnOpen(func() {
+		b.dc.SendText(`{"type":"session.update","session":{"tools":[{"type":"function","name":"browser_tool"}]}}`)
+		b.dc.SendText(`{"type":"response.create"}`)
+	})
+	if status := b.call(t, server.URL, "alice-token"); status != http.StatusCreated {
+		t.Fatalf("status %d, want 201", status)
+	}
+	if tools := sharedTools[:cap(sharedTools)]; tools[1].Name != "" {
+		t.Errorf("the server tools were added to the shared tools: %+v", tools)
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	go b.speak(ctx)
+
+	// The events of the browser reach the API, with the relay tools added
+	// to its session.update.
+	select {
+	case update := <-api.updates:
+		if !strings.Contains(update, `"browser_tool"`) || !strings.Contains(update, `"lookup"`) {
+			t.Errorf("session.update %s, want both tools", update)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no session.update upstream")
+	}
+
+	// The relay runs its tool, and the call stays hidden from the browser.
+	select {
+	case args := <-toolArgs:
+		if args != `{"q":"weather"}` {
+			t.Errorf("tool arguments %s", args)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("the tool was not called")
+	}
+	select {
+	case output := <-api.toolOutputs:
+		if output != "sunny" {
+			t.Errorf("tool output %q", output)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no tool output upstream")
+	}
+	// The events of the API reach the browser.
+	before := b.waitEvent(t, "response.done")
+	for _, event := range append(before, "response.done") {
+		if event == "response.function_call_arguments.done" {
+			t.Error("the relay tool call reached the browser")
+		}
+	}
+
+	// The audio of the browser goes upstream, and the echo comes back.
+	for deadline := time.Now().Add(10 * time.Second); b.played.Load() < 20; {
+		if time.Now().After(deadline) {
+			t.Fatalf("the browser received %d packets of model audio", b.played.Load())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := len(r.Sessions()); n != 1 {
+		t.Fatalf("%d calls in progress, want 1", n)
+	}
+
+	// Close ends the call.
+	r.Close()
+	select {
+	case usage := <-ended:
+		if usage.UserPackets == 0 || usage.ModelPackets == 0 || usage.ToolCalls != 1 ||
+			usage.InputTokens == 0 || usage.OutputTokens == 0 {
+			t.Errorf("usage %+v", usage)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("OnEnd was not called")
+	}
+	if n := len(r.Sessions()); n != 0 {
+		t.Errorf("%d calls in progress after Close", n)
+	}
+	if status := b.call(t, server.URL, "alice-token"); status == http.StatusCreated {
+		t.Error("a call was accepted after Close")
+	}
+	recordings, _ := filepath.Glob(filepath.Join(recordDir, "*"))
+	for _, path := range recordings {
+		if info, err := os.Stat(path); err != nil || info.Size() == 0 {
+			t.Errorf("empty recording %s", path)
+		}
+	}
+	if len(recordings) == 0 {
+		t.Error("the call was not recorded")
+	}
+}
+
+func TestRelayRejects(t *testing.T) {
+	api := newFakeAPI(t)
+	sessions := realtime.NewSessionManager(realtime.ManagerOptions{MaxSessions: 1})
+	const app = "https://app.example.com"
+	r := newTestRelay(t, api, Options{
+		Sessions:       sessions,
+		ServerEvent:    func(s *Session, event realtime.Event) bool { return event.Type != "session.created" },
+		AllowedOrigins: []string{app},
+	})
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	tests := []struct {
+		name      string
+		method    string
+		origin    string
+		token     string
+		body      string
+		want      int
+		wantAllow string
+	}{
+		{"method", http.MethodGet, "", "alice-token", "", http.StatusMethodNotAllowed, ""},
+		{"no token", http.MethodPost, "", "", "v=0", http.StatusUnauthorized, ""},
+		{"wrong token", http.MethodPost, "", "mallory-token", "v=0", http.StatusUnauthorized, ""},
+		{"invalid offer", http.MethodPost, "", "alice-token", "not sdp", http.StatusBadRequest, ""},
+		{"preflight", http.MethodOptions, app, "", "", http.StatusNoContent, app},
+		{"origin", http.MethodPost, app, "alice-token", "not sdp", http.StatusBadRequest, app},
+		{"other origin", http.MethodPost, "https://evil.example.com", "alice-token", "v=0", http.StatusForbidden, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, server.URL, strings.NewReader(tt.body))
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			res.Body.Close()
+			if res.StatusCode != tt.want {
+				t.Errorf("status %d, want %d", res.StatusCode, tt.want)
+			}
+			if got := res.Header.Get("Access-Control-Allow-Origin"); got != tt.wantAllow {
+				t.Errorf("Access-Control-Allow-Origin %q, want %q", got, tt.wantAllow)
+			}
+		})
+	}
+
+	// The first call takes the only session, the second is answered 503.
+	first := newBrowser(t)
+	if status := first.call(t, server.URL, "alice-token"); status != http.StatusCreated {
+		t.Fatalf("first call: status %d", status)
+	}
+	second := newBrowser(t)
+	if status := second.call(t, server.URL, "alice-token"); status != http.StatusServiceUnavailable {
+		t.Errorf("second call: status %d, want 503", status)
+	}
+	if stats := sessions.Stats(); stats.Active != 1 || stats.Rejected != 1 {
+		t.Errorf("session stats %+v", stats)
+	}
+
+	// ServerEvent drops the events it filters.
+	first.dc.OnOpen(func() { first.dc.SendText(`{"type":"response.create"}`) })
+	for _, event := range first.waitEvent(t, "response.done") {
+		if event == "session.created" {
+			t.Error("the filtered session.created reached the browser")
+		}
+	}
+}
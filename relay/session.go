@@ -0,0 +1,630 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+
+	"exp-openai-webrtc-streaming/audio"
+	"exp-openai-webrtc-streaming/internal/ids"
+	"exp-openai-webrtc-streaming/realtime"
+)
+
+// opusCodec is the codec of the browser side, as offered by the browsers.
+var opusCodec = webrtc.RTPCodecParameters{
+	RTPCodecCapability: webrtc.RTPCodecCapability{
+		MimeType:    webrtc.MimeTypeOpus,
+		ClockRate:   48_000,
+		Channels:    2,
+		SDPFmtpLine: "minptime=10;useinbandfec=1",
+	},
+	PayloadType: 111,
+}
+
+// dataChannelLabel is the label of the data channel opened by the browsers,
+// the one of the API.
+const dataChannelLabel = "oai-events"
+
+// userQueueSize is how many packets of user audio may wait for the upstream,
+// dropping the newer ones when full.
+const userQueueSize = 50
+
+// Session is a call relayed from a browser to the API.
+type Session struct {
+	ID      string
+	User    string
+	Started time.Time
+
+	relay  *Relay
+	client *realtime.Client
+	// session is set once the client is connected
+	session *realtime.ManagedSession
+	pc      *webrtc.PeerConnection
+	track   *webrtc.TrackLocalStaticRTP
+	source  *userSource
+	log     *slog.Logger
+	// userRecorder and modelRecorder are nil unless Options.RecordDir is set
+	userRecorder  *audio.TrackRecorder
+	modelRecorder *audio.TrackRecorder
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+
+	// The events are held until their destination is ready: the events of
+	// the browser until the first event of the API, the events of the API
+	// until the data channel of the browser is open.
+	mutex         sync.Mutex
+	dc            *webrtc.DataChannel
+	dcOpen        bool
+	upstreamReady bool
+	toBrowser     [][]byte
+	toUpstream    [][]byte
+	usage         Usage
+	ended         time.Time
+}
+
+// Usage meters a call.
+type Usage struct {
+	Duration time.Duration
+	// UserPackets and UserBytes count the audio of the browser,
+	// ModelPackets and ModelBytes the audio of the model.
+	UserPackets  int
+	UserBytes    int
+	ModelPackets int
+	ModelBytes   int
+	// ClientEvents and ServerEvents count the events relayed, the dropped
+	// ones excluded.
+	ClientEvents int
+	ServerEvents int
+	// ToolCalls counts the calls of Options.Tools.
+	ToolCalls int
+	// InputTokens and OutputTokens add up the usage of the responses.
+	InputTokens  int
+	OutputTokens int
+}
+
+// Usage returns the usage of the call so far.
+func (s *Session) Usage() Usage {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	usage := s.usage
+	if s.ended.IsZero() {
+		usage.Duration = time.Since(s.Started)
+	} else {
+		usage.Duration = s.ended.Sub(s.Started)
+	}
+	return usage
+}
+
+// SendEvent sends a client event upstream on behalf of the relay, e.g. a
+// conversation.item.create with context only the server knows.
+func (s *Session) SendEvent(event any) error {
+	return s.client.SendEvent(event)
+}
+
+// start answers the offer of a browser, once the call is connected
+// upstream.
+func (r *Relay) start(user, offer string) (*Session, string, error) {
+	client, err := r.opts.NewClient(user)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create client: %w", err)
+	}
+
+	id := ids.New()
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Session{
+		ID:      id,
+		User:    user,
+		Started: time.Now(),
+		relay:   r,
+		client:  client,
+		source:  newUserSource(),
+		log:     r.log.With("session", id, "user", user),
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+	if err := r.add(s); err != nil {
+		cancel()
+		return nil, "", err
+	}
+
+	answer, err := s.connect(offer)
+	if err != nil {
+		s.Close()
+		return nil, "", err
+	}
+	return s, answer, nil
+}
+
+func (s *Session) connect(offer string) (string, error) {
+	r := s.relay
+	if r.opts.RecordDir != "" {
+		s.userRecorder = audio.NewTrackRecorder(s.log)
+		s.modelRecorder = audio.NewTrackRecorder(s.log)
+		if err := s.userRecorder.Start(filepath.Join(r.opts.RecordDir, s.ID+"-user.ogg")); err != nil {
+			return "", err
+		}
+		if err := s.modelRecorder.Start(filepath.Join(r.opts.RecordDir, s.ID+"-model.ogg")); err != nil {
+			return "", err
+		}
+	}
+
+	pc, err := r.api.NewPeerConnection(webrtc.Configuration{ICEServers: r.opts.ICEServers})
+	if err != nil {
+		return "", fmt.Errorf("failed to create peer connection: %w", err)
+	}
+	s.pc = pc
+
+	s.track, err = webrtc.NewTrackLocalStaticRTP(opusCodec.RTPCodecCapability, "audio", "relay")
+	if err != nil {
+		return "", fmt.Errorf("failed to create local track: %w", err)
+	}
+	sender, err := pc.AddTrack(s.track)
+	if err != nil {
+		return "", fmt.Errorf("failed to add track: %w", err)
+	}
+	go func() {
+		// The RTCP must be read for the interceptors to process it.
+		buf := make([]byte, 1500)
+		for {
+			if _, _, err := sender.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		s.log.Info("user track", "codec", track.Codec().MimeType)
+		var writer audio.TrackWriter = s.source
+		if s.userRecorder != nil {
+			writer = audio.MultiWriter{s.source, s.userRecorder}
+		}
+		if err := writer.WriteWebRTCTrack(meteredTrack{track, s.meterUser}); err != nil {
+			s.log.Error("failed to relay user audio", "err", err)
+		}
+	})
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		if dc.Label() != dataChannelLabel {
+			s.log.Warn("ignoring data channel", "label", dc.Label())
+			return
+		}
+		s.attachDataChannel(dc)
+	})
+	pc.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		s.log.Debug("browser connection state", "state", state)
+		switch state {
+		case webrtc.PeerConnectionStateFailed, webrtc.PeerConnectionStateClosed:
+			go s.Close()
+		}
+	})
+
+	err = pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer})
+	if err != nil {
+		return "", &offerError{fmt.Errorf("failed to set offer: %w", err)}
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return "", &offerError{fmt.Errorf("failed to create answer: %w", err)}
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return "", fmt.Errorf("failed to set answer: %w", err)
+	}
+
+	// The upstream is connected while the candidates are gathered.
+	c := s.client
+	// The tools of the client may be shared with the other calls, e.g. by
+	// config.Apply.
+	c.Tools = slices.Clone(c.Tools)
+	for _, tool := range r.opts.Tools {
+		c.Tools = append(c.Tools, tool.Tool)
+	}
+	c.Logger = s.log
+	c.OnEvent = s.serverEvent
+	var writer audio.TrackWriter = modelForwarder{s}
+	if s.modelRecorder != nil {
+		writer = audio.MultiWriter{writer, s.modelRecorder}
+	}
+	session, err := r.opts.Sessions.Start(s.ID, c, s.source, writer)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect upstream: %w", err)
+	}
+	s.mutex.Lock()
+	s.session = session
+	s.mutex.Unlock()
+	if s.ctx.Err() != nil {
+		// Close has run without the session
+		session.Close()
+	}
+
+	select {
+	case <-gathered:
+	case <-s.ctx.Done():
+		return "", errors.New("session closed")
+	}
+	return pc.LocalDescription().SDP, nil
+}
+
+// Close ends the call: it disconnects the upstream and the browser, then
+// finishes the recordings and calls Options.OnEnd.
+func (s *Session) Close() error {
+	s.closeOnce.Do(func() {
+		s.cancel()
+		s.source.Close()
+		s.mutex.Lock()
+		session := s.session
+		s.mutex.Unlock()
+		if session != nil {
+			session.Close()
+		} else {
+			// Waits for the client to connect, if it is connecting.
+			s.client.Disconnect()
+		}
+		if s.pc != nil {
+			s.pc.Close()
+		}
+		for _, recorder := range []*audio.TrackRecorder{s.userRecorder, s.modelRecorder} {
+			if recorder == nil {
+				continue
+			}
+			if err := recorder.Close(); err != nil {
+				s.log.Warn("failed to finish recording", "err", err)
+			}
+		}
+
+		s.mutex.Lock()
+		s.ended = time.Now()
+		s.toBrowser, s.toUpstream = nil, nil
+		s.mutex.Unlock()
+		s.relay.remove(s)
+
+		usage := s.Usage()
+		s.log.Info("call ended", "duration", usage.Duration,
+			"input_tokens", usage.InputTokens, "output_tokens", usage.OutputTokens)
+		if s.relay.opts.OnEnd != nil {
+			s.relay.opts.OnEnd(s)
+		}
+	})
+	return nil
+}
+
+func (s *Session) meterUser(n int) {
+	s.mutex.Lock()
+	s.usage.UserPackets++
+	s.usage.UserBytes += n
+	s.mutex.Unlock()
+}
+
+func (s *Session) meterModel(n int) {
+	s.mutex.Lock()
+	s.usage.ModelPackets++
+	s.usage.ModelBytes += n
+	s.mutex.Unlock()
+}
+
+// meteredTrack counts the packets read from a track.
+type meteredTrack struct {
+	audio.RemoteTrack
+	meter func(n int)
+}
+
+func (t meteredTrack) ReadRTP() (*rtp.Packet, interceptor.Attributes, error) {
+	p, attributes, err := t.RemoteTrack.ReadRTP()
+	if err == nil {
+		t.meter(len(p.Payload))
+	}
+	return p, attributes, err
+}
+
+// modelForwarder writes the model audio to the track of the browser.
+type modelForwarder struct {
+	s *Session
+}
+
+func (f modelForwarder) WriteWebRTCTrack(track audio.RemoteTrack) error {
+	for {
+		p, _, err := track.ReadRTP()
+		if err != nil {
+			if errors.Is(err, io.EOF) || f.s.ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("failed to read RTP packet: %w", err)
+		}
+		f.s.meterModel(len(p.Payload))
+		if err := f.s.track.WriteRTP(p); err != nil && !errors.Is(err, io.ErrClosedPipe) {
+			return fmt.Errorf("failed to write RTP packet: %w", err)
+		}
+	}
+}
+
+// userSource is the audio of the browser as the Source of the upstream,
+// the Opus packets sent as they are.
+type userSource struct {
+	frames    chan audio.Frame
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newUserSource() *userSource {
+	return &userSource{
+		frames: make(chan audio.Frame, userQueueSize),
+		done:   make(chan struct{}),
+	}
+}
+
+// WriteWebRTCTrack queues the packets of the browser track. They arrive in
+// real time, so that ReadAudio is paced by the browser.
+func (u *userSource) WriteWebRTCTrack(track audio.RemoteTrack) error {
+	for {
+		p, _, err := track.ReadRTP()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			select {
+			case <-u.done:
+				return nil
+			default:
+				return fmt.Errorf("failed to read RTP packet: %w", err)
+			}
+		}
+		duration := audio.OpusPacketDuration(p.Payload)
+		if duration == 0 {
+			continue
+		}
+		select {
+		case u.frames <- audio.Frame{Opus: p.Payload, Duration: duration}:
+		case <-u.done:
+			return nil
+		default:
+			// the upstream is behind, dropping beats adding latency
+		}
+	}
+}
+
+func (u *userSource) ReadAudio() (audio.Frame, error) {
+	select {
+	case frame := <-u.frames:
+		return frame, nil
+	case <-u.done:
+		return audio.Frame{}, io.EOF
+	}
+}
+
+// Close ends ReadAudio, which may be waiting for a browser that never
+// sends.
+func (u *userSource) Close() error {
+	u.closeOnce.Do(func() { close(u.done) })
+	return nil
+}
+
+// attachDataChannel relays the events of the browser and flushes the
+// events of the API once the channel is open.
+func (s *Session) attachDataChannel(dc *webrtc.DataChannel) {
+	s.mutex.Lock()
+	s.dc = dc
+	s.mutex.Unlock()
+
+	dc.OnOpen(func() {
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		s.dcOpen = true
+		for _, data := range s.toBrowser {
+			if err := dc.SendText(string(data)); err != nil {
+				s.log.Warn("failed to relay server event", "err", err)
+			}
+		}
+		s.toBrowser = nil
+	})
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		s.clientEvent(msg.Data)
+	})
+	dc.OnClose(func() {
+		s.log.Debug("browser data channel closed")
+		go s.Close()
+	})
+}
+
+// clientEvent relays an event of the browser upstream.
+func (s *Session) clientEvent(data []byte) {
+	var event struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(data, &event); err != nil {
+		s.log.Warn("failed to parse client event", "err", err)
+		return
+	}
+	if filter := s.relay.opts.ClientEvent; filter != nil && !filter(s, realtime.Event{Type: event.Type, Data: data}) {
+		s.log.Debug("dropped client event", "type", event.Type)
+		return
+	}
+	if event.Type == "session.update" && len(s.relay.opts.Tools) > 0 {
+		var err error
+		if data, err = s.relay.withTools(data); err != nil {
+			s.log.Warn("failed to add server tools", "err", err)
+			return
+		}
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.usage.ClientEvents++
+	if !s.upstreamReady {
+		s.toUpstream = append(s.toUpstream, data)
+		return
+	}
+	if err := s.client.SendEvent(json.RawMessage(data)); err != nil {
+		s.log.Warn("failed to relay client event", "type", event.Type, "err", err)
+	}
+}
+
+// serverEvent relays an event of the API to the browser, once it has run
+// the calls of the server tools.
+func (s *Session) serverEvent(event realtime.Event) {
+	switch event.Type {
+	case "response.done":
+		s.meterResponse(event.Data)
+	case "response.function_call_arguments.done":
+		if s.callTool(event.Data) {
+			// The browser must not run it too.
+			s.flushUpstream()
+			return
+		}
+	}
+	s.flushUpstream()
+
+	if filter := s.relay.opts.ServerEvent; filter != nil && !filter(s, event) {
+		s.log.Debug("dropped server event", "type", event.Type)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.usage.ServerEvents++
+	if !s.dcOpen {
+		s.toBrowser = append(s.toBrowser, event.Data)
+		return
+	}
+	if err := s.dc.SendText(string(event.Data)); err != nil {
+		s.log.Warn("failed to relay server event", "type", event.Type, "err", err)
+	}
+}
+
+// flushUpstream sends the events of the browser held until the upstream
+// was ready, which the first server event tells.
+func (s *Session) flushUpstream() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.upstreamReady {
+		return
+	}
+	s.upstreamReady = true
+	for _, data := range s.toUpstream {
+		if err := s.client.SendEvent(json.RawMessage(data)); err != nil {
+			s.log.Warn("failed to relay client event", "err", err)
+		}
+	}
+	s.toUpstream = nil
+}
+
+func (s *Session) meterResponse(data []byte) {
+	var event struct {
+		Response struct {
+			Usage struct {
+				InputTokens  int `json:"input_tokens"`
+				OutputTokens int `json:"output_tokens"`
+			} `json:"usage"`
+		} `json:"response"`
+	}
+	if err := json.Unmarshal(data, &event); err != nil {
+		s.log.Warn("failed to parse response usage", "err", err)
+		return
+	}
+	s.mutex.Lock()
+	s.usage.InputTokens += event.Response.Usage.InputTokens
+	s.usage.OutputTokens += event.Response.Usage.OutputTokens
+	s.mutex.Unlock()
+}
+
+// callTool runs the call of a server tool in the background, then sends
+// its output and asks for a response. It returns false for the tools of
+// the browser.
+func (s *Session) callTool(data []byte) bool {
+	var call struct {
+		Name      string `json:"name"`
+		CallID    string `json:"call_id"`
+		Arguments string `json:"arguments"`
+	}
+	if err := json.Unmarshal(data, &call); err != nil {
+		s.log.Warn("failed to parse function call", "err", err)
+		return false
+	}
+	tool := s.relay.tool(call.Name)
+	if tool == nil {
+		return false
+	}
+
+	s.mutex.Lock()
+	s.usage.ToolCalls++
+	s.mutex.Unlock()
+
+	go func() {
+		log := s.log.With("tool", call.Name, "call_id", call.CallID)
+		output, err := tool.Call(s.ctx, s, json.RawMessage(call.Arguments))
+		if err != nil {
+			log.Warn("tool call failed", "err", err)
+			data, _ := json.Marshal(map[string]string{"error": err.Error()})
+			output = string(data)
+		}
+		if s.ctx.Err() != nil {
+			return
+		}
+		log.Debug("tool call done")
+
+		err = s.client.SendEvent(map[string]any{
+			"type": "conversation.item.create",
+			"item": map[string]string{
+				"type":    "function_call_output",
+				"call_id": call.CallID,
+				"output":  output,
+			},
+		})
+		if err == nil {
+			err = s.client.SendEvent(map[string]string{"type": "response.create"})
+		}
+		if err != nil {
+			log.Warn("failed to send tool output", "err", err)
+		}
+	}()
+	return true
+}
+
+// withTools adds the server tools to the tools of a session.update. The
+// browser does not know them, so it would otherwise remove them.
+func (r *Relay) withTools(data []byte) ([]byte, error) {
+	var event map[string]json.RawMessage
+	if err := json.Unmarshal(data, &event); err != nil {
+		return nil, err
+	}
+	var session map[string]json.RawMessage
+	if err := json.Unmarshal(event["session"], &session); err != nil {
+		return nil, err
+	}
+	raw, ok := session["tools"]
+	if !ok {
+		return data, nil
+	}
+
+	var tools []json.RawMessage
+	if err := json.Unmarshal(raw, &tools); err != nil {
+		return nil, err
+	}
+	for _, tool := range r.opts.Tools {
+		encoded, err := json.Marshal(tool.Tool)
+		if err != nil {
+			return nil, err
+		}
+		tools = append(tools, encoded)
+	}
+
+	var err error
+	if session["tools"], err = json.Marshal(tools); err != nil {
+		return nil, err
+	}
+	if event["session"], err = json.Marshal(session); err != nil {
+		return nil, err
+	}
+	return json.Marshal(event)
+}
@@ -0,0 +1,355 @@
+package sip
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"exp-openai-webrtc-streaming/internal/ids"
+	"exp-openai-webrtc-streaming/realtime"
+)
+
+// callState is the progress of the INVITE of a call.
+type callState int
+
+const (
+	// stateSetup is until the final response
+	stateSetup callState = iota
+	// stateAnswered is once the 200 OK is sent
+	stateAnswered
+	// stateEnded is once the call has ended, or its INVITE was rejected or
+	// cancelled
+	stateEnded
+)
+
+// Call is a phone call bridged to the API.
+type Call struct {
+	// ID is the Call-ID of the dialog.
+	ID string
+	// From and To are the URIs of the caller and of the called number, e.g.
+	// sip:+15551234567@trunk.example.com.
+	From string
+	To   string
+	// Remote is the address the INVITE came from.
+	Remote *net.UDPAddr
+	// Codec is PCMU or PCMA, once the offer is accepted.
+	Codec   string
+	Started time.Time
+
+	ua       *UA
+	invite   *message
+	localTag string
+	log      *slog.Logger
+
+	mutex   sync.Mutex
+	session *realtime.ManagedSession
+	media   *media
+	state   callState
+	// response is the last response to the INVITE, sent again when the
+	// INVITE is retransmitted
+	response *message
+	// sdp is the last answer, sent again for re-INVITEs without an offer,
+	// and sdpVersion the version of its origin, see RFC 3264 section 8
+	sdp        []byte
+	sdpID      int64
+	sdpVersion int64
+
+	acked   chan struct{}
+	ackOnce sync.Once
+	done    chan struct{}
+	endOnce sync.Once
+}
+
+// Done is closed once the call has ended.
+func (c *Call) Done() <-chan struct{} {
+	return c.done
+}
+
+// Hangup ends the call, with a BYE once it is answered, or a 480 during the
+// setup.
+func (c *Call) Hangup() {
+	c.mutex.Lock()
+	state := c.state
+	c.mutex.Unlock()
+	switch state {
+	case stateSetup:
+		c.reject(480, "Temporarily Unavailable")
+		return
+	case stateAnswered:
+		c.sendBye()
+	}
+	c.end()
+}
+
+// setup accepts the offer and connects the upstream, then answers the
+// INVITE.
+func (c *Call) setup() {
+	offer, err := parseOffer(c.invite.body, "")
+	if err != nil {
+		c.log.Info("rejected offer", "err", err)
+		c.reject(488, "Not Acceptable Here")
+		return
+	}
+	c.Codec = offer.codec
+
+	client, err := c.ua.opts.NewClient(c)
+	if err != nil {
+		c.log.Info("rejected call", "err", err)
+		c.reject(403, "Forbidden")
+		return
+	}
+	client.Logger = c.log
+	media, err := newMedia(offer, c.ID, c.log)
+	if err != nil {
+		c.log.Error("failed to set up media", "err", err)
+		c.reject(500, "Server Internal Error")
+		return
+	}
+
+	// From here, end closes it, e.g. when the call is cancelled or the UA
+	// closes during the setup, and the final response has been sent.
+	c.mutex.Lock()
+	if c.state == stateEnded {
+		c.mutex.Unlock()
+		media.close()
+		return
+	}
+	c.media = media
+	c.mutex.Unlock()
+
+	session, err := c.ua.opts.Sessions.Start(c.ID, client, media, media)
+	if err != nil {
+		c.log.Error("failed to connect upstream", "err", err)
+		c.reject(503, "Service Unavailable")
+		return
+	}
+
+	c.sdpID = time.Now().Unix()
+	c.sdpVersion = c.sdpID
+	sdp := c.answer(offer)
+	c.mutex.Lock()
+	c.session = session
+	if c.state == stateEnded {
+		// end has run without the session
+		c.mutex.Unlock()
+		session.Close()
+		return
+	}
+	c.state = stateAnswered
+	c.sdp = sdp
+	c.mutex.Unlock()
+
+	c.log.Info("call answered", "codec", offer.codec, "rtp", offer.addr)
+	c.respond(200, "OK", sdp)
+	go c.retransmitOK()
+}
+
+// reject sends a final error response, unless the INVITE already has one,
+// and ends the call.
+func (c *Call) reject(statusCode int, reason string) {
+	if c.finish() {
+		c.respond(statusCode, reason, nil)
+	}
+	c.end()
+}
+
+// finish ends the setup, and reports whether it was in progress: only then
+// may the INVITE get a final error response.
+func (c *Call) finish() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.state != stateSetup {
+		return false
+	}
+	c.state = stateEnded
+	return true
+}
+
+// answer returns the SDP answer to o, with the same version as the last
+// one unless it changed.
+func (c *Call) answer(o *offer) []byte {
+	ip := c.ua.localIP(c.Remote)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	sdp := answer(c.sdpID, c.sdpVersion, ip, c.media.port(), o)
+	if c.sdp != nil && !bytes.Equal(sdp, c.sdp) {
+		c.sdpVersion++
+		sdp = answer(c.sdpID, c.sdpVersion, ip, c.media.port(), o)
+	}
+	return sdp
+}
+
+// respond responds to the INVITE. The responses after 100 Trying have the
+// tag of the dialog, the 200 OK the SDP answer.
+func (c *Call) respond(statusCode int, reason string, sdp []byte) {
+	res := newResponse(c.invite, statusCode, reason)
+	if statusCode > 100 {
+		res.setTag(c.localTag)
+	}
+	if sdp != nil {
+		res.add("Contact", c.contact())
+		res.add("Content-Type", "application/sdp")
+		res.body = sdp
+	}
+	c.mutex.Lock()
+	c.response = res
+	c.mutex.Unlock()
+	c.ua.send(res, c.Remote)
+}
+
+func (c *Call) contact() string {
+	port := c.ua.conn.LocalAddr().(*net.UDPAddr).Port
+	return fmt.Sprintf("<sip:%s>", net.JoinHostPort(c.ua.localIP(c.Remote).String(), strconv.Itoa(port)))
+}
+
+// retransmitOK sends the 200 OK again until the ACK, see RFC 3261 section
+// 13.3.1.4, and hangs up without one.
+func (c *Call) retransmitOK() {
+	interval := timerT1
+	deadline := time.After(64 * timerT1)
+	for {
+		timer := time.NewTimer(interval)
+		select {
+		case <-c.acked:
+			timer.Stop()
+			return
+		case <-c.done:
+			timer.Stop()
+			return
+		case <-deadline:
+			timer.Stop()
+			c.log.Warn("no ACK, hanging up")
+			c.Hangup()
+			return
+		case <-timer.C:
+		}
+		c.mutex.Lock()
+		res := c.response
+		c.mutex.Unlock()
+		c.ua.send(res, c.Remote)
+		interval = min(2*interval, timerT2)
+	}
+}
+
+// handleInvite answers a retransmitted INVITE with the last response, and a
+// re-INVITE, e.g. a session refresh or a hold, with the answer to its offer.
+// The offer may move the RTP of the caller or put it on hold, but not drop
+// the codec of the call. A re-INVITE without an offer gets the last answer.
+func (c *Call) handleInvite(req *message) {
+	number, _ := req.cseq()
+	inviteNumber, _ := c.invite.cseq()
+	c.mutex.Lock()
+	res, sdp, state := c.response, c.sdp, c.state
+	c.mutex.Unlock()
+
+	if number == inviteNumber {
+		if res != nil {
+			c.ua.send(res, c.Remote)
+		}
+		return
+	}
+	switch state {
+	case stateSetup:
+		c.ua.send(newResponse(req, 491, "Request Pending"), c.Remote)
+		return
+	case stateEnded:
+		c.ua.send(newResponse(req, 481, "Call/Transaction Does Not Exist"), c.Remote)
+		return
+	}
+
+	if len(req.body) > 0 {
+		offer, err := parseOffer(req.body, c.Codec)
+		if err != nil {
+			c.log.Info("rejected re-INVITE", "err", err)
+			c.ua.send(newResponse(req, 488, "Not Acceptable Here"), c.Remote)
+			return
+		}
+		if c.media.update(offer) {
+			c.log.Info("media updated", "rtp", offer.addr, "hold", offer.hold())
+		}
+		sdp = c.answer(offer)
+		c.mutex.Lock()
+		c.sdp = sdp
+		c.mutex.Unlock()
+	}
+	reinvite := newResponse(req, 200, "OK")
+	reinvite.setTag(c.localTag)
+	reinvite.add("Contact", c.contact())
+	reinvite.add("Content-Type", "application/sdp")
+	reinvite.body = sdp
+	c.ua.send(reinvite, c.Remote)
+}
+
+func (c *Call) handleAck() {
+	c.ackOnce.Do(func() { close(c.acked) })
+}
+
+// handleCancel answers the INVITE of a call not answered yet with 487 and
+// ends the call off the signaling goroutine. The setup stops at its next
+// step, closing the upstream if it was connecting.
+func (c *Call) handleCancel() {
+	if !c.finish() {
+		return
+	}
+	c.log.Info("caller cancelled")
+	c.respond(487, "Request Terminated", nil)
+	c.ua.teardown(c)
+}
+
+// handleResponse handles the responses to the BYE.
+func (c *Call) handleResponse(res *message) {
+	c.log.Debug("received response", "status", res.statusCode)
+}
+
+// sendBye ends the dialog from this side, see RFC 3261 section 15.1.1. The
+// BYE goes to where the INVITE came from, which works behind NAT.
+func (c *Call) sendBye() {
+	local := net.JoinHostPort(c.ua.localIP(c.Remote).String(), strconv.Itoa(c.ua.conn.LocalAddr().(*net.UDPAddr).Port))
+
+	c.mutex.Lock()
+	to := c.response.get("To")
+	c.mutex.Unlock()
+
+	uri := headerURI(c.invite.get("Contact"))
+	if uri == "" {
+		uri = c.From
+	}
+	bye := &message{method: "BYE", uri: uri}
+	bye.add("Via", "SIP/2.0/UDP "+local+";branch=z9hG4bK"+ids.New()+";rport")
+	bye.add("Max-Forwards", "70")
+	bye.add("From", to)
+	bye.add("To", c.invite.get("From"))
+	bye.add("Call-ID", c.ID)
+	// The CSeq numbers of each side are independent, this is our first
+	// request of the dialog.
+	bye.add("CSeq", "1 BYE")
+	c.ua.send(bye, c.Remote)
+	c.log.Info("hung up")
+}
+
+// end disconnects the upstream and the media, once.
+func (c *Call) end() {
+	c.endOnce.Do(func() {
+		c.mutex.Lock()
+		c.state = stateEnded
+		session, media := c.session, c.media
+		c.mutex.Unlock()
+		close(c.done)
+
+		if media != nil {
+			media.close()
+		}
+		if session != nil {
+			session.Close()
+		}
+		c.ua.remove(c)
+		c.log.Info("call ended", "duration", time.Since(c.Started).Round(time.Second))
+		if c.ua.opts.OnEnd != nil {
+			c.ua.opts.OnEnd(c)
+		}
+	})
+}
@@ -0,0 +1,274 @@
+package sip
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+
+	"exp-openai-webrtc-streaming/audio"
+	"exp-openai-webrtc-streaming/internal/playback"
+)
+
+// The formats of the media: G.711 on the phone side, and the 48kHz mono PCM
+// of the frames sent upstream, encoded to Opus by the client.
+const (
+	g711Rate      = 8_000
+	upstreamRate  = 48_000
+	packetSamples = g711Rate / 50 // 20ms
+	packetTime    = 20 * time.Millisecond
+)
+
+// media is the RTP of a call on one socket, the caller's audio received and
+// the model audio sent from it. It is the audio.Source of the upstream,
+// decoding the G.711 of the caller, and its audio.TrackWriter, transcoding
+// the model audio to G.711 through a jitter buffer paced in real time.
+type media struct {
+	conn  *net.UDPConn
+	ulaw  bool
+	log   *slog.Logger
+	loops playback.Loops
+
+	// remote is where the audio is sent: the address of the SDP offer, then
+	// the source of the caller's packets, which is the right one behind NAT.
+	// A re-INVITE may change the offered address, the payload type, or hold
+	// the audio.
+	mutex       sync.Mutex
+	remote      *net.UDPAddr
+	offered     *net.UDPAddr
+	latched     bool
+	payloadType uint8
+	hold        bool
+	// sequence drops the late packets, restarted by a re-INVITE
+	sequence audio.RTPSequence
+
+	// read by ReadAudio
+	buf []byte
+	pcm []int16
+
+	// the model audio, 8kHz mono S16LE
+	buffer    *audio.Buffer
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+func newMedia(o *offer, session string, log *slog.Logger) (*media, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for RTP: %w", err)
+	}
+	m := &media{
+		conn:        conn,
+		ulaw:        o.codec == "PCMU",
+		log:         log,
+		remote:      o.addr,
+		offered:     o.addr,
+		payloadType: o.payloadType,
+		hold:        o.hold(),
+		buf:         make([]byte, 1500),
+		buffer:      audio.NewBuffer(g711Rate, 1, 0, 0),
+		done:        make(chan struct{}),
+	}
+	m.buffer.SetSession(session)
+	m.wg.Add(1)
+	go m.send()
+	return m, nil
+}
+
+func (m *media) port() int {
+	return m.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// update applies the offer of a re-INVITE, and reports whether it changed
+// the media. A new address is latched again to the source of the packets,
+// and the caller's stream may restart with any sequence number.
+func (m *media) update(o *offer) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.sequence.Reset()
+	changed := o.payloadType != m.payloadType || o.hold() != m.hold
+	if o.addr.String() != m.offered.String() {
+		m.remote, m.offered, m.latched = o.addr, o.addr, false
+		changed = true
+	}
+	m.payloadType, m.hold = o.payloadType, o.hold()
+	return changed
+}
+
+// ReadAudio returns the audio of the next packet of the caller, io.EOF once
+// the call has ended.
+func (m *media) ReadAudio() (audio.Frame, error) {
+	for {
+		n, addr, err := m.conn.ReadFromUDP(m.buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return audio.Frame{}, io.EOF
+			}
+			return audio.Frame{}, fmt.Errorf("failed to read RTP: %w", err)
+		}
+		var packet rtp.Packet
+		if err := packet.Unmarshal(m.buf[:n]); err != nil {
+			continue
+		}
+		m.mutex.Lock()
+		if packet.PayloadType != m.payloadType {
+			// e.g. telephone-event or comfort noise
+			m.mutex.Unlock()
+			continue
+		}
+		if !m.sequence.Next(&packet.Header) {
+			m.mutex.Unlock()
+			continue
+		}
+
+		if !m.latched {
+			m.latched = true
+			if addr.String() != m.remote.String() {
+				m.log.Debug("sending RTP to the source of the caller's packets", "addr", addr, "offered", m.remote)
+			}
+			m.remote = addr
+		}
+		m.mutex.Unlock()
+
+		m.pcm = m.pcm[:0]
+		for _, b := range packet.Payload {
+			if m.ulaw {
+				m.pcm = append(m.pcm, audio.ULawDecode(b))
+			} else {
+				m.pcm = append(m.pcm, audio.ALawDecode(b))
+			}
+		}
+		if len(m.pcm) == 0 {
+			continue
+		}
+		pcm := audio.ConvertPCM(m.pcm, g711Rate, 1, upstreamRate, 1)
+		return audio.Frame{PCM: pcm, SampleRate: upstreamRate, Channels: 1}, nil
+	}
+}
+
+// WriteWebRTCTrack decodes the model audio into the jitter buffer, until the
+// track ends or the call ends.
+func (m *media) WriteWebRTCTrack(track audio.RemoteTrack) error {
+	if !m.loops.Start(track) {
+		return nil
+	}
+	defer m.loops.Done(track)
+
+	decoder := audio.NewTrackDecoder(track, upstreamRate, 1)
+	var data []byte
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			if m.loops.IsClosed() || errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("failed to read RTP packet: %w", err)
+		}
+		duration := audio.OpusPacketDuration(packet.Payload)
+		if duration == 0 {
+			continue
+		}
+		pcm, err := decoder.Decode(audio.Frame{Opus: packet.Payload, Duration: duration})
+		if err != nil {
+			m.log.Warn("failed to decode model audio", "err", err)
+			continue
+		}
+		pcm = audio.ConvertPCM(pcm, upstreamRate, 1, g711Rate, 1)
+		data = data[:0]
+		for _, sample := range pcm {
+			data = binary.LittleEndian.AppendUint16(data, uint16(sample))
+		}
+		if _, err := m.buffer.Write(data); err != nil {
+			return nil // closed
+		}
+	}
+}
+
+// send sends the buffered model audio to the caller in real time. Nothing
+// is sent while the buffer is empty: the timestamps skip the silence, and the
+// first packet after it has the marker bit, as with silence suppression.
+func (m *media) send() {
+	defer m.wg.Done()
+	ssrc := rand.Uint32()
+	sequence := uint16(rand.Uint32())
+	timestamp := rand.Uint32()
+	data := make([]byte, packetSamples*2)
+	payload := make([]byte, packetSamples)
+	out := make([]byte, 1500)
+	var next time.Time
+	for {
+		if _, err := io.ReadFull(m.buffer, data); err != nil {
+			return
+		}
+
+		now := time.Now()
+		marker := false
+		if late := now.Sub(next); next.IsZero() || late > packetTime {
+			if !next.IsZero() {
+				timestamp += uint32(late / (time.Second / g711Rate))
+			}
+			next, marker = now, true
+		}
+
+		for i := range payload {
+			sample := int16(binary.LittleEndian.Uint16(data[i*2:]))
+			if m.ulaw {
+				payload[i] = audio.ULawEncode(sample)
+			} else {
+				payload[i] = audio.ALawEncode(sample)
+			}
+		}
+		m.mutex.Lock()
+		remote, payloadType, hold := m.remote, m.payloadType, m.hold
+		m.mutex.Unlock()
+		packet := rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         marker,
+				PayloadType:    payloadType,
+				SequenceNumber: sequence,
+				Timestamp:      timestamp,
+				SSRC:           ssrc,
+			},
+			Payload: payload,
+		}
+		sequence++
+		timestamp += packetSamples
+		// On hold, the audio plays on without being sent.
+		if n, err := packet.MarshalTo(out); err != nil {
+			m.log.Warn("dropped RTP packet", "err", err)
+		} else if !hold {
+			if _, err := m.conn.WriteToUDP(out[:n], remote); err != nil {
+				m.log.Debug("failed to send RTP packet", "err", err)
+			}
+		}
+
+		next = next.Add(packetTime)
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-m.done:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// close stops the audio both ways.
+func (m *media) close() {
+	m.closeOnce.Do(func() {
+		close(m.done)
+		m.loops.Close()
+		m.buffer.Close()
+		m.conn.Close()
+		m.wg.Wait()
+	})
+}
@@ -0,0 +1,214 @@
+package sip
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// message is a SIP request or response, see RFC 3261 section 7. The
+// headers keep their order, since the Via headers of a response must be the
+// ones of the request in order.
+type message struct {
+	// Method and URI are set for a request
+	method string
+	uri    string
+	// statusCode and reason are set for a response
+	statusCode int
+	reason     string
+	headers    []header
+	body       []byte
+}
+
+type header struct {
+	name  string
+	value string
+}
+
+// compactNames maps the compact header names to the full ones.
+var compactNames = map[string]string{
+	"i": "Call-ID",
+	"f": "From",
+	"t": "To",
+	"v": "Via",
+	"m": "Contact",
+	"l": "Content-Length",
+	"c": "Content-Type",
+	"k": "Supported",
+}
+
+// canonicalNames are the full names spelled as in RFC 3261, which
+// textproto.CanonicalMIMEHeaderKey would not produce, e.g. Call-Id and Cseq.
+var canonicalNames = map[string]string{
+	"call-id":          "Call-ID",
+	"cseq":             "CSeq",
+	"www-authenticate": "WWW-Authenticate",
+}
+
+func canonicalName(name string) string {
+	if full, ok := compactNames[strings.ToLower(name)]; ok {
+		return full
+	}
+	if canonical, ok := canonicalNames[strings.ToLower(name)]; ok {
+		return canonical
+	}
+	parts := strings.Split(strings.ToLower(name), "-")
+	for i, part := range parts {
+		if part != "" {
+			parts[i] = strings.ToUpper(part[:1]) + part[1:]
+		}
+	}
+	return strings.Join(parts, "-")
+}
+
+func parseMessage(data []byte) (*message, error) {
+	head, body, ok := bytes.Cut(data, []byte("\r\n\r\n"))
+	if !ok {
+		head, body, ok = bytes.Cut(data, []byte("\n\n"))
+		if !ok {
+			return nil, errors.New("no end of headers")
+		}
+	}
+	lines := strings.Split(strings.ReplaceAll(string(head), "\r\n", "\n"), "\n")
+
+	m := &message{}
+	start := strings.SplitN(lines[0], " ", 3)
+	if len(start) != 3 {
+		return nil, fmt.Errorf("invalid start line %q", lines[0])
+	}
+	if start[0] == "SIP/2.0" {
+		code, err := strconv.Atoi(start[1])
+		if err != nil || code < 100 || code > 699 {
+			return nil, fmt.Errorf("invalid status line %q", lines[0])
+		}
+		m.statusCode, m.reason = code, start[2]
+	} else {
+		if start[2] != "SIP/2.0" {
+			return nil, fmt.Errorf("invalid request line %q", lines[0])
+		}
+		m.method, m.uri = start[0], start[1]
+	}
+
+	for _, line := range lines[1:] {
+		if line == "" {
+			continue
+		}
+		// folded header lines continue the previous one
+		if (line[0] == ' ' || line[0] == '\t') && len(m.headers) > 0 {
+			m.headers[len(m.headers)-1].value += " " + strings.TrimSpace(line)
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid header %q", line)
+		}
+		m.headers = append(m.headers, header{canonicalName(strings.TrimSpace(name)), strings.TrimSpace(value)})
+	}
+
+	if length := m.get("Content-Length"); length != "" {
+		n, err := strconv.Atoi(length)
+		if err != nil || n < 0 || n > len(body) {
+			return nil, fmt.Errorf("invalid Content-Length %q", length)
+		}
+		body = body[:n]
+	}
+	m.body = body
+	if m.get("Call-ID") == "" || m.get("CSeq") == "" {
+		return nil, errors.New("missing Call-ID or CSeq")
+	}
+	return m, nil
+}
+
+func (m *message) isRequest() bool {
+	return m.method != ""
+}
+
+// get returns the first value of a header, empty if missing.
+func (m *message) get(name string) string {
+	for _, h := range m.headers {
+		if h.name == name {
+			return h.value
+		}
+	}
+	return ""
+}
+
+func (m *message) add(name, value string) {
+	m.headers = append(m.headers, header{name, value})
+}
+
+// cseq returns the sequence number and the method of the CSeq header.
+func (m *message) cseq() (int, string) {
+	number, method, _ := strings.Cut(m.get("CSeq"), " ")
+	n, _ := strconv.Atoi(number)
+	return n, strings.TrimSpace(method)
+}
+
+func (m *message) bytes() []byte {
+	var b bytes.Buffer
+	if m.isRequest() {
+		fmt.Fprintf(&b, "%s %s SIP/2.0\r\n", m.method, m.uri)
+	} else {
+		fmt.Fprintf(&b, "SIP/2.0 %d %s\r\n", m.statusCode, m.reason)
+	}
+	for _, h := range m.headers {
+		if h.name == "Content-Length" {
+			continue
+		}
+		fmt.Fprintf(&b, "%s: %s\r\n", h.name, h.value)
+	}
+	fmt.Fprintf(&b, "Content-Length: %d\r\n\r\n", len(m.body))
+	b.Write(m.body)
+	return b.Bytes()
+}
+
+// newResponse answers request with its Via, From, To, Call-ID and CSeq
+// headers, see RFC 3261 section 8.2.6.
+func newResponse(request *message, statusCode int, reason string) *message {
+	res := &message{statusCode: statusCode, reason: reason}
+	for _, h := range request.headers {
+		switch h.name {
+		case "Via", "From", "To", "Call-ID", "CSeq":
+			res.headers = append(res.headers, h)
+		}
+	}
+	return res
+}
+
+// setTag adds a tag to the To header of a response, unless it has one.
+func (m *message) setTag(tag string) {
+	for i, h := range m.headers {
+		if h.name == "To" && headerParam(h.value, "tag") == "" {
+			m.headers[i].value += ";tag=" + tag
+		}
+	}
+}
+
+// headerParam returns a parameter of a header value such as From, outside
+// of the URI in angle brackets.
+func headerParam(value, name string) string {
+	if i := strings.LastIndex(value, ">"); i >= 0 {
+		value = value[i+1:]
+	}
+	for _, param := range strings.Split(value, ";")[1:] {
+		key, v, _ := strings.Cut(strings.TrimSpace(param), "=")
+		if strings.EqualFold(key, name) {
+			return v
+		}
+	}
+	return ""
+}
+
+// headerURI returns the URI of a header value such as Contact, in angle
+// brackets or not.
+func headerURI(value string) string {
+	if start := strings.Index(value, "<"); start >= 0 {
+		if end := strings.Index(value[start:], ">"); end >= 0 {
+			return value[start+1 : start+end]
+		}
+	}
+	uri, _, _ := strings.Cut(value, ";")
+	return strings.TrimSpace(uri)
+}
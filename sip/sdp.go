@@ -0,0 +1,160 @@
+package sip
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// The payload types of G.711, static in RFC 3551.
+const (
+	payloadPCMU = 0
+	payloadPCMA = 8
+)
+
+// offer is the audio of an SDP offer, see RFC 4566. Only G.711 at 8kHz is
+// accepted, the first of PCMU and PCMA in the order of the offer.
+type offer struct {
+	addr        *net.UDPAddr
+	payloadType uint8
+	// codec is PCMU or PCMA
+	codec string
+	// direction is sendrecv, sendonly, recvonly or inactive, from the side
+	// of the caller, see RFC 3264 section 5.1
+	direction string
+}
+
+// hold reports whether the caller does not want the audio, see RFC 3264
+// section 8.4, including the old style hold with the address 0.0.0.0.
+func (o *offer) hold() bool {
+	return o.direction == "sendonly" || o.direction == "inactive" || o.addr.IP.IsUnspecified()
+}
+
+// answerDirection is the direction of the answer to the direction of an
+// offer.
+var answerDirection = map[string]string{
+	"sendrecv": "sendrecv",
+	"sendonly": "recvonly",
+	"recvonly": "sendonly",
+	"inactive": "inactive",
+}
+
+// parseOffer returns the audio of an offer. If codec is set, e.g. in a
+// re-INVITE, it is the only one accepted.
+func parseOffer(body []byte, codec string) (*offer, error) {
+	var sessionIP, mediaIP string
+	var port int
+	var formats []string
+	rtpmaps := map[string]string{}
+	inAudio := false
+	sessionDirection, mediaDirection := "sendrecv", ""
+	for _, line := range strings.Split(strings.ReplaceAll(string(body), "\r\n", "\n"), "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "m":
+			fields := strings.Fields(value)
+			// The first audio stream is the one answered.
+			inAudio = len(fields) >= 4 && fields[0] == "audio" && port == 0
+			if inAudio {
+				var err error
+				if port, err = strconv.Atoi(fields[1]); err != nil {
+					return nil, fmt.Errorf("invalid media port %q", fields[1])
+				}
+				formats = fields[3:]
+			}
+		case "c":
+			fields := strings.Fields(value)
+			if len(fields) != 3 || fields[0] != "IN" {
+				continue
+			}
+			if port == 0 {
+				sessionIP = fields[2]
+			} else if inAudio {
+				mediaIP = fields[2]
+			}
+		case "a":
+			if _, ok := answerDirection[value]; ok {
+				if port == 0 {
+					sessionDirection = value
+				} else if inAudio {
+					mediaDirection = value
+				}
+				continue
+			}
+			if !inAudio {
+				continue
+			}
+			if rtpmap, ok := strings.CutPrefix(value, "rtpmap:"); ok {
+				pt, encoding, _ := strings.Cut(rtpmap, " ")
+				rtpmaps[pt] = strings.ToUpper(encoding)
+			}
+		}
+	}
+	if port == 0 {
+		return nil, errors.New("no audio stream")
+	}
+	if mediaIP == "" {
+		mediaIP = sessionIP
+	}
+	ip := net.ParseIP(mediaIP)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid connection address %q", mediaIP)
+	}
+	if mediaDirection == "" {
+		mediaDirection = sessionDirection
+	}
+
+	for _, format := range formats {
+		pt, err := strconv.Atoi(format)
+		if err != nil || pt < 0 || pt > 127 {
+			continue
+		}
+		var offered string
+		encoding, mapped := rtpmaps[format]
+		switch {
+		case encoding == "PCMU/8000" || encoding == "PCMU/8000/1" || (!mapped && pt == payloadPCMU):
+			offered = "PCMU"
+		case encoding == "PCMA/8000" || encoding == "PCMA/8000/1" || (!mapped && pt == payloadPCMA):
+			offered = "PCMA"
+		default:
+			continue
+		}
+		if codec != "" && offered != codec {
+			continue
+		}
+		return &offer{
+			addr:        &net.UDPAddr{IP: ip, Port: port},
+			payloadType: uint8(pt),
+			codec:       offered,
+			direction:   mediaDirection,
+		}, nil
+	}
+	if codec != "" {
+		return nil, fmt.Errorf("%s not offered", codec)
+	}
+	return nil, errors.New("no G.711 codec offered")
+}
+
+// answer is the SDP answer to o for the RTP of a call on ip:port.
+func answer(sessionID, version int64, ip net.IP, port int, o *offer) []byte {
+	family := "IP4"
+	if ip.To4() == nil {
+		family = "IP6"
+	}
+	return []byte(fmt.Sprintf("v=0\r\n"+
+		"o=- %d %d IN %s %s\r\n"+
+		"s=-\r\n"+
+		"c=IN %s %s\r\n"+
+		"t=0 0\r\n"+
+		"m=audio %d RTP/AVP %d\r\n"+
+		"a=rtpmap:%d %s/8000\r\n"+
+		"a=ptime:20\r\n"+
+		"a=%s\r\n",
+		sessionID, version, family, ip, family, ip, port, o.payloadType, o.payloadType, o.codec,
+		answerDirection[o.direction]))
+}
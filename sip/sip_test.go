@@ -0,0 +1,655 @@
+package sip
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+
+	"exp-openai-webrtc-streaming/audio"
+	"exp-openai-webrtc-streaming/realtime"
+)
+
+// fakeAPI is a local fake of the WebRTC endpoints of the Realtime API,
+// echoing the audio of the calls. While hold is set, the offers wait for it
+// to be closed, to keep the calls in their setup.
+type fakeAPI struct {
+	*httptest.Server
+	mutex sync.Mutex
+	peers []*webrtc.PeerConnection
+	hold  chan struct{}
+}
+
+func newFakeAPI(t *testing.T) *fakeAPI {
+	f := &fakeAPI{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/realtime/sessions", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"client_secret":{"value":"ek_test0123456789","expires_at":4102444800}}`)
+	})
+	mux.HandleFunc("/v1/realtime", func(w http.ResponseWriter, r *http.Request) {
+		f.mutex.Lock()
+		hold := f.hold
+		f.mutex.Unlock()
+		if hold != nil {
+			<-hold
+		}
+		offer, _ := io.ReadAll(r.Body)
+		answer, err := f.answer(string(offer))
+		if err != nil {
+			t.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/sdp")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, answer)
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(func() {
+		f.Close()
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		for _, pc := range f.peers {
+			pc.Close()
+		}
+	})
+	return f
+}
+
+func (f *fakeAPI) answer(offer string) (string, error) {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return "", err
+	}
+	f.mutex.Lock()
+	f.peers = append(f.peers, pc)
+	f.mutex.Unlock()
+
+	capability := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48_000, Channels: 2}
+	model, err := webrtc.NewTrackLocalStaticRTP(capability, "audio", "model")
+	if err != nil {
+		return "", err
+	}
+	if _, err := pc.AddTrack(model); err != nil {
+		return "", err
+	}
+	pc.OnTrack(func(user *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		for {
+			p, _, err := user.ReadRTP()
+			if err != nil {
+				return
+			}
+			model.WriteRTP(p)
+		}
+	})
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		return "", err
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+	<-gathered
+	return pc.LocalDescription().SDP, nil
+}
+
+// setHold makes the offers wait until the returned function is called.
+func (f *fakeAPI) setHold() (release func()) {
+	hold := make(chan struct{})
+	f.mutex.Lock()
+	f.hold = hold
+	f.mutex.Unlock()
+	return sync.OnceFunc(func() {
+		f.mutex.Lock()
+		f.hold = nil
+		f.mutex.Unlock()
+		close(hold)
+	})
+}
+
+// phone is a caller on the loopback, with its SIP and RTP sockets.
+type phone struct {
+	t    *testing.T
+	sip  *net.UDPConn
+	rtp  *net.UDPConn
+	ua   *net.UDPAddr
+	id   string
+	from string
+	// answered is set once the 200 OK of the INVITE is ACKed
+	answered bool
+}
+
+func newPhone(t *testing.T, ua *UA, id string) *phone {
+	t.Helper()
+	p := &phone{t: t, ua: ua.Addr().(*net.UDPAddr), id: id, from: "<sip:alice@127.0.0.1>;tag=alice1"}
+	p.sip = listenLoopback(t)
+	p.rtp = listenLoopback(t)
+	return p
+}
+
+func listenLoopback(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func (p *phone) request(method string, cseq int, to, body string) {
+	p.t.Helper()
+	m := &message{method: method, uri: "sip:bot@127.0.0.1"}
+	m.add("Via", fmt.Sprintf("SIP/2.0/UDP %s;branch=z9hG4bK%s%d", p.sip.LocalAddr(), method, cseq))
+	m.add("From", p.from)
+	m.add("To", to)
+	m.add("Call-ID", p.id)
+	m.add("CSeq", fmt.Sprintf("%d %s", cseq, method))
+	m.add("Contact", fmt.Sprintf("<sip:alice@%s>", p.sip.LocalAddr()))
+	if body != "" {
+		m.add("Content-Type", "application/sdp")
+		m.body = []byte(body)
+	}
+	if _, err := p.sip.WriteToUDP(m.bytes(), p.ua); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+// read returns the next SIP message received, skipping the retransmitted
+// 200 OK of the INVITE.
+func (p *phone) read() *message {
+	p.t.Helper()
+	buf := make([]byte, 65535)
+	for {
+		p.sip.SetReadDeadline(time.Now().Add(10 * time.Second))
+		n, _, err := p.sip.ReadFromUDP(buf)
+		if err != nil {
+			p.t.Fatal(err)
+		}
+		m, err := parseMessage(buf[:n])
+		if err != nil {
+			p.t.Fatal(err)
+		}
+		if number, method := m.cseq(); p.answered && m.statusCode == 200 && number == 1 && method == "INVITE" {
+			continue
+		}
+		return m
+	}
+}
+
+func (p *phone) expect(statusCode int) *message {
+	p.t.Helper()
+	m := p.read()
+	if m.statusCode != statusCode {
+		p.t.Fatalf("got %d %s, want %d", m.statusCode, m.reason, statusCode)
+	}
+	return m
+}
+
+// offer is an SDP offer of codecs for the RTP socket rtp, with attribute
+// lines extra.
+func (p *phone) offer(rtp *net.UDPConn, codecs string, extra ...string) string {
+	sdp := fmt.Sprintf("v=0\r\n"+
+		"o=- 1 1 IN IP4 127.0.0.1\r\n"+
+		"s=-\r\n"+
+		"c=IN IP4 127.0.0.1\r\n"+
+		"t=0 0\r\n"+
+		"m=audio %d RTP/AVP %s\r\n"+
+		"a=rtpmap:101 telephone-event/8000\r\n",
+		rtp.LocalAddr().(*net.UDPAddr).Port, codecs)
+	for _, line := range extra {
+		sdp += line + "\r\n"
+	}
+	return sdp
+}
+
+// call invites the UA, checks the answer and ACKs it, and returns the To
+// header with the tag of the dialog and the RTP address of the UA.
+func (p *phone) call(codecs string) (string, *net.UDPAddr) {
+	p.t.Helper()
+	p.request("INVITE", 1, "<sip:bot@127.0.0.1>", p.offer(p.rtp, codecs))
+	p.expect(100)
+	ok := p.expect(200)
+	to := ok.get("To")
+	if headerParam(to, "tag") == "" || ok.get("Contact") == "" {
+		p.t.Fatalf("invalid 200 OK:\n%s", ok.bytes())
+	}
+	answer, err := parseOffer(ok.body, "")
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	p.request("ACK", 1, to, "")
+	p.answered = true
+	return to, answer.addr
+}
+
+// speak sends a 440Hz tone in G.711 packets from conn to addr until stop is
+// closed, in a new stream with a random SSRC and sequence number.
+func speak(conn *net.UDPConn, addr *net.UDPAddr, payloadType uint8, stop <-chan struct{}) {
+	ticker := time.NewTicker(packetTime)
+	defer ticker.Stop()
+	ssrc := rand.Uint32()
+	sequence := uint16(rand.Uint32())
+	var timestamp uint32
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		payload := make([]byte, packetSamples)
+		for i := range payload {
+			sample := int16(8000 * math.Sin(2*math.Pi*440*float64(timestamp+uint32(i))/g711Rate))
+			if payloadType == payloadPCMU {
+				payload[i] = audio.ULawEncode(sample)
+			} else {
+				payload[i] = audio.ALawEncode(sample)
+			}
+		}
+		packet := rtp.Packet{
+			Header:  rtp.Header{Version: 2, PayloadType: payloadType, SequenceNumber: sequence, Timestamp: timestamp, SSRC: ssrc},
+			Payload: payload,
+		}
+		data, _ := packet.Marshal()
+		conn.WriteToUDP(data, addr)
+		sequence++
+		timestamp += packetSamples
+	}
+}
+
+// loudPackets waits for n packets of the echoed tone on conn, checking
+// their G.711 format.
+func loudPackets(t *testing.T, conn *net.UDPConn, payloadType uint8, n int) {
+	t.Helper()
+	buf := make([]byte, 1500)
+	deadline := time.Now().Add(15 * time.Second)
+	for loud := 0; loud < n; {
+		conn.SetReadDeadline(deadline)
+		size, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatalf("%d of %d echoed packets: %v", loud, n, err)
+		}
+		var packet rtp.Packet
+		if err := packet.Unmarshal(buf[:size]); err != nil {
+			t.Fatal(err)
+		}
+		if packet.PayloadType != payloadType || len(packet.Payload) != packetSamples {
+			t.Fatalf("payload type %d with %d bytes, want %d with %d", packet.PayloadType, len(packet.Payload), payloadType, packetSamples)
+		}
+		var energy float64
+		for _, b := range packet.Payload {
+			sample := audio.ALawDecode(b)
+			if payloadType == payloadPCMU {
+				sample = audio.ULawDecode(b)
+			}
+			energy += float64(sample) * float64(sample)
+		}
+		if math.Sqrt(energy/packetSamples) > 1000 {
+			loud++
+		}
+	}
+}
+
+// silent checks that nothing is received on conn for d.
+func silent(t *testing.T, conn *net.UDPConn, d time.Duration) {
+	t.Helper()
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(d))
+	if _, _, err := conn.ReadFromUDP(buf); !isTimeout(err) {
+		t.Fatalf("received RTP, want none (err %v)", err)
+	}
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// drain discards the packets received on conn.
+func drain(conn *net.UDPConn) {
+	buf := make([]byte, 1500)
+	for {
+		conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		if _, _, err := conn.ReadFromUDP(buf); err != nil {
+			return
+		}
+	}
+}
+
+func startUA(t *testing.T, api *fakeAPI, sessions *realtime.SessionManager) (*UA, chan *Call) {
+	t.Helper()
+	ended := make(chan *Call, 10)
+	ua, err := Listen(Options{
+		Addr:    "127.0.0.1:0",
+		MediaIP: net.IPv4(127, 0, 0, 1),
+		NewClient: func(c *Call) (*realtime.Client, error) {
+			if strings.Contains(c.From, "mallory") {
+				return nil, errors.New("blocked caller")
+			}
+			client := realtime.NewClient("sk-test-0123456789")
+			client.ICEServers = nil
+			client.SessionsURL = api.URL + "/v1/realtime/sessions"
+			client.WebRTCURL = api.URL + "/v1/realtime"
+			return client, nil
+		},
+		Sessions: sessions,
+		OnEnd:    func(c *Call) { ended <- c },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ua.Close() })
+	return ua, ended
+}
+
+func waitEnded(t *testing.T, ended <-chan *Call, id string) {
+	t.Helper()
+	select {
+	case c := <-ended:
+		if c.ID != id {
+			t.Fatalf("call %s ended, want %s", c.ID, id)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("call %s did not end", id)
+	}
+}
+
+// requireOpusEncoder skips the tests of the audio of the calls in the builds
+// without libopus, in which the client cannot encode it.
+func requireOpusEncoder(t *testing.T) {
+	t.Helper()
+	track, err := audio.NewPCMTrack(upstreamRate, 1, audio.DefaultOpusEncoderOptions())
+	if err != nil {
+		t.Skip(err)
+	}
+	track.Close()
+}
+
+func TestCall(t *testing.T) {
+	requireOpusEncoder(t)
+	api := newFakeAPI(t)
+	ua, ended := startUA(t, api, nil)
+	p := newPhone(t, ua, "call@test")
+
+	p.request("OPTIONS", 1, "<sip:bot@127.0.0.1>", "")
+	if res := p.expect(200); !strings.Contains(res.get("Allow"), "INVITE") {
+		t.Errorf("Allow %q", res.get("Allow"))
+	}
+
+	to, remote := p.call("8 0 101")
+	if calls := ua.Calls(); len(calls) != 1 || calls[0].Codec != "PCMA" {
+		t.Fatalf("calls %+v, want one PCMA call", calls)
+	}
+
+	// The tone of the caller comes back through the echo of the API, in
+	// G.711 after a round trip through Opus.
+	stop := make(chan struct{})
+	defer close(stop)
+	go speak(p.rtp, remote, payloadPCMA, stop)
+	loudPackets(t, p.rtp, payloadPCMA, 10)
+
+	p.request("BYE", 2, to, "")
+	p.expect(200)
+	waitEnded(t, ended, "call@test")
+	if calls := ua.Calls(); len(calls) != 0 {
+		t.Errorf("%d calls after the BYE", len(calls))
+	}
+	p.request("BYE", 3, to, "")
+	p.expect(481)
+}
+
+func TestReInvite(t *testing.T) {
+	requireOpusEncoder(t)
+	api := newFakeAPI(t)
+	ua, ended := startUA(t, api, nil)
+	p := newPhone(t, ua, "reinvite@test")
+	to, remote := p.call("0")
+	stop := make(chan struct{})
+	go speak(p.rtp, remote, payloadPCMU, stop)
+	loudPackets(t, p.rtp, payloadPCMU, 5)
+
+	// A session refresh without an offer gets the same answer.
+	p.request("INVITE", 2, to, "")
+	first := p.expect(200)
+	if headerParam(first.get("To"), "tag") != headerParam(to, "tag") {
+		t.Errorf("To %q, want the tag of the dialog", first.get("To"))
+	}
+
+	// The phone moves its RTP to another socket. The answer is the same,
+	// with the same version.
+	close(stop)
+	moved := listenLoopback(t)
+	p.request("INVITE", 3, to, p.offer(moved, "0"))
+	if res := p.expect(200); string(res.body) != string(first.body) {
+		t.Errorf("answer changed to:\n%s", res.body)
+	}
+	stop = make(chan struct{})
+	defer close(stop)
+	go speak(moved, remote, payloadPCMU, stop)
+	loudPackets(t, moved, payloadPCMU, 5)
+
+	// On hold, the model audio is not sent, and the answer has a new
+	// version.
+	p.request("INVITE", 4, to, p.offer(moved, "0", "a=sendonly"))
+	res := p.expect(200)
+	if !strings.Contains(string(res.body), "a=recvonly") || sdpVersion(res.body) != sdpVersion(first.body)+1 {
+		t.Errorf("answer to the hold:\n%s", res.body)
+	}
+	drain(moved)
+	silent(t, moved, 300*time.Millisecond)
+
+	p.request("INVITE", 5, to, p.offer(moved, "0", "a=sendrecv"))
+	if res := p.expect(200); !strings.Contains(string(res.body), "a=sendrecv") {
+		t.Errorf("answer to the resume:\n%s", res.body)
+	}
+	loudPackets(t, moved, payloadPCMU, 5)
+
+	// An offer without the codec of the call, or an invalid one, is
+	// rejected and leaves the call as it was.
+	p.request("INVITE", 6, to, p.offer(moved, "8"))
+	p.expect(488)
+	p.request("INVITE", 7, to, "v=0\r\n")
+	p.expect(488)
+	loudPackets(t, moved, payloadPCMU, 5)
+
+	p.request("BYE", 8, to, "")
+	p.expect(200)
+	waitEnded(t, ended, "reinvite@test")
+}
+
+// sdpVersion returns the version of the origin of an SDP body.
+func sdpVersion(body []byte) int64 {
+	var id, version int64
+	for _, line := range strings.Split(string(body), "\r\n") {
+		if origin, ok := strings.CutPrefix(line, "o="); ok {
+			fmt.Sscanf(origin, "- %d %d", &id, &version)
+		}
+	}
+	return version
+}
+
+func TestCancel(t *testing.T) {
+	api := newFakeAPI(t)
+	sessions := realtime.NewSessionManager(realtime.ManagerOptions{})
+	ua, ended := startUA(t, api, sessions)
+	release := api.setHold()
+	defer release()
+
+	p := newPhone(t, ua, "cancel@test")
+	p.request("INVITE", 1, "<sip:bot@127.0.0.1>", p.offer(p.rtp, "0"))
+	p.expect(100)
+	// The CANCEL is answered while the upstream is still connecting.
+	p.request("CANCEL", 1, "<sip:bot@127.0.0.1>", "")
+	p.expect(200)
+	p.expect(487)
+	waitEnded(t, ended, "cancel@test")
+
+	// Once connected, the upstream is closed without answering the INVITE.
+	release()
+	deadline := time.Now().Add(10 * time.Second)
+	for sessions.Stats().Active != 0 || sessions.Stats().Started != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("session stats %+v", sessions.Stats())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	p.sip.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, _, err := p.sip.ReadFromUDP(make([]byte, 65535)); !isTimeout(err) {
+		t.Errorf("received a response after the 487 (err %v)", err)
+	}
+}
+
+func TestRejections(t *testing.T) {
+	api := newFakeAPI(t)
+	sessions := realtime.NewSessionManager(realtime.ManagerOptions{MaxSessions: 1})
+	ua, ended := startUA(t, api, sessions)
+
+	tests := []struct {
+		name   string
+		from   string
+		codecs string
+		want   int
+	}{
+		{"G.729 only", "", "18", 488},
+		{"screened", "<sip:mallory@127.0.0.1>;tag=m", "0", 403},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newPhone(t, ua, tt.name+"@test")
+			if tt.from != "" {
+				p.from = tt.from
+			}
+			p.request("INVITE", 1, "<sip:bot@127.0.0.1>", p.offer(p.rtp, tt.codecs))
+			p.expect(100)
+			p.expect(tt.want)
+			waitEnded(t, ended, tt.name+"@test")
+		})
+	}
+
+	// Beyond the session limit, the calls are rejected with 503.
+	first := newPhone(t, ua, "first@test")
+	to, _ := first.call("0")
+	busy := newPhone(t, ua, "busy@test")
+	busy.request("INVITE", 1, "<sip:bot@127.0.0.1>", busy.offer(busy.rtp, "0"))
+	busy.expect(100)
+	busy.expect(503)
+	waitEnded(t, ended, "busy@test")
+	first.request("BYE", 2, to, "")
+	first.expect(200)
+	waitEnded(t, ended, "first@test")
+	if stats := sessions.Stats(); stats.Active != 0 || stats.Started != 1 || stats.Rejected != 1 {
+		t.Errorf("session stats %+v", stats)
+	}
+}
+
+func TestClose(t *testing.T) {
+	api := newFakeAPI(t)
+	ua, ended := startUA(t, api, nil)
+	phones := []*phone{newPhone(t, ua, "close-1@test"), newPhone(t, ua, "close-2@test")}
+	for _, p := range phones {
+		p.call("0")
+	}
+
+	// Close hangs up every call with a BYE to its Contact.
+	if err := ua.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range phones {
+		bye := p.read()
+		if bye.method != "BYE" || bye.uri != "sip:alice@"+p.sip.LocalAddr().String() ||
+			headerParam(bye.get("To"), "tag") != "alice1" {
+			t.Errorf("invalid BYE:\n%s", bye.bytes())
+		}
+	}
+	for range phones {
+		select {
+		case <-ended:
+		case <-time.After(10 * time.Second):
+			t.Fatal("a call did not end")
+		}
+	}
+	if calls := ua.Calls(); len(calls) != 0 {
+		t.Errorf("%d calls after Close", len(calls))
+	}
+}
+
+func TestParseOffer(t *testing.T) {
+	const header = "v=0\r\no=- 1 1 IN IP4 192.0.2.1\r\ns=-\r\nc=IN IP4 192.0.2.1\r\nt=0 0\r\n"
+	tests := []struct {
+		name      string
+		sdp       string
+		codec     string
+		want      string
+		direction string
+		hold      bool
+		wantErr   bool
+	}{
+		{"first G.711", "m=audio 4000 RTP/AVP 18 8 0\r\n", "", "PCMA/8 192.0.2.1:4000", "sendrecv", false, false},
+		{"dynamic", "m=audio 4000 RTP/AVP 96\r\na=rtpmap:96 PCMU/8000\r\n", "", "PCMU/96 192.0.2.1:4000", "sendrecv", false, false},
+		{"media address", "m=audio 4000 RTP/AVP 0\r\nc=IN IP4 198.51.100.1\r\n", "", "PCMU/0 198.51.100.1:4000", "sendrecv", false, false},
+		{"codec of the call", "m=audio 4000 RTP/AVP 8 0\r\n", "PCMU", "PCMU/0 192.0.2.1:4000", "sendrecv", false, false},
+		{"sendonly", "m=audio 4000 RTP/AVP 0\r\na=sendonly\r\n", "", "PCMU/0 192.0.2.1:4000", "sendonly", true, false},
+		{"session inactive", "a=inactive\r\nm=audio 4000 RTP/AVP 0\r\n", "", "PCMU/0 192.0.2.1:4000", "inactive", true, false},
+		{"recvonly", "m=audio 4000 RTP/AVP 0\r\na=recvonly\r\n", "", "PCMU/0 192.0.2.1:4000", "recvonly", false, false},
+		{"old hold", "m=audio 4000 RTP/AVP 0\r\nc=IN IP4 0.0.0.0\r\n", "", "PCMU/0 0.0.0.0:4000", "sendrecv", true, false},
+		{"no G.711", "m=audio 4000 RTP/AVP 18\r\n", "", "", "", false, true},
+		{"codec missing", "m=audio 4000 RTP/AVP 8\r\n", "PCMU", "", "", false, true},
+		{"no audio", "m=video 4000 RTP/AVP 96\r\n", "", "", "", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o, err := parseOffer([]byte(header+tt.sdp), tt.codec)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, want an error", o)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fmt.Sprintf("%s/%d %s", o.codec, o.payloadType, o.addr); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+			if o.direction != tt.direction || o.hold() != tt.hold {
+				t.Errorf("direction %s hold %t, want %s %t", o.direction, o.hold(), tt.direction, tt.hold)
+			}
+		})
+	}
+}
+
+func TestParseMessage(t *testing.T) {
+	m, err := parseMessage([]byte("INVITE sip:a@b SIP/2.0\r\n" +
+		"v: SIP/2.0/UDP x\r\nVia: SIP/2.0/UDP y\r\ncall-id: 1\r\ncseq: 5 INVITE\r\nl: 3\r\n\r\nabcdef"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(m.body) != "abc" || m.get("Call-ID") != "1" {
+		t.Errorf("body %q Call-ID %q", m.body, m.get("Call-ID"))
+	}
+	if n, method := m.cseq(); n != 5 || method != "INVITE" {
+		t.Errorf("CSeq %d %s", n, method)
+	}
+	res := newResponse(m, 180, "Ringing")
+	if !strings.Contains(string(res.bytes()), "Via: SIP/2.0/UDP x\r\nVia: SIP/2.0/UDP y\r\n") {
+		t.Errorf("the response lost the Vias:\n%s", res.bytes())
+	}
+	if _, err := parseMessage([]byte("INVITE sip:a@b SIP/2.0\r\n\r\n")); err == nil {
+		t.Error("parsed a message without Call-ID")
+	}
+}
@@ -0,0 +1,267 @@
+// Package sip is a minimal SIP user agent answering phone calls, e.g. from a
+// SIP trunk or a PBX, and bridging each of them to the Realtime API over its
+// own realtime.Client. It speaks INVITE, ACK, BYE, CANCEL and OPTIONS over
+// UDP, without registration or authentication, and transcodes the G.711
+// μ-law or A-law RTP of the calls to and from Opus at 48kHz.
+package sip
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"exp-openai-webrtc-streaming/internal/ids"
+	"exp-openai-webrtc-streaming/internal/logging"
+	"exp-openai-webrtc-streaming/realtime"
+)
+
+// The timers of the transactions over UDP, see RFC 3261 section 17.
+const (
+	timerT1 = 500 * time.Millisecond
+	timerT2 = 4 * time.Second
+)
+
+// Options configures a UA. Zero values select the defaults.
+type Options struct {
+	// Addr is the UDP address of the signaling, :5060 by default.
+	Addr string
+	// MediaIP is the address of the RTP announced in the SDP answers and
+	// the Contact headers, by default the local address routing to the
+	// caller.
+	MediaIP net.IP
+	// NewClient returns the upstream client of a call, configured but not
+	// connected. An error rejects the call with 403 Forbidden, e.g. to screen
+	// the callers. Required.
+	NewClient func(call *Call) (*realtime.Client, error)
+	// Sessions runs the upstream clients, e.g. to limit the concurrent
+	// calls, which are rejected with 503 beyond the limit. Without it, the
+	// clients are connected directly.
+	Sessions *realtime.SessionManager
+	// OnEnd is called once a call has ended.
+	OnEnd  func(call *Call)
+	Logger *slog.Logger
+}
+
+// UA answers the calls received on its address.
+type UA struct {
+	opts Options
+	conn *net.UDPConn
+	log  *slog.Logger
+
+	mutex  sync.Mutex
+	calls  map[string]*Call
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// Listen starts answering the calls.
+func Listen(opts Options) (*UA, error) {
+	if opts.NewClient == nil {
+		return nil, errors.New("the SIP UA needs a NewClient hook")
+	}
+	if opts.Addr == "" {
+		opts.Addr = ":5060"
+	}
+	addr, err := net.ResolveUDPAddr("udp", opts.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SIP address: %w", err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for SIP: %w", err)
+	}
+
+	u := &UA{
+		opts:  opts,
+		conn:  conn,
+		log:   logging.Component(opts.Logger, "sip"),
+		calls: make(map[string]*Call),
+	}
+	u.wg.Add(1)
+	go u.serve()
+	u.log.Info("answering calls", "addr", conn.LocalAddr())
+	return u, nil
+}
+
+// Addr returns the local address, e.g. to find the port picked for :0.
+func (u *UA) Addr() net.Addr {
+	return u.conn.LocalAddr()
+}
+
+// Calls returns the calls in progress.
+func (u *UA) Calls() []*Call {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	calls := make([]*Call, 0, len(u.calls))
+	for _, c := range u.calls {
+		calls = append(calls, c)
+	}
+	return calls
+}
+
+// Close hangs up the calls in progress and stops answering.
+func (u *UA) Close() error {
+	u.mutex.Lock()
+	u.closed = true
+	calls := make([]*Call, 0, len(u.calls))
+	for _, c := range u.calls {
+		calls = append(calls, c)
+	}
+	u.mutex.Unlock()
+
+	// The calls hang up in parallel, each disconnecting its upstream.
+	var wg sync.WaitGroup
+	for _, c := range calls {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Hangup()
+		}()
+	}
+	wg.Wait()
+	err := u.conn.Close()
+	u.wg.Wait()
+	return err
+}
+
+func (u *UA) serve() {
+	defer u.wg.Done()
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := u.conn.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				u.log.Error("failed to read SIP", "err", err)
+			}
+			return
+		}
+		m, err := parseMessage(buf[:n])
+		if err != nil {
+			u.log.Debug("dropped invalid SIP message", "from", addr, "err", err)
+			continue
+		}
+		if m.isRequest() {
+			u.handleRequest(m, addr)
+		} else if c := u.call(m.get("Call-ID")); c != nil {
+			c.handleResponse(m)
+		}
+	}
+}
+
+func (u *UA) handleRequest(req *message, addr *net.UDPAddr) {
+	u.log.Debug("received request", "method", req.method, "from", addr, "call_id", req.get("Call-ID"))
+	c := u.call(req.get("Call-ID"))
+	switch req.method {
+	case "INVITE":
+		if c != nil {
+			c.handleInvite(req)
+			return
+		}
+		u.answer(req, addr)
+	case "ACK":
+		// An ACK to an error response is for the transaction only.
+		if c != nil {
+			c.handleAck()
+		}
+	case "BYE":
+		if c == nil {
+			u.send(newResponse(req, 481, "Call/Transaction Does Not Exist"), addr)
+			return
+		}
+		u.send(newResponse(req, 200, "OK"), addr)
+		c.log.Info("caller hung up")
+		u.teardown(c)
+	case "CANCEL":
+		if c == nil {
+			u.send(newResponse(req, 481, "Call/Transaction Does Not Exist"), addr)
+			return
+		}
+		u.send(newResponse(req, 200, "OK"), addr)
+		c.handleCancel()
+	case "OPTIONS":
+		res := newResponse(req, 200, "OK")
+		res.add("Allow", allow)
+		u.send(res, addr)
+	default:
+		res := newResponse(req, 405, "Method Not Allowed")
+		res.add("Allow", allow)
+		u.send(res, addr)
+	}
+}
+
+// allow lists the methods of the UA.
+const allow = "INVITE, ACK, BYE, CANCEL, OPTIONS"
+
+// answer starts a call for a new INVITE.
+func (u *UA) answer(invite *message, addr *net.UDPAddr) {
+	id := invite.get("Call-ID")
+	c := &Call{
+		ID:       id,
+		From:     headerURI(invite.get("From")),
+		To:       headerURI(invite.get("To")),
+		Remote:   addr,
+		Started:  time.Now(),
+		ua:       u,
+		invite:   invite,
+		localTag: ids.New(),
+		log:      u.log.With("call_id", id, "from", headerURI(invite.get("From"))),
+		acked:    make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	u.mutex.Lock()
+	if u.closed {
+		u.mutex.Unlock()
+		u.send(newResponse(invite, 503, "Service Unavailable"), addr)
+		return
+	}
+	u.calls[id] = c
+	u.mutex.Unlock()
+
+	c.respond(100, "Trying", nil)
+	go c.setup()
+}
+
+// teardown ends c off the signaling goroutine, which must not wait for the
+// upstream to disconnect.
+func (u *UA) teardown(c *Call) {
+	u.wg.Add(1)
+	go func() {
+		defer u.wg.Done()
+		c.end()
+	}()
+}
+
+func (u *UA) call(id string) *Call {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	return u.calls[id]
+}
+
+func (u *UA) remove(c *Call) {
+	u.mutex.Lock()
+	delete(u.calls, c.ID)
+	u.mutex.Unlock()
+}
+
+func (u *UA) send(m *message, addr *net.UDPAddr) {
+	if _, err := u.conn.WriteToUDP(m.bytes(), addr); err != nil {
+		u.log.Warn("failed to send SIP message", "to", addr, "err", err)
+	}
+}
+
+// localIP returns the address announced to remote.
+func (u *UA) localIP(remote *net.UDPAddr) net.IP {
+	if u.opts.MediaIP != nil {
+		return u.opts.MediaIP
+	}
+	// Connecting a UDP socket sends nothing, it only picks the route.
+	if conn, err := net.DialUDP("udp", nil, remote); err == nil {
+		defer conn.Close()
+		return conn.LocalAddr().(*net.UDPAddr).IP
+	}
+	return u.conn.LocalAddr().(*net.UDPAddr).IP
+}
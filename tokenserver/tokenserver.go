@@ -0,0 +1,235 @@
+// Package tokenserver mints ephemeral Realtime API tokens for browser
+// clients, so that they connect without ever seeing the API key. Each
+// request is authenticated by a hook, gets the session template of its user
+// and is rate limited per user; browsers on other origins are allowed with
+// CORS.
+package tokenserver
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"exp-openai-webrtc-streaming/internal/logging"
+	"exp-openai-webrtc-streaming/realtime"
+)
+
+// Options configures a Server. Zero values select the defaults.
+type Options struct {
+	// Sessions creates the sessions with the API key.
+	Sessions realtime.SessionsEndpoint
+	// Authenticate identifies the caller of a request, e.g. from a cookie
+	// or a bearer token, and returns its user. An error wrapping
+	// realtime.ErrUnauthorized answers 401, any other 403. Required, see
+	// BearerAuth.
+	Authenticate func(r *http.Request) (user string, err error)
+	// Template returns the session configuration of a user: its model,
+	// voice, instructions and tools. An error rejects the request with 403.
+	// Defaults to DefaultTemplate for every user.
+	Template func(user string) (realtime.SessionConfig, error)
+	// DefaultTemplate is the session configuration without Template. Its
+	// empty fields are left to the API defaults.
+	DefaultTemplate realtime.SessionConfig
+	// RateLimit is how many tokens a user may mint per RateInterval, zero
+	// for no limit. Unused tokens accumulate up to RateLimit.
+	RateLimit int
+	// RateInterval defaults to a minute.
+	RateInterval time.Duration
+	// AllowedOrigins are the origins of the browser apps, e.g.
+	// https://app.example.com, allowed with CORS and their cookies. "*"
+	// allows any other origin without credentials, so that no website can
+	// mint tokens with the cookies of a logged-in user. Requests from other
+	// origins are rejected, requests without an Origin header are not
+	// browser requests and are allowed. Browsers send an Origin with the
+	// POSTs of the same origin too, so an app served by the same host needs
+	// its origin listed: without any, all the browser requests are rejected.
+	AllowedOrigins []string
+	Logger         *slog.Logger
+}
+
+// Server is the http.Handler minting the tokens. A POST returns the session
+// created by the API as is, with the token in client_secret.value and its
+// expiry in client_secret.expires_at.
+type Server struct {
+	opts    Options
+	limiter *limiter
+	log     *slog.Logger
+}
+
+// New returns a Server with opts, or an error if they are invalid.
+func New(opts Options) (*Server, error) {
+	if opts.Authenticate == nil {
+		return nil, errors.New("the token server needs an Authenticate hook")
+	}
+	if opts.RateLimit < 0 {
+		return nil, fmt.Errorf("invalid rate limit %d", opts.RateLimit)
+	}
+	if opts.RateInterval == 0 {
+		opts.RateInterval = time.Minute
+	}
+	s := &Server{
+		opts: opts,
+		log:  logging.Component(opts.Logger, "tokens"),
+	}
+	if opts.RateLimit > 0 {
+		s.limiter = newLimiter(opts.RateLimit, opts.RateInterval)
+	}
+	return s, nil
+}
+
+// ServeHTTP answers the CORS preflights of the allowed origins, and mints a
+// token for each authenticated POST within the rate limit.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Add("Vary", "Origin")
+		switch {
+		case slices.Contains(s.opts.AllowedOrigins, origin):
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		case slices.Contains(s.opts.AllowedOrigins, "*"):
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		default:
+			s.log.Warn("rejected origin", "origin", origin)
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodOptions:
+		// CORS preflight
+		w.Header().Set("Access-Control-Allow-Methods", "POST")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		w.Header().Set("Access-Control-Max-Age", "600")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "POST, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := s.opts.Authenticate(r)
+	if err != nil {
+		s.log.Info("rejected request", "remote", r.RemoteAddr, "err", err)
+		if errors.Is(err, realtime.ErrUnauthorized) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		} else {
+			http.Error(w, "forbidden", http.StatusForbidden)
+		}
+		return
+	}
+	log := s.log.With("user", user)
+
+	if s.limiter != nil {
+		if wait := s.limiter.take(user, time.Now()); wait > 0 {
+			log.Info("rate limited", "retry_after", wait)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+	}
+
+	template := s.opts.DefaultTemplate
+	if s.opts.Template != nil {
+		if template, err = s.opts.Template(user); err != nil {
+			log.Info("no session template", "err", err)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+	}
+
+	session, err := s.opts.Sessions.Create(r.Context(), template)
+	if err != nil {
+		log.Error("failed to create session", "err", err)
+		http.Error(w, "failed to create session", http.StatusBadGateway)
+		return
+	}
+	log.Info("minted token", "model", template.Model, "expires_at", session.ExpiresAt)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(session.Data)
+}
+
+// BearerAuth authenticates the requests by their bearer token, mapping the
+// users to their tokens. The tokens are compared in constant time.
+func BearerAuth(tokens map[string]string) func(r *http.Request) (string, error) {
+	return func(r *http.Request) (string, error) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || token == "" {
+			return "", realtime.ErrUnauthorized
+		}
+		for user, t := range tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+				return user, nil
+			}
+		}
+		return "", realtime.ErrUnauthorized
+	}
+}
+
+// limiter is a token bucket per user.
+type limiter struct {
+	capacity float64
+	// rate is in tokens per second
+	rate     float64
+	interval time.Duration
+
+	mutex   sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(limit int, interval time.Duration) *limiter {
+	return &limiter{
+		capacity: float64(limit),
+		rate:     float64(limit) / interval.Seconds(),
+		interval: interval,
+		buckets:  make(map[string]*bucket),
+	}
+}
+
+// take takes a token of user, or returns how long until one is available.
+func (l *limiter) take(user string, now time.Time) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	b, ok := l.buckets[user]
+	if !ok {
+		b = &bucket{tokens: l.capacity, last: now}
+		l.buckets[user] = b
+	}
+	b.tokens = min(l.capacity, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+
+	// Full buckets are the same as no bucket, dropping them bounds the map
+	// by the users active within the interval.
+	if now.Sub(l.swept) >= l.interval {
+		l.swept = now
+		for u, other := range l.buckets {
+			if other.tokens+now.Sub(other.last).Seconds()*l.rate >= l.capacity {
+				delete(l.buckets, u)
+			}
+		}
+	}
+	return 0
+}
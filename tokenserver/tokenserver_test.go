@@ -0,0 +1,326 @@
+package tokenserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"exp-openai-webrtc-streaming/internal/logging"
+	"exp-openai-webrtc-streaming/realtime"
+)
+
+const upstreamKey = "sk-upstream-0123456789"
+
+// fakeSessions is a fake of the sessions endpoint of the API, recording
+// the bodies of the requests.
+type fakeSessions struct {
+	*httptest.Server
+	mutex  sync.Mutex
+	bodies []map[string]any
+}
+
+func newFakeSessions(t *testing.T) *fakeSessions {
+	f := &fakeSessions{}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Authorization") != "Bearer "+upstreamKey {
+			w.WriteHeader(http.StatusUnauthorized)
+			io.WriteString(w, `{"error":{"message":"Incorrect API key provided: `+
+				strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")+
+				`","type":"invalid_request_error","code":"invalid_api_key"}}`)
+			return
+		}
+		var body map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Error(err)
+		}
+		f.mutex.Lock()
+		f.bodies = append(f.bodies, body)
+		f.mutex.Unlock()
+		model, _ := body["model"].(string)
+		io.WriteString(w, `{"id":"sess_1","model":"`+model+`","client_secret":{"value":"ek_0123456789abcdef","expires_at":1700000060}}`)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeSessions) lastBody() map[string]any {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if len(f.bodies) == 0 {
+		return nil
+	}
+	return f.bodies[len(f.bodies)-1]
+}
+
+// request serves a request with the bearer token and the origin, if not
+// empty.
+func request(s http.Handler, method, origin, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/session", nil)
+	if origin != "" {
+		r.Header.Set("Origin", origin)
+	}
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func newTestServer(t *testing.T, opts Options) *Server {
+	t.Helper()
+	if opts.Authenticate == nil {
+		opts.Authenticate = BearerAuth(map[string]string{"alice": "alice-token", "bob": "bob-token"})
+	}
+	s, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestAuthenticate(t *testing.T) {
+	upstream := newFakeSessions(t)
+	s := newTestServer(t, Options{
+		Sessions: realtime.SessionsEndpoint{Key: upstreamKey, URL: upstream.URL},
+		Authenticate: func(r *http.Request) (string, error) {
+			switch r.Header.Get("Authorization") {
+			case "Bearer alice-token":
+				return "alice", nil
+			case "Bearer suspended-token":
+				return "", errors.New("suspended")
+			}
+			return "", realtime.ErrUnauthorized
+		},
+	})
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"valid", "alice-token", http.StatusOK},
+		{"missing", "", http.StatusUnauthorized},
+		{"unknown", "mallory-token", http.StatusUnauthorized},
+		{"rejected", "suspended-token", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := request(s, http.MethodPost, "", tt.token); w.Code != tt.want {
+				t.Errorf("status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestBearerAuth(t *testing.T) {
+	auth := BearerAuth(map[string]string{"alice": "alice-token"})
+	tests := []struct {
+		header   string
+		wantUser string
+	}{
+		{"Bearer alice-token", "alice"},
+		{"Bearer alice-token2", ""},
+		{"Bearer ", ""},
+		{"Basic alice-token", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.Header.Set("Authorization", tt.header)
+		user, err := auth(r)
+		if user != tt.wantUser || (tt.wantUser == "" && !errors.Is(err, realtime.ErrUnauthorized)) {
+			t.Errorf("%q: user %q, error %v", tt.header, user, err)
+		}
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	upstream := newFakeSessions(t)
+	s := newTestServer(t, Options{
+		Sessions: realtime.SessionsEndpoint{Key: upstreamKey, URL: upstream.URL},
+		Template: func(user string) (realtime.SessionConfig, error) {
+			if user == "bob" {
+				return realtime.SessionConfig{}, errors.New("no template")
+			}
+			return realtime.SessionConfig{
+				Model:        "model-" + user,
+				Voice:        "alloy",
+				Instructions: "Help " + user,
+				Tools:        []realtime.Tool{{Name: "lookup"}},
+			}, nil
+		},
+	})
+
+	w := request(s, http.MethodPost, "", "alice-token")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	if !strings.Contains(w.Body.String(), `"value":"ek_0123456789abcdef"`) {
+		t.Errorf("body %s, want the session as is", w.Body)
+	}
+	if w.Header().Get("Cache-Control") != "no-store" {
+		t.Error("the token may be cached")
+	}
+	body := upstream.lastBody()
+	tools, _ := body["tools"].([]any)
+	if body["model"] != "model-alice" || body["voice"] != "alloy" || body["instructions"] != "Help alice" || len(tools) != 1 {
+		t.Errorf("upstream body %v, want the template of alice", body)
+	}
+
+	if w := request(s, http.MethodPost, "", "bob-token"); w.Code != http.StatusForbidden {
+		t.Errorf("without template: status %d, want 403", w.Code)
+	}
+}
+
+func TestDefaultTemplate(t *testing.T) {
+	upstream := newFakeSessions(t)
+	s := newTestServer(t, Options{
+		Sessions:        realtime.SessionsEndpoint{Key: upstreamKey, URL: upstream.URL},
+		DefaultTemplate: realtime.SessionConfig{Voice: "verse"},
+	})
+	if w := request(s, http.MethodPost, "", "bob-token"); w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+	if body := upstream.lastBody(); len(body) != 1 || body["voice"] != "verse" {
+		t.Errorf("upstream body %v, want only the default voice", body)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	upstream := newFakeSessions(t)
+	s := newTestServer(t, Options{
+		Sessions:     realtime.SessionsEndpoint{Key: upstreamKey, URL: upstream.URL},
+		RateLimit:    2,
+		RateInterval: time.Second,
+	})
+
+	for i := range 2 {
+		if w := request(s, http.MethodPost, "", "alice-token"); w.Code != http.StatusOK {
+			t.Fatalf("request %d: status %d", i, w.Code)
+		}
+	}
+	w := request(s, http.MethodPost, "", "alice-token")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("over the limit: status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	// the buckets are per user
+	if w := request(s, http.MethodPost, "", "bob-token"); w.Code != http.StatusOK {
+		t.Errorf("other user: status %d", w.Code)
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	l := newLimiter(2, time.Second)
+	now := time.Now()
+	for i := range 2 {
+		if wait := l.take("alice", now); wait != 0 {
+			t.Fatalf("take %d: wait %v", i, wait)
+		}
+	}
+	if wait := l.take("alice", now); wait != 500*time.Millisecond {
+		t.Errorf("empty bucket: wait %v, want 500ms", wait)
+	}
+	if wait := l.take("alice", now.Add(500*time.Millisecond)); wait != 0 {
+		t.Errorf("refilled bucket: wait %v", wait)
+	}
+	// the full buckets are swept
+	l.take("bob", now.Add(10*time.Second))
+	if len(l.buckets) != 1 {
+		t.Errorf("%d buckets, want only bob", len(l.buckets))
+	}
+}
+
+func TestCORS(t *testing.T) {
+	upstream := newFakeSessions(t)
+	const app = "https://app.example.com"
+	tests := []struct {
+		name            string
+		allowed         []string
+		method          string
+		origin          string
+		want            int
+		wantAllow       string
+		wantCredentials bool
+	}{
+		{"preflight", []string{app}, http.MethodOptions, app, http.StatusNoContent, app, true},
+		{"post", []string{app}, http.MethodPost, app, http.StatusOK, app, true},
+		{"other origin", []string{app}, http.MethodPost, "https://evil.example.com", http.StatusForbidden, "", false},
+		{"other origin preflight", []string{app}, http.MethodOptions, "https://evil.example.com", http.StatusForbidden, "", false},
+		{"any origin", []string{"*"}, http.MethodPost, "https://other.example.com", http.StatusOK, "*", false},
+		{"listed origin and any", []string{"*", app}, http.MethodPost, app, http.StatusOK, app, true},
+		{"no origin", nil, http.MethodPost, "", http.StatusOK, "", false},
+		{"no allowed origin", nil, http.MethodPost, app, http.StatusForbidden, "", false},
+		{"method", []string{app}, http.MethodGet, app, http.StatusMethodNotAllowed, app, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestServer(t, Options{
+				Sessions:       realtime.SessionsEndpoint{Key: upstreamKey, URL: upstream.URL},
+				AllowedOrigins: tt.allowed,
+			})
+			w := request(s, tt.method, tt.origin, "alice-token")
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d", w.Code, tt.want)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.wantAllow {
+				t.Errorf("Access-Control-Allow-Origin %q, want %q", got, tt.wantAllow)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Credentials") == "true"; got != tt.wantCredentials {
+				t.Errorf("Access-Control-Allow-Credentials %v, want %v", got, tt.wantCredentials)
+			}
+			if tt.method == http.MethodOptions && w.Code == http.StatusNoContent {
+				if w.Header().Get("Access-Control-Allow-Methods") != "POST" ||
+					!strings.Contains(w.Header().Get("Access-Control-Allow-Headers"), "Authorization") {
+					t.Errorf("preflight headers %v", w.Header())
+				}
+			}
+		})
+	}
+}
+
+func TestUpstreamErrorRedacted(t *testing.T) {
+	// The fake echoes the wrong key in its error, as the API does.
+	const wrongKey = "sk-wrong-0123456789abcdef"
+	upstream := newFakeSessions(t)
+	var logs bytes.Buffer
+	logger, err := logging.New(&logs, "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTestServer(t, Options{
+		Sessions: realtime.SessionsEndpoint{Key: wrongKey, URL: upstream.URL},
+		Logger:   logger,
+	})
+
+	w := request(s, http.MethodPost, "", "alice-token")
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("status %d, want 502", w.Code)
+	}
+	if strings.Contains(w.Body.String(), "Incorrect API key") || strings.Contains(w.Body.String(), wrongKey) {
+		t.Errorf("the upstream error reached the client: %s", w.Body)
+	}
+	if !strings.Contains(logs.String(), "invalid_api_key") {
+		t.Errorf("the upstream error is not logged:\n%s", logs.String())
+	}
+	if strings.Contains(logs.String(), wrongKey) {
+		t.Errorf("the key is in the logs:\n%s", logs.String())
+	}
+}
+
+func TestNew(t *testing.T) {
+	if _, err := New(Options{}); err == nil {
+		t.Error("no error without Authenticate")
+	}
+	auth := BearerAuth(nil)
+	if _, err := New(Options{Authenticate: auth, RateLimit: -1}); err == nil {
+		t.Error("no error with a negative rate limit")
+	}
+}
@@ -0,0 +1,163 @@
+// Package twilio bridges the calls of Twilio Media Streams to the Realtime
+// API, each over its own realtime.Client. Twilio connects to the Bridge over
+// a WebSocket, see the <Connect><Stream> TwiML verb, and sends the μ-law
+// audio of the caller in base64 media messages. The model audio is sent back
+// the same way, followed by marks, so that the audio still queued at Twilio
+// is known and cleared when the caller interrupts the model.
+package twilio
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"exp-openai-webrtc-streaming/internal/logging"
+	"exp-openai-webrtc-streaming/realtime"
+)
+
+// startTimeout bounds the wait for the start message of a stream.
+const startTimeout = 10 * time.Second
+
+// Options configures a Bridge. Zero values select the defaults.
+type Options struct {
+	// Authenticate checks the WebSocket request of a stream, e.g. with
+	// SignatureAuth. An error wrapping realtime.ErrUnauthorized answers
+	// 401, any other 403. Required.
+	Authenticate func(r *http.Request) error
+	// NewClient returns the upstream client of a call, configured but not
+	// connected. The call has the SIDs and the custom parameters of the
+	// start message. An error hangs up.
+	// Required.
+	NewClient func(call *Call) (*realtime.Client, error)
+	// Sessions runs the upstream clients, e.g. to limit the concurrent
+	// calls, which are hung up beyond the limit. Without it, the clients are
+	// connected directly.
+	Sessions *realtime.SessionManager
+	// OnEnd is called once a call has ended.
+	OnEnd  func(call *Call)
+	Logger *slog.Logger
+}
+
+// Bridge is the http.Handler of the Media Streams WebSockets. Each
+// connection is served until its stream stops.
+type Bridge struct {
+	opts     Options
+	upgrader websocket.Upgrader
+	log      *slog.Logger
+
+	mutex  sync.Mutex
+	calls  map[string]*Call
+	closed bool
+}
+
+// New returns a Bridge with opts, or an error if a required hook is
+// missing.
+func New(opts Options) (*Bridge, error) {
+	if opts.Authenticate == nil {
+		return nil, errors.New("the bridge needs an Authenticate hook")
+	}
+	if opts.NewClient == nil {
+		return nil, errors.New("the bridge needs a NewClient hook")
+	}
+	return &Bridge{
+		opts:  opts,
+		log:   logging.Component(opts.Logger, "twilio"),
+		calls: make(map[string]*Call),
+	}, nil
+}
+
+// ServeHTTP authenticates the request and upgrades it to the WebSocket of
+// a stream, which it serves until the stream stops.
+func (b *Bridge) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := b.opts.Authenticate(r); err != nil {
+		b.log.Info("rejected stream", "remote", r.RemoteAddr, "err", err)
+		if errors.Is(err, realtime.ErrUnauthorized) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+		} else {
+			http.Error(w, "forbidden", http.StatusForbidden)
+		}
+		return
+	}
+	conn, err := b.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has answered.
+		b.log.Info("failed to upgrade stream", "remote", r.RemoteAddr, "err", err)
+		return
+	}
+	b.serve(conn)
+}
+
+// Calls returns the calls in progress.
+func (b *Bridge) Calls() []*Call {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	calls := make([]*Call, 0, len(b.calls))
+	for _, c := range b.calls {
+		calls = append(calls, c)
+	}
+	return calls
+}
+
+// Close ends the calls in progress and rejects the new ones.
+func (b *Bridge) Close() error {
+	b.mutex.Lock()
+	b.closed = true
+	calls := make([]*Call, 0, len(b.calls))
+	for _, c := range b.calls {
+		calls = append(calls, c)
+	}
+	b.mutex.Unlock()
+
+	for _, c := range calls {
+		c.Close()
+	}
+	return nil
+}
+
+func (b *Bridge) add(c *Call) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return errors.New("bridge closed")
+	}
+	b.calls[c.StreamSID] = c
+	return nil
+}
+
+func (b *Bridge) remove(c *Call) {
+	b.mutex.Lock()
+	delete(b.calls, c.StreamSID)
+	b.mutex.Unlock()
+}
+
+// SignatureAuth checks the X-Twilio-Signature header of the requests, the
+// HMAC-SHA1 of the URL of the stream keyed with the auth token of the
+// account. url is the URL as configured at Twilio, e.g.
+// wss://bridge.example.com/media; if empty, it is rebuilt from the request,
+// which only works without a proxy rewriting it.
+func SignatureAuth(authToken, url string) func(r *http.Request) error {
+	return func(r *http.Request) error {
+		signature := r.Header.Get("X-Twilio-Signature")
+		if signature == "" {
+			return realtime.ErrUnauthorized
+		}
+		signed := url
+		if signed == "" {
+			signed = "wss://" + r.Host + r.URL.RequestURI()
+		}
+		mac := hmac.New(sha1.New, []byte(authToken))
+		mac.Write([]byte(signed))
+		want := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+		if !hmac.Equal([]byte(signature), []byte(want)) {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+}
@@ -0,0 +1,526 @@
+package twilio
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"exp-openai-webrtc-streaming/audio"
+	"exp-openai-webrtc-streaming/realtime"
+)
+
+// The formats of the media: μ-law at 8kHz on the Twilio side, and the 48kHz
+// mono PCM of the frames sent upstream, encoded to Opus by the client.
+const (
+	twilioRate   = 8_000
+	upstreamRate = 48_000
+)
+
+// callerQueueSize is how many media messages of the caller may wait for the
+// upstream, dropping the newer ones when full.
+const callerQueueSize = 50
+
+// writeTimeout bounds the writes to Twilio, so that a stuck connection does
+// not block the model audio.
+const writeTimeout = 5 * time.Second
+
+// markInterval is how much model audio a mark follows, and how long after
+// the last audio the rest is marked, e.g. at the end of a response. A mark
+// per 20ms packet would double the messages to Twilio, for a precision the
+// truncation does not need.
+const markInterval = 200 * time.Millisecond
+
+// message is a message of the Media Streams protocol, both ways, see
+// https://www.twilio.com/docs/voice/media-streams/websocket-messages.
+type message struct {
+	Event     string        `json:"event"`
+	StreamSID string        `json:"streamSid,omitempty"`
+	Start     *startPayload `json:"start,omitempty"`
+	Media     *mediaPayload `json:"media,omitempty"`
+	Mark      *markPayload  `json:"mark,omitempty"`
+	DTMF      *struct {
+		Digit string `json:"digit"`
+	} `json:"dtmf,omitempty"`
+}
+
+type startPayload struct {
+	AccountSID  string `json:"accountSid"`
+	CallSID     string `json:"callSid"`
+	StreamSID   string `json:"streamSid"`
+	MediaFormat struct {
+		Encoding   string `json:"encoding"`
+		SampleRate int    `json:"sampleRate"`
+		Channels   int    `json:"channels"`
+	} `json:"mediaFormat"`
+	CustomParameters map[string]string `json:"customParameters"`
+}
+
+type mediaPayload struct {
+	// Track is inbound for the audio of the caller, empty for the audio
+	// sent to Twilio.
+	Track   string `json:"track,omitempty"`
+	Payload string `json:"payload"`
+}
+
+type markPayload struct {
+	Name string `json:"name"`
+}
+
+// Call is the stream of a phone call bridged to the API.
+type Call struct {
+	StreamSID  string
+	CallSID    string
+	AccountSID string
+	// Parameters are the custom parameters of the <Stream>.
+	Parameters map[string]string
+	Started    time.Time
+
+	bridge     *Bridge
+	conn       *websocket.Conn
+	log        *slog.Logger
+	frames     chan audio.Frame
+	done       chan struct{}
+	closeOnce  sync.Once
+	writeMutex sync.Mutex
+
+	// The model audio is followed by marks, which Twilio echoes once the
+	// audio before them is played: marks are the ones not echoed yet, and
+	// played the last one echoed. unmarked is the audio sent since the last
+	// mark, marked by markTimer once the audio pauses.
+	mutex     sync.Mutex
+	session   *realtime.ManagedSession
+	closed    bool
+	itemID    string
+	itemSent  time.Duration
+	marks     []mark
+	played    mark
+	markCount int
+	unmarked  time.Duration
+	markTimer *time.Timer
+}
+
+// mark is a mark sent after the model audio.
+type mark struct {
+	name   string
+	itemID string
+	// end is the duration of the audio of the item sent before the mark
+	end time.Duration
+}
+
+// serve bridges a stream until it stops.
+func (b *Bridge) serve(conn *websocket.Conn) {
+	start, err := readStart(conn)
+	if err != nil {
+		b.log.Info("invalid stream", "err", err)
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseProtocolError, ""),
+			time.Now().Add(time.Second))
+		conn.Close()
+		return
+	}
+
+	c := &Call{
+		StreamSID:  start.StreamSID,
+		CallSID:    start.CallSID,
+		AccountSID: start.AccountSID,
+		Parameters: start.CustomParameters,
+		Started:    time.Now(),
+		bridge:     b,
+		conn:       conn,
+		log:        b.log.With("call_sid", start.CallSID, "stream_sid", start.StreamSID),
+		frames:     make(chan audio.Frame, callerQueueSize),
+		done:       make(chan struct{}),
+	}
+	if err := b.add(c); err != nil {
+		conn.Close()
+		return
+	}
+	defer c.Close()
+
+	if err := c.connect(); err != nil {
+		c.log.Error("failed to connect upstream", "err", err)
+		return
+	}
+	c.log.Info("call started")
+	c.read()
+}
+
+// readStart reads the messages until the start of the stream.
+func readStart(conn *websocket.Conn) (*startPayload, error) {
+	conn.SetReadDeadline(time.Now().Add(startTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read start: %w", err)
+		}
+		var m message
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, fmt.Errorf("failed to parse message: %w", err)
+		}
+		switch m.Event {
+		case "connected":
+			continue
+		case "start":
+		default:
+			return nil, fmt.Errorf("unexpected %q before start", m.Event)
+		}
+		if m.Start == nil || m.Start.StreamSID == "" {
+			return nil, errors.New("start without a stream")
+		}
+		format := m.Start.MediaFormat
+		if format.Encoding != "audio/x-mulaw" || format.SampleRate != twilioRate || format.Channels != 1 {
+			return nil, fmt.Errorf("unsupported media format %s/%d/%d", format.Encoding, format.SampleRate, format.Channels)
+		}
+		return m.Start, nil
+	}
+}
+
+func (c *Call) connect() error {
+	client, err := c.bridge.opts.NewClient(c)
+	if err != nil {
+		return fmt.Errorf("failed to create client: %w", err)
+	}
+	client.Logger = c.log
+	onEvent := client.OnEvent
+	client.OnEvent = func(event realtime.Event) {
+		c.serverEvent(event)
+		if onEvent != nil {
+			onEvent(event)
+		}
+	}
+
+	session, err := c.bridge.opts.Sessions.Start(c.StreamSID, client, callerSource{c}, modelWriter{c})
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	closed := c.closed
+	c.session = session
+	c.mutex.Unlock()
+	if closed {
+		// Close has run without the session
+		session.Close()
+		return errors.New("call closed")
+	}
+	return nil
+}
+
+// read handles the messages of Twilio until the stream stops.
+func (c *Call) read() {
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) && !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				c.log.Error("failed to read stream", "err", err)
+			}
+			return
+		}
+		var m message
+		if err := json.Unmarshal(data, &m); err != nil {
+			c.log.Warn("failed to parse message", "err", err)
+			continue
+		}
+		switch m.Event {
+		case "media":
+			if m.Media != nil && (m.Media.Track == "" || m.Media.Track == "inbound") {
+				c.receiveAudio(m.Media.Payload)
+			}
+		case "mark":
+			if m.Mark != nil {
+				c.markPlayed(m.Mark.Name)
+			}
+		case "dtmf":
+			if m.DTMF != nil {
+				c.log.Info("caller pressed a key", "digit", m.DTMF.Digit)
+			}
+		case "stop":
+			c.log.Info("stream stopped")
+			return
+		}
+	}
+}
+
+// receiveAudio queues the μ-law audio of a media message, converted to the
+// upstream format.
+func (c *Call) receiveAudio(payload string) {
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		c.log.Warn("failed to decode caller audio", "err", err)
+		return
+	}
+	if len(data) == 0 {
+		return
+	}
+	pcm := make([]int16, len(data))
+	for i, b := range data {
+		pcm[i] = audio.ULawDecode(b)
+	}
+	frame := audio.Frame{
+		PCM:        audio.ConvertPCM(pcm, twilioRate, 1, upstreamRate, 1),
+		SampleRate: upstreamRate,
+		Channels:   1,
+	}
+	select {
+	case c.frames <- frame:
+	default:
+		// the upstream is behind, dropping beats adding latency
+	}
+}
+
+// sendAudio sends μ-law model audio to Twilio, followed by a mark every
+// markInterval of audio, or once the audio pauses for markInterval.
+func (c *Call) sendAudio(ulaw []byte) error {
+	err := c.send(message{
+		Event:     "media",
+		StreamSID: c.StreamSID,
+		Media:     &mediaPayload{Payload: base64.StdEncoding.EncodeToString(ulaw)},
+	})
+	if err != nil {
+		return err
+	}
+
+	duration := time.Duration(len(ulaw)) * time.Second / twilioRate
+	c.mutex.Lock()
+	c.itemSent += duration
+	c.unmarked += duration
+	due := c.unmarked >= markInterval
+	if !due && !c.closed {
+		if c.markTimer == nil {
+			c.markTimer = time.AfterFunc(markInterval, c.flushMark)
+		} else {
+			c.markTimer.Reset(markInterval)
+		}
+	}
+	c.mutex.Unlock()
+	if due {
+		return c.sendMark()
+	}
+	return nil
+}
+
+// sendMark sends a mark after the audio sent since the last one, if any.
+func (c *Call) sendMark() error {
+	c.mutex.Lock()
+	if c.unmarked == 0 {
+		c.mutex.Unlock()
+		return nil
+	}
+	c.unmarked = 0
+	c.markCount++
+	m := mark{name: strconv.Itoa(c.markCount), itemID: c.itemID, end: c.itemSent}
+	c.marks = append(c.marks, m)
+	c.mutex.Unlock()
+	return c.send(message{Event: "mark", StreamSID: c.StreamSID, Mark: &markPayload{Name: m.name}})
+}
+
+// flushMark marks the audio sent before a pause.
+func (c *Call) flushMark() {
+	if err := c.sendMark(); err != nil {
+		c.log.Debug("failed to send mark", "err", err)
+	}
+}
+
+// markPlayed records that the audio before a mark is played. The marks
+// echoed after a clear are not queued anymore and ignored.
+func (c *Call) markPlayed(name string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for i, m := range c.marks {
+		if m.name == name {
+			c.played = m
+			c.marks = c.marks[i+1:]
+			return
+		}
+	}
+}
+
+// serverEvent follows the items of the model audio and interrupts it when
+// the caller starts speaking.
+func (c *Call) serverEvent(event realtime.Event) {
+	switch event.Type {
+	case "response.output_item.added":
+		var added struct {
+			Item struct {
+				ID   string `json:"id"`
+				Type string `json:"type"`
+			} `json:"item"`
+		}
+		if err := json.Unmarshal(event.Data, &added); err != nil {
+			c.log.Warn("failed to parse output item", "err", err)
+			return
+		}
+		if added.Item.Type == "message" {
+			// the audio sent so far is of the last item
+			c.flushMark()
+			c.mutex.Lock()
+			c.itemID, c.itemSent = added.Item.ID, 0
+			c.mutex.Unlock()
+		}
+	case "input_audio_buffer.speech_started":
+		c.interrupt()
+	}
+}
+
+// interrupt clears the model audio queued at Twilio, and truncates its item
+// to what the caller heard.
+func (c *Call) interrupt() {
+	c.mutex.Lock()
+	queued := len(c.marks) > 0 || c.unmarked > 0
+	itemID := c.itemID
+	var played time.Duration
+	if c.played.itemID == itemID {
+		played = c.played.end
+	}
+	c.marks = nil
+	c.unmarked = 0
+	c.itemID = ""
+	c.mutex.Unlock()
+
+	if !queued {
+		return
+	}
+	c.log.Debug("caller interrupted", "item_id", itemID, "played", played)
+	if err := c.send(message{Event: "clear", StreamSID: c.StreamSID}); err != nil {
+		c.log.Warn("failed to clear model audio", "err", err)
+	}
+	if itemID == "" {
+		return
+	}
+	err := c.SendEvent(map[string]any{
+		"type":          "conversation.item.truncate",
+		"item_id":       itemID,
+		"content_index": 0,
+		"audio_end_ms":  played.Milliseconds(),
+	})
+	if err != nil {
+		c.log.Warn("failed to truncate interrupted item", "err", err)
+	}
+}
+
+// SendEvent sends a client event upstream on behalf of the bridge.
+func (c *Call) SendEvent(event any) error {
+	c.mutex.Lock()
+	session := c.session
+	c.mutex.Unlock()
+	if session == nil {
+		return errors.New("call not connected")
+	}
+	return session.Client.SendEvent(event)
+}
+
+func (c *Call) send(m message) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err := c.conn.WriteMessage(websocket.TextMessage, data); err != nil {
+		return fmt.Errorf("failed to write message: %w", err)
+	}
+	return nil
+}
+
+// Close ends the call: it disconnects the upstream and closes the stream,
+// which makes Twilio carry on with the TwiML after the <Connect>.
+func (c *Call) Close() error {
+	c.closeOnce.Do(func() {
+		c.mutex.Lock()
+		c.closed = true
+		session := c.session
+		if c.markTimer != nil {
+			c.markTimer.Stop()
+		}
+		c.mutex.Unlock()
+		close(c.done)
+
+		c.conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+			time.Now().Add(time.Second))
+		c.conn.Close()
+		if session != nil {
+			session.Close()
+		}
+		c.bridge.remove(c)
+
+		c.log.Info("call ended", "duration", time.Since(c.Started).Round(time.Second))
+		if c.bridge.opts.OnEnd != nil {
+			c.bridge.opts.OnEnd(c)
+		}
+	})
+	return nil
+}
+
+// callerSource is the audio of the caller as the Source of the upstream. It
+// is paced by Twilio, which sends the audio in real time.
+type callerSource struct {
+	c *Call
+}
+
+func (s callerSource) ReadAudio() (audio.Frame, error) {
+	select {
+	case frame := <-s.c.frames:
+		return frame, nil
+	case <-s.c.done:
+		return audio.Frame{}, io.EOF
+	}
+}
+
+// modelWriter transcodes the model audio to μ-law for Twilio. It arrives in
+// real time, so it is sent as it is decoded.
+type modelWriter struct {
+	c *Call
+}
+
+func (w modelWriter) WriteWebRTCTrack(track audio.RemoteTrack) error {
+	decoder := audio.NewTrackDecoder(track, upstreamRate, 1)
+	var ulaw []byte
+	for {
+		packet, _, err := track.ReadRTP()
+		if err != nil {
+			if errors.Is(err, io.EOF) || w.closed() {
+				return nil
+			}
+			return fmt.Errorf("failed to read RTP packet: %w", err)
+		}
+		duration := audio.OpusPacketDuration(packet.Payload)
+		if duration == 0 {
+			continue
+		}
+		pcm, err := decoder.Decode(audio.Frame{Opus: packet.Payload, Duration: duration})
+		if err != nil {
+			w.c.log.Warn("failed to decode model audio", "err", err)
+			continue
+		}
+		ulaw = ulaw[:0]
+		for _, sample := range audio.ConvertPCM(pcm, upstreamRate, 1, twilioRate, 1) {
+			ulaw = append(ulaw, audio.ULawEncode(sample))
+		}
+		if err := w.c.sendAudio(ulaw); err != nil {
+			if w.closed() {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func (w modelWriter) closed() bool {
+	select {
+	case <-w.c.done:
+		return true
+	default:
+		return false
+	}
+}
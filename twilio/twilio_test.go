@@ -0,0 +1,511 @@
+package twilio
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pion/webrtc/v4"
+
+	"exp-openai-webrtc-streaming/audio"
+	"exp-openai-webrtc-streaming/realtime"
+)
+
+// fakeAPI is a local fake of the WebRTC endpoints of the Realtime API. Its
+// peer echoes the audio of the call as the model audio, and its data channel
+// starts an item of the model, then waits for the test to send events.
+type fakeAPI struct {
+	*httptest.Server
+	opened    chan struct{}
+	truncates chan map[string]any
+
+	mutex sync.Mutex
+	peers []*webrtc.PeerConnection
+	dc    *webrtc.DataChannel
+}
+
+func newFakeAPI(t *testing.T) *fakeAPI {
+	f := &fakeAPI{opened: make(chan struct{}), truncates: make(chan map[string]any, 10)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/realtime/sessions", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, `{"client_secret":{"value":"ek_test0123456789","expires_at":4102444800}}`)
+	})
+	mux.HandleFunc("/v1/realtime", func(w http.ResponseWriter, r *http.Request) {
+		offer, _ := io.ReadAll(r.Body)
+		answer, err := f.answer(string(offer))
+		if err != nil {
+			t.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/sdp")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, answer)
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(func() {
+		f.Close()
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		for _, pc := range f.peers {
+			pc.Close()
+		}
+	})
+	return f
+}
+
+func (f *fakeAPI) answer(offer string) (string, error) {
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return "", err
+	}
+	f.mutex.Lock()
+	f.peers = append(f.peers, pc)
+	f.mutex.Unlock()
+
+	capability := webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48_000, Channels: 2}
+	model, err := webrtc.NewTrackLocalStaticRTP(capability, "audio", "model")
+	if err != nil {
+		return "", err
+	}
+	if _, err := pc.AddTrack(model); err != nil {
+		return "", err
+	}
+	pc.OnTrack(func(user *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		for {
+			p, _, err := user.ReadRTP()
+			if err != nil {
+				return
+			}
+			model.WriteRTP(p)
+		}
+	})
+	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+		dc.OnOpen(func() {
+			f.mutex.Lock()
+			f.dc = dc
+			f.mutex.Unlock()
+			dc.SendText(`{"type":"session.created"}`)
+			dc.SendText(`{"type":"response.output_item.added","item":{"id":"item_1","type":"message"}}`)
+			close(f.opened)
+		})
+		dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+			var event map[string]any
+			json.Unmarshal(msg.Data, &event)
+			if event["type"] == "conversation.item.truncate" {
+				f.truncates <- event
+			}
+		})
+	})
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		return "", err
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+	<-gathered
+	return pc.LocalDescription().SDP, nil
+}
+
+// sendEvent sends a server event on the data channel.
+func (f *fakeAPI) sendEvent(t *testing.T, event string) {
+	t.Helper()
+	select {
+	case <-f.opened:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the data channel did not open")
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.dc.SendText(event); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// twilioClient is the Media Streams side of a call, on a gorilla WebSocket.
+type twilioClient struct {
+	t        *testing.T
+	conn     *websocket.Conn
+	messages chan message
+	// err is the error ending the messages
+	err error
+
+	writeMutex sync.Mutex
+}
+
+func dialBridge(t *testing.T, url string, header http.Header) *twilioClient {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	c := &twilioClient{t: t, conn: conn, messages: make(chan message, 1000)}
+	go func() {
+		defer close(c.messages)
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				c.err = err
+				return
+			}
+			var m message
+			if err := json.Unmarshal(data, &m); err != nil {
+				c.err = err
+				return
+			}
+			c.messages <- m
+		}
+	}()
+	return c
+}
+
+func (c *twilioClient) write(m any) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	c.conn.WriteJSON(m)
+}
+
+// next returns the next message, or false after timeout.
+func (c *twilioClient) next(timeout time.Duration) (message, bool) {
+	select {
+	case m, ok := <-c.messages:
+		if !ok {
+			c.t.Fatalf("stream closed: %v", c.err)
+		}
+		if m.StreamSID != "MZ1" {
+			c.t.Fatalf("%s message of stream %q", m.Event, m.StreamSID)
+		}
+		return m, true
+	case <-time.After(timeout):
+		return message{}, false
+	}
+}
+
+// speak sends a 440Hz tone in 20ms media messages until stop is closed.
+func (c *twilioClient) speak(stop <-chan struct{}) {
+	ticker := time.NewTicker(20 * time.Millisecond)
+	defer ticker.Stop()
+	phase := 0
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		payload := make([]byte, 160)
+		for i := range payload {
+			payload[i] = audio.ULawEncode(int16(8000 * math.Sin(2*math.Pi*440*float64(phase)/twilioRate)))
+			phase++
+		}
+		c.write(map[string]any{
+			"event":     "media",
+			"streamSid": "MZ1",
+			"media":     map[string]string{"track": "inbound", "payload": base64.StdEncoding.EncodeToString(payload)},
+		})
+	}
+}
+
+func loud(payload string) bool {
+	ulaw, _ := base64.StdEncoding.DecodeString(payload)
+	var energy float64
+	for _, b := range ulaw {
+		sample := float64(audio.ULawDecode(b))
+		energy += sample * sample
+	}
+	return len(ulaw) > 0 && math.Sqrt(energy/float64(len(ulaw))) > 1000
+}
+
+func sign(authToken, url string) string {
+	mac := hmac.New(sha1.New, []byte(authToken))
+	mac.Write([]byte(url))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+const start = `{"event":"start","sequenceNumber":"1","streamSid":"MZ1","start":{` +
+	`"accountSid":"AC1","streamSid":"MZ1","callSid":"CA1","tracks":["inbound"],` +
+	`"mediaFormat":{"encoding":"audio/x-mulaw","sampleRate":8000,"channels":1},` +
+	`"customParameters":{"caller":"+15551234567"}}}`
+
+// requireOpusEncoder skips the tests of the audio of the calls in the builds
+// without libopus, in which the client cannot encode it.
+func requireOpusEncoder(t *testing.T) {
+	t.Helper()
+	track, err := audio.NewPCMTrack(upstreamRate, 1, audio.DefaultOpusEncoderOptions())
+	if err != nil {
+		t.Skip(err)
+	}
+	track.Close()
+}
+
+func TestBridge(t *testing.T) {
+	requireOpusEncoder(t)
+	api := newFakeAPI(t)
+	ended := make(chan *Call, 1)
+	var events sync.Map
+	b, err := New(Options{
+		Authenticate: SignatureAuth("auth-token", ""),
+		NewClient: func(call *Call) (*realtime.Client, error) {
+			if call.Parameters["caller"] != "+15551234567" {
+				t.Errorf("parameters %v", call.Parameters)
+			}
+			client := realtime.NewClient("sk-test-0123456789")
+			client.ICEServers = nil
+			client.SessionsURL = api.URL + "/v1/realtime/sessions"
+			client.WebRTCURL = api.URL + "/v1/realtime"
+			client.OnEvent = func(event realtime.Event) { events.Store(event.Type, true) }
+			return client, nil
+		},
+		OnEnd: func(c *Call) { ended <- c },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(b)
+	defer server.Close()
+	defer b.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/media"
+
+	tests := []struct {
+		name      string
+		signature string
+		want      int
+	}{
+		{"unsigned", "", http.StatusUnauthorized},
+		{"wrong signature", sign("wrong-token", "wss://"+strings.TrimPrefix(server.URL, "http://")+"/media"), http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.signature != "" {
+			header.Set("X-Twilio-Signature", tt.signature)
+		}
+		if _, res, err := websocket.DefaultDialer.Dial(url, header); err == nil || res.StatusCode != tt.want {
+			t.Errorf("%s: got %v, want %d", tt.name, err, tt.want)
+		}
+	}
+
+	signature := sign("auth-token", "wss://"+strings.TrimPrefix(server.URL, "http://")+"/media")
+	c := dialBridge(t, url, http.Header{"X-Twilio-Signature": {signature}})
+	c.write(json.RawMessage(`{"event":"connected","protocol":"Call","version":"1.0.0"}`))
+	c.write(json.RawMessage(start))
+	stop := make(chan struct{})
+	go c.speak(stop)
+
+	// The tone comes back through the echo of the API, with a mark every
+	// 200ms of audio rather than every packet. Twilio plays the audio up to
+	// the second mark.
+	var media, loudMedia int
+	var marks []string
+	for len(marks) < 5 || loudMedia < 20 {
+		m, ok := c.next(15 * time.Second)
+		if !ok {
+			t.Fatalf("%d media messages, %d loud, %d marks", media, loudMedia, len(marks))
+		}
+		switch m.Event {
+		case "media":
+			media++
+			if loud(m.Media.Payload) {
+				loudMedia++
+			}
+		case "mark":
+			marks = append(marks, m.Mark.Name)
+			if len(marks) <= 2 {
+				c.write(message{Event: "mark", StreamSID: "MZ1", Mark: &markPayload{Name: m.Mark.Name}})
+			}
+		}
+	}
+
+	// Once the audio pauses, the rest of it is marked. The tone stops with
+	// some audio sent since the last mark.
+	for unmarked := 0; unmarked < 3; {
+		m, ok := c.next(5 * time.Second)
+		if !ok {
+			t.Fatal("the model audio stopped")
+		}
+		switch m.Event {
+		case "media":
+			media++
+			unmarked++
+		case "mark":
+			marks = append(marks, m.Mark.Name)
+			unmarked = 0
+		}
+	}
+	close(stop)
+	var last string
+	for {
+		m, ok := c.next(time.Second)
+		if !ok {
+			break
+		}
+		last = m.Event
+		switch m.Event {
+		case "media":
+			media++
+		case "mark":
+			marks = append(marks, m.Mark.Name)
+		}
+	}
+	if last != "mark" {
+		t.Errorf("the audio ends with a %s, want a mark", last)
+	}
+	if perMark := float64(media) / float64(len(marks)); perMark < 5 {
+		t.Errorf("%d marks for %d media messages, want one per 200ms", len(marks), media)
+	}
+	if _, ok := events.Load("session.created"); !ok {
+		t.Error("the OnEvent of the client was not called")
+	}
+
+	// When the caller barges in, the audio queued at Twilio is cleared, its
+	// marks are dropped, and the item is truncated to what was played.
+	calls := b.Calls()
+	if len(calls) != 1 || calls[0].CallSID != "CA1" {
+		t.Fatalf("calls %+v", calls)
+	}
+	call := calls[0]
+	call.mutex.Lock()
+	played := call.played
+	call.mutex.Unlock()
+	if played.name != marks[1] {
+		t.Fatalf("played mark %q, want %q", played.name, marks[1])
+	}
+	api.sendEvent(t, `{"type":"input_audio_buffer.speech_started"}`)
+	if m, ok := c.next(5 * time.Second); !ok || m.Event != "clear" {
+		t.Fatalf("got %q, want clear", m.Event)
+	}
+	select {
+	case truncate := <-api.truncates:
+		end := time.Duration(truncate["audio_end_ms"].(float64)) * time.Millisecond
+		if truncate["item_id"] != "item_1" || end != played.end || end <= 0 || end > 2*markInterval {
+			t.Errorf("truncate %v, want item_1 to %v", truncate, played.end)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the item was not truncated")
+	}
+	call.mutex.Lock()
+	queued := len(call.marks)
+	call.mutex.Unlock()
+	if queued != 0 {
+		t.Errorf("%d marks queued after the clear", queued)
+	}
+	// The marks Twilio echoes after the clear are ignored.
+	c.write(message{Event: "mark", StreamSID: "MZ1", Mark: &markPayload{Name: marks[len(marks)-1]}})
+	time.Sleep(100 * time.Millisecond)
+	call.mutex.Lock()
+	if call.played.name != marks[1] {
+		t.Errorf("played mark %q after the clear, want %q", call.played.name, marks[1])
+	}
+	call.mutex.Unlock()
+	// Without audio queued, a barge-in clears nothing.
+	api.sendEvent(t, `{"type":"input_audio_buffer.speech_started"}`)
+	if m, ok := c.next(300 * time.Millisecond); ok {
+		t.Errorf("got %s, want nothing", m.Event)
+	}
+
+	// The stop message ends the call, which closes the WebSocket.
+	c.write(json.RawMessage(`{"event":"stop","sequenceNumber":"9","streamSid":"MZ1","stop":{"accountSid":"AC1","callSid":"CA1"}}`))
+	select {
+	case ended := <-ended:
+		if ended.StreamSID != "MZ1" {
+			t.Errorf("call %s ended", ended.StreamSID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnEnd was not called")
+	}
+	for range c.messages {
+	}
+	var closeErr *websocket.CloseError
+	if !errors.As(c.err, &closeErr) || closeErr.Code != websocket.CloseNormalClosure {
+		t.Errorf("stream closed with %v", c.err)
+	}
+	if calls := b.Calls(); len(calls) != 0 {
+		t.Errorf("%d calls after the stop", len(calls))
+	}
+}
+
+func TestInvalidStart(t *testing.T) {
+	b, err := New(Options{
+		Authenticate: func(*http.Request) error { return nil },
+		NewClient:    func(*Call) (*realtime.Client, error) { return nil, errors.New("unreachable") },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(b)
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		messages []string
+	}{
+		{"L16", []string{`{"event":"start","streamSid":"MZ2","start":{"streamSid":"MZ2","mediaFormat":{"encoding":"audio/x-l16","sampleRate":16000,"channels":1}}}`}},
+		{"media before start", []string{`{"event":"connected"}`, `{"event":"media","streamSid":"MZ2"}`}},
+		{"no stream", []string{`{"event":"start","start":{"mediaFormat":{"encoding":"audio/x-mulaw","sampleRate":8000,"channels":1}}}`}},
+		{"invalid JSON", []string{`{`}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			for _, m := range tt.messages {
+				conn.WriteMessage(websocket.TextMessage, []byte(m))
+			}
+			_, _, err = conn.ReadMessage()
+			var closeErr *websocket.CloseError
+			if !errors.As(err, &closeErr) || closeErr.Code != websocket.CloseProtocolError {
+				t.Errorf("got %v, want a protocol error", err)
+			}
+		})
+	}
+	if calls := b.Calls(); len(calls) != 0 {
+		t.Errorf("%d calls", len(calls))
+	}
+}
+
+func TestSignatureAuth(t *testing.T) {
+	const url = "wss://bridge.example.com/media?tenant=1"
+	tests := []struct {
+		name       string
+		configured string
+		signature  string
+		wantErr    error
+		wantOK     bool
+	}{
+		{"configured URL", url, sign("auth-token", url), nil, true},
+		{"rebuilt URL", "", sign("auth-token", url), nil, true},
+		{"other URL", "wss://other.example.com/media", sign("auth-token", url), nil, false},
+		{"other token", url, sign("other-token", url), nil, false},
+		{"unsigned", url, "", realtime.ErrUnauthorized, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "https://bridge.example.com/media?tenant=1", nil)
+			if tt.signature != "" {
+				r.Header.Set("X-Twilio-Signature", tt.signature)
+			}
+			err := SignatureAuth("auth-token", tt.configured)(r)
+			if (err == nil) != tt.wantOK || (tt.wantErr != nil && !errors.Is(err, tt.wantErr)) {
+				t.Errorf("got %v", err)
+			}
+		})
+	}
+}